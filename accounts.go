@@ -0,0 +1,631 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"format"
+	"log"
+	"strings"
+	"telegram"
+	"time"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// legacyAccountName Название кабинета из настроек, сохраненных до появления нескольких кабинетов
+	legacyAccountName = "Основной"
+	// accountNameMaxLength Название кабинета выводится на кнопках, длинные названия не помещаются
+	accountNameMaxLength = 32
+	// summaryCallback Кнопка выбора кабинета сводного отчета: /summary-ГГГГММДД-ГГГГММДД-кабинет
+	summaryCallback = "/summary-"
+	// allAccounts Кабинет сводного отчета "Все кабинеты"
+	allAccounts = "all"
+)
+
+// allMarketplaces Маркетплейсы в порядке вывода в настройках и отчетах
+var allMarketplaces = []Marketplace{MarketplaceOzon, MarketplaceWildberries, MarketplaceYandex}
+
+// MarketplaceAccount Кабинет продавца на маркетплейсе. У пользователя может быть несколько кабинетов
+// на одном маркетплейсе, один из них основной: по нему строятся отчеты, где кабинет не выбирается.
+type MarketplaceAccount struct {
+	Id          primitive.ObjectID `bson:"id"`
+	Marketplace Marketplace        `bson:"marketplace"`
+	Name        string             `bson:"name"`
+	// ClientId Только для OZON
+	ClientId string `bson:"client_id,omitempty"`
+	Token    string `bson:"token"`
+	// Campaigns Кампании, включаемые в отчеты, только для Яндекс Маркета
+	Campaigns []YandexCampaign `bson:"campaigns,omitempty"`
+	Default   bool             `bson:"default"`
+}
+
+func (a MarketplaceAccount) String() string {
+	return fmt.Sprintf("%s «%s»", a.Marketplace, a.Name)
+}
+
+// connected Кабинет можно использовать в отчетах
+func (a MarketplaceAccount) connected() bool {
+	switch a.Marketplace {
+	case MarketplaceOzon:
+		return a.ClientId != ""
+	case MarketplaceYandex:
+		return a.Token != "" && len(a.Campaigns) > 0
+	default:
+		return a.Token != ""
+	}
+}
+
+// code Маркетплейс в данных кнопок
+func (mp Marketplace) code() string {
+	switch mp {
+	case MarketplaceWildberries:
+		return "wb"
+	case MarketplaceYandex:
+		return "ym"
+	default:
+		return "ozon"
+	}
+}
+
+func marketplaceByCode(code string) (Marketplace, bool) {
+	for _, mp := range allMarketplaces {
+		if mp.code() == code {
+			return mp, true
+		}
+	}
+	return "", false
+}
+
+// legacyAccount Кабинет из настроек маркетплейса, сохраненных до появления нескольких кабинетов.
+// Id постоянный, чтобы кнопки работали и после сохранения кабинета в список.
+func (s Settings) legacyAccount(mp Marketplace) (MarketplaceAccount, bool) {
+	a := MarketplaceAccount{Marketplace: mp, Name: legacyAccountName, Default: true}
+	a.Id[len(a.Id)-1] = byte(findIndex(allMarketplaces, func(e Marketplace) bool { return e == mp }) + 1)
+	switch mp {
+	case MarketplaceOzon:
+		a.ClientId, a.Token = s.OzonSetting.ClientId, s.OzonSetting.Token
+	case MarketplaceWildberries:
+		a.Token = s.WildberriesSetting.Token
+	case MarketplaceYandex:
+		a.Token, a.Campaigns = s.YandexMarketSetting.Token, s.YandexMarketSetting.Campaigns
+	}
+	return a, a.Token != "" || a.ClientId != ""
+}
+
+// accounts Кабинеты маркетплейса mp. Пока список не менялся, в нем кабинет из прежних настроек.
+func (s Settings) accounts(mp Marketplace) []MarketplaceAccount {
+	var result []MarketplaceAccount
+	for _, a := range s.Accounts {
+		if a.Marketplace == mp {
+			result = append(result, a)
+		}
+	}
+	if len(result) == 0 {
+		if legacy, ok := s.legacyAccount(mp); ok {
+			result = append(result, legacy)
+		}
+	}
+	return result
+}
+
+// defaultAccount Основной кабинет маркетплейса
+func (s Settings) defaultAccount(mp Marketplace) (MarketplaceAccount, bool) {
+	accounts := s.accounts(mp)
+	if i := findIndex(accounts, func(a MarketplaceAccount) bool { return a.Default }); i >= 0 {
+		return accounts[i], true
+	}
+	if len(accounts) > 0 {
+		return accounts[0], true
+	}
+	return MarketplaceAccount{}, false
+}
+
+// account Кабинет любого маркетплейса по id из кнопки
+func (s Settings) account(hex string) (MarketplaceAccount, bool) {
+	for _, mp := range allMarketplaces {
+		for _, a := range s.accounts(mp) {
+			if a.Id.Hex() == hex {
+				return a, true
+			}
+		}
+	}
+	return MarketplaceAccount{}, false
+}
+
+// reportAccounts Подключенные кабинеты всех маркетплейсов
+func (s Settings) reportAccounts() []MarketplaceAccount {
+	var result []MarketplaceAccount
+	for _, mp := range allMarketplaces {
+		for _, a := range s.accounts(mp) {
+			if a.connected() {
+				result = append(result, a)
+			}
+		}
+	}
+	return result
+}
+
+// resolveAccount Кабинет адаптера маркетплейса, а если он не задан - основной кабинет пользователя
+func resolveAccount(account *MarketplaceAccount, userId int64, mp Marketplace) (MarketplaceAccount, error) {
+	if account != nil {
+		return *account, nil
+	}
+	user, err := UserDB{}.getTelegramUser(userId)
+	if err != nil {
+		return MarketplaceAccount{}, err
+	}
+	if a, ok := user.Settings.defaultAccount(mp); ok {
+		return a, nil
+	}
+	return MarketplaceAccount{}, fmt.Errorf("не добавлен кабинет %s", mp)
+}
+
+// yandexSetting Настройки Яндекс Маркета с токеном и кампаниями кабинета
+func (a MarketplaceAccount) yandexSetting(cost float64) YandexMarketSetting {
+	return YandexMarketSetting{Token: a.Token, Cost: cost, Campaigns: a.Campaigns}
+}
+
+// accountMarketplace Адаптер маркетплейса для отчета по кабинету a
+func accountMarketplace(a MarketplaceAccount) ReportMarketplace {
+	switch a.Marketplace {
+	case MarketplaceWildberries:
+		return &WildberriesMarketplace{Account: &a}
+	case MarketplaceYandex:
+		return &YandexMarketMarketplace{Account: &a}
+	default:
+		return &OzonMarketplace{Account: &a}
+	}
+}
+
+// withDefault Кабинеты, в которых основной ровно один: если основной удален, основным становится первый
+func withDefault(accounts []MarketplaceAccount) []MarketplaceAccount {
+	if len(accounts) > 0 && findIndex(accounts, func(a MarketplaceAccount) bool { return a.Default }) < 0 {
+		accounts[0].Default = true
+	}
+	return accounts
+}
+
+// addAccount Новый кабинет в конце списка, первый кабинет маркетплейса становится основным
+func addAccount(accounts []MarketplaceAccount, account MarketplaceAccount) ([]MarketplaceAccount, error) {
+	if findIndex(accounts, func(a MarketplaceAccount) bool { return a.Name == account.Name }) >= 0 {
+		return nil, fmt.Errorf("кабинет «%s» уже есть", account.Name)
+	}
+	account.Id = primitive.NewObjectID()
+	account.Default = false
+	return withDefault(append(accounts, account)), nil
+}
+
+func renameAccount(accounts []MarketplaceAccount, id primitive.ObjectID, name string) ([]MarketplaceAccount, error) {
+	if findIndex(accounts, func(a MarketplaceAccount) bool { return a.Name == name && a.Id != id }) >= 0 {
+		return nil, fmt.Errorf("кабинет «%s» уже есть", name)
+	}
+	i := findIndex(accounts, func(a MarketplaceAccount) bool { return a.Id == id })
+	if i < 0 {
+		return nil, fmt.Errorf("кабинет не найден")
+	}
+	accounts[i].Name = name
+	return accounts, nil
+}
+
+func removeAccount(accounts []MarketplaceAccount, id primitive.ObjectID) []MarketplaceAccount {
+	var result []MarketplaceAccount
+	for _, a := range accounts {
+		if a.Id != id {
+			result = append(result, a)
+		}
+	}
+	return withDefault(result)
+}
+
+func setDefaultAccount(accounts []MarketplaceAccount, id primitive.ObjectID) []MarketplaceAccount {
+	for i := range accounts {
+		accounts[i].Default = accounts[i].Id == id
+	}
+	return withDefault(accounts)
+}
+
+// parseAccount Кабинет из сообщения: название на первой строке, дальше Client-Id и API-ключ для OZON
+// или токен для остальных маркетплейсов
+func parseAccount(mp Marketplace, text string) (MarketplaceAccount, error) {
+	var lines []string
+	for _, line := range strings.Split(text, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	want := 2
+	if mp == MarketplaceOzon {
+		want = 3
+	}
+	if len(lines) != want {
+		return MarketplaceAccount{}, fmt.Errorf("нужно %d строки, а пришло %d", want, len(lines))
+	}
+	if err := checkAccountName(lines[0]); err != nil {
+		return MarketplaceAccount{}, err
+	}
+	a := MarketplaceAccount{Marketplace: mp, Name: lines[0], Token: lines[len(lines)-1]}
+	if mp == MarketplaceOzon {
+		a.ClientId = lines[1]
+	}
+	return a, nil
+}
+
+func checkAccountName(name string) error {
+	if name == "" {
+		return fmt.Errorf("название не может быть пустым")
+	}
+	if utf8.RuneCountInString(name) > accountNameMaxLength {
+		return fmt.Errorf("название длиннее %d символов", accountNameMaxLength)
+	}
+	return nil
+}
+
+// updateAccounts Изменение кабинетов маркетплейса mp. Вместе со списком очищаются прежние настройки
+// маркетплейса: кабинет из них после первого изменения хранится в списке.
+func (m UserDB) updateAccounts(userId int64, mp Marketplace, update func([]MarketplaceAccount) ([]MarketplaceAccount, error)) ([]MarketplaceAccount, error) {
+	user, err := m.getTelegramUser(userId)
+	if err != nil {
+		return nil, err
+	}
+	accounts, err := update(user.Settings.accounts(mp))
+	if err != nil {
+		return nil, err
+	}
+	all := []MarketplaceAccount{}
+	for _, a := range user.Settings.Accounts {
+		if a.Marketplace != mp {
+			all = append(all, a)
+		}
+	}
+	all = append(all, accounts...)
+	set := bson.D{{"telegram_user.settings.accounts", all}}
+	switch mp {
+	case MarketplaceOzon:
+		set = append(set, bson.E{"telegram_user.settings.ozon_setting.client_id", ""}, bson.E{"telegram_user.settings.ozon_setting.token", ""})
+	case MarketplaceWildberries:
+		set = append(set, bson.E{"telegram_user.settings.wildberries_setting.token", ""})
+	case MarketplaceYandex:
+		set = append(set, bson.E{"telegram_user.settings.yandex_market_setting.token", ""}, bson.E{"telegram_user.settings.yandex_market_setting.campaigns", nil})
+	}
+	coll := clientMongo.Database("MyInfantBotDB").Collection("bot_users")
+	filter := bson.D{{"telegram_user.user.id", userId}}
+	if _, err := coll.UpdateOne(context.TODO(), filter, bson.D{{"$set", set}}); err != nil {
+		return nil, err
+	}
+	return accounts, nil
+}
+
+// userAccount Кабинет пользователя по id из кнопки
+func userAccount(userId int64, hex string) (MarketplaceAccount, bool) {
+	user, err := UserDB{}.getTelegramUser(userId)
+	if err != nil {
+		log.Printf("Не удалось получить настройки пользователя %d: %v", userId, err)
+		return MarketplaceAccount{}, false
+	}
+	return user.Settings.account(hex)
+}
+
+// marketplaceSettingsCallback Кнопка настроек маркетплейса
+func marketplaceSettingsCallback(mp Marketplace) string {
+	return "/" + mp.code() + "setting"
+}
+
+func accountsMarkup(mp Marketplace, accounts []MarketplaceAccount) telegram.InlineKeyboardMarkup {
+	var buttons []telegram.ButtonBot[telegram.InlineKeyboardButton]
+	for i, a := range accounts {
+		text := a.Name
+		if a.Default {
+			text = "⭐ " + a.Name
+		}
+		buttons = append(buttons, telegram.ButtonBot[telegram.InlineKeyboardButton]{
+			Row: i + 1, Col: 1, Button: telegram.InlineKeyboardButton{Text: text, CallbackData: "/account-" + a.Id.Hex()},
+		})
+	}
+	buttons = append(buttons,
+		telegram.ButtonBot[telegram.InlineKeyboardButton]{Row: len(accounts) + 1, Col: 1, Button: telegram.InlineKeyboardButton{Text: "Добавить кабинет", CallbackData: "/accountadd-" + mp.code()}},
+		telegram.ButtonBot[telegram.InlineKeyboardButton]{Row: len(accounts) + 2, Col: 1, Button: telegram.InlineKeyboardButton{Text: "Назад", CallbackData: marketplaceSettingsCallback(mp)}},
+	)
+	return telegram.InlineKeyboardMarkup{InlineKeyboard: CreateButtonsBot[telegram.InlineKeyboardButton](buttons)}
+}
+
+func accountsText(mp Marketplace, accounts []MarketplaceAccount) string {
+	if len(accounts) == 0 {
+		return htmlText(format.Plainf("Кабинеты %s не добавлены. Добавьте кабинет, чтобы получать отчеты.", mp))
+	}
+	return htmlText(format.Plainf("Кабинеты %s. ", mp), format.Plain("⭐ - основной кабинет: по нему строятся отчеты, в которых кабинет не выбирается."))
+}
+
+func editAccounts(q telegram.CallbackQuery, mp Marketplace, accounts []MarketplaceAccount) {
+	bot := TelegramBot{}
+	EditMessageTextToBot(&bot, telegram.EditMessageTextRequestBody{
+		ChatId:      q.Message.Chat.Id,
+		MessageId:   q.Message.MessageId,
+		ParseMode:   format.HTML.ParseMode(),
+		Text:        accountsText(mp, accounts),
+		ReplyMarkup: accountsMarkup(mp, accounts),
+	})
+}
+
+func accountsHandler(c *RouteContext) {
+	q := c.Update.CallbackQuery
+	bot := TelegramBot{}
+	mp, ok := marketplaceByCode(c.Payload)
+	user, err := UserDB{}.getTelegramUser(q.From.Id)
+	if !ok || err != nil {
+		answerCallbackQueryToBot(&bot, telegram.AnswerCallbackQueryRequestBody{CallbackQueryId: q.Id, Text: "Кнопка устарела."})
+		return
+	}
+	answerCallbackQueryToBot(&bot, telegram.AnswerCallbackQueryRequestBody{CallbackQueryId: q.Id})
+	editAccounts(q, mp, user.Settings.accounts(mp))
+}
+
+func accountHandler(c *RouteContext) {
+	q := c.Update.CallbackQuery
+	bot := TelegramBot{}
+	a, ok := userAccount(q.From.Id, c.Payload)
+	if !ok {
+		answerCallbackQueryToBot(&bot, telegram.AnswerCallbackQueryRequestBody{CallbackQueryId: q.Id, Text: "Кнопка устарела."})
+		return
+	}
+	answerCallbackQueryToBot(&bot, telegram.AnswerCallbackQueryRequestBody{CallbackQueryId: q.Id})
+	hex := a.Id.Hex()
+	buttons := []telegram.ButtonBot[telegram.InlineKeyboardButton]{
+		{Row: 1, Col: 1, Button: telegram.InlineKeyboardButton{Text: "Переименовать", CallbackData: "/accountrename-" + hex}},
+		{Row: 1, Col: 2, Button: telegram.InlineKeyboardButton{Text: "Удалить", CallbackData: "/accountdel-" + hex}},
+		{Row: 2, Col: 1, Button: telegram.InlineKeyboardButton{Text: "Проверка подключения", CallbackData: "/accounttest-" + hex}},
+		{Row: 4, Col: 1, Button: telegram.InlineKeyboardButton{Text: "Назад", CallbackData: "/accounts-" + a.Marketplace.code()}},
+	}
+	if !a.Default {
+		buttons = append(buttons, telegram.ButtonBot[telegram.InlineKeyboardButton]{Row: 2, Col: 2, Button: telegram.InlineKeyboardButton{Text: "Сделать основным", CallbackData: "/accountdefault-" + hex}})
+	}
+	if a.Marketplace == MarketplaceYandex {
+		buttons = append(buttons, telegram.ButtonBot[telegram.InlineKeyboardButton]{Row: 3, Col: 1, Button: telegram.InlineKeyboardButton{Text: "Кампании", CallbackData: "/ymcampaigns-" + hex}})
+	}
+	text := []format.Fragment{format.Line(format.Bold(format.Plain(a.String())))}
+	if a.ClientId != "" {
+		text = append(text, format.Line(format.Plain("Client-Id: "), format.Code(a.ClientId)))
+	}
+	text = append(text, format.Line(format.Plain("Токен: "), format.Code(maskToken(a.Token))))
+	if a.Marketplace == MarketplaceYandex {
+		text = append(text, format.Line(format.Plainf("Кампаний в отчетах: %d", len(a.Campaigns))))
+	}
+	EditMessageTextToBot(&bot, telegram.EditMessageTextRequestBody{
+		ChatId:      q.Message.Chat.Id,
+		MessageId:   q.Message.MessageId,
+		ParseMode:   format.HTML.ParseMode(),
+		Text:        htmlText(text...),
+		ReplyMarkup: telegram.InlineKeyboardMarkup{InlineKeyboard: CreateButtonsBot[telegram.InlineKeyboardButton](buttons)},
+	})
+}
+
+// maskToken Токен для показа в чате: только последние символы
+func maskToken(token string) string {
+	runes := []rune(token)
+	if len(runes) <= 4 {
+		return "****"
+	}
+	return "****" + string(runes[len(runes)-4:])
+}
+
+func newAccountHandler(c *RouteContext) {
+	q := c.Update.CallbackQuery
+	mp, ok := marketplaceByCode(c.Payload)
+	if !ok {
+		answerCallbackQueryToBot(&TelegramBot{}, telegram.AnswerCallbackQueryRequestBody{CallbackQueryId: q.Id, Text: "Кнопка устарела."})
+		return
+	}
+	hint := format.Plain("ОК. Пришлите, пожалуйста, в одном сообщении название кабинета на первой строке и токен на второй.")
+	if mp == MarketplaceOzon {
+		hint = format.Plain("ОК. Пришлите, пожалуйста, в одном сообщении название кабинета, ClientId и Token - каждый на своей строке. Их можно получить в личном кабинете продавца.")
+	}
+	askSettingValue(q, StateAwaitAccount, ConversationPayload{Marketplace: mp}, hint)
+}
+
+// sendAccounts Список кабинетов новым сообщением после диалога
+func sendAccounts(chatId int64, text format.Fragment, mp Marketplace, accounts []MarketplaceAccount) {
+	bot := TelegramBot{}
+	SendMessageToBot(&bot, telegram.SendMessageRequestBody[telegram.InlineKeyboardMarkup, int64]{
+		ChatId:      chatId,
+		ParseMode:   format.HTML.ParseMode(),
+		Text:        htmlText(text),
+		ReplyMarkup: accountsMarkup(mp, accounts),
+	})
+}
+
+func saveAccountHandler(c *RouteContext) {
+	m := c.Update.Message
+	mp := c.Conversation.Payload.Marketplace
+	finishConversation(m)
+	account, err := parseAccount(mp, m.Text)
+	var accounts []MarketplaceAccount
+	if err == nil {
+		accounts, err = UserDB{}.updateAccounts(m.From.Id, mp, func(list []MarketplaceAccount) ([]MarketplaceAccount, error) {
+			return addAccount(list, account)
+		})
+	}
+	if err != nil {
+		user, _ := UserDB{}.getTelegramUser(m.From.Id)
+		sendAccounts(m.Chat.Id, format.Plainf("Кабинет не добавлен: %s. Попробуйте еще раз.", err), mp, user.Settings.accounts(mp))
+		return
+	}
+	text := format.Concat(format.Plain("Кабинет "), format.Bold(format.Plain(account.Name)), format.Plain(" добавлен."))
+	if mp == MarketplaceYandex {
+		text = format.Concat(text, format.Plain(" Выберите в нем кампании для отчетов."))
+	}
+	sendAccounts(m.Chat.Id, text, mp, accounts)
+}
+
+func renameAccountHandler(c *RouteContext) {
+	q := c.Update.CallbackQuery
+	a, ok := userAccount(q.From.Id, c.Payload)
+	if !ok {
+		answerCallbackQueryToBot(&TelegramBot{}, telegram.AnswerCallbackQueryRequestBody{CallbackQueryId: q.Id, Text: "Кнопка устарела."})
+		return
+	}
+	askSettingValue(q, StateAwaitAccountName, ConversationPayload{Marketplace: a.Marketplace, AccountId: a.Id.Hex()},
+		format.Plainf("ОК. Пришлите, пожалуйста, новое название кабинета «%s».", a.Name))
+}
+
+func saveAccountNameHandler(c *RouteContext) {
+	m := c.Update.Message
+	payload := c.Conversation.Payload
+	finishConversation(m)
+	name := strings.TrimSpace(m.Text)
+	id, err := primitive.ObjectIDFromHex(payload.AccountId)
+	if err == nil {
+		err = checkAccountName(name)
+	}
+	var accounts []MarketplaceAccount
+	if err == nil {
+		accounts, err = UserDB{}.updateAccounts(m.From.Id, payload.Marketplace, func(list []MarketplaceAccount) ([]MarketplaceAccount, error) {
+			return renameAccount(list, id, name)
+		})
+	}
+	if err != nil {
+		user, _ := UserDB{}.getTelegramUser(m.From.Id)
+		sendAccounts(m.Chat.Id, format.Plainf("Кабинет не переименован: %s.", err), payload.Marketplace, user.Settings.accounts(payload.Marketplace))
+		return
+	}
+	sendAccounts(m.Chat.Id, format.Concat(format.Plain("Кабинет переименован в "), format.Bold(format.Plain(name)), format.Plain(".")), payload.Marketplace, accounts)
+}
+
+// changeAccountHandler Изменение кабинета из кнопки с id кабинета и обновление списка кабинетов
+func changeAccountHandler(change func([]MarketplaceAccount, primitive.ObjectID) []MarketplaceAccount) func(c *RouteContext) {
+	return func(c *RouteContext) {
+		q := c.Update.CallbackQuery
+		bot := TelegramBot{}
+		a, ok := userAccount(q.From.Id, c.Payload)
+		if !ok {
+			answerCallbackQueryToBot(&bot, telegram.AnswerCallbackQueryRequestBody{CallbackQueryId: q.Id, Text: "Кнопка устарела."})
+			return
+		}
+		accounts, err := UserDB{}.updateAccounts(q.From.Id, a.Marketplace, func(list []MarketplaceAccount) ([]MarketplaceAccount, error) {
+			return change(list, a.Id), nil
+		})
+		if err != nil {
+			panic(err)
+		}
+		answerCallbackQueryToBot(&bot, telegram.AnswerCallbackQueryRequestBody{CallbackQueryId: q.Id})
+		editAccounts(q, a.Marketplace, accounts)
+	}
+}
+
+// checkAuthAccount Проверка подключения к кабинету
+func checkAuthAccount(a MarketplaceAccount) string {
+	switch a.Marketplace {
+	case MarketplaceWildberries:
+		return checkAuthWildberries(a.Token)
+	case MarketplaceYandex:
+		if _, err := (&YandexMarketMarketplace{}).yandexCampaigns(a.Token); err != nil {
+			log.Printf("Проверка подключения к Яндекс Маркету: %v", err)
+			return "Не удалось подключиться к Яндекс Маркету, проверьте токен."
+		}
+		return "Подключение к Яндекс Маркету работает."
+	default:
+		return checkAuthOzonSeller(a.ClientId, a.Token)
+	}
+}
+
+func testAccountHandler(c *RouteContext) {
+	q := c.Update.CallbackQuery
+	bot := TelegramBot{}
+	a, ok := userAccount(q.From.Id, c.Payload)
+	if !ok {
+		answerCallbackQueryToBot(&bot, telegram.AnswerCallbackQueryRequestBody{CallbackQueryId: q.Id, Text: "Кнопка устарела."})
+		return
+	}
+	answerCallbackQueryToBot(&bot, telegram.AnswerCallbackQueryRequestBody{CallbackQueryId: q.Id, Text: checkAuthAccount(a)})
+	sendReportKeyboard(q.Message.Chat.Id)
+}
+
+// summaryData Данные кнопки выбора кабинета сводного отчета за дни периода
+func summaryData(period DateRange, account string) string {
+	return summaryCallback + period.From.Format("20060102") + "-" + period.lastDay().Format("20060102") + "-" + account
+}
+
+// parseSummaryData Дни периода и кабинет из данных кнопки
+func parseSummaryData(payload string, loc *time.Location) (DateRange, string, error) {
+	parts := strings.Split(payload, "-")
+	if len(parts) != 3 {
+		return DateRange{}, "", fmt.Errorf("неизвестная кнопка отчета %q", payload)
+	}
+	from, err := time.ParseInLocation("20060102", parts[0], loc)
+	if err != nil {
+		return DateRange{}, "", err
+	}
+	to, err := time.ParseInLocation("20060102", parts[1], loc)
+	if err != nil {
+		return DateRange{}, "", err
+	}
+	return daysRange(from, to, loc), parts[2], nil
+}
+
+// summaryPickerMarkup Выбор кабинета для сводного отчета
+func summaryPickerMarkup(accounts []MarketplaceAccount, period DateRange) telegram.InlineKeyboardMarkup {
+	var buttons []telegram.ButtonBot[telegram.InlineKeyboardButton]
+	for i, a := range accounts {
+		buttons = append(buttons, telegram.ButtonBot[telegram.InlineKeyboardButton]{
+			Row: i + 1, Col: 1, Button: telegram.InlineKeyboardButton{Text: a.String(), CallbackData: summaryData(period, a.Id.Hex())},
+		})
+	}
+	buttons = append(buttons, telegram.ButtonBot[telegram.InlineKeyboardButton]{
+		Row: len(accounts) + 1, Col: 1, Button: telegram.InlineKeyboardButton{Text: "Все кабинеты", CallbackData: summaryData(period, allAccounts)},
+	})
+	return telegram.InlineKeyboardMarkup{InlineKeyboard: CreateButtonsBot[telegram.InlineKeyboardButton](buttons)}
+}
+
+// requestOrderSummaryReport Сводный отчет по кабинетам пользователя userId за период: если подключено
+// несколько кабинетов, сначала предлагается выбрать кабинет или все кабинеты сразу
+func requestOrderSummaryReport(m telegram.Message, userId int64, period DateRange) {
+	var settings Settings
+	if user, err := (UserDB{}).getTelegramUser(userId); err != nil {
+		log.Printf("Не удалось получить настройки пользователя %d: %v", userId, err)
+	} else {
+		settings = user.Settings
+	}
+	accounts := settings.reportAccounts()
+	if len(accounts) < 2 {
+		sendOrderSummaryReport(userId, m.Chat.Id, period, reportMarketplaces(settings))
+		return
+	}
+	bot := TelegramBot{}
+	SendMessageToBot(&bot, telegram.SendMessageRequestBody[telegram.InlineKeyboardMarkup, int64]{
+		ChatId:      m.Chat.Id,
+		ParseMode:   format.HTML.ParseMode(),
+		Text:        htmlText(format.Plainf("Отчет с %s по %s. Выберите кабинет:", period.From.Format("02.01.2006"), period.lastDay().Format("02.01.2006"))),
+		ReplyMarkup: summaryPickerMarkup(accounts, period),
+	})
+}
+
+// summaryMarketplaces Кабинеты отчета по кабинету из кнопки, false - кабинет удален
+func summaryMarketplaces(s Settings, account string) ([]ReportMarketplace, bool) {
+	if account == allAccounts {
+		return reportMarketplaces(s), true
+	}
+	a, ok := s.account(account)
+	if !ok {
+		return nil, false
+	}
+	return []ReportMarketplace{accountMarketplace(a)}, true
+}
+
+func summaryHandler(c *RouteContext) {
+	q := c.Update.CallbackQuery
+	bot := TelegramBot{}
+	period, account, err := parseSummaryData(c.Payload, UserDB{}.userLocation(q.From.Id))
+	user, userErr := UserDB{}.getTelegramUser(c.Access.OwnerId)
+	if err != nil || userErr != nil {
+		answerCallbackQueryToBot(&bot, telegram.AnswerCallbackQueryRequestBody{CallbackQueryId: q.Id, Text: "Кнопка устарела."})
+		return
+	}
+	marketplaces, ok := summaryMarketplaces(user.Settings, account)
+	if !ok {
+		answerCallbackQueryToBot(&bot, telegram.AnswerCallbackQueryRequestBody{CallbackQueryId: q.Id, Text: "Кабинет удален, выберите другой."})
+		return
+	}
+	answerCallbackQueryToBot(&bot, telegram.AnswerCallbackQueryRequestBody{CallbackQueryId: q.Id, Text: "Формирую отчет..."})
+	sendOrderSummaryReport(c.Access.OwnerId, q.Message.Chat.Id, period, marketplaces)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestParseAccount(t *testing.T) {
+	tests := []struct {
+		name    string
+		mp      Marketplace
+		text    string
+		want    MarketplaceAccount
+		wantErr bool
+	}{
+		{
+			name: "OZON - название, Client-Id и ключ",
+			mp:   MarketplaceOzon,
+			text: " Детский \n123\n\nkey-1 ",
+			want: MarketplaceAccount{Marketplace: MarketplaceOzon, Name: "Детский", ClientId: "123", Token: "key-1"},
+		},
+		{
+			name: "WB - название и токен",
+			mp:   MarketplaceWildberries,
+			text: "Основной\ntoken",
+			want: MarketplaceAccount{Marketplace: MarketplaceWildberries, Name: "Основной", Token: "token"},
+		},
+		{name: "OZON без ключа", mp: MarketplaceOzon, text: "Детский\n123", wantErr: true},
+		{name: "Лишняя строка", mp: MarketplaceYandex, text: "Маркет\nACMA:1\nеще", wantErr: true},
+		{name: "Длинное название", mp: MarketplaceWildberries, text: strings.Repeat("я", accountNameMaxLength+1) + "\ntoken", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseAccount(tt.mp, tt.text)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && (got.Marketplace != tt.want.Marketplace || got.Name != tt.want.Name || got.ClientId != tt.want.ClientId || got.Token != tt.want.Token) {
+				t.Errorf("parseAccount() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSettings_accounts(t *testing.T) {
+	legacy := Settings{OzonSetting: OzonSetting{ClientId: "1", Token: "t"}}
+	accounts := legacy.accounts(MarketplaceOzon)
+	if len(accounts) != 1 || accounts[0].Name != legacyAccountName || !accounts[0].Default || accounts[0].ClientId != "1" {
+		t.Fatalf("кабинет из прежних настроек = %+v", accounts)
+	}
+	if again := legacy.accounts(MarketplaceOzon); again[0].Id != accounts[0].Id {
+		t.Errorf("id кабинета из прежних настроек меняется: %s и %s", accounts[0].Id.Hex(), again[0].Id.Hex())
+	}
+	if wb, _ := legacy.legacyAccount(MarketplaceWildberries); wb.Id == accounts[0].Id {
+		t.Errorf("одинаковый id кабинетов разных маркетплейсов")
+	}
+	if got := legacy.accounts(MarketplaceWildberries); len(got) != 0 {
+		t.Errorf("WB не подключен, а кабинеты %+v", got)
+	}
+
+	stored := legacy
+	stored.Accounts = []MarketplaceAccount{
+		{Id: primitive.NewObjectID(), Marketplace: MarketplaceOzon, Name: "Первый", ClientId: "2"},
+		{Id: primitive.NewObjectID(), Marketplace: MarketplaceOzon, Name: "Второй", ClientId: "3", Default: true},
+		{Id: primitive.NewObjectID(), Marketplace: MarketplaceWildberries, Name: "WB", Token: "w"},
+	}
+	if got := stored.accounts(MarketplaceOzon); len(got) != 2 {
+		t.Errorf("кабинеты из списка заменяют прежние настройки, а получено %+v", got)
+	}
+	if a, ok := stored.defaultAccount(MarketplaceOzon); !ok || a.Name != "Второй" {
+		t.Errorf("defaultAccount() = %+v", a)
+	}
+	if a, ok := stored.account(stored.Accounts[2].Id.Hex()); !ok || a.Name != "WB" {
+		t.Errorf("account() = %+v", a)
+	}
+}
+
+func TestAccountList(t *testing.T) {
+	first := MarketplaceAccount{Marketplace: MarketplaceOzon, Name: "Первый"}
+	accounts, err := addAccount(nil, first)
+	if err != nil || len(accounts) != 1 || !accounts[0].Default {
+		t.Fatalf("первый кабинет должен стать основным: %+v, %v", accounts, err)
+	}
+	accounts, err = addAccount(accounts, MarketplaceAccount{Marketplace: MarketplaceOzon, Name: "Второй"})
+	if err != nil || len(accounts) != 2 || accounts[1].Default {
+		t.Fatalf("второй кабинет не основной: %+v, %v", accounts, err)
+	}
+	if _, err := addAccount(accounts, first); err == nil {
+		t.Errorf("добавлен кабинет с повторяющимся названием")
+	}
+	if _, err := renameAccount(accounts, accounts[1].Id, "Первый"); err == nil {
+		t.Errorf("кабинет переименован в название другого кабинета")
+	}
+	if accounts, err = renameAccount(accounts, accounts[1].Id, "Детский"); err != nil || accounts[1].Name != "Детский" {
+		t.Errorf("renameAccount() = %+v, %v", accounts, err)
+	}
+	accounts = setDefaultAccount(accounts, accounts[1].Id)
+	if accounts[0].Default || !accounts[1].Default {
+		t.Errorf("setDefaultAccount() = %+v", accounts)
+	}
+	accounts = removeAccount(accounts, accounts[1].Id)
+	if len(accounts) != 1 || !accounts[0].Default {
+		t.Errorf("после удаления основного основным становится первый: %+v", accounts)
+	}
+}
+
+func TestReportMarketplaces_accounts(t *testing.T) {
+	s := Settings{Accounts: []MarketplaceAccount{
+		{Marketplace: MarketplaceOzon, Name: "Первый", ClientId: "1", Token: "t"},
+		{Marketplace: MarketplaceOzon, Name: "Второй", ClientId: "2", Token: "t"},
+		{Marketplace: MarketplaceYandex, Name: "Маркет", Token: "ACMA:1"},
+	}}
+	var titles []string
+	for _, m := range reportMarketplaces(s) {
+		titles = append(titles, reportTitle(m))
+	}
+	if got := strings.Join(titles, ","); got != "OZON «Первый»,OZON «Второй»" {
+		t.Errorf("reportMarketplaces() = %s", got)
+	}
+}
+
+func TestPrintOrderSummaryReport_account(t *testing.T) {
+	report := OrderReport{Marketplace: MarketplaceOzon, Account: "Детский", Products: map[string]int{}, CancelledProducts: map[string]int{}}
+	if text := printOrderSummaryReport(report); !strings.Contains(text, "OZON «Детский»") {
+		t.Errorf("нет кабинета в заголовке: %s", text)
+	}
+	combined := printCombinedReport([]OrderReport{report, {Marketplace: MarketplaceOzon, Account: "Взрослый"}})
+	if !strings.Contains(combined, "OZON «Детский»: ") || !strings.Contains(combined, "OZON «Взрослый»: ") {
+		t.Errorf("нет строк по кабинетам в итогах: %s", combined)
+	}
+}
+
+func TestSummaryData(t *testing.T) {
+	loc := time.FixedZone("MSK", 3*60*60)
+	period := daysRange(time.Date(2024, 3, 1, 0, 0, 0, 0, loc), time.Date(2024, 3, 3, 0, 0, 0, 0, loc), loc)
+	id := primitive.NewObjectID().Hex()
+	data := summaryData(period, id)
+	if len(data) > 64 {
+		t.Errorf("данные кнопки длиннее 64 байт: %s", data)
+	}
+	got, account, err := parseSummaryData(strings.TrimPrefix(data, summaryCallback), loc)
+	if err != nil || account != id || !got.From.Equal(period.From) || !got.To.Equal(period.To) {
+		t.Errorf("parseSummaryData(%s) = %+v, %s, %v", data, got, account, err)
+	}
+	if _, _, err := parseSummaryData("20240301-"+allAccounts, loc); err == nil {
+		t.Errorf("разобраны данные без конца периода")
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// ozonRequestsPerSecond Запросов в секунду к Seller API на один Client-Id, общий бюджет всех пользователей кабинета
+	ozonRequestsPerSecond = 10
+	ozonRequestsBurst     = 10
+	// apiMaxAttempts Попыток запроса при ответах 429, 5xx и сетевых ошибках
+	apiMaxAttempts = 4
+	// apiRetryDelay Задержка перед первым повтором, дальше удваивается
+	apiRetryDelay = 500 * time.Millisecond
+	// apiMaxRetryDelay Предел задержки, в том числе указанной в ответе
+	apiMaxRetryDelay  = 90 * time.Second
+	apiRequestTimeout = time.Minute
+)
+
+// APIError Ответ API маркетплейса с кодом, отличным от 200
+type APIError struct {
+	Path       string
+	StatusCode int
+	Status     string
+	Body       string
+	// RetryAfter Задержка из заголовка Retry-After или X-Ratelimit-Retry, 0 если его нет
+	RetryAfter time.Duration
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%s: %s %s", e.Path, e.Status, e.Body)
+}
+
+// temporary Повтор запроса может помочь: превышен лимит или ошибка на стороне маркетплейса
+func (e *APIError) temporary() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= http.StatusInternalServerError
+}
+
+// RateLimitedError Запрос не отправлен: бюджет запросов кабинета исчерпан, повторить можно через RetryAfter
+type RateLimitedError struct {
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitedError) Error() string {
+	return fmt.Sprintf("лимит запросов исчерпан, повтор через %s", e.RetryAfter)
+}
+
+// retryAfterSeconds Через сколько секунд повторить запрос, если err - исчерпанный лимит
+func retryAfterSeconds(err error) (int, bool) {
+	var limited *RateLimitedError
+	if !errors.As(err, &limited) {
+		return 0, false
+	}
+	return int(math.Ceil(limited.RetryAfter.Seconds())), true
+}
+
+// PartialResultError Выгрузка прервана ошибкой, часть данных уже получена и возвращена вместе с ошибкой
+type PartialResultError struct {
+	// Fetched Сколько элементов получено до ошибки
+	Fetched int
+	Err     error
+}
+
+func (e *PartialResultError) Error() string {
+	return fmt.Sprintf("получено %d записей, выгрузка прервана: %v", e.Fetched, e.Err)
+}
+
+func (e *PartialResultError) Unwrap() error {
+	return e.Err
+}
+
+// isPartialResult Ошибка означает неполные, но пригодные данные
+func isPartialResult(err error) bool {
+	var partial *PartialResultError
+	return errors.As(err, &partial)
+}
+
+// paginate Постраничная выгрузка списка по offset и limit. Выгрузка заканчивается на странице короче limit
+// или когда fetch сообщает, что страниц больше нет. При ошибке на второй и следующих страницах
+// возвращаются уже полученные элементы и PartialResultError.
+func paginate[T any](limit int, fetch func(offset int, limit int) (page []T, hasNext bool, err error)) ([]T, error) {
+	var items []T
+	for offset := 0; ; offset += limit {
+		page, hasNext, err := fetch(offset, limit)
+		if err != nil {
+			if len(items) == 0 {
+				return nil, err
+			}
+			return items, &PartialResultError{Fetched: len(items), Err: err}
+		}
+		items = append(items, page...)
+		if !hasNext || len(page) < limit {
+			return items, nil
+		}
+	}
+}
+
+// RequestLimiter Бюджет запросов к API по ключу кабинета продавца. Один кабинет может быть подключен
+// у нескольких пользователей, и лимит маркетплейса общий для всех их запросов.
+type RequestLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*TokenBucket
+	now     func() time.Time
+	sleep   func(time.Duration)
+}
+
+func NewRequestLimiter(rate float64, burst float64) *RequestLimiter {
+	return &RequestLimiter{rate: rate, burst: burst, buckets: make(map[string]*TokenBucket), now: time.Now, sleep: time.Sleep}
+}
+
+// acquire Ожидание свободного запроса в бюджете key
+func (l *RequestLimiter) acquire(key string) {
+	for {
+		wait := l.tryAcquire(key)
+		if wait == 0 {
+			return
+		}
+		l.sleep(wait)
+	}
+}
+
+// tryAcquire Запрос из бюджета key без ожидания: 0 если запрос выделен, иначе время до свободного запроса
+func (l *RequestLimiter) tryAcquire(key string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = NewTokenBucket(l.rate, l.burst)
+		l.buckets[key] = b
+	}
+	wait := b.wait(now)
+	if wait == 0 {
+		b.take(now)
+		l.forget(now)
+	}
+	return wait
+}
+
+// forget Удаление восстановившихся корзин, чтобы не хранить их для давно неактивных кабинетов
+func (l *RequestLimiter) forget(now time.Time) {
+	for key, b := range l.buckets {
+		if b.full(now) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// APIClient Запросы к API маркетплейса с ограничением частоты и повтором временных ошибок
+type APIClient struct {
+	http        *http.Client
+	limiter     *RequestLimiter
+	maxAttempts int
+	retryDelay  time.Duration
+	sleep       func(time.Duration)
+	// failFast Не ждать свободного запроса, а сразу вернуть RateLimitedError
+	failFast bool
+}
+
+func NewAPIClient(limiter *RequestLimiter) *APIClient {
+	return &APIClient{
+		http:        &http.Client{Timeout: apiRequestTimeout},
+		limiter:     limiter,
+		maxAttempts: apiMaxAttempts,
+		retryDelay:  apiRetryDelay,
+		sleep:       time.Sleep,
+	}
+}
+
+// NewFailFastAPIClient Клиент для API с редкими запросами: ожидание лимита заняло бы обработчик обновлений
+// на минуты, поэтому при исчерпанном бюджете или 429 сразу возвращается RateLimitedError, повторов нет.
+func NewFailFastAPIClient(limiter *RequestLimiter) *APIClient {
+	c := NewAPIClient(limiter)
+	c.maxAttempts = 1
+	c.failFast = true
+	return c
+}
+
+var ozonClient = NewAPIClient(NewRequestLimiter(ozonRequestsPerSecond, ozonRequestsBurst))
+
+// ozonPost Запрос к Seller API: POST с JSON телом и ключами кабинета в заголовках
+func ozonPost(baseUrl string, clientId string, token string, path string, body interface{}) (func() (*http.Request, error), error) {
+	requestBody, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	return func() (*http.Request, error) {
+		r, err := http.NewRequest("POST", baseUrl+path, bytes.NewReader(requestBody))
+		if err != nil {
+			return nil, err
+		}
+		r.Header.Set("Client-Id", clientId)
+		r.Header.Set("Api-Key", token)
+		r.Header.Set("content-type", "application/json")
+		return r, nil
+	}, nil
+}
+
+// do Запрос в бюджете key с разбором ответа в result. newRequest вызывается на каждую попытку.
+// Ответы 429 и 5xx и сетевые ошибки повторяются с экспоненциальной задержкой, задержка из ответа учитывается.
+func (c *APIClient) do(key string, newRequest func() (*http.Request, error), result interface{}) error {
+	var lastErr error
+	for attempt := 0; attempt < c.maxAttempts; attempt++ {
+		r, err := newRequest()
+		if err != nil {
+			return err
+		}
+		if attempt > 0 {
+			delay := c.retryDelay << (attempt - 1)
+			var apiErr *APIError
+			if errors.As(lastErr, &apiErr) && apiErr.RetryAfter > delay {
+				delay = apiErr.RetryAfter
+			}
+			delay = min(delay, apiMaxRetryDelay)
+			log.Printf("Повтор запроса %s через %s: %v", r.URL.Path, delay, lastErr)
+			c.sleep(delay)
+		}
+		if c.failFast {
+			if wait := c.limiter.tryAcquire(key); wait > 0 {
+				return &RateLimitedError{RetryAfter: wait}
+			}
+		} else {
+			c.limiter.acquire(key)
+		}
+		b, err := c.send(r)
+		if err == nil {
+			return json.Unmarshal(b, result)
+		}
+		var apiErr *APIError
+		if c.failFast && errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusTooManyRequests {
+			return &RateLimitedError{RetryAfter: max(apiErr.RetryAfter, time.Duration(float64(time.Second)/c.limiter.rate))}
+		}
+		if errors.As(err, &apiErr) && !apiErr.temporary() {
+			return err
+		}
+		lastErr = err
+	}
+	return lastErr
+}
+
+func (c *APIClient) send(r *http.Request) ([]byte, error) {
+	response, err := c.http.Do(r)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	b, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		apiErr := &APIError{Path: r.URL.Path, StatusCode: response.StatusCode, Status: response.Status, Body: string(b)}
+		for _, header := range []string{"Retry-After", "X-Ratelimit-Retry"} {
+			if seconds, err := strconv.Atoi(response.Header.Get(header)); err == nil {
+				apiErr.RetryAfter = time.Duration(seconds) * time.Second
+				break
+			}
+		}
+		return nil, apiErr
+	}
+	return b, nil
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPaginate(t *testing.T) {
+	failure := errors.New("503")
+	tests := []struct {
+		name        string
+		total       int
+		hasNext     bool
+		failAt      int
+		wantItems   int
+		wantCalls   int
+		wantPartial bool
+		wantErr     bool
+	}{
+		{name: "Последняя страница короче лимита", total: 25, hasNext: true, failAt: -1, wantItems: 25, wantCalls: 3},
+		{name: "Кратно лимиту - одна пустая страница", total: 20, hasNext: true, failAt: -1, wantItems: 20, wantCalls: 3},
+		{name: "OZON сообщил, что страниц больше нет", total: 30, hasNext: false, failAt: -1, wantItems: 10, wantCalls: 1},
+		{name: "Ошибка на первой странице", total: 30, hasNext: true, failAt: 0, wantCalls: 1, wantErr: true},
+		{name: "Ошибка на середине - частичный результат", total: 30, hasNext: true, failAt: 2, wantItems: 20, wantCalls: 3, wantErr: true, wantPartial: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			items, err := paginate(10, func(offset int, limit int) ([]int, bool, error) {
+				calls++
+				if offset/limit == tt.failAt {
+					return nil, false, failure
+				}
+				var page []int
+				for i := offset; i < min(offset+limit, tt.total); i++ {
+					page = append(page, i)
+				}
+				return page, tt.hasNext, nil
+			})
+			if (err != nil) != tt.wantErr || isPartialResult(err) != tt.wantPartial {
+				t.Fatalf("paginate() error = %v", err)
+			}
+			if err != nil && !errors.Is(err, failure) {
+				t.Errorf("error %v does not wrap %v", err, failure)
+			}
+			if len(items) != tt.wantItems || calls != tt.wantCalls {
+				t.Errorf("items = %d, calls = %d, want %d, %d", len(items), calls, tt.wantItems, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestAPIClient_do(t *testing.T) {
+	tests := []struct {
+		name       string
+		responses  []int
+		wantCalls  int
+		wantSleeps []time.Duration
+		wantErr    bool
+	}{
+		{name: "Успешный ответ", responses: []int{200}, wantCalls: 1},
+		{name: "429 с Retry-After, затем 500", responses: []int{429, 500, 200}, wantCalls: 3, wantSleeps: []time.Duration{2 * time.Second, 20 * time.Millisecond}},
+		{name: "400 не повторяется", responses: []int{400, 200}, wantCalls: 1, wantErr: true},
+		{name: "Попытки закончились", responses: []int{502, 502, 502, 502, 200}, wantCalls: 4, wantErr: true,
+			wantSleeps: []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 40 * time.Millisecond}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("Client-Id") != "42" || r.Header.Get("Api-Key") != "token" {
+					t.Errorf("headers = %v", r.Header)
+				}
+				code := tt.responses[calls]
+				calls++
+				if code == http.StatusTooManyRequests {
+					w.Header().Set("Retry-After", "2")
+				}
+				w.WriteHeader(code)
+				_, _ = w.Write([]byte(`{"result":[{"posting_number":"1"}]}`))
+			}))
+			defer server.Close()
+
+			var sleeps []time.Duration
+			c := NewAPIClient(NewRequestLimiter(1000, 1000))
+			c.retryDelay = 10 * time.Millisecond
+			c.sleep = func(d time.Duration) { sleeps = append(sleeps, d) }
+			request, err := ozonPost(server.URL, "42", "token", "/v2/posting/fbo/list", ListBodyRequestFBO{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var l ListResponseFBO
+			err = c.do("42", request, &l)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("do() error = %v", err)
+			}
+			var apiErr *APIError
+			if err != nil && (!errors.As(err, &apiErr) || !strings.HasPrefix(err.Error(), "/v2/posting/fbo/list: ")) {
+				t.Errorf("error = %v, want APIError with path", err)
+			}
+			if err == nil && (len(l.Result) != 1 || l.Result[0].PostingNumber != "1") {
+				t.Errorf("result = %+v", l)
+			}
+			if calls != tt.wantCalls || len(sleeps) != len(tt.wantSleeps) {
+				t.Fatalf("calls = %d, sleeps = %v", calls, sleeps)
+			}
+			for i := range sleeps {
+				if sleeps[i] != tt.wantSleeps[i] {
+					t.Errorf("sleeps = %v, want %v", sleeps, tt.wantSleeps)
+				}
+			}
+		})
+	}
+}
+
+func TestRequestLimiter_acquire(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var slept time.Duration
+	l := NewRequestLimiter(2, 2)
+	l.now = func() time.Time { return now }
+	l.sleep = func(d time.Duration) {
+		slept += d
+		now = now.Add(d)
+	}
+	// Два пользователя одного кабинета расходуют общий бюджет
+	l.acquire("42")
+	l.acquire("42")
+	if slept != 0 {
+		t.Fatalf("slept %s within burst", slept)
+	}
+	l.acquire("42")
+	if slept != 500*time.Millisecond {
+		t.Errorf("slept %s, want 500ms", slept)
+	}
+	// У другого кабинета свой бюджет
+	l.acquire("7")
+	if slept != 500*time.Millisecond {
+		t.Errorf("other client waited, slept %s", slept)
+	}
+	now = now.Add(time.Hour)
+	l.acquire("7")
+	if _, ok := l.buckets["42"]; ok {
+		t.Errorf("restored bucket is kept")
+	}
+}
+
+func TestFailFastAPIClient_do(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	calls := 0
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if status == http.StatusTooManyRequests {
+			w.Header().Set("X-Ratelimit-Retry", "30")
+		}
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(`[]`))
+	}))
+	defer server.Close()
+
+	limiter := NewRequestLimiter(1.0/60, 1)
+	limiter.now = func() time.Time { return now }
+	c := NewFailFastAPIClient(limiter)
+	c.sleep = func(d time.Duration) { t.Errorf("клиент ждет %s", d) }
+	limiter.sleep = c.sleep
+	request := wbGet(server.URL, "token", "/api/v1/supplier/orders", url.Values{})
+
+	var orders []WbOrder
+	if err := c.do("token/orders", request, &orders); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(15 * time.Second)
+	err := c.do("token/orders", request, &orders)
+	if seconds, ok := retryAfterSeconds(err); !ok || seconds != 45 {
+		t.Errorf("второй запрос за минуту: err = %v, повтор через %d сек., want 45", err, seconds)
+	}
+	if calls != 1 {
+		t.Errorf("запрос сверх лимита отправлен, calls = %d", calls)
+	}
+
+	// 429 от WB тоже не ждем
+	now = now.Add(time.Minute)
+	status = http.StatusTooManyRequests
+	err = c.do("token/orders", request, &orders)
+	if seconds, ok := retryAfterSeconds(err); !ok || seconds != 60 {
+		t.Errorf("ответ 429: err = %v, повтор через %d сек., want 60", err, seconds)
+	}
+	if calls != 2 {
+		t.Errorf("calls = %d, want 2 без повторов", calls)
+	}
+}
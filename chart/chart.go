@@ -0,0 +1,266 @@
+// Package chart Отрисовка линейных графиков в PNG без внешних сервисов.
+//
+// График состоит из нескольких панелей с общей осью X, у каждой панели своя шкала Y,
+// поэтому на одном изображении помещаются и суммы в рублях, и количество штук.
+package chart
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+// Series Линия графика, Values по одному значению на каждую подпись оси X
+type Series struct {
+	Name   string
+	Color  color.RGBA
+	Values []float64
+}
+
+// Panel Область графика со своей шкалой Y
+type Panel struct {
+	Title  string
+	Series []Series
+}
+
+type Chart struct {
+	Title  string
+	Labels []string
+	Panels []Panel
+	Width  int
+	Height int
+}
+
+var (
+	Blue  = color.RGBA{R: 0x1f, G: 0x77, B: 0xb4, A: 0xff}
+	Green = color.RGBA{R: 0x2c, G: 0xa0, B: 0x2c, A: 0xff}
+	Red   = color.RGBA{R: 0xd6, G: 0x27, B: 0x28, A: 0xff}
+
+	textColor = color.RGBA{R: 0x33, G: 0x33, B: 0x33, A: 0xff}
+	gridColor = color.RGBA{R: 0xe0, G: 0xe0, B: 0xe0, A: 0xff}
+	axisColor = color.RGBA{R: 0x99, G: 0x99, B: 0x99, A: 0xff}
+)
+
+const (
+	defaultWidth  = 1000
+	defaultHeight = 700
+	marginLeft    = 80
+	marginRight   = 30
+	marginTop     = 50
+	marginBottom  = 40
+	panelHeader   = 28
+	panelGap      = 20
+	yTicks        = 4
+	lineWidth     = 2
+	// maxMarkers Точки значений рисуются, только если их немного
+	maxMarkers = 31
+)
+
+var (
+	regularFace = mustFace(goregular.TTF, 13)
+	boldFace    = mustFace(gobold.TTF, 16)
+)
+
+func mustFace(ttf []byte, size float64) font.Face {
+	f, err := opentype.Parse(ttf)
+	if err != nil {
+		panic(err)
+	}
+	face, err := opentype.NewFace(f, &opentype.FaceOptions{Size: size, DPI: 72, Hinting: font.HintingFull})
+	if err != nil {
+		panic(err)
+	}
+	return face
+}
+
+// PNG Отрисовка графика в формате PNG
+func (c Chart) PNG(w io.Writer) error {
+	return png.Encode(w, c.Image())
+}
+
+func (c Chart) Image() *image.RGBA {
+	width, height := c.Width, c.Height
+	if width == 0 {
+		width = defaultWidth
+	}
+	if height == 0 {
+		height = defaultHeight
+	}
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), image.White, image.Point{}, draw.Src)
+	drawText(img, boldFace, c.Title, marginLeft, 30, textColor)
+
+	plotLeft, plotRight := marginLeft, width-marginRight
+	if len(c.Panels) == 0 {
+		return img
+	}
+	panelHeight := (height - marginTop - marginBottom - panelGap*(len(c.Panels)-1)) / len(c.Panels)
+	for i, p := range c.Panels {
+		top := marginTop + i*(panelHeight+panelGap)
+		area := image.Rect(plotLeft, top+panelHeader, plotRight, top+panelHeight)
+		c.drawPanel(img, p, top, area)
+	}
+	c.drawLabels(img, plotLeft, plotRight, height-marginBottom+18)
+	return img
+}
+
+func (c Chart) drawPanel(img *image.RGBA, p Panel, top int, area image.Rectangle) {
+	// Заголовок и легенда
+	x := area.Min.X
+	x += drawText(img, boldFace, p.Title, x, top+16, textColor) + 16
+	for _, s := range p.Series {
+		fillRect(img, image.Rect(x, top+7, x+12, top+17), s.Color)
+		x += 18
+		x += drawText(img, regularFace, s.Name, x, top+16, textColor) + 16
+	}
+
+	maxValue := 0.0
+	for _, s := range p.Series {
+		for _, v := range s.Values {
+			maxValue = math.Max(maxValue, v)
+		}
+	}
+	step := niceStep(maxValue / yTicks)
+	scaleMax := step * math.Ceil(maxValue/step)
+	if scaleMax == 0 {
+		scaleMax = step
+	}
+	y := func(v float64) int {
+		return area.Max.Y - int(math.Round(v/scaleMax*float64(area.Dy())))
+	}
+	for v := 0.0; v <= scaleMax+step/2; v += step {
+		py := y(v)
+		hLine(img, area.Min.X, area.Max.X, py, gridColor)
+		label := FormatNumber(v)
+		drawText(img, regularFace, label, area.Min.X-8-textWidth(regularFace, label), py+5, textColor)
+	}
+	vLine(img, area.Min.X, area.Min.Y, area.Max.Y, axisColor)
+	hLine(img, area.Min.X, area.Max.X, area.Max.Y, axisColor)
+
+	for _, s := range p.Series {
+		var prev image.Point
+		for i, v := range s.Values {
+			pt := image.Pt(c.x(i, area.Min.X, area.Max.X), y(v))
+			if i > 0 {
+				drawLine(img, prev, pt, s.Color)
+			}
+			if len(s.Values) <= maxMarkers {
+				fillRect(img, image.Rect(pt.X-3, pt.Y-3, pt.X+4, pt.Y+4), s.Color)
+			}
+			prev = pt
+		}
+	}
+}
+
+// drawLabels Подписи оси X, часть подписей пропускается, чтобы они не накладывались
+func (c Chart) drawLabels(img *image.RGBA, left int, right int, baseline int) {
+	if len(c.Labels) == 0 {
+		return
+	}
+	widest := 0
+	for _, l := range c.Labels {
+		widest = max(widest, textWidth(regularFace, l))
+	}
+	every := 1
+	if slot := float64(right-left) / float64(len(c.Labels)); slot > 0 {
+		every = int(math.Ceil(float64(widest+10) / slot))
+	}
+	for i := len(c.Labels) - 1; i >= 0; i -= every {
+		x := c.x(i, left, right)
+		vLine(img, x, baseline-22, baseline-16, axisColor)
+		drawText(img, regularFace, c.Labels[i], x-textWidth(regularFace, c.Labels[i])/2, baseline, textColor)
+	}
+}
+
+// x Координата i-го значения, точки расставляются по центрам равных интервалов
+func (c Chart) x(i int, left int, right int) int {
+	n := len(c.Labels)
+	if n == 0 {
+		n = 1
+	}
+	slot := float64(right-left) / float64(n)
+	return left + int(math.Round(slot*(float64(i)+0.5)))
+}
+
+// niceStep Шаг шкалы из ряда 1, 2, 5, 10 умноженного на степень десяти
+func niceStep(raw float64) float64 {
+	if raw <= 0 {
+		return 1
+	}
+	magnitude := math.Pow(10, math.Floor(math.Log10(raw)))
+	for _, m := range []float64{1, 2, 5, 10} {
+		if raw <= m*magnitude {
+			return math.Max(m*magnitude, 1)
+		}
+	}
+	return 10 * magnitude
+}
+
+// FormatNumber Целое число с разделением разрядов пробелом: 12 500
+func FormatNumber(v float64) string {
+	s := strconv.FormatInt(int64(math.Round(v)), 10)
+	sign := ""
+	if strings.HasPrefix(s, "-") {
+		sign, s = "-", s[1:]
+	}
+	var b strings.Builder
+	for i, r := range s {
+		if i > 0 && (len(s)-i)%3 == 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteRune(r)
+	}
+	return sign + b.String()
+}
+
+func textWidth(face font.Face, s string) int {
+	return font.MeasureString(face, s).Ceil()
+}
+
+// drawText Вывод текста от точки базовой линии, возвращает ширину текста
+func drawText(img *image.RGBA, face font.Face, s string, x int, y int, c color.Color) int {
+	d := font.Drawer{Dst: img, Src: image.NewUniform(c), Face: face, Dot: fixed.P(x, y)}
+	d.DrawString(s)
+	return textWidth(face, s)
+}
+
+func fillRect(img *image.RGBA, r image.Rectangle, c color.Color) {
+	draw.Draw(img, r, image.NewUniform(c), image.Point{}, draw.Over)
+}
+
+func hLine(img *image.RGBA, x1 int, x2 int, y int, c color.Color) {
+	fillRect(img, image.Rect(x1, y, x2+1, y+1), c)
+}
+
+func vLine(img *image.RGBA, x int, y1 int, y2 int, c color.Color) {
+	fillRect(img, image.Rect(x, y1, x+1, y2+1), c)
+}
+
+// drawLine Отрезок толщиной lineWidth
+func drawLine(img *image.RGBA, a image.Point, b image.Point, c color.Color) {
+	dx, dy := b.X-a.X, b.Y-a.Y
+	steps := max(abs(dx), abs(dy), 1)
+	for i := 0; i <= steps; i++ {
+		x := a.X + int(math.Round(float64(dx*i)/float64(steps)))
+		y := a.Y + int(math.Round(float64(dy*i)/float64(steps)))
+		fillRect(img, image.Rect(x-lineWidth/2, y-lineWidth/2, x-lineWidth/2+lineWidth, y-lineWidth/2+lineWidth), c)
+	}
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
@@ -0,0 +1,94 @@
+package chart
+
+import (
+	"bytes"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+func TestChart_PNG(t *testing.T) {
+	c := Chart{
+		Title:  "Продажи за 7 дней",
+		Labels: []string{"01.01", "02.01", "03.01", "04.01", "05.01", "06.01", "07.01"},
+		Panels: []Panel{
+			{Title: "Выручка, ₽", Series: []Series{{Name: "Выручка", Color: Blue, Values: []float64{1200, 3400, 0, 5600, 2300, 4100, 3900}}}},
+			{Title: "Товары, шт.", Series: []Series{
+				{Name: "Заказано", Color: Green, Values: []float64{3, 8, 0, 12, 5, 9, 8}},
+				{Name: "Отменено", Color: Red, Values: []float64{0, 1, 0, 2, 0, 1, 0}},
+			}},
+		},
+		Width:  800,
+		Height: 600,
+	}
+	var b bytes.Buffer
+	if err := c.PNG(&b); err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := img.Bounds().Size(); got.X != 800 || got.Y != 600 {
+		t.Errorf("size = %v, want 800x600", got)
+	}
+	found := make(map[color.RGBA]bool)
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, a := img.At(x, y).RGBA()
+			found[color.RGBA{R: uint8(r >> 8), G: uint8(g >> 8), B: uint8(b >> 8), A: uint8(a >> 8)}] = true
+		}
+	}
+	for _, want := range []color.RGBA{Blue, Green, Red} {
+		if !found[want] {
+			t.Errorf("image does not contain series color %v", want)
+		}
+	}
+}
+
+func TestChart_Empty(t *testing.T) {
+	var b bytes.Buffer
+	c := Chart{Title: "Нет данных", Panels: []Panel{{Title: "Выручка", Series: []Series{{Name: "Выручка", Color: Blue}}}}}
+	if err := c.PNG(&b); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNiceStep(t *testing.T) {
+	tests := []struct {
+		raw  float64
+		want float64
+	}{
+		{0, 1},
+		{0.3, 1},
+		{3, 5},
+		{12, 20},
+		{1250, 2000},
+		{4900, 5000},
+		{7000, 10000},
+	}
+	for _, tt := range tests {
+		if got := niceStep(tt.raw); got != tt.want {
+			t.Errorf("niceStep(%v) = %v, want %v", tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestFormatNumber(t *testing.T) {
+	tests := []struct {
+		v    float64
+		want string
+	}{
+		{0, "0"},
+		{999, "999"},
+		{12500, "12 500"},
+		{1234567.6, "1 234 568"},
+		{-4500, "-4 500"},
+	}
+	for _, tt := range tests {
+		if got := FormatNumber(tt.v); got != tt.want {
+			t.Errorf("FormatNumber(%v) = %q, want %q", tt.v, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,7 @@
+module chart
+
+go 1.21.5
+
+require golang.org/x/image v0.15.0
+
+require golang.org/x/text v0.14.0 // indirect
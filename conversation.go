@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"sync"
+	"time"
+)
+
+// ConversationState Состояние диалога пользователя с ботом
+type ConversationState string
+
+const (
+	StateIdle                ConversationState = ""
+	StateAwaitCostOzon       ConversationState = "await_cost_ozon"
+	StateAwaitPurchasePrice  ConversationState = "await_purchase_price"
+	StateAwaitStockAlertDays ConversationState = "await_stock_alert_days"
+	StateAwaitDigestTime     ConversationState = "await_digest_time"
+	StateAwaitGroupRule      ConversationState = "await_group_rule"
+	StateAwaitCostWb         ConversationState = "await_cost_wb"
+	StateAwaitCostYm         ConversationState = "await_cost_ym"
+	StateAwaitAccount        ConversationState = "await_account"
+	StateAwaitAccountName    ConversationState = "await_account_name"
+)
+
+// conversationTimeouts Время, в течение которого бот ждет ответа пользователя в каждом состоянии
+var conversationTimeouts = map[ConversationState]time.Duration{
+	StateAwaitCostOzon:       10 * time.Minute,
+	StateAwaitPurchasePrice:  10 * time.Minute,
+	StateAwaitStockAlertDays: 10 * time.Minute,
+	StateAwaitDigestTime:     10 * time.Minute,
+	StateAwaitGroupRule:      10 * time.Minute,
+	StateAwaitCostWb:         10 * time.Minute,
+	StateAwaitCostYm:         10 * time.Minute,
+	StateAwaitAccount:        15 * time.Minute,
+	StateAwaitAccountName:    10 * time.Minute,
+}
+
+const defaultConversationTimeout = 10 * time.Minute
+
+// ConversationKey Диалог ведется отдельно для каждого пользователя в каждом чате
+type ConversationKey struct {
+	UserId int64 `bson:"user_id"`
+	ChatId int64 `bson:"chat_id"`
+}
+
+// ConversationPayload Данные, собранные в ходе диалога
+type ConversationPayload struct {
+	// NameGroup Группа товаров, для которой вводится закупочная цена
+	NameGroup string `bson:"name_group,omitempty"`
+	// Digest Выбранные отчет, периодичность и день недели рассылки, см. digestSpec
+	Digest string `bson:"digest,omitempty"`
+	// GroupRuleKind Вид добавляемого правила группировки товаров
+	GroupRuleKind GroupRuleKind `bson:"group_rule_kind,omitempty"`
+	// Marketplace Маркетплейс добавляемого или переименовываемого кабинета
+	Marketplace Marketplace `bson:"marketplace,omitempty"`
+	// AccountId Переименовываемый кабинет
+	AccountId string `bson:"account_id,omitempty"`
+}
+
+type Conversation struct {
+	Key       ConversationKey     `bson:"_id"`
+	State     ConversationState   `bson:"state"`
+	Payload   ConversationPayload `bson:"payload"`
+	ExpiresAt time.Time           `bson:"expires_at"`
+}
+
+type ConversationRepository interface {
+	getConversation(key ConversationKey) (*Conversation, error)
+	setConversation(c Conversation) error
+	deleteConversation(key ConversationKey) error
+}
+
+// ConversationDB Хранение диалогов в MongoDB, истекшие диалоги удаляются TTL индексом
+type ConversationDB struct{}
+
+func (d ConversationDB) collection() *mongo.Collection {
+	return clientMongo.Database("MyInfantBotDB").Collection("bot_conversations")
+}
+
+func (d ConversationDB) createIndexes() error {
+	_, err := d.collection().Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys:    bson.D{{"expires_at", 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	return err
+}
+
+func (d ConversationDB) getConversation(key ConversationKey) (*Conversation, error) {
+	var c Conversation
+	err := d.collection().FindOne(context.TODO(), bson.D{{"_id", key}}).Decode(&c)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (d ConversationDB) setConversation(c Conversation) error {
+	opts := options.Replace().SetUpsert(true)
+	_, err := d.collection().ReplaceOne(context.TODO(), bson.D{{"_id", c.Key}}, c, opts)
+	return err
+}
+
+func (d ConversationDB) deleteConversation(key ConversationKey) error {
+	_, err := d.collection().DeleteOne(context.TODO(), bson.D{{"_id", key}})
+	return err
+}
+
+// ConversationMemory Хранение диалогов в памяти процесса
+type ConversationMemory struct {
+	mu            sync.Mutex
+	conversations map[ConversationKey]Conversation
+}
+
+func NewConversationMemory() *ConversationMemory {
+	return &ConversationMemory{conversations: make(map[ConversationKey]Conversation)}
+}
+
+func (d *ConversationMemory) getConversation(key ConversationKey) (*Conversation, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	c, ok := d.conversations[key]
+	if !ok {
+		return nil, nil
+	}
+	return &c, nil
+}
+
+func (d *ConversationMemory) setConversation(c Conversation) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.conversations[c.Key] = c
+	return nil
+}
+
+func (d *ConversationMemory) deleteConversation(key ConversationKey) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.conversations, key)
+	return nil
+}
+
+// ConversationFSM Переходы между состояниями диалога с учетом времени ожидания ответа
+type ConversationFSM struct {
+	repo ConversationRepository
+	now  func() time.Time
+}
+
+func NewConversationFSM(repo ConversationRepository) *ConversationFSM {
+	return &ConversationFSM{repo: repo, now: time.Now}
+}
+
+// current Текущий диалог. Истекший диалог считается завершенным.
+func (f *ConversationFSM) current(key ConversationKey) (Conversation, error) {
+	c, err := f.repo.getConversation(key)
+	if err != nil || c == nil {
+		return Conversation{Key: key}, err
+	}
+	if !c.ExpiresAt.After(f.now()) {
+		return Conversation{Key: key}, f.repo.deleteConversation(key)
+	}
+	return *c, nil
+}
+
+// enter Переход в состояние state, ожидание ответа ограничено conversationTimeouts
+func (f *ConversationFSM) enter(key ConversationKey, state ConversationState, payload ConversationPayload) error {
+	if state == StateIdle {
+		return f.reset(key)
+	}
+	timeout, ok := conversationTimeouts[state]
+	if !ok {
+		timeout = defaultConversationTimeout
+	}
+	return f.repo.setConversation(Conversation{
+		Key:       key,
+		State:     state,
+		Payload:   payload,
+		ExpiresAt: f.now().Add(timeout),
+	})
+}
+
+func (f *ConversationFSM) reset(key ConversationKey) error {
+	return f.repo.deleteConversation(key)
+}
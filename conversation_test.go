@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConversationFSM(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	fsm := NewConversationFSM(NewConversationMemory())
+	fsm.now = func() time.Time { return now }
+
+	first := ConversationKey{UserId: 1, ChatId: 2}
+	second := ConversationKey{UserId: 2, ChatId: 1}
+	if err := fsm.enter(first, StateAwaitPurchasePrice, ConversationPayload{NameGroup: "Носки"}); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := fsm.current(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.State != StateAwaitPurchasePrice || c.Payload.NameGroup != "Носки" {
+		t.Errorf("current() = %+v, want state %s with payload", c, StateAwaitPurchasePrice)
+	}
+
+	c, _ = fsm.current(second)
+	if c.State != StateIdle {
+		t.Errorf("current() for another user = %s, want idle", c.State)
+	}
+
+	now = now.Add(conversationTimeouts[StateAwaitPurchasePrice])
+	c, _ = fsm.current(first)
+	if c.State != StateIdle {
+		t.Errorf("current() after timeout = %s, want idle", c.State)
+	}
+
+	if err := fsm.enter(first, StateAwaitAccount, ConversationPayload{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsm.reset(first); err != nil {
+		t.Fatal(err)
+	}
+	c, _ = fsm.current(first)
+	if c.State != StateIdle {
+		t.Errorf("current() after reset = %s, want idle", c.State)
+	}
+}
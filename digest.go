@@ -0,0 +1,739 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"format"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"telegram"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// DigestKind Периодичность рассылки
+type DigestKind string
+
+const (
+	DigestDaily   DigestKind = "daily"
+	DigestWeekly  DigestKind = "weekly"
+	DigestMonthly DigestKind = "monthly"
+)
+
+var digestKinds = []DigestKind{DigestDaily, DigestWeekly, DigestMonthly}
+
+func (k DigestKind) String() string {
+	switch k {
+	case DigestDaily:
+		return "Ежедневно"
+	case DigestWeekly:
+		return "Еженедельно"
+	case DigestMonthly:
+		return "Ежемесячно"
+	}
+	return string(k)
+}
+
+// DigestReport Отчет, отправляемый в рассылке
+type DigestReport string
+
+const (
+	DigestSummary DigestReport = "summary"
+	DigestFinance DigestReport = "finance"
+	DigestReturns DigestReport = "returns"
+)
+
+var digestReports = []DigestReport{DigestSummary, DigestFinance, DigestReturns}
+
+func (r DigestReport) String() string {
+	switch r {
+	case DigestSummary:
+		return "Продажи"
+	case DigestFinance:
+		return "Финансы"
+	case DigestReturns:
+		return "Возвраты"
+	}
+	return string(r)
+}
+
+var weekdayNames = [...]string{"воскресеньям", "понедельникам", "вторникам", "средам", "четвергам", "пятницам", "субботам"}
+
+const (
+	digestCheckInterval = 30 * time.Second
+	digestBatchSize     = 50
+	// digestLeaseTimeout Время, на которое реплика захватывает рассылку. Если реплика упала
+	// или отчет не удалось построить, рассылку повторит любая реплика после окончания аренды.
+	digestLeaseTimeout = 10 * time.Minute
+	// digestLeaseRenewInterval Как часто реплика продлевает аренду, пока строит отчет
+	digestLeaseRenewInterval = digestLeaseTimeout / 3
+	// digestMaxDelay Рассылка, которую не удалось отправить за это время, пропускается до следующего срока
+	digestMaxDelay = 12 * time.Hour
+)
+
+// DigestSchedule Рассылка отчета пользователя по расписанию
+type DigestSchedule struct {
+	Id     primitive.ObjectID `bson:"_id"`
+	UserId int64              `bson:"user_id"`
+	Kind   DigestKind         `bson:"kind"`
+	Report DigestReport       `bson:"report"`
+	Hour   int                `bson:"hour"`
+	Minute int                `bson:"minute"`
+	// Weekday День недели еженедельной рассылки
+	Weekday time.Weekday `bson:"weekday"`
+	// Day День месяца ежемесячной рассылки, в коротких месяцах - последний день
+	Day        int       `bson:"day"`
+	NextRunAt  time.Time `bson:"next_run_at"`
+	LeaseUntil time.Time `bson:"lease_until"`
+	LeaseOwner string    `bson:"lease_owner,omitempty"`
+	CreatedAt  time.Time `bson:"created_at"`
+}
+
+func (s DigestSchedule) String() string {
+	at := fmt.Sprintf("в %02d:%02d", s.Hour, s.Minute)
+	switch s.Kind {
+	case DigestWeekly:
+		return fmt.Sprintf("По %s %s: %s", weekdayNames[s.Weekday], at, s.Report)
+	case DigestMonthly:
+		return fmt.Sprintf("Ежемесячно %d числа %s: %s", s.Day, at, s.Report)
+	}
+	return fmt.Sprintf("%s %s: %s", s.Kind, at, s.Report)
+}
+
+// nextRun Ближайший срок рассылки строго после after
+func (s DigestSchedule) nextRun(after time.Time, loc *time.Location) time.Time {
+	local := after.In(loc)
+	switch s.Kind {
+	case DigestWeekly:
+		shift := (int(s.Weekday) - int(local.Weekday()) + 7) % 7
+		run := time.Date(local.Year(), local.Month(), local.Day()+shift, s.Hour, s.Minute, 0, 0, loc)
+		if !run.After(after) {
+			run = time.Date(local.Year(), local.Month(), local.Day()+shift+7, s.Hour, s.Minute, 0, 0, loc)
+		}
+		return run
+	case DigestMonthly:
+		for i := 0; ; i++ {
+			first := time.Date(local.Year(), local.Month()+time.Month(i), 1, 0, 0, 0, 0, loc)
+			day := min(s.Day, daysIn(first))
+			run := time.Date(first.Year(), first.Month(), day, s.Hour, s.Minute, 0, 0, loc)
+			if run.After(after) {
+				return run
+			}
+		}
+	}
+	run := time.Date(local.Year(), local.Month(), local.Day(), s.Hour, s.Minute, 0, 0, loc)
+	if !run.After(after) {
+		run = time.Date(local.Year(), local.Month(), local.Day()+1, s.Hour, s.Minute, 0, 0, loc)
+	}
+	return run
+}
+
+// daysIn Количество дней в месяце
+func daysIn(t time.Time) int {
+	return time.Date(t.Year(), t.Month()+1, 0, 0, 0, 0, 0, t.Location()).Day()
+}
+
+// period Период отчета рассылки со сроком runAt: вчера, последние 7 дней или прошлый месяц
+func (s DigestSchedule) period(runAt time.Time, loc *time.Location) DateRange {
+	yesterday := dayRange(runAt, loc, -1)
+	switch s.Kind {
+	case DigestWeekly:
+		return DateRange{From: dayRange(runAt, loc, -7).From, To: yesterday.To}
+	case DigestMonthly:
+		return monthRange(monthRange(runAt, loc).From.Add(-time.Nanosecond), loc)
+	}
+	return yesterday
+}
+
+// digestSpec Разбор данных кнопок мастера рассылки: отчет[-периодичность[-день недели]].
+// complete - выбрано все, кроме времени (и дня месяца для ежемесячной рассылки).
+func digestSpec(spec string) (s DigestSchedule, complete bool, err error) {
+	parts := strings.Split(spec, "-")
+	s.Report = DigestReport(parts[0])
+	if findIndex(digestReports, func(r DigestReport) bool { return r == s.Report }) < 0 {
+		return s, false, fmt.Errorf("неизвестный отчет рассылки %q", parts[0])
+	}
+	if len(parts) == 1 {
+		return s, false, nil
+	}
+	s.Kind = DigestKind(parts[1])
+	if findIndex(digestKinds, func(k DigestKind) bool { return k == s.Kind }) < 0 {
+		return s, false, fmt.Errorf("неизвестная периодичность рассылки %q", parts[1])
+	}
+	if s.Kind != DigestWeekly {
+		return s, len(parts) == 2, nil
+	}
+	if len(parts) == 2 {
+		return s, false, nil
+	}
+	weekday, err := strconv.Atoi(parts[2])
+	if err != nil || weekday < 0 || weekday > 6 {
+		return s, false, fmt.Errorf("неизвестный день недели %q", parts[2])
+	}
+	s.Weekday = time.Weekday(weekday)
+	return s, len(parts) == 3, nil
+}
+
+var digestTimePattern = regexp.MustCompile(`^(?:(\d{1,2})\s+)?(\d{1,2})[:.](\d{2})$`)
+
+// parseDigestTime Время рассылки "ЧЧ:ММ", для ежемесячной рассылки - "день ЧЧ:ММ"
+func parseDigestTime(s *DigestSchedule, text string) error {
+	m := digestTimePattern.FindStringSubmatch(strings.TrimSpace(text))
+	if m == nil || (m[1] != "") != (s.Kind == DigestMonthly) {
+		return fmt.Errorf("неверный формат времени %q", text)
+	}
+	s.Hour, _ = strconv.Atoi(m[2])
+	s.Minute, _ = strconv.Atoi(m[3])
+	if s.Hour > 23 || s.Minute > 59 {
+		return fmt.Errorf("неверное время %q", text)
+	}
+	if s.Kind == DigestMonthly {
+		s.Day, _ = strconv.Atoi(m[1])
+		if s.Day < 1 || s.Day > 31 {
+			return fmt.Errorf("неверный день месяца %q", m[1])
+		}
+	}
+	return nil
+}
+
+type DigestRepository interface {
+	saveSchedule(s DigestSchedule) error
+	deleteSchedule(userId int64, id primitive.ObjectID) error
+	userSchedules(userId int64) ([]DigestSchedule, error)
+	// due Рассылки, срок которых наступил и которые не захвачены другой репликой
+	due(now time.Time, limit int) ([]DigestSchedule, error)
+	// claim Захват рассылки до leaseUntil, false если ее уже захватила другая реплика
+	claim(id primitive.ObjectID, owner string, now time.Time, leaseUntil time.Time) (bool, error)
+	// extend Продление захвата рассылки, false если она больше не захвачена owner
+	extend(id primitive.ObjectID, owner string, leaseUntil time.Time) (bool, error)
+	// complete Перенос рассылки на следующий срок и освобождение захвата
+	complete(id primitive.ObjectID, owner string, nextRunAt time.Time) error
+	// reschedule Перенос срока рассылки, которая сейчас не отправляется
+	reschedule(id primitive.ObjectID, now time.Time, nextRunAt time.Time) error
+}
+
+type DigestDB struct{}
+
+func (d DigestDB) collection() *mongo.Collection {
+	return clientMongo.Database("MyInfantBotDB").Collection("bot_digests")
+}
+
+func (d DigestDB) createIndexes() error {
+	_, err := d.collection().Indexes().CreateMany(context.TODO(), []mongo.IndexModel{
+		{Keys: bson.D{{"next_run_at", 1}}},
+		{Keys: bson.D{{"user_id", 1}}},
+	})
+	return err
+}
+
+func dueFilter(now time.Time) bson.D {
+	return bson.D{{"next_run_at", bson.D{{"$lte", now}}}, {"lease_until", bson.D{{"$lt", now}}}}
+}
+
+func (d DigestDB) saveSchedule(s DigestSchedule) error {
+	_, err := d.collection().ReplaceOne(context.TODO(), bson.D{{"_id", s.Id}}, s, options.Replace().SetUpsert(true))
+	return err
+}
+
+func (d DigestDB) deleteSchedule(userId int64, id primitive.ObjectID) error {
+	_, err := d.collection().DeleteOne(context.TODO(), bson.D{{"_id", id}, {"user_id", userId}})
+	return err
+}
+
+func (d DigestDB) userSchedules(userId int64) ([]DigestSchedule, error) {
+	cursor, err := d.collection().Find(context.TODO(), bson.D{{"user_id", userId}}, options.Find().SetSort(bson.D{{"created_at", 1}}))
+	if err != nil {
+		return nil, err
+	}
+	var schedules []DigestSchedule
+	err = cursor.All(context.TODO(), &schedules)
+	return schedules, err
+}
+
+func (d DigestDB) due(now time.Time, limit int) ([]DigestSchedule, error) {
+	opts := options.Find().SetSort(bson.D{{"next_run_at", 1}}).SetLimit(int64(limit))
+	cursor, err := d.collection().Find(context.TODO(), dueFilter(now), opts)
+	if err != nil {
+		return nil, err
+	}
+	var schedules []DigestSchedule
+	err = cursor.All(context.TODO(), &schedules)
+	return schedules, err
+}
+
+func (d DigestDB) claim(id primitive.ObjectID, owner string, now time.Time, leaseUntil time.Time) (bool, error) {
+	filter := append(bson.D{{"_id", id}}, dueFilter(now)...)
+	update := bson.D{{"$set", bson.D{{"lease_until", leaseUntil}, {"lease_owner", owner}}}}
+	result, err := d.collection().UpdateOne(context.TODO(), filter, update)
+	if err != nil {
+		return false, err
+	}
+	return result.ModifiedCount == 1, nil
+}
+
+func (d DigestDB) extend(id primitive.ObjectID, owner string, leaseUntil time.Time) (bool, error) {
+	filter := bson.D{{"_id", id}, {"lease_owner", owner}}
+	result, err := d.collection().UpdateOne(context.TODO(), filter, bson.D{{"$set", bson.D{{"lease_until", leaseUntil}}}})
+	if err != nil {
+		return false, err
+	}
+	return result.MatchedCount == 1, nil
+}
+
+func (d DigestDB) complete(id primitive.ObjectID, owner string, nextRunAt time.Time) error {
+	update := bson.D{
+		{"$set", bson.D{{"next_run_at", nextRunAt}, {"lease_until", time.Time{}}}},
+		{"$unset", bson.D{{"lease_owner", ""}}},
+	}
+	_, err := d.collection().UpdateOne(context.TODO(), bson.D{{"_id", id}, {"lease_owner", owner}}, update)
+	return err
+}
+
+func (d DigestDB) reschedule(id primitive.ObjectID, now time.Time, nextRunAt time.Time) error {
+	filter := bson.D{{"_id", id}, {"lease_until", bson.D{{"$lt", now}}}}
+	_, err := d.collection().UpdateOne(context.TODO(), filter, bson.D{{"$set", bson.D{{"next_run_at", nextRunAt}}}})
+	return err
+}
+
+// DigestMemory Рассылки в памяти процесса
+type DigestMemory struct {
+	mu        sync.Mutex
+	schedules map[primitive.ObjectID]DigestSchedule
+}
+
+func NewDigestMemory() *DigestMemory {
+	return &DigestMemory{schedules: make(map[primitive.ObjectID]DigestSchedule)}
+}
+
+func (s DigestSchedule) due(now time.Time) bool {
+	return !s.NextRunAt.After(now) && s.LeaseUntil.Before(now)
+}
+
+func (d *DigestMemory) saveSchedule(s DigestSchedule) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.schedules[s.Id] = s
+	return nil
+}
+
+func (d *DigestMemory) deleteSchedule(userId int64, id primitive.ObjectID) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if s, ok := d.schedules[id]; ok && s.UserId == userId {
+		delete(d.schedules, id)
+	}
+	return nil
+}
+
+func (d *DigestMemory) userSchedules(userId int64) ([]DigestSchedule, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var schedules []DigestSchedule
+	for _, s := range d.schedules {
+		if s.UserId == userId {
+			schedules = append(schedules, s)
+		}
+	}
+	return schedules, nil
+}
+
+func (d *DigestMemory) due(now time.Time, limit int) ([]DigestSchedule, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var schedules []DigestSchedule
+	for _, s := range d.schedules {
+		if s.due(now) && len(schedules) < limit {
+			schedules = append(schedules, s)
+		}
+	}
+	return schedules, nil
+}
+
+func (d *DigestMemory) claim(id primitive.ObjectID, owner string, now time.Time, leaseUntil time.Time) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	s, ok := d.schedules[id]
+	if !ok || !s.due(now) {
+		return false, nil
+	}
+	s.LeaseUntil, s.LeaseOwner = leaseUntil, owner
+	d.schedules[id] = s
+	return true, nil
+}
+
+func (d *DigestMemory) extend(id primitive.ObjectID, owner string, leaseUntil time.Time) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	s, ok := d.schedules[id]
+	if !ok || s.LeaseOwner != owner {
+		return false, nil
+	}
+	s.LeaseUntil = leaseUntil
+	d.schedules[id] = s
+	return true, nil
+}
+
+func (d *DigestMemory) complete(id primitive.ObjectID, owner string, nextRunAt time.Time) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	s, ok := d.schedules[id]
+	if !ok || s.LeaseOwner != owner {
+		return nil
+	}
+	s.NextRunAt, s.LeaseUntil, s.LeaseOwner = nextRunAt, time.Time{}, ""
+	d.schedules[id] = s
+	return nil
+}
+
+func (d *DigestMemory) reschedule(id primitive.ObjectID, now time.Time, nextRunAt time.Time) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	s, ok := d.schedules[id]
+	if !ok || !s.LeaseUntil.Before(now) {
+		return nil
+	}
+	s.NextRunAt = nextRunAt
+	d.schedules[id] = s
+	return nil
+}
+
+// rescheduleDigests Пересчет сроков рассылок пользователя после смены часового пояса
+func rescheduleDigests(repo DigestRepository, userId int64, loc *time.Location, now time.Time) error {
+	schedules, err := repo.userSchedules(userId)
+	if err != nil {
+		return err
+	}
+	for _, s := range schedules {
+		if err := repo.reschedule(s.Id, now, s.nextRun(now, loc)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Digests Отправка рассылок по расписанию.
+//
+// Несколько реплик бота могут работать с одним репозиторием: рассылка захватывается
+// атомарно, поэтому ее отправляет только одна реплика. Срок переносится только после
+// успешной постановки отчета в очередь отправки, при ошибке рассылка повторяется
+// после окончания аренды, но не позже digestMaxDelay от срока. Пока отчет строится,
+// аренда продлевается, поэтому долгий отчет не отправит еще и другая реплика.
+type Digests struct {
+	repo  DigestRepository
+	owner string
+	// location Часовой пояс пользователя, в котором считаются сроки его рассылок
+	location func(userId int64) *time.Location
+	deliver  func(s DigestSchedule) error
+	now      func() time.Time
+	// renewInterval Период продления аренды во время отправки
+	renewInterval time.Duration
+}
+
+func NewDigests(repo DigestRepository, deliver func(s DigestSchedule) error) *Digests {
+	return &Digests{
+		repo:     repo,
+		owner:    primitive.NewObjectID().Hex(),
+		location: UserDB{}.userLocation,
+		deliver:  deliver,
+		now:      time.Now,
+
+		renewInterval: digestLeaseRenewInterval,
+	}
+}
+
+func (d *Digests) run(ctx context.Context) {
+	ticker := time.NewTicker(digestCheckInterval)
+	defer ticker.Stop()
+	for {
+		d.dispatch()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// dispatch Отправка всех рассылок, срок которых наступил
+func (d *Digests) dispatch() {
+	schedules, err := d.repo.due(d.now(), digestBatchSize)
+	if err != nil {
+		log.Printf("Не удалось получить рассылки: %v", err)
+		return
+	}
+	for _, s := range schedules {
+		// Отчеты строятся по очереди и могут занимать минуты, аренда считается от момента захвата
+		now := d.now()
+		claimed, err := d.repo.claim(s.Id, d.owner, now, now.Add(digestLeaseTimeout))
+		if err != nil {
+			log.Printf("Не удалось захватить рассылку %s: %v", s.Id.Hex(), err)
+			continue
+		}
+		if !claimed {
+			continue
+		}
+		if err := d.deliverLeased(s); err != nil {
+			log.Printf("Рассылка %s пользователя %d не отправлена: %v", s.Id.Hex(), s.UserId, err)
+			if now.Sub(s.NextRunAt) < digestMaxDelay {
+				continue
+			}
+		}
+		if err := d.repo.complete(s.Id, d.owner, s.nextRun(now, d.location(s.UserId))); err != nil {
+			log.Printf("Не удалось перенести рассылку %s: %v", s.Id.Hex(), err)
+		}
+	}
+}
+
+// deliverLeased Отправка рассылки с продлением аренды, пока строится отчет
+func (d *Digests) deliverLeased(s DigestSchedule) error {
+	extend := func() (bool, error) { return d.repo.extend(s.Id, d.owner, d.now().Add(digestLeaseTimeout)) }
+	return keepLease(d.renewInterval, extend, "рассылки "+s.Id.Hex(), func() error { return d.deliverSafe(s) })
+}
+
+// deliverSafe Паника при построении отчета считается ошибкой отправки
+func (d *Digests) deliverSafe(s DigestSchedule) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	return d.deliver(s)
+}
+
+// getTelegramUser Пользователь бота с его чатами и настройками
+func (m UserDB) getTelegramUser(id int64) (*TelegramUser, error) {
+	coll := clientMongo.Database("MyInfantBotDB").Collection("bot_users")
+	filter := bson.D{{"telegram_user.user.id", id}}
+	err := coll.FindOne(context.TODO(), filter).Decode(&m)
+	return &m.TelegramUser, err
+}
+
+// digestText Отчет рассылки за период
+func digestText(s DigestSchedule, period DateRange) (string, error) {
+	// Участник магазина получает отчеты по кабинетам владельца
+	userId := storeAccess(storeRepo, s.UserId).OwnerId
+	from, to := period.From, period.To
+	switch s.Report {
+	case DigestFinance:
+		report, err := financeReport(userId, from, to, time.Now())
+		if err != nil {
+			return "", err
+		}
+		return printFinanceReport(report, from, to), nil
+	case DigestReturns:
+		report, err := returnsReportFor(userId, from, to)
+		if err != nil {
+			return "", err
+		}
+		return printReturnsReport(report, from, to), nil
+	}
+	header := htmlText(format.Line(format.Italic(format.Plainf("%s с %s по %s", s.Kind, from.Format("02.01.2006"), period.lastDay().Format("02.01.2006")))))
+	user, err := UserDB{}.getTelegramUser(userId)
+	if err != nil {
+		return "", err
+	}
+	text := header
+	var reports []OrderReport
+	for _, marketplace := range reportMarketplaces(user.Settings) {
+		report, err := orderSummaryReport(marketplace, userId, period)
+		if err != nil {
+			return "", err
+		}
+		reports = append(reports, report)
+		text += printOrderSummaryReport(report)
+	}
+	if len(reports) > 1 {
+		text += printCombinedReport(reports)
+	}
+	return text, nil
+}
+
+// deliverDigest Постановка отчета рассылки в очередь отправки во все чаты пользователя
+func deliverDigest(s DigestSchedule) error {
+	user, err := UserDB{}.getTelegramUser(s.UserId)
+	if err != nil {
+		return err
+	}
+	text, err := digestText(s, s.period(s.NextRunAt, user.Settings.location()))
+	if err != nil {
+		return err
+	}
+	BroadcastToChats(user.Chats, text)
+	return nil
+}
+
+func startDigests(ctx context.Context) (done chan struct{}) {
+	if err := (DigestDB{}).createIndexes(); err != nil {
+		log.Printf("Не удалось создать индексы рассылок: %v", err)
+	}
+	digests := NewDigests(digestRepo, deliverDigest)
+	done = make(chan struct{})
+	go func() {
+		defer close(done)
+		digests.run(ctx)
+	}()
+	return done
+}
+
+// digestsMarkup Список рассылок пользователя с кнопками удаления и добавления
+func digestsMarkup(schedules []DigestSchedule) telegram.InlineKeyboardMarkup {
+	var buttons []telegram.ButtonBot[telegram.InlineKeyboardButton]
+	for i, s := range schedules {
+		buttons = append(buttons, telegram.ButtonBot[telegram.InlineKeyboardButton]{
+			Row: i + 1, Col: 1, Button: telegram.InlineKeyboardButton{Text: "❌ " + s.String(), CallbackData: "/digestdel-" + s.Id.Hex()},
+		})
+	}
+	buttons = append(buttons,
+		telegram.ButtonBot[telegram.InlineKeyboardButton]{Row: len(schedules) + 1, Col: 1, Button: telegram.InlineKeyboardButton{Text: "Добавить рассылку", CallbackData: "/digestadd"}},
+		telegram.ButtonBot[telegram.InlineKeyboardButton]{Row: len(schedules) + 2, Col: 1, Button: telegram.InlineKeyboardButton{Text: "Назад", CallbackData: "/settings"}},
+	)
+	return telegram.InlineKeyboardMarkup{InlineKeyboard: CreateButtonsBot[telegram.InlineKeyboardButton](buttons)}
+}
+
+func editDigests(q telegram.CallbackQuery) {
+	bot := TelegramBot{}
+	schedules, err := digestRepo.userSchedules(q.From.Id)
+	if err != nil {
+		log.Printf("Не удалось получить рассылки пользователя %d: %v", q.From.Id, err)
+		return
+	}
+	text := "Отчеты по расписанию отправляются во все чаты, где вы запускали бота. Нажмите на рассылку, чтобы удалить ее."
+	if len(schedules) == 0 {
+		text = "Рассылок пока нет. Отчеты по расписанию отправляются во все чаты, где вы запускали бота."
+	}
+	EditMessageTextToBot(&bot, telegram.EditMessageTextRequestBody{
+		ChatId:      q.Message.Chat.Id,
+		MessageId:   q.Message.MessageId,
+		ParseMode:   format.HTML.ParseMode(),
+		Text:        htmlText(format.Plain(text)),
+		ReplyMarkup: digestsMarkup(schedules),
+	})
+}
+
+func digestsHandler(c *RouteContext) {
+	bot := TelegramBot{}
+	answerCallbackQueryToBot(&bot, telegram.AnswerCallbackQueryRequestBody{CallbackQueryId: c.Update.CallbackQuery.Id})
+	editDigests(c.Update.CallbackQuery)
+}
+
+func deleteDigestHandler(c *RouteContext) {
+	q := c.Update.CallbackQuery
+	bot := TelegramBot{}
+	id, err := primitive.ObjectIDFromHex(c.Payload)
+	if err != nil {
+		answerCallbackQueryToBot(&bot, telegram.AnswerCallbackQueryRequestBody{CallbackQueryId: q.Id, Text: "Кнопка устарела."})
+		return
+	}
+	if err := digestRepo.deleteSchedule(q.From.Id, id); err != nil {
+		panic(err)
+	}
+	answerCallbackQueryToBot(&bot, telegram.AnswerCallbackQueryRequestBody{CallbackQueryId: q.Id, Text: "Рассылка удалена."})
+	editDigests(q)
+}
+
+// newDigestHandler Мастер добавления рассылки: отчет, периодичность, день недели, затем время сообщением
+func newDigestHandler(c *RouteContext) {
+	q := c.Update.CallbackQuery
+	bot := TelegramBot{}
+	var text string
+	var buttons []telegram.ButtonBot[telegram.InlineKeyboardButton]
+	s, complete, err := digestSpec(c.Payload)
+	switch {
+	case c.Payload == "":
+		text = "Какой отчет присылать?"
+		for i, r := range digestReports {
+			buttons = append(buttons, telegram.ButtonBot[telegram.InlineKeyboardButton]{
+				Row: 1, Col: i + 1, Button: telegram.InlineKeyboardButton{Text: r.String(), CallbackData: "/digestnew-" + string(r)},
+			})
+		}
+	case err != nil:
+		answerCallbackQueryToBot(&bot, telegram.AnswerCallbackQueryRequestBody{CallbackQueryId: q.Id, Text: "Кнопка устарела."})
+		return
+	case complete && s.Kind == DigestMonthly:
+		askSettingValue(q, StateAwaitDigestTime, ConversationPayload{Digest: c.Payload},
+			format.Plain("ОК. Пришлите день месяца и время рассылки, например 1 09:00. Отчет придет за прошлый месяц."))
+		return
+	case complete:
+		askSettingValue(q, StateAwaitDigestTime, ConversationPayload{Digest: c.Payload},
+			format.Plain("ОК. Пришлите время рассылки, например 09:00."))
+		return
+	case s.Kind == DigestWeekly:
+		text = "В какой день недели? Отчет придет за последние 7 дней."
+		for i := 0; i < 7; i++ {
+			weekday := time.Weekday((i + 1) % 7)
+			buttons = append(buttons, telegram.ButtonBot[telegram.InlineKeyboardButton]{
+				Row: i/4 + 1, Col: i%4 + 1, Button: telegram.InlineKeyboardButton{Text: weekdayShortNames[weekday], CallbackData: fmt.Sprintf("/digestnew-%s-%d", c.Payload, weekday)},
+			})
+		}
+	default:
+		text = "Как часто присылать отчет?"
+		for i, k := range digestKinds {
+			buttons = append(buttons, telegram.ButtonBot[telegram.InlineKeyboardButton]{
+				Row: 1, Col: i + 1, Button: telegram.InlineKeyboardButton{Text: k.String(), CallbackData: "/digestnew-" + c.Payload + "-" + string(k)},
+			})
+		}
+	}
+	answerCallbackQueryToBot(&bot, telegram.AnswerCallbackQueryRequestBody{CallbackQueryId: q.Id})
+	buttons = append(buttons, telegram.ButtonBot[telegram.InlineKeyboardButton]{
+		Row: 10, Col: 1, Button: telegram.InlineKeyboardButton{Text: "Назад", CallbackData: "/digests"},
+	})
+	EditMessageTextToBot(&bot, telegram.EditMessageTextRequestBody{
+		ChatId:      q.Message.Chat.Id,
+		MessageId:   q.Message.MessageId,
+		ParseMode:   format.HTML.ParseMode(),
+		Text:        htmlText(format.Plain(text)),
+		ReplyMarkup: telegram.InlineKeyboardMarkup{InlineKeyboard: CreateButtonsBot[telegram.InlineKeyboardButton](buttons)},
+	})
+}
+
+var weekdayShortNames = [...]string{"Вс", "Пн", "Вт", "Ср", "Чт", "Пт", "Сб"}
+
+func saveDigestHandler(c *RouteContext) {
+	m := c.Update.Message
+	spec := c.Conversation.Payload.Digest
+	finishConversation(m)
+	bot := TelegramBot{}
+	s, complete, err := digestSpec(spec)
+	if err == nil && !complete {
+		err = fmt.Errorf("рассылка %q настроена не полностью", spec)
+	}
+	if err == nil {
+		err = parseDigestTime(&s, m.Text)
+	}
+	if err != nil {
+		SendMessageToBot(&bot, telegram.SendMessageRequestBody[telegram.InlineKeyboardMarkup, int64]{
+			ChatId:    m.Chat.Id,
+			ParseMode: format.HTML.ParseMode(),
+			Text:      htmlText(format.Plain("Не удалось распознать время. Попробуйте еще раз через меню рассылок.")),
+			ReplyMarkup: telegram.InlineKeyboardMarkup{InlineKeyboard: CreateButtonsBot[telegram.InlineKeyboardButton]([]telegram.ButtonBot[telegram.InlineKeyboardButton]{
+				{Row: 1, Col: 1, Button: telegram.InlineKeyboardButton{Text: "Рассылка отчетов", CallbackData: "/digests"}},
+			})},
+		})
+		return
+	}
+	now := time.Now()
+	loc := UserDB{}.userLocation(m.From.Id)
+	s.Id = primitive.NewObjectID()
+	s.UserId = m.From.Id
+	s.CreatedAt = now
+	s.NextRunAt = s.nextRun(now, loc)
+	if err := digestRepo.saveSchedule(s); err != nil {
+		panic(err)
+	}
+	SendMessageToBot(&bot, telegram.SendMessageRequestBody[telegram.InlineKeyboardMarkup, int64]{
+		ChatId:    m.Chat.Id,
+		ParseMode: format.HTML.ParseMode(),
+		Text: htmlText(format.Plain("Рассылка добавлена: "), format.Bold(format.Plain(s.String())),
+			format.Plain(". Первый отчет придет "), format.Bold(format.Plain(s.NextRunAt.In(loc).Format("02.01.2006 15:04"))), format.Plain(".")),
+		ReplyMarkup: telegram.InlineKeyboardMarkup{InlineKeyboard: CreateButtonsBot[telegram.InlineKeyboardButton]([]telegram.ButtonBot[telegram.InlineKeyboardButton]{
+			{Row: 1, Col: 1, Button: telegram.InlineKeyboardButton{Text: "Рассылка отчетов", CallbackData: "/digests"}},
+		})},
+	})
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestDigestSchedule_nextRun(t *testing.T) {
+	loc := time.FixedZone("UTC+4", 4*60*60)
+	tests := []struct {
+		name     string
+		schedule DigestSchedule
+		after    time.Time
+		want     time.Time
+	}{
+		{
+			name:     "Ежедневно, время еще не наступило",
+			schedule: DigestSchedule{Kind: DigestDaily, Hour: 9},
+			after:    time.Date(2024, 1, 10, 8, 59, 0, 0, loc),
+			want:     time.Date(2024, 1, 10, 9, 0, 0, 0, loc),
+		},
+		{
+			name:     "Ежедневно, ровно в срок - следующий день",
+			schedule: DigestSchedule{Kind: DigestDaily, Hour: 9},
+			after:    time.Date(2024, 1, 31, 9, 0, 0, 0, loc),
+			want:     time.Date(2024, 2, 1, 9, 0, 0, 0, loc),
+		},
+		{
+			name:     "Еженедельно по понедельникам из среды",
+			schedule: DigestSchedule{Kind: DigestWeekly, Weekday: time.Monday, Hour: 10, Minute: 30},
+			after:    time.Date(2024, 1, 10, 12, 0, 0, 0, loc),
+			want:     time.Date(2024, 1, 15, 10, 30, 0, 0, loc),
+		},
+		{
+			name:     "Еженедельно, в тот же день после срока",
+			schedule: DigestSchedule{Kind: DigestWeekly, Weekday: time.Wednesday, Hour: 10},
+			after:    time.Date(2024, 1, 10, 12, 0, 0, 0, loc),
+			want:     time.Date(2024, 1, 17, 10, 0, 0, 0, loc),
+		},
+		{
+			name:     "Ежемесячно 31 числа в феврале високосного года",
+			schedule: DigestSchedule{Kind: DigestMonthly, Day: 31, Hour: 9},
+			after:    time.Date(2024, 2, 1, 0, 0, 0, 0, loc),
+			want:     time.Date(2024, 2, 29, 9, 0, 0, 0, loc),
+		},
+		{
+			name:     "Ежемесячно, срок в этом месяце прошел",
+			schedule: DigestSchedule{Kind: DigestMonthly, Day: 1, Hour: 9},
+			after:    time.Date(2024, 12, 1, 9, 0, 0, 0, loc),
+			want:     time.Date(2025, 1, 1, 9, 0, 0, 0, loc),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.schedule.nextRun(tt.after, loc); !got.Equal(tt.want) {
+				t.Errorf("nextRun() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDigestSchedule_period(t *testing.T) {
+	loc := time.FixedZone("UTC+4", 4*60*60)
+	runAt := time.Date(2024, 3, 1, 9, 0, 0, 0, loc)
+	tests := []struct {
+		kind     DigestKind
+		from, to time.Time
+	}{
+		{DigestDaily, time.Date(2024, 2, 29, 0, 0, 0, 0, loc), time.Date(2024, 3, 1, 0, 0, 0, 0, loc)},
+		{DigestWeekly, time.Date(2024, 2, 23, 0, 0, 0, 0, loc), time.Date(2024, 3, 1, 0, 0, 0, 0, loc)},
+		{DigestMonthly, time.Date(2024, 2, 1, 0, 0, 0, 0, loc), time.Date(2024, 3, 1, 0, 0, 0, 0, loc)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.kind.String(), func(t *testing.T) {
+			got := DigestSchedule{Kind: tt.kind}.period(runAt, loc)
+			if !got.From.Equal(tt.from) || !got.To.Equal(tt.to) {
+				t.Errorf("period() = %s - %s, want %s - %s", got.From, got.To, tt.from, tt.to)
+			}
+		})
+	}
+}
+
+func TestDigestSpec(t *testing.T) {
+	tests := []struct {
+		name     string
+		spec     string
+		text     string
+		want     string
+		complete bool
+		wantErr  bool
+	}{
+		{name: "Выбран только отчет", spec: "summary"},
+		{name: "Ежедневно", spec: "summary-daily", text: "9:05", want: "Ежедневно в 09:05: Продажи", complete: true},
+		{name: "Еженедельно без дня недели", spec: "returns-weekly"},
+		{name: "Еженедельно", spec: "returns-weekly-1", text: "18.00", want: "По понедельникам в 18:00: Возвраты", complete: true},
+		{name: "Ежемесячно", spec: "finance-monthly", text: "5 10:00", want: "Ежемесячно 5 числа в 10:00: Финансы", complete: true},
+		{name: "Неизвестный отчет", spec: "stock-daily", wantErr: true},
+		{name: "Неверный день недели", spec: "summary-weekly-9", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, complete, err := digestSpec(tt.spec)
+			if (err != nil) != tt.wantErr || complete != tt.complete {
+				t.Fatalf("digestSpec() complete = %v, err = %v", complete, err)
+			}
+			if !complete {
+				return
+			}
+			if err := parseDigestTime(&s, tt.text); err != nil {
+				t.Fatal(err)
+			}
+			if s.String() != tt.want {
+				t.Errorf("schedule = %q, want %q", s.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestParseDigestTime_invalid(t *testing.T) {
+	for _, text := range []string{"25:00", "9", "09:60", "32 10:00", "1 10:00"} {
+		s := DigestSchedule{Kind: DigestDaily}
+		if text == "32 10:00" {
+			s.Kind = DigestMonthly
+		}
+		if err := parseDigestTime(&s, text); err == nil {
+			t.Errorf("parseDigestTime(%q) = %+v, want error", text, s)
+		}
+	}
+}
+
+func TestDigests_dispatch(t *testing.T) {
+	now := time.Date(2024, 1, 10, 5, 0, 30, 0, time.UTC)
+	repo := NewDigestMemory()
+	schedule := DigestSchedule{Id: primitive.NewObjectID(), UserId: 7, Kind: DigestDaily, Hour: 9, NextRunAt: time.Date(2024, 1, 10, 5, 0, 0, 0, time.UTC)}
+	later := DigestSchedule{Id: primitive.NewObjectID(), UserId: 8, Kind: DigestDaily, Hour: 10, NextRunAt: time.Date(2024, 1, 10, 6, 0, 0, 0, time.UTC)}
+	repo.saveSchedule(schedule)
+	repo.saveSchedule(later)
+
+	// Две реплики с общим репозиторием
+	var delivered []int64
+	var failure error
+	deliver := func(s DigestSchedule) error {
+		delivered = append(delivered, s.UserId)
+		return failure
+	}
+	replicas := []*Digests{NewDigests(repo, deliver), NewDigests(repo, deliver)}
+	for _, d := range replicas {
+		d.now = func() time.Time { return now }
+		d.location = func(int64) *time.Location { return time.FixedZone("UTC+4", 4*60*60) }
+		d.dispatch()
+	}
+	if len(delivered) != 1 || delivered[0] != 7 {
+		t.Fatalf("delivered = %v, want exactly once to 7", delivered)
+	}
+	schedules, _ := repo.userSchedules(7)
+	if want := time.Date(2024, 1, 11, 5, 0, 0, 0, time.UTC); !schedules[0].NextRunAt.Equal(want) || schedules[0].LeaseOwner != "" {
+		t.Errorf("schedule after delivery = %+v", schedules[0])
+	}
+
+	// Ошибка: рассылка повторяется после окончания аренды
+	delivered, failure = nil, errors.New("ozon недоступен")
+	now = time.Date(2024, 1, 10, 6, 0, 0, 0, time.UTC)
+	replicas[0].dispatch()
+	replicas[1].dispatch()
+	now = now.Add(digestLeaseTimeout + time.Second)
+	failure = nil
+	replicas[1].dispatch()
+	if len(delivered) != 2 || delivered[0] != 8 || delivered[1] != 8 {
+		t.Errorf("delivered = %v, want failed attempt and retry to 8", delivered)
+	}
+	schedules, _ = repo.userSchedules(8)
+	if want := time.Date(2024, 1, 11, 6, 0, 0, 0, time.UTC); !schedules[0].NextRunAt.Equal(want) {
+		t.Errorf("next run after retry = %s, want %s", schedules[0].NextRunAt, want)
+	}
+}
+
+func TestDigests_dispatchSlowDelivery(t *testing.T) {
+	var mu sync.Mutex
+	now := time.Date(2024, 1, 10, 5, 0, 30, 0, time.UTC)
+	clock := func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+	repo := NewDigestMemory()
+	for _, userId := range []int64{7, 8} {
+		repo.saveSchedule(DigestSchedule{Id: primitive.NewObjectID(), UserId: userId, Kind: DigestDaily, Hour: 5, NextRunAt: time.Date(2024, 1, 10, 5, 0, 0, 0, time.UTC)})
+	}
+	leaseUntil := func(userId int64) time.Time {
+		schedules, _ := repo.userSchedules(userId)
+		return schedules[0].LeaseUntil
+	}
+
+	var other *Digests
+	delivered := map[int64]int{}
+	deliver := func(s DigestSchedule) error {
+		if !leaseUntil(s.UserId).After(clock()) {
+			t.Errorf("рассылка %d захвачена с уже истекшей арендой", s.UserId)
+		}
+		mu.Lock()
+		delivered[s.UserId]++
+		// Отчет строится дольше аренды
+		now = now.Add(2 * digestLeaseTimeout)
+		last := len(delivered) == 2
+		mu.Unlock()
+		// Ждем продления аренды
+		for deadline := time.Now().Add(time.Second); time.Now().Before(deadline) && !leaseUntil(s.UserId).After(clock()); {
+			time.Sleep(time.Millisecond)
+		}
+		if last {
+			// Другая реплика проверяет рассылки, пока строится второй отчет
+			other.dispatch()
+		}
+		return nil
+	}
+	replica := NewDigests(repo, deliver)
+	other = NewDigests(repo, func(s DigestSchedule) error {
+		mu.Lock()
+		defer mu.Unlock()
+		delivered[s.UserId]++
+		return nil
+	})
+	for _, d := range []*Digests{replica, other} {
+		d.now = clock
+		d.location = func(int64) *time.Location { return time.UTC }
+		d.renewInterval = time.Millisecond
+	}
+	replica.dispatch()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if delivered[7] != 1 || delivered[8] != 1 {
+		t.Errorf("delivered = %v, want по одному разу каждому пользователю", delivered)
+	}
+}
@@ -0,0 +1,105 @@
+package export
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testTable = Table{
+	Sheet:  "Заказы FBO",
+	Header: []string{"Отправление", "Товар", "Количество", "Цена", "Создано"},
+	Rows: [][]interface{}{
+		{"0001-1", `Носки "Colibri"; белые`, 2, 199.5, time.Date(2024, 1, 2, 15, 4, 0, 0, time.UTC)},
+		{"0002-1", "Гетры <серые> & черные", 1, 300.0, time.Time{}},
+	},
+}
+
+func TestWriteCSV(t *testing.T) {
+	var b bytes.Buffer
+	if err := WriteCSV(&b, testTable); err != nil {
+		t.Fatal(err)
+	}
+	want := utf8BOM + "Отправление;Товар;Количество;Цена;Создано\n" +
+		"0001-1;\"Носки \"\"Colibri\"\"; белые\";2;199.5;2024-01-02 15:04:00\n" +
+		"0002-1;Гетры <серые> & черные;1;300;\n"
+	if got := b.String(); got != want {
+		t.Errorf("WriteCSV() = %q, want %q", got, want)
+	}
+}
+
+func TestWriteXLSX(t *testing.T) {
+	var b bytes.Buffer
+	if err := WriteXLSX(&b, testTable); err != nil {
+		t.Fatal(err)
+	}
+	z, err := zip.NewReader(bytes.NewReader(b.Bytes()), int64(b.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string]string)
+	for _, f := range z.File {
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, _ := io.ReadAll(r)
+		r.Close()
+		files[f.Name] = string(content)
+		// Каждая часть книги должна быть корректным XML
+		d := xml.NewDecoder(bytes.NewReader(content))
+		for {
+			if _, err := d.Token(); err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatalf("%s: %v", f.Name, err)
+			}
+		}
+	}
+	for _, name := range []string{"[Content_Types].xml", "_rels/.rels", "xl/workbook.xml", "xl/_rels/workbook.xml.rels", "xl/styles.xml", "xl/worksheets/sheet1.xml"} {
+		if _, ok := files[name]; !ok {
+			t.Errorf("part %s is missing", name)
+		}
+	}
+	sheet := files["xl/worksheets/sheet1.xml"]
+	for _, want := range []string{
+		`<c r="A1" s="1" t="inlineStr"><is><t xml:space="preserve">Отправление</t></is></c>`,
+		`<c r="C2"><v>2</v></c>`,
+		`<c r="D2"><v>199.5</v></c>`,
+		`<c r="E2" s="2"><v>45293.62777777778</v></c>`,
+		`Гетры &lt;серые&gt; &amp; черные`,
+	} {
+		if !strings.Contains(sheet, want) {
+			t.Errorf("sheet does not contain %s", want)
+		}
+	}
+	if strings.Contains(sheet, `r="E3"`) {
+		t.Error("zero time must produce an empty cell")
+	}
+	if !strings.Contains(files["xl/workbook.xml"], `name="Заказы FBO"`) {
+		t.Error("workbook does not contain sheet name")
+	}
+}
+
+func TestCellRef(t *testing.T) {
+	tests := []struct {
+		col  int
+		row  int
+		want string
+	}{
+		{0, 1, "A1"},
+		{25, 2, "Z2"},
+		{26, 3, "AA3"},
+		{701, 4, "ZZ4"},
+		{702, 5, "AAA5"},
+	}
+	for _, tt := range tests {
+		if got := cellRef(tt.col, tt.row); got != tt.want {
+			t.Errorf("cellRef(%d, %d) = %s, want %s", tt.col, tt.row, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,3 @@
+module export
+
+go 1.21.5
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// DeliveryScheme Схема работы с маркетплейсом: FBO (FBY у Яндекс Маркета) - со склада маркетплейса,
+// FBS - со склада продавца с доставкой маркетплейсом, DBS - со склада и доставкой продавца
+type DeliveryScheme string
+
+const (
+	SchemeFBO DeliveryScheme = "fbo"
+	SchemeFBS DeliveryScheme = "fbs"
+	SchemeFBY DeliveryScheme = "fby"
+	SchemeDBS DeliveryScheme = "dbs"
+)
+
+// deliverySchemes Все схемы работы OZON в порядке вывода в отчете
+var deliverySchemes = []DeliveryScheme{SchemeFBO, SchemeFBS}
+
+func (s DeliveryScheme) String() string {
+	return strings.ToUpper(string(s))
+}
+
+// schemes Схемы, включаемые в отчеты. Если пользователь их не выбирал, включаются все.
+func (s OzonSetting) schemes() []DeliveryScheme {
+	if len(s.Schemes) == 0 {
+		return deliverySchemes
+	}
+	var result []DeliveryScheme
+	for _, scheme := range deliverySchemes {
+		if s.hasScheme(scheme) {
+			result = append(result, scheme)
+		}
+	}
+	return result
+}
+
+func (s OzonSetting) hasScheme(scheme DeliveryScheme) bool {
+	if len(s.Schemes) == 0 {
+		return true
+	}
+	return findIndex(s.Schemes, func(e DeliveryScheme) bool { return e == scheme }) >= 0
+}
+
+// toggleScheme Схемы после включения или выключения scheme. Последнюю схему выключить нельзя.
+func (s OzonSetting) toggleScheme(scheme DeliveryScheme) ([]DeliveryScheme, bool) {
+	var result []DeliveryScheme
+	for _, e := range deliverySchemes {
+		if (e == scheme) != s.hasScheme(e) {
+			result = append(result, e)
+		}
+	}
+	return result, len(result) > 0
+}
+
+func (m UserDB) setOzonSchemes(userId int64, schemes []DeliveryScheme) error {
+	coll := clientMongo.Database("MyInfantBotDB").Collection("bot_users")
+	update := bson.D{{"$set", bson.D{{"telegram_user.settings.ozon_setting.schemes", schemes}}}}
+	filter := bson.D{{"telegram_user.user.id", userId}}
+	_, err := coll.UpdateOne(context.TODO(), filter, update)
+	return err
+}
+
+type StatusFBS int
+
+const (
+	FbsAwaitingRegistration StatusFBS = iota // ожидает регистрации,
+	FbsAcceptanceInProgress                  // идёт приёмка,
+	FbsAwaitingApprove                       // ожидает подтверждения,
+	FbsAwaitingPackaging                     // ожидает упаковки,
+	FbsAwaitingVerification                  // создано,
+	FbsAwaitingDeliver                       // ожидает отгрузки,
+	FbsArbitration                           // арбитраж,
+	FbsClientArbitration                     // клиентский арбитраж доставки,
+	FbsDelivering                            // доставляется,
+	FbsDriverPickup                          // у водителя,
+	FbsDelivered                             // доставлено,
+	FbsCancelled                             // отменено,
+	FbsNotAccepted                           // не принят на сортировочном центре,
+	FbsSentBySeller                          // отправлено продавцом.
+)
+
+func (s StatusFBS) String() string {
+	return [...]string{"awaiting_registration", "acceptance_in_progress", "awaiting_approve", "awaiting_packaging",
+		"awaiting_verification", "awaiting_deliver", "arbitration", "client_arbitration", "delivering", "driver_pickup",
+		"delivered", "cancelled", "not_accepted", "sent_by_seller"}[s]
+}
+
+type WithFbs struct {
+	AnalyticsData bool `json:"analytics_data"`
+	Barcodes      bool `json:"barcodes"`
+	FinancialData bool `json:"financial_data"`
+	Translit      bool `json:"translit"`
+}
+type ListBodyRequestFBS struct {
+	Dir    string    `json:"dir"`
+	Filter FilterFbo `json:"filter"`
+	Limit  int64     `json:"limit"`
+	Offset int64     `json:"offset"`
+	With   WithFbs   `json:"with"`
+}
+type ListResponseFBS struct {
+	Result struct {
+		Postings []PostingFBS `json:"postings"`
+		HasNext  bool         `json:"has_next"`
+	} `json:"result"`
+}
+type PostingFBS struct {
+	PostingNumber  string            `json:"posting_number"`
+	OrderId        int64             `json:"order_id"`
+	OrderNumber    string            `json:"order_number"`
+	Status         string            `json:"status"`
+	Substatus      string            `json:"substatus"`
+	DeliveryMethod DeliveryMethodFBS `json:"delivery_method"`
+	TrackingNumber string            `json:"tracking_number"`
+	InProcessAt    time.Time         `json:"in_process_at"`
+	ShipmentDate   time.Time         `json:"shipment_date"`
+	DeliveringDate *time.Time        `json:"delivering_date"`
+	Cancellation   CancellationFBS   `json:"cancellation"`
+	Products       []PostingProduct  `json:"products"`
+	AnalyticsData  AnalyticsDataFBS  `json:"analytics_data"`
+	FinancialData  PostingFinancials `json:"financial_data"`
+	IsExpress      bool              `json:"is_express"`
+}
+type DeliveryMethodFBS struct {
+	Id            int64  `json:"id"`
+	Name          string `json:"name"`
+	WarehouseId   int64  `json:"warehouse_id"`
+	Warehouse     string `json:"warehouse"`
+	TplProviderId int64  `json:"tpl_provider_id"`
+	TplProvider   string `json:"tpl_provider"`
+}
+type CancellationFBS struct {
+	CancelReasonId           int64  `json:"cancel_reason_id"`
+	CancelReason             string `json:"cancel_reason"`
+	CancellationType         string `json:"cancellation_type"`
+	CancelledAfterShip       bool   `json:"cancelled_after_ship"`
+	AffectCancellationRating bool   `json:"affect_cancellation_rating"`
+	CancellationInitiator    string `json:"cancellation_initiator"`
+}
+type AnalyticsDataFBS struct {
+	Region               string `json:"region"`
+	City                 string `json:"city"`
+	DeliveryType         string `json:"delivery_type"`
+	IsPremium            bool   `json:"is_premium"`
+	PaymentTypeGroupName string `json:"payment_type_group_name"`
+	WarehouseId          int64  `json:"warehouse_id"`
+	Warehouse            string `json:"warehouse"`
+	TplProviderId        int64  `json:"tpl_provider_id"`
+	TplProvider          string `json:"tpl_provider"`
+	IsLegal              bool   `json:"is_legal"`
+}
+
+// ozonRequest Запрос к Seller API от имени кабинета с разбором ответа в result, см. APIClient
+func (m *OzonMarketplace) ozonRequest(userId int64, path string, body interface{}, result interface{}) error {
+	account, err := resolveAccount(m.Account, userId, MarketplaceOzon)
+	if err != nil {
+		return err
+	}
+	request, err := ozonPost(urlOzon, account.ClientId, account.Token, path, body)
+	if err != nil {
+		return err
+	}
+	return ozonClient.do(account.ClientId, request, result)
+}
+
+func (m *OzonMarketplace) fbsListHandler(userId int64, body ListBodyRequestFBS) (*ListResponseFBS, error) {
+	var l ListResponseFBS
+	if err := m.ozonRequest(userId, "/v3/posting/fbs/list", body, &l); err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+// fbsPostings Все отправления FBS за период. При ошибке на середине выгрузки возвращает
+// полученные отправления и PartialResultError.
+func (m *OzonMarketplace) fbsPostings(userId int64, filter FilterFbo, with WithFbs) ([]PostingFBS, error) {
+	return paginate(1000, func(offset int, limit int) ([]PostingFBS, bool, error) {
+		response, err := m.fbsListHandler(userId, ListBodyRequestFBS{
+			Dir:    "ASC",
+			Filter: filter,
+			Limit:  int64(limit),
+			Offset: int64(offset),
+			With:   with,
+		})
+		if err != nil {
+			return nil, false, err
+		}
+		return response.Result.Postings, response.Result.HasNext, nil
+	})
+}
+
+// ozonLine Товар отправления OZON любой схемы работы, в общую модель OrderLine переводится normalizeOzonLines
+type ozonLine struct {
+	Scheme        DeliveryScheme
+	PostingNumber string
+	Product       PostingProduct
+	Cancelled     bool
+	Delivered     bool
+	// Payout Расходы и выплата по данным OZON, nil если финансовых данных нет
+	Payout *Payout
+}
+
+// status Статус отправления в общей модели: для отчета важны только отмена и доставка
+func (l ozonLine) status() Status {
+	switch {
+	case l.Cancelled:
+		return Cancelled
+	case l.Delivered:
+		return Delivered
+	default:
+		return Delivering
+	}
+}
+
+// normalizeOzonLines Отправления в общей модели. Товары одного отправления идут в lines подряд.
+func normalizeOzonLines(lines []ozonLine) []Order {
+	var orders []Order
+	for _, l := range lines {
+		if n := len(orders); n == 0 || l.PostingNumber == "" || orders[n-1].Number != l.PostingNumber {
+			orders = append(orders, Order{Marketplace: MarketplaceOzon, Number: l.PostingNumber, Scheme: l.Scheme, Status: l.status()})
+		}
+		price, _ := decimal.NewFromString(l.Product.Price)
+		line := OrderLine{
+			Sku:      int64(l.Product.Sku),
+			OfferId:  l.Product.OfferId,
+			Name:     l.Product.Name,
+			Quantity: l.Product.Quantity,
+			Price:    price,
+		}
+		if l.Payout != nil {
+			line.settle(*l.Payout)
+		}
+		order := &orders[len(orders)-1]
+		order.Lines = append(order.Lines, line)
+	}
+	return orders
+}
+
+// orderLines Товары отправлений за период по схеме scheme. Если выгрузка прервана на середине,
+// возвращаются товары полученных отправлений и PartialResultError.
+func (m *OzonMarketplace) orderLines(userId int64, scheme DeliveryScheme, filter FilterFbo) ([]ozonLine, error) {
+	var lines []ozonLine
+	var fetchErr error
+	switch scheme {
+	case SchemeFBO:
+		resp, err := m.postings(userId, filter, WithFbo{FinancialData: true})
+		if err != nil && !isPartialResult(err) {
+			return nil, err
+		}
+		fetchErr = err
+		for _, posting := range resp.Result {
+			payouts := postingPayouts(posting.FinancialData, posting.Products)
+			for i, product := range posting.Products {
+				lines = append(lines, ozonLine{
+					Scheme:        scheme,
+					PostingNumber: posting.PostingNumber,
+					Product:       product,
+					Cancelled:     posting.Status == Cancelled.String(),
+					Delivered:     posting.Status == Delivered.String(),
+					Payout:        payouts[i],
+				})
+			}
+		}
+	case SchemeFBS:
+		postings, err := m.fbsPostings(userId, filter, WithFbs{FinancialData: true})
+		if err != nil && !isPartialResult(err) {
+			return nil, err
+		}
+		fetchErr = err
+		for _, posting := range postings {
+			payouts := postingPayouts(posting.FinancialData, posting.Products)
+			for i, product := range posting.Products {
+				lines = append(lines, ozonLine{
+					Scheme:        scheme,
+					PostingNumber: posting.PostingNumber,
+					Product:       product,
+					Cancelled:     posting.Status == FbsCancelled.String(),
+					Delivered:     posting.Status == FbsDelivered.String(),
+					Payout:        payouts[i],
+				})
+			}
+		}
+	default:
+		return nil, fmt.Errorf("неизвестная схема работы %s", scheme)
+	}
+	return lines, fetchErr
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestOzonSetting_toggleScheme(t *testing.T) {
+	tests := []struct {
+		name    string
+		schemes []DeliveryScheme
+		toggle  DeliveryScheme
+		want    []DeliveryScheme
+		wantOk  bool
+	}{
+		{
+			name:   "По умолчанию включены все схемы",
+			toggle: SchemeFBS,
+			want:   []DeliveryScheme{SchemeFBO},
+			wantOk: true,
+		},
+		{
+			name:    "Включение схемы",
+			schemes: []DeliveryScheme{SchemeFBS},
+			toggle:  SchemeFBO,
+			want:    []DeliveryScheme{SchemeFBO, SchemeFBS},
+			wantOk:  true,
+		},
+		{
+			name:    "Последнюю схему выключить нельзя",
+			schemes: []DeliveryScheme{SchemeFBO},
+			toggle:  SchemeFBO,
+			wantOk:  false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := OzonSetting{Schemes: tt.schemes}
+			got, ok := s.toggleScheme(tt.toggle)
+			if ok != tt.wantOk || (ok && !reflect.DeepEqual(got, tt.want)) {
+				t.Errorf("toggleScheme() = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+	if got := (OzonSetting{}).schemes(); !reflect.DeepEqual(got, deliverySchemes) {
+		t.Errorf("schemes() = %v, want all", got)
+	}
+}
+
+func TestListResponseFBS(t *testing.T) {
+	body := `{"result":{"postings":[{"posting_number":"05708065-0029-1","order_id":680420041,"status":"cancelled",
+		"in_process_at":"2024-01-02T10:00:00Z","shipment_date":"2024-01-03T10:00:00Z","delivering_date":null,
+		"delivery_method":{"id":21321684811000,"name":"Ozon Логистика самостоятельно, Красногорск","warehouse":"Стим Тойз Нахабино"},
+		"cancellation":{"cancel_reason_id":352,"cancel_reason":"Товар закончился у продавца","cancellation_initiator":"Продавец"},
+		"products":[{"price":"1390.000000","offer_id":"205953","name":"Носки","sku":1973847,"quantity":1,"currency_code":"RUB"}],
+		"financial_data":{"products":[{"commission_amount":139.0,"payout":1251.0,"product_id":1973847,
+		"item_services":{"marketplace_service_item_direct_flow_trans":-45.26}}]}}],"has_next":false}}`
+	var l ListResponseFBS
+	if err := json.Unmarshal([]byte(body), &l); err != nil {
+		t.Fatal(err)
+	}
+	if len(l.Result.Postings) != 1 || l.Result.HasNext {
+		t.Fatalf("result = %+v", l.Result)
+	}
+	p := l.Result.Postings[0]
+	if p.Status != FbsCancelled.String() || p.Products[0].Sku != 1973847 || p.Cancellation.CancelReasonId != 352 ||
+		p.FinancialData.Products[0].ItemServices.MarketplaceServiceItemDirectFlowTrans != -45.26 {
+		t.Errorf("posting = %+v", p)
+	}
+}
+
+func TestPrintOrderSummaryReport_Schemes(t *testing.T) {
+	text := printOrderSummaryReport(OrderReport{
+		TotalCount: 5,
+		Products:   map[string]int{"Носки": 5},
+		Schemes: []SchemeSummary{
+			{Scheme: SchemeFBO, TotalCount: 3, SumCount: decimal.NewFromInt(300)},
+			{Scheme: SchemeFBS, TotalCount: 2, CancelledTotalCount: 1, SumCount: decimal.NewFromInt(150)},
+		},
+	})
+	for _, want := range []string{"OZON FBO + FBS:", "<i>FBO: <b>3 шт. на 300.00</b>", "<i>FBS: <b>1 шт. на 150.00</b>, отменено 1"} {
+		if !strings.Contains(text, want) {
+			t.Errorf("report %q does not contain %q", text, want)
+		}
+	}
+}
+
+func TestPrintOrderSummaryReport_Incomplete(t *testing.T) {
+	text := printOrderSummaryReport(OrderReport{TotalCount: 1, Incomplete: true})
+	if !strings.Contains(text, "отчет неполный") {
+		t.Errorf("report %q does not mention incomplete data", text)
+	}
+	if text = printOrderSummaryReport(OrderReport{TotalCount: 1}); strings.Contains(text, "отчет неполный") {
+		t.Errorf("complete report %q mentions incomplete data", text)
+	}
+}
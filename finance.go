@@ -0,0 +1,535 @@
+package main
+
+import (
+	"context"
+	"format"
+	"log"
+	"sort"
+	"sync"
+	"telegram"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Типы операций в поле type ответа /v3/finance/transaction/list
+const (
+	FinanceOrders           = "orders"
+	FinanceReturns          = "returns"
+	FinanceServices         = "services"
+	FinanceCompensation     = "compensation"
+	FinanceTransferDelivery = "transferDelivery"
+	FinanceOther            = "other"
+)
+
+// financeTypeNames Порядок и названия типов операций в отчете
+var financeTypeNames = []struct {
+	Type string
+	Name string
+}{
+	{FinanceOrders, "Продажи"},
+	{FinanceReturns, "Возвраты"},
+	{FinanceServices, "Услуги"},
+	{FinanceCompensation, "Компенсации"},
+	{FinanceTransferDelivery, "Доставка покупателю"},
+	{FinanceOther, "Прочее"},
+}
+
+// expectedFeeOperations Операции списаний, которые ожидаются при обычной работе с OZON.
+// Остальные списания попадают в отчет как неожиданные.
+var expectedFeeOperations = map[string]bool{
+	"OperationAgentDeliveredToCustomer":             true,
+	"OperationAgentStornoDeliveredToCustomer":       true,
+	"ClientReturnAgentOperation":                    true,
+	"OperationItemReturn":                           true,
+	"OperationReturnGoodsFBSofRMS":                  true,
+	"MarketplaceRedistributionOfAcquiringOperation": true,
+}
+
+// financePeriodLimit Ozon отдает операции не более чем за месяц за один запрос
+const financePeriodLimit = 28 * 24 * time.Hour
+
+const financeOperationDateLayout = "2006-01-02 15:04:05"
+
+// ozonLocation Даты операций Ozon указывает по московскому времени
+var ozonLocation = time.FixedZone("MSK", 3*60*60)
+
+type FinanceTransactionDate struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+type FinanceTransactionFilter struct {
+	Date            FinanceTransactionDate `json:"date"`
+	OperationType   []string               `json:"operation_type"`
+	PostingNumber   string                 `json:"posting_number"`
+	TransactionType string                 `json:"transaction_type"`
+}
+type FinanceTransactionListRequest struct {
+	Filter   FinanceTransactionFilter `json:"filter"`
+	Page     int64                    `json:"page"`
+	PageSize int64                    `json:"page_size"`
+}
+type FinanceTransactionListResponse struct {
+	Result struct {
+		Operations []FinanceTransaction `json:"operations"`
+		PageCount  int64                `json:"page_count"`
+		RowCount   int64                `json:"row_count"`
+	} `json:"result"`
+}
+type FinanceTransaction struct {
+	OperationId          int64   `json:"operation_id"`
+	OperationType        string  `json:"operation_type"`
+	OperationDate        string  `json:"operation_date"`
+	OperationTypeName    string  `json:"operation_type_name"`
+	DeliveryCharge       float64 `json:"delivery_charge"`
+	ReturnDeliveryCharge float64 `json:"return_delivery_charge"`
+	AccrualsForSale      float64 `json:"accruals_for_sale"`
+	SaleCommission       float64 `json:"sale_commission"`
+	Amount               float64 `json:"amount"`
+	Type                 string  `json:"type"`
+	Posting              struct {
+		DeliverySchema string `json:"delivery_schema"`
+		OrderDate      string `json:"order_date"`
+		PostingNumber  string `json:"posting_number"`
+		WarehouseId    int64  `json:"warehouse_id"`
+	} `json:"posting"`
+	Items    []FinanceItem    `json:"items"`
+	Services []FinanceService `json:"services"`
+}
+type FinanceItem struct {
+	Name string `json:"name" bson:"name"`
+	Sku  int64  `json:"sku" bson:"sku"`
+}
+type FinanceService struct {
+	Name  string  `json:"name" bson:"name"`
+	Price float64 `json:"price" bson:"price"`
+}
+
+// FinanceOperationKey Операция хранится отдельно для каждого кабинета OZON пользователя
+type FinanceOperationKey struct {
+	UserId      int64              `bson:"user_id"`
+	AccountId   primitive.ObjectID `bson:"account_id"`
+	OperationId int64              `bson:"operation_id"`
+}
+
+// FinanceOperation Операция журнала начислений и списаний OZON
+type FinanceOperation struct {
+	Key                  FinanceOperationKey `bson:"_id"`
+	Type                 string              `bson:"type"`
+	OperationType        string              `bson:"operation_type"`
+	OperationTypeName    string              `bson:"operation_type_name"`
+	Date                 time.Time           `bson:"date"`
+	PostingNumber        string              `bson:"posting_number"`
+	DeliverySchema       string              `bson:"delivery_schema"`
+	Amount               float64             `bson:"amount"`
+	AccrualsForSale      float64             `bson:"accruals_for_sale"`
+	SaleCommission       float64             `bson:"sale_commission"`
+	DeliveryCharge       float64             `bson:"delivery_charge"`
+	ReturnDeliveryCharge float64             `bson:"return_delivery_charge"`
+	Items                []FinanceItem       `bson:"items"`
+	Services             []FinanceService    `bson:"services"`
+}
+
+func (t FinanceTransaction) operation(userId int64, accountId primitive.ObjectID) FinanceOperation {
+	date, _ := time.ParseInLocation(financeOperationDateLayout, t.OperationDate, ozonLocation)
+	return FinanceOperation{
+		Key:                  FinanceOperationKey{UserId: userId, AccountId: accountId, OperationId: t.OperationId},
+		Type:                 t.Type,
+		OperationType:        t.OperationType,
+		OperationTypeName:    t.OperationTypeName,
+		Date:                 date.UTC(),
+		PostingNumber:        t.Posting.PostingNumber,
+		DeliverySchema:       t.Posting.DeliverySchema,
+		Amount:               t.Amount,
+		AccrualsForSale:      t.AccrualsForSale,
+		SaleCommission:       t.SaleCommission,
+		DeliveryCharge:       t.DeliveryCharge,
+		ReturnDeliveryCharge: t.ReturnDeliveryCharge,
+		Items:                t.Items,
+		Services:             t.Services,
+	}
+}
+
+type FinanceLedgerRepository interface {
+	upsertOperations(ops []FinanceOperation) error
+	// operations Операции кабинета пользователя с датой в интервале [from, to)
+	operations(userId int64, accountId primitive.ObjectID, from time.Time, to time.Time) ([]FinanceOperation, error)
+}
+
+// FinanceLedgerDB Журнал операций в MongoDB, повторная синхронизация перезаписывает операции по их id
+type FinanceLedgerDB struct{}
+
+func (d FinanceLedgerDB) collection() *mongo.Collection {
+	return clientMongo.Database("MyInfantBotDB").Collection("bot_finance_operations")
+}
+
+func (d FinanceLedgerDB) createIndexes() error {
+	_, err := d.collection().Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys: bson.D{{"_id.user_id", 1}, {"_id.account_id", 1}, {"date", 1}},
+	})
+	return err
+}
+
+// removeUnkeyed Удаление операций, сохраненных без кабинета в ключе. Загрузка журнала сохранит их заново с кабинетом.
+func (d FinanceLedgerDB) removeUnkeyed() error {
+	_, err := d.collection().DeleteMany(context.TODO(), bson.D{{"_id.account_id", bson.D{{"$exists", false}}}})
+	return err
+}
+
+func (d FinanceLedgerDB) upsertOperations(ops []FinanceOperation) error {
+	if len(ops) == 0 {
+		return nil
+	}
+	models := make([]mongo.WriteModel, 0, len(ops))
+	for _, op := range ops {
+		models = append(models, mongo.NewReplaceOneModel().SetFilter(bson.D{{"_id", op.Key}}).SetReplacement(op).SetUpsert(true))
+	}
+	_, err := d.collection().BulkWrite(context.TODO(), models, options.BulkWrite().SetOrdered(false))
+	return err
+}
+
+func (d FinanceLedgerDB) operations(userId int64, accountId primitive.ObjectID, from time.Time, to time.Time) ([]FinanceOperation, error) {
+	filter := bson.D{{"_id.user_id", userId}, {"_id.account_id", accountId}, {"date", bson.D{{"$gte", from}, {"$lt", to}}}}
+	cursor, err := d.collection().Find(context.TODO(), filter, options.Find().SetSort(bson.D{{"date", 1}}))
+	if err != nil {
+		return nil, err
+	}
+	var ops []FinanceOperation
+	err = cursor.All(context.TODO(), &ops)
+	return ops, err
+}
+
+// FinanceLedgerMemory Журнал операций в памяти процесса
+type FinanceLedgerMemory struct {
+	mu  sync.Mutex
+	ops map[FinanceOperationKey]FinanceOperation
+}
+
+func NewFinanceLedgerMemory() *FinanceLedgerMemory {
+	return &FinanceLedgerMemory{ops: make(map[FinanceOperationKey]FinanceOperation)}
+}
+
+func (d *FinanceLedgerMemory) upsertOperations(ops []FinanceOperation) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, op := range ops {
+		d.ops[op.Key] = op
+	}
+	return nil
+}
+
+func (d *FinanceLedgerMemory) operations(userId int64, accountId primitive.ObjectID, from time.Time, to time.Time) ([]FinanceOperation, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var ops []FinanceOperation
+	for _, op := range d.ops {
+		if op.Key.UserId == userId && op.Key.AccountId == accountId && !op.Date.Before(from) && op.Date.Before(to) {
+			ops = append(ops, op)
+		}
+	}
+	sort.Slice(ops, func(i, j int) bool { return ops[i].Date.Before(ops[j].Date) })
+	return ops, nil
+}
+
+// FinanceTransactionsSource Постраничная выгрузка операций из Seller API
+type FinanceTransactionsSource interface {
+	financeTransactions(userId int64, body FinanceTransactionListRequest) (*FinanceTransactionListResponse, error)
+}
+
+func (m *OzonMarketplace) financeTransactions(userId int64, body FinanceTransactionListRequest) (*FinanceTransactionListResponse, error) {
+	var l FinanceTransactionListResponse
+	if err := m.ozonRequest(userId, "/v3/finance/transaction/list", body, &l); err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+// syncFinanceLedger Загрузка в журнал всех операций кабинета accountId за [from, to),
+// период разбивается на части не длиннее financePeriodLimit. source должен обращаться к тому же кабинету.
+func syncFinanceLedger(source FinanceTransactionsSource, ledger FinanceLedgerRepository, userId int64, accountId primitive.ObjectID, from time.Time, to time.Time) error {
+	for start := from; start.Before(to); start = start.Add(financePeriodLimit) {
+		end := start.Add(financePeriodLimit)
+		if end.After(to) {
+			end = to
+		}
+		for page := int64(1); ; page++ {
+			response, err := source.financeTransactions(userId, FinanceTransactionListRequest{
+				Filter: FinanceTransactionFilter{
+					Date: FinanceTransactionDate{
+						From: start.UTC().Format("2006-01-02T15:04:05.000Z"),
+						To:   end.Add(-time.Millisecond).UTC().Format("2006-01-02T15:04:05.000Z"),
+					},
+					OperationType:   []string{},
+					TransactionType: "all",
+				},
+				Page:     page,
+				PageSize: 1000,
+			})
+			if err != nil {
+				return err
+			}
+			ops := make([]FinanceOperation, 0, len(response.Result.Operations))
+			for _, t := range response.Result.Operations {
+				ops = append(ops, t.operation(userId, accountId))
+			}
+			if err := ledger.upsertOperations(ops); err != nil {
+				return err
+			}
+			if page >= response.Result.PageCount {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// FinanceTypeTotal Сумма операций одного типа
+type FinanceTypeTotal struct {
+	Type   string
+	Name   string
+	Amount decimal.Decimal
+}
+
+// FinanceReport Сверка проданного с начисленным OZON за период
+type FinanceReport struct {
+	// Account Кабинет OZON, по которому построен отчет
+	Account         string
+	Totals          []FinanceTypeTotal
+	AccrualsForSale decimal.Decimal
+	SaleCommission  decimal.Decimal
+	Delivery        decimal.Decimal
+	Total           decimal.Decimal
+	// DeliveredCount, DeliveredSum Доставленные покупателям товары из отправлений периода
+	DeliveredCount int
+	DeliveredSum   decimal.Decimal
+	// Unpaid Доставленные отправления, по которым нет начисления за продажу
+	Unpaid []string
+	// UnexpectedFees Списания, не относящиеся к обычным операциям продаж
+	UnexpectedFees []FinanceOperation
+}
+
+// reconcile Сверка отправлений периода [from, to) с операциями журнала.
+// ops могут выходить за конец периода: начисление за продажу приходит после доставки.
+func reconcile(lines []ozonLine, ops []FinanceOperation, from time.Time, to time.Time) FinanceReport {
+	var r FinanceReport
+	totals := make(map[string]decimal.Decimal)
+	paid := make(map[string]bool)
+	for _, op := range ops {
+		if op.Type == FinanceOrders && op.PostingNumber != "" {
+			paid[op.PostingNumber] = true
+		}
+		if op.Date.Before(from) || !op.Date.Before(to) {
+			continue
+		}
+		amount := decimal.NewFromFloat(op.Amount)
+		totals[op.Type] = totals[op.Type].Add(amount)
+		r.Total = r.Total.Add(amount)
+		r.AccrualsForSale = r.AccrualsForSale.Add(decimal.NewFromFloat(op.AccrualsForSale))
+		r.SaleCommission = r.SaleCommission.Add(decimal.NewFromFloat(op.SaleCommission))
+		r.Delivery = r.Delivery.Add(decimal.NewFromFloat(op.DeliveryCharge + op.ReturnDeliveryCharge))
+		if op.Amount < 0 && op.Type != FinanceOrders && op.Type != FinanceReturns && op.Type != FinanceTransferDelivery &&
+			!expectedFeeOperations[op.OperationType] {
+			r.UnexpectedFees = append(r.UnexpectedFees, op)
+		}
+	}
+	for _, t := range financeTypeNames {
+		if amount, ok := totals[t.Type]; ok {
+			r.Totals = append(r.Totals, FinanceTypeTotal{Type: t.Type, Name: t.Name, Amount: amount})
+			delete(totals, t.Type)
+		}
+	}
+	for t, amount := range totals {
+		r.Totals = append(r.Totals, FinanceTypeTotal{Type: t, Name: t, Amount: amount})
+	}
+
+	unpaid := make(map[string]bool)
+	for _, line := range lines {
+		if !line.Delivered {
+			continue
+		}
+		r.DeliveredCount += line.Product.Quantity
+		if price, err := decimal.NewFromString(line.Product.Price); err == nil {
+			r.DeliveredSum = r.DeliveredSum.Add(price.Mul(decimal.NewFromInt(int64(line.Product.Quantity))))
+		}
+		if !paid[line.PostingNumber] && !unpaid[line.PostingNumber] {
+			unpaid[line.PostingNumber] = true
+			r.Unpaid = append(r.Unpaid, line.PostingNumber)
+		}
+	}
+	return r
+}
+
+// financeGracePeriod Сколько после конца периода ждать начисления за доставленные отправления
+const financeGracePeriod = 30 * 24 * time.Hour
+
+const (
+	// financeSyncInterval Период загрузки журнала операций всех пользователей, отчеты читают журнал из базы
+	financeSyncInterval = time.Hour
+	// financeSyncDays За сколько последних дней загружаются операции: прошлый месяц целиком
+	// и начисления по нему, пришедшие позже
+	financeSyncDays = 62
+)
+
+// financeReportLimit Сколько отправлений и списаний перечислять в отчете
+const financeReportLimit = 20
+
+func printFinanceReport(r FinanceReport, from time.Time, to time.Time) string {
+	indent := format.Plain("    ")
+	mess := []format.Fragment{
+		format.Line(format.Bold(format.Plainf("Финансы %s с %s по %s:", marketplaceTitle(MarketplaceOzon, r.Account), from.Format("02.01.2006"), to.Add(-time.Second).Format("02.01.2006")))),
+		format.Line(),
+		format.Line(format.Bold(format.Plain("Начислено OZON:"))),
+	}
+	for _, t := range r.Totals {
+		mess = append(mess, format.Line(indent, format.Plain(t.Name+": "), format.Bold(format.Plain(t.Amount.StringFixed(2)))))
+	}
+	mess = append(mess,
+		format.Line(indent, format.Bold(format.Plainf("Итого: %s", r.Total.StringFixed(2)))),
+		format.Line(),
+		format.Line(indent, format.Plainf("Выручка от продаж: %s", r.AccrualsForSale.StringFixed(2))),
+		format.Line(indent, format.Plainf("Комиссия за продажи: %s", r.SaleCommission.StringFixed(2))),
+		format.Line(indent, format.Plainf("Логистика: %s", r.Delivery.StringFixed(2))),
+		format.Line(),
+		format.Line(format.Bold(format.Plainf("Доставлено покупателям: %d шт. на %s", r.DeliveredCount, r.DeliveredSum.StringFixed(2)))),
+	)
+	if len(r.Unpaid) > 0 {
+		mess = append(mess, format.Line(), format.Line(format.Bold(format.Plainf("Доставлено, но не оплачено OZON: %d", len(r.Unpaid)))))
+		for i, number := range r.Unpaid {
+			if i == financeReportLimit {
+				mess = append(mess, format.Line(indent, format.Plainf("и еще %d", len(r.Unpaid)-i)))
+				break
+			}
+			mess = append(mess, format.Line(indent, format.Code(number)))
+		}
+	}
+	if len(r.UnexpectedFees) > 0 {
+		sum := decimal.Zero
+		for _, op := range r.UnexpectedFees {
+			sum = sum.Add(decimal.NewFromFloat(op.Amount))
+		}
+		mess = append(mess, format.Line(), format.Line(format.Bold(format.Plainf("Неожиданные списания: %d на %s", len(r.UnexpectedFees), sum.StringFixed(2)))))
+		for i, op := range r.UnexpectedFees {
+			if i == financeReportLimit {
+				mess = append(mess, format.Line(indent, format.Plainf("и еще %d", len(r.UnexpectedFees)-i)))
+				break
+			}
+			mess = append(mess, format.Line(indent, format.Plainf("%s %s: ", op.Date.In(ozonLocation).Format("02.01"), op.OperationTypeName),
+				format.Bold(format.Plain(decimal.NewFromFloat(op.Amount).StringFixed(2)))))
+		}
+	}
+	if len(r.Unpaid) == 0 && len(r.UnexpectedFees) == 0 {
+		mess = append(mess, format.Line(), format.Line(format.Italic(format.Plain("Расхождений не найдено."))))
+	}
+	mess = append(mess, format.Line(), format.Line(format.Italic(format.Plain("Начисления OZON загружаются раз в час."))))
+	return htmlText(mess...)
+}
+
+func financeCommandHandler(c *RouteContext) {
+	bot := TelegramBot{}
+	SendMessageToBot(&bot, telegram.SendMessageRequestBody[telegram.InlineKeyboardMarkup, int64]{
+		ChatId:    c.Update.Message.Chat.Id,
+		ParseMode: format.HTML.ParseMode(),
+		Text:      htmlText(format.Plain("За какой месяц сверить продажи с начислениями OZON?")),
+		ReplyMarkup: telegram.InlineKeyboardMarkup{InlineKeyboard: CreateButtonsBot[telegram.InlineKeyboardButton]([]telegram.ButtonBot[telegram.InlineKeyboardButton]{
+			{Row: 1, Col: 1, Button: telegram.InlineKeyboardButton{Text: "Текущий месяц", CallbackData: "/finance-current"}},
+			{Row: 1, Col: 2, Button: telegram.InlineKeyboardButton{Text: "Прошлый месяц", CallbackData: "/finance-previous"}},
+		})},
+	})
+}
+
+func financeHandler(c *RouteContext) {
+	q := c.Update.CallbackQuery
+	bot := TelegramBot{}
+	now := time.Now()
+	period := monthRange(now, UserDB{}.userLocation(q.From.Id))
+	switch c.Payload {
+	case "current":
+	case "previous":
+		period = monthRange(period.From.AddDate(0, 0, -1), period.From.Location())
+	default:
+		answerCallbackQueryToBot(&bot, telegram.AnswerCallbackQueryRequestBody{CallbackQueryId: q.Id, Text: "Кнопка устарела."})
+		return
+	}
+	answerCallbackQueryToBot(&bot, telegram.AnswerCallbackQueryRequestBody{CallbackQueryId: q.Id, Text: "Сверяю начисления OZON..."})
+
+	from, to := period.From, period.To
+	report, err := financeReport(c.Access.OwnerId, from, to, now)
+	if err != nil {
+		log.Printf("Не удалось сверить начисления пользователя %d: %v", c.Access.OwnerId, err)
+		SendMessageToBot(&bot, telegram.SendMessageRequestBody[telegram.InlineKeyboardMarkup, int64]{
+			ChatId:    q.Message.Chat.Id,
+			ParseMode: format.HTML.ParseMode(),
+			Text:      htmlText(format.Plain("Не удалось получить данные OZON, попробуйте позже.")),
+		})
+		return
+	}
+	SendLongMessageToBot(&bot, telegram.SendMessageRequestBody[telegram.InlineKeyboardMarkup, int64]{
+		ChatId:    q.Message.Chat.Id,
+		ParseMode: format.HTML.ParseMode(),
+		Text:      printFinanceReport(report, from, to),
+	})
+}
+
+// financeReport Сверка основного кабинета OZON за [from, to) по загруженному журналу, см. syncAllFinance
+func financeReport(userId int64, from time.Time, to time.Time, now time.Time) (FinanceReport, error) {
+	account, err := resolveAccount(nil, userId, MarketplaceOzon)
+	if err != nil {
+		return FinanceReport{}, err
+	}
+	marketplace := &OzonMarketplace{Account: &account}
+	setting, err := UserDB{}.getOzonSetting(userId)
+	if err != nil {
+		return FinanceReport{}, err
+	}
+	filter := DateRange{From: from, To: to}.filter()
+	var lines []ozonLine
+	for _, scheme := range setting.schemes() {
+		schemeLines, err := marketplace.orderLines(userId, scheme, filter)
+		if err != nil {
+			return FinanceReport{}, err
+		}
+		lines = append(lines, schemeLines...)
+	}
+	opsTo := to.Add(financeGracePeriod)
+	if opsTo.After(now) {
+		opsTo = now
+	}
+	ops, err := financeLedger.operations(userId, account.Id, from, opsTo)
+	if err != nil {
+		return FinanceReport{}, err
+	}
+	report := reconcile(lines, ops, from, to)
+	report.Account = account.Name
+	return report, nil
+}
+
+// syncAllFinance Загрузка журнала операций всех кабинетов OZON всех пользователей
+func syncAllFinance(now time.Time) {
+	users, err := UserDB{}.ozonUsers()
+	if err != nil {
+		log.Printf("Не удалось получить пользователей для загрузки журнала операций: %v", err)
+		return
+	}
+	for _, user := range users {
+		userId := user.TelegramUser.User.Id
+		for _, account := range user.TelegramUser.Settings.accounts(MarketplaceOzon) {
+			if !account.connected() {
+				continue
+			}
+			account := account
+			err := syncFinanceLedger(&OzonMarketplace{Account: &account}, financeLedger, userId, account.Id, now.AddDate(0, 0, -financeSyncDays), now)
+			if err != nil {
+				log.Printf("Не удалось загрузить журнал операций %s пользователя %d: %v", account, userId, err)
+			}
+		}
+	}
+}
+
+// startFinanceSync Загрузка журнала операций раз в financeSyncInterval одной из реплик
+func startFinanceSync(ctx context.Context) (done chan struct{}) {
+	return NewScheduledJob(JobDB{}, "finance", financeSyncInterval, syncAllFinance).start(ctx)
+}
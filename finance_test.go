@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type financeSourceMock struct {
+	requests []FinanceTransactionListRequest
+	pages    map[int64][]FinanceTransaction
+}
+
+func (s *financeSourceMock) financeTransactions(userId int64, body FinanceTransactionListRequest) (*FinanceTransactionListResponse, error) {
+	s.requests = append(s.requests, body)
+	var r FinanceTransactionListResponse
+	r.Result.Operations = s.pages[body.Page]
+	r.Result.PageCount = int64(len(s.pages))
+	return &r, nil
+}
+
+func TestSyncFinanceLedger(t *testing.T) {
+	var page1, page2 []FinanceTransaction
+	json.Unmarshal([]byte(`[{"operation_id":1,"operation_type":"OperationAgentDeliveredToCustomer","operation_date":"2024-01-05 10:00:00",
+		"accruals_for_sale":1000,"sale_commission":-150,"amount":850,"type":"orders","posting":{"posting_number":"0001-1"}}]`), &page1)
+	json.Unmarshal([]byte(`[{"operation_id":2,"operation_type":"OperationMarketplaceServiceStorage","operation_date":"2024-01-06 00:30:00",
+		"amount":-40.5,"type":"services","posting":{"posting_number":""}}]`), &page2)
+	source := &financeSourceMock{pages: map[int64][]FinanceTransaction{1: page1, 2: page2}}
+	ledger := NewFinanceLedgerMemory()
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := from.AddDate(0, 2, 0)
+	account, other := primitive.NewObjectID(), primitive.NewObjectID()
+	if err := syncFinanceLedger(source, ledger, 7, account, from, to); err != nil {
+		t.Fatal(err)
+	}
+	// 60 дней - три периода по 28 дней, в каждом по две страницы
+	if len(source.requests) != 6 {
+		t.Errorf("requests = %d, want 6", len(source.requests))
+	}
+	if got := source.requests[2].Filter.Date; got.From != "2024-01-29T00:00:00.000Z" || got.To != "2024-02-25T23:59:59.999Z" {
+		t.Errorf("second period = %+v", got)
+	}
+	ops, _ := ledger.operations(7, account, from, to)
+	if len(ops) != 2 {
+		t.Fatalf("ledger = %+v, want 2 operations without duplicates", ops)
+	}
+	if want := time.Date(2024, 1, 5, 7, 0, 0, 0, time.UTC); !ops[0].Date.Equal(want) || ops[0].PostingNumber != "0001-1" {
+		t.Errorf("operation = %+v", ops[0])
+	}
+	if ops, _ := ledger.operations(8, account, from, to); len(ops) != 0 {
+		t.Errorf("operations of another user = %+v", ops)
+	}
+	if ops, _ := ledger.operations(7, other, from, to); len(ops) != 0 {
+		t.Errorf("operations of another account = %+v", ops)
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := from.AddDate(0, 1, 0)
+	lines := []ozonLine{
+		{PostingNumber: "0001-1", Product: PostingProduct{Quantity: 1, Price: "1000"}, Delivered: true},
+		{PostingNumber: "0002-1", Product: PostingProduct{Quantity: 2, Price: "300"}, Delivered: true},
+		{PostingNumber: "0002-1", Product: PostingProduct{Quantity: 1, Price: "200"}, Delivered: true},
+		{PostingNumber: "0003-1", Product: PostingProduct{Quantity: 1, Price: "500"}, Cancelled: true},
+		{PostingNumber: "0004-1", Product: PostingProduct{Quantity: 1, Price: "700"}, Delivered: true},
+	}
+	ops := []FinanceOperation{
+		{Type: FinanceOrders, OperationType: "OperationAgentDeliveredToCustomer", Date: from.AddDate(0, 0, 3), PostingNumber: "0001-1", Amount: 850, AccrualsForSale: 1000, SaleCommission: -150},
+		{Type: FinanceServices, OperationType: "MarketplaceRedistributionOfAcquiringOperation", Date: from.AddDate(0, 0, 3), PostingNumber: "0001-1", Amount: -15},
+		{Type: FinanceServices, OperationType: "OperationMarketplaceServiceStorage", OperationTypeName: "Хранение", Date: from.AddDate(0, 0, 10), Amount: -40},
+		{Type: FinanceTransferDelivery, OperationType: "OperationMarketplaceDeliveryCost", Date: from.AddDate(0, 0, 11), Amount: -60, DeliveryCharge: -60},
+		// Начисление за отправление месяца пришло уже в следующем месяце
+		{Type: FinanceOrders, OperationType: "OperationAgentDeliveredToCustomer", Date: to.AddDate(0, 0, 2), PostingNumber: "0004-1", Amount: 600, AccrualsForSale: 700, SaleCommission: -100},
+	}
+	r := reconcile(lines, ops, from, to)
+	if want := []string{"0002-1"}; !reflect.DeepEqual(r.Unpaid, want) {
+		t.Errorf("unpaid = %v, want %v", r.Unpaid, want)
+	}
+	if len(r.UnexpectedFees) != 1 || r.UnexpectedFees[0].OperationType != "OperationMarketplaceServiceStorage" {
+		t.Errorf("unexpected fees = %+v", r.UnexpectedFees)
+	}
+	if r.DeliveredCount != 5 || !r.DeliveredSum.Equal(decimal.NewFromInt(2500)) {
+		t.Errorf("delivered = %d на %s", r.DeliveredCount, r.DeliveredSum)
+	}
+	if !r.Total.Equal(decimal.NewFromInt(735)) || !r.AccrualsForSale.Equal(decimal.NewFromInt(1000)) || !r.Delivery.Equal(decimal.NewFromInt(-60)) {
+		t.Errorf("totals = %s, accruals = %s, delivery = %s", r.Total, r.AccrualsForSale, r.Delivery)
+	}
+	if len(r.Totals) != 3 || r.Totals[0].Name != "Продажи" || !r.Totals[1].Amount.Equal(decimal.NewFromInt(-55)) {
+		t.Errorf("totals by type = %+v", r.Totals)
+	}
+
+	r.Account = "Основной"
+	text := printFinanceReport(r, from, to)
+	for _, want := range []string{"Финансы OZON «Основной» с 01.01.2024 по 31.01.2024", "Доставлено, но не оплачено OZON: 1", "<code>0002-1</code>", "Неожиданные списания: 1 на -40.00", "Хранение: <b>-40.00</b>"} {
+		if !strings.Contains(text, want) {
+			t.Errorf("report %q does not contain %q", text, want)
+		}
+	}
+}
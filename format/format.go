@@ -0,0 +1,179 @@
+// Package format Построение текста сообщений Telegram с экранированием для HTML и MarkdownV2.
+//
+// Любые строки, полученные от пользователя или маркетплейса, передаются через Plain и
+// экранируются при отрисовке, разметку добавляют только Bold, Italic, Code, Pre, Link и Table.
+package format
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Mode Режим разметки Telegram (parse_mode)
+type Mode interface {
+	ParseMode() string
+	// Escape Экранирование обычного текста
+	Escape(s string) string
+	// EscapeCode Экранирование текста внутри code и pre
+	EscapeCode(s string) string
+	// EscapeURL Экранирование адреса ссылки
+	EscapeURL(s string) string
+	Bold(s string) string
+	Italic(s string) string
+	Code(s string) string
+	Pre(s string) string
+	Link(text string, url string) string
+}
+
+type htmlMode struct{}
+
+var htmlEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;")
+
+func (htmlMode) ParseMode() string                   { return "HTML" }
+func (htmlMode) Escape(s string) string              { return htmlEscaper.Replace(s) }
+func (htmlMode) EscapeCode(s string) string          { return htmlEscaper.Replace(s) }
+func (htmlMode) EscapeURL(s string) string           { return htmlEscaper.Replace(s) }
+func (htmlMode) Bold(s string) string                { return "<b>" + s + "</b>" }
+func (htmlMode) Italic(s string) string              { return "<i>" + s + "</i>" }
+func (htmlMode) Code(s string) string                { return "<code>" + s + "</code>" }
+func (htmlMode) Pre(s string) string                 { return "<pre>" + s + "</pre>" }
+func (htmlMode) Link(text string, url string) string { return `<a href="` + url + `">` + text + "</a>" }
+
+type markdownV2Mode struct{}
+
+var (
+	markdownV2Escaper = strings.NewReplacer(
+		`\`, `\\`, "_", `\_`, "*", `\*`, "[", `\[`, "]", `\]`, "(", `\(`, ")", `\)`, "~", `\~`, "`", "\\`",
+		">", `\>`, "#", `\#`, "+", `\+`, "-", `\-`, "=", `\=`, "|", `\|`, "{", `\{`, "}", `\}`, ".", `\.`, "!", `\!`,
+	)
+	markdownV2CodeEscaper = strings.NewReplacer(`\`, `\\`, "`", "\\`")
+	markdownV2URLEscaper  = strings.NewReplacer(`\`, `\\`, ")", `\)`)
+)
+
+func (markdownV2Mode) ParseMode() string                   { return "MarkdownV2" }
+func (markdownV2Mode) Escape(s string) string              { return markdownV2Escaper.Replace(s) }
+func (markdownV2Mode) EscapeCode(s string) string          { return markdownV2CodeEscaper.Replace(s) }
+func (markdownV2Mode) EscapeURL(s string) string           { return markdownV2URLEscaper.Replace(s) }
+func (markdownV2Mode) Bold(s string) string                { return "*" + s + "*" }
+func (markdownV2Mode) Italic(s string) string              { return "_" + s + "_" }
+func (markdownV2Mode) Code(s string) string                { return "`" + s + "`" }
+func (markdownV2Mode) Pre(s string) string                 { return "```\n" + s + "\n```" }
+func (markdownV2Mode) Link(text string, url string) string { return "[" + text + "](" + url + ")" }
+
+var (
+	HTML       Mode = htmlMode{}
+	MarkdownV2 Mode = markdownV2Mode{}
+)
+
+// Fragment Часть сообщения, отрисовываемая в заданном режиме разметки
+type Fragment func(m Mode) string
+
+func render(m Mode, parts []Fragment) string {
+	var b strings.Builder
+	for _, p := range parts {
+		b.WriteString(p(m))
+	}
+	return b.String()
+}
+
+// Render Текст сообщения из фрагментов
+func Render(m Mode, parts ...Fragment) string {
+	return render(m, parts)
+}
+
+// Plain Обычный текст, экранируется
+func Plain(s string) Fragment {
+	return func(m Mode) string { return m.Escape(s) }
+}
+
+func Plainf(format string, a ...interface{}) Fragment {
+	return Plain(fmt.Sprintf(format, a...))
+}
+
+func Concat(parts ...Fragment) Fragment {
+	return func(m Mode) string { return render(m, parts) }
+}
+
+// Line Фрагменты и перевод строки
+func Line(parts ...Fragment) Fragment {
+	return func(m Mode) string { return render(m, parts) + "\n" }
+}
+
+func Bold(parts ...Fragment) Fragment {
+	return func(m Mode) string { return m.Bold(render(m, parts)) }
+}
+
+func Italic(parts ...Fragment) Fragment {
+	return func(m Mode) string { return m.Italic(render(m, parts)) }
+}
+
+func Code(s string) Fragment {
+	return func(m Mode) string { return m.Code(m.EscapeCode(s)) }
+}
+
+func Pre(s string) Fragment {
+	return func(m Mode) string { return m.Pre(m.EscapeCode(s)) }
+}
+
+func Link(text string, url string) Fragment {
+	return func(m Mode) string { return m.Link(m.Escape(text), m.EscapeURL(url)) }
+}
+
+// Table Таблица моноширинным шрифтом, колонки выравниваются по самому длинному значению.
+// Колонки с числами выравниваются по правому краю.
+func Table(header []string, rows [][]string) Fragment {
+	return func(m Mode) string {
+		all := append([][]string{header}, rows...)
+		var widths []int
+		numeric := make(map[int]bool)
+		for _, row := range all {
+			for i, cell := range row {
+				if i >= len(widths) {
+					widths = append(widths, 0)
+					numeric[i] = true
+				}
+				widths[i] = max(widths[i], utf8.RuneCountInString(cell))
+			}
+		}
+		for _, row := range rows {
+			for i, cell := range row {
+				if !isNumber(cell) {
+					numeric[i] = false
+				}
+			}
+		}
+		var b strings.Builder
+		for r, row := range all {
+			if r > 0 {
+				b.WriteString("\n")
+			}
+			for i, cell := range row {
+				if i > 0 {
+					b.WriteString("  ")
+				}
+				pad := strings.Repeat(" ", widths[i]-utf8.RuneCountInString(cell))
+				if numeric[i] {
+					b.WriteString(pad + cell)
+				} else if i < len(row)-1 {
+					b.WriteString(cell + pad)
+				} else {
+					b.WriteString(cell)
+				}
+			}
+		}
+		return m.Pre(m.EscapeCode(b.String()))
+	}
+}
+
+func isNumber(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if (r < '0' || r > '9') && r != '.' && r != ',' && r != '-' && r != ' ' && r != '%' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,54 @@
+package format
+
+import "testing"
+
+func TestRender(t *testing.T) {
+	message := []Fragment{
+		Line(Bold(Plain("Статистика <FBO> & FBS:"))),
+		Line(Plain("    "), Italic(Plain("Носки 5-pack (x2): "), Bold(Plainf("%d", 3)))),
+		Line(Code("a`b<c>"), Plain(" "), Link("Ozon [seller]", "https://seller.ozon.ru/app?a=1&b=(2)")),
+	}
+	tests := []struct {
+		name string
+		mode Mode
+		want string
+	}{
+		{
+			name: "HTML",
+			mode: HTML,
+			want: "<b>Статистика &lt;FBO&gt; &amp; FBS:</b>\n" +
+				"    <i>Носки 5-pack (x2): <b>3</b></i>\n" +
+				"<code>a`b&lt;c&gt;</code> <a href=\"https://seller.ozon.ru/app?a=1&amp;b=(2)\">Ozon [seller]</a>\n",
+		},
+		{
+			name: "MarkdownV2",
+			mode: MarkdownV2,
+			want: "*Статистика <FBO\\> & FBS:*\n" +
+				"    _Носки 5\\-pack \\(x2\\): *3*_\n" +
+				"`a\\`b<c>` [Ozon \\[seller\\]](https://seller.ozon.ru/app?a=1&b=(2\\))\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Render(tt.mode, message...); got != tt.want {
+				t.Errorf("Render() = %q, want %q", got, tt.want)
+			}
+			if tt.mode.ParseMode() != tt.name {
+				t.Errorf("ParseMode() = %s, want %s", tt.mode.ParseMode(), tt.name)
+			}
+		})
+	}
+}
+
+func TestTable(t *testing.T) {
+	got := Render(HTML, Table([]string{"Группа", "Кол-во", "Сумма"}, [][]string{
+		{"Носки", "12", "1200.00"},
+		{"<Гетры>", "3", "450.50"},
+	}))
+	want := "<pre>Группа   Кол-во    Сумма\n" +
+		"Носки        12  1200.00\n" +
+		"&lt;Гетры&gt;       3   450.50</pre>"
+	if got != want {
+		t.Errorf("Table() = %q, want %q", got, want)
+	}
+}
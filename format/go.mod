@@ -0,0 +1,3 @@
+module format
+
+go 1.21.5
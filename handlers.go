@@ -0,0 +1,656 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"format"
+	"github.com/shopspring/decimal"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"hash/fnv"
+	"log"
+	"strconv"
+	"strings"
+	"telegram"
+	"time"
+)
+
+var (
+	conversations                         = NewConversationFSM(ConversationDB{})
+	botRouter                             = newBotRouter()
+	financeLedger FinanceLedgerRepository = FinanceLedgerDB{}
+	returnsRepo   ReturnsRepository       = ReturnsDB{}
+	stockRepo     StockRepository         = StockDB{}
+	digestRepo    DigestRepository        = DigestDB{}
+	// productGroupRepo Группы товаров для закупочных цен
+	productGroupRepo ProductGroupRepository = UserDB{}
+	storeRepo        StoreRepository        = StoreDB{}
+)
+
+// newBotRouter Регистрация обработчиков команд, кнопок и состояний диалога бота.
+// Отчеты, рассылки и часовой пояс доступны всем участникам магазина, настройки - менеджерам,
+// кабинеты с ключами API и участники магазина - только владельцу, см. forRole.
+func newBotRouter() *Router {
+	r := NewRouter()
+	r.Conversations = conversations
+	r.Stores = storeRepo
+
+	r.Command("/start", startHandler)
+	r.CommandPrefix("/start ", startHandler)
+	r.Command("/settings", settingsCommandHandler)
+	r.Command(GenReportToday.String(), forRole(RoleViewer, reportTodayHandler))
+	r.Command(GenReportYesterday.String(), forRole(RoleViewer, reportYesterdayHandler))
+	r.Command(GenReportTrend.String(), forRole(RoleViewer, trendCommandHandler))
+	r.Command(GenReportFinance.String(), forRole(RoleViewer, financeCommandHandler))
+	r.Command(GenReportReturns.String(), forRole(RoleViewer, returnsCommandHandler))
+
+	r.WebAppData(GenReportArbitraryDate.String(), forRole(RoleViewer, reportArbitraryDateHandler))
+
+	r.Callback("/settings", settingsCallbackHandler)
+	r.Callback("/backsettings", backSettingsHandler)
+	r.Callback("/digests", forRole(RoleViewer, digestsHandler))
+	r.Callback("/timezones", forRole(RoleViewer, timezonesHandler))
+	r.CallbackPrefix("/settimezone-", forRole(RoleViewer, setTimezoneHandler))
+	r.Callback("/digestadd", forRole(RoleViewer, newDigestHandler))
+	r.CallbackPrefix("/digestnew-", forRole(RoleViewer, newDigestHandler))
+	r.CallbackPrefix("/digestdel-", forRole(RoleViewer, deleteDigestHandler))
+	r.CallbackPrefix(summaryCallback, forRole(RoleViewer, summaryHandler))
+	r.CallbackPrefix(exportReportCallback, forRole(RoleViewer, exportReportHandler))
+	r.CallbackPrefix(trendCallback, forRole(RoleViewer, trendHandler))
+	r.CallbackPrefix("/finance-", forRole(RoleViewer, financeHandler))
+	r.Callback("/store", forRole(RoleViewer, storeHandler))
+	r.Callback("/storeleave", forRole(RoleViewer, leaveStoreHandler))
+
+	r.Callback("/ozonsetting", forRole(RoleManager, ozonSettingHandler))
+	r.Callback("/settinglocalpricing", forRole(RoleManager, settingLocalPricingHandler))
+	r.Callback("/settingpurchaseprice", forRole(RoleManager, settingPurchasePriceHandler))
+	r.CallbackPrefix("/purchaseprices-", forRole(RoleManager, purchasePricesPageHandler))
+	r.CallbackPrefix("/setpurchaseprice-", forRole(RoleManager, askPurchasePriceHandler))
+	r.Callback("/setcostozon", forRole(RoleManager, askCostOzonHandler))
+	r.Callback("/setstockalertdays", forRole(RoleManager, askStockAlertDaysHandler))
+	r.Callback("/ozonschemes", forRole(RoleManager, ozonSchemesHandler))
+	r.CallbackPrefix("/toggleozonscheme-", forRole(RoleManager, toggleOzonSchemeHandler))
+	r.Callback("/wbsetting", forRole(RoleManager, wildberriesSettingHandler))
+	r.Callback("/setcostwb", forRole(RoleManager, askCostWbHandler))
+	r.Callback("/ymsetting", forRole(RoleManager, yandexMarketSettingHandler))
+	r.Callback("/setcostym", forRole(RoleManager, askCostYmHandler))
+	r.Callback("/grouprules", forRole(RoleManager, groupRulesHandler))
+	r.Callback("/groupruleadd", forRole(RoleManager, newGroupRuleHandler))
+	r.Callback("/grouprulestest", forRole(RoleManager, testGroupRulesHandler))
+	r.CallbackPrefix("/grouprulenew-", forRole(RoleManager, newGroupRuleHandler))
+	r.CallbackPrefix("/groupruledel-", forRole(RoleManager, deleteGroupRuleHandler))
+
+	r.CallbackPrefix("/ymcampaigns-", forRole(RoleOwner, ymCampaignsHandler))
+	r.CallbackPrefix("/toggleymcampaign-", forRole(RoleOwner, toggleYmCampaignHandler))
+	r.CallbackPrefix("/accounts-", forRole(RoleOwner, accountsHandler))
+	r.CallbackPrefix("/account-", forRole(RoleOwner, accountHandler))
+	r.CallbackPrefix("/accountadd-", forRole(RoleOwner, newAccountHandler))
+	r.CallbackPrefix("/accountrename-", forRole(RoleOwner, renameAccountHandler))
+	r.CallbackPrefix("/accountdefault-", forRole(RoleOwner, changeAccountHandler(setDefaultAccount)))
+	r.CallbackPrefix("/accountdel-", forRole(RoleOwner, changeAccountHandler(removeAccount)))
+	r.CallbackPrefix("/accounttest-", forRole(RoleOwner, testAccountHandler))
+	r.CallbackPrefix("/storeinvite-", forRole(RoleOwner, storeInviteHandler))
+	r.CallbackPrefix("/storemember-", forRole(RoleOwner, storeMemberHandler))
+	r.CallbackPrefix("/storerole-", forRole(RoleOwner, storeRoleHandler))
+	r.CallbackPrefix("/storeremove-", forRole(RoleOwner, storeRemoveHandler))
+
+	r.State(StateAwaitDigestTime, forRole(RoleViewer, saveDigestHandler))
+	r.State(StateAwaitCostOzon, forRole(RoleManager, saveCostOzonHandler))
+	r.State(StateAwaitPurchasePrice, forRole(RoleManager, savePurchasePriceHandler))
+	r.State(StateAwaitStockAlertDays, forRole(RoleManager, saveStockAlertDaysHandler))
+	r.State(StateAwaitGroupRule, forRole(RoleManager, saveGroupRuleHandler))
+	r.State(StateAwaitCostWb, forRole(RoleManager, saveCostWbHandler))
+	r.State(StateAwaitCostYm, forRole(RoleManager, saveCostYmHandler))
+	r.State(StateAwaitAccount, forRole(RoleOwner, saveAccountHandler))
+	r.State(StateAwaitAccountName, forRole(RoleOwner, saveAccountNameHandler))
+
+	r.Fallback(fallbackHandler)
+	return r
+}
+
+// htmlText Текст сообщения в разметке HTML, пользовательские строки экранируются
+func htmlText(parts ...format.Fragment) string {
+	return format.Render(format.HTML, parts...)
+}
+
+// ozonSettingButtons Кнопки, показываемые после сохранения параметра настроек OZON
+func ozonSettingButtons() telegram.InlineKeyboardMarkup {
+	return telegram.InlineKeyboardMarkup{InlineKeyboard: CreateButtonsBot[telegram.InlineKeyboardButton]([]telegram.ButtonBot[telegram.InlineKeyboardButton]{
+		{Row: 1, Col: 1, Button: telegram.InlineKeyboardButton{Text: "Кабинеты", CallbackData: "/accounts-ozon"}},
+		{Row: 2, Col: 1, Button: telegram.InlineKeyboardButton{Text: "Назад", CallbackData: "/backsettings"}},
+	})}
+}
+
+// saveOzonSetting Сохранение одного поля настроек OZON и ответ об успешном сохранении
+func saveOzonSetting(m telegram.Message, userId int64, field string, value interface{}, text format.Fragment) {
+	saveUserSetting(m, userId, field, value, text, ozonSettingButtons())
+}
+
+// saveUserSetting Сохранение одного поля настроек пользователя userId и ответ на сообщение m с кнопками markup
+func saveUserSetting(m telegram.Message, userId int64, field string, value interface{}, text format.Fragment, markup telegram.InlineKeyboardMarkup) {
+	coll := clientMongo.Database("MyInfantBotDB").Collection("bot_users")
+	update := bson.D{{"$set", bson.D{{field, value}}}}
+	filter := bson.D{{"telegram_user.user.id", userId}}
+	opts := options.Update().SetUpsert(true)
+	_, err := coll.UpdateOne(context.TODO(), filter, update, opts)
+	if err != nil {
+		panic(err)
+	}
+	bot := TelegramBot{}
+	SendMessageToBot(&bot, telegram.SendMessageRequestBody[telegram.InlineKeyboardMarkup, int64]{
+		ChatId:      m.Chat.Id,
+		ParseMode:   format.HTML.ParseMode(),
+		Text:        htmlText(text),
+		ReplyMarkup: markup,
+	})
+}
+
+// finishConversation Завершение диалога после получения ожидаемого ответа
+func finishConversation(m telegram.Message) {
+	if err := conversations.reset(messageConversationKey(m)); err != nil {
+		log.Printf("Не удалось сбросить состояние диалога: %v", err)
+	}
+}
+
+// parseNumber Разбор числа, присланного пользователем. При ошибке пользователю отправляется подсказка.
+func parseNumber(m telegram.Message) (float64, bool) {
+	value, err := strconv.ParseFloat(strings.ReplaceAll(strings.TrimSpace(m.Text), ",", "."), 64)
+	if err != nil {
+		bot := TelegramBot{}
+		SendMessageToBot(&bot, telegram.SendMessageRequestBody[telegram.InlineKeyboardMarkup, int64]{
+			ChatId:      m.Chat.Id,
+			ParseMode:   format.HTML.ParseMode(),
+			Text:        htmlText(format.Plain("Не удалось распознать число. Попробуйте еще раз через меню настроек.")),
+			ReplyMarkup: ozonSettingButtons(),
+		})
+		return 0, false
+	}
+	return value, true
+}
+
+func saveCostOzonHandler(c *RouteContext) {
+	m := c.Update.Message
+	finishConversation(m)
+	cost, ok := parseNumber(m)
+	if !ok {
+		return
+	}
+	saveOzonSetting(m, c.Access.OwnerId, "telegram_user.settings.ozon_setting.product_setting.cost", cost,
+		format.Concat(format.Plain("% сборов OZON "), format.Bold(format.Plainf("%s", decimal.NewFromFloat(cost).StringFixed(2))), format.Plain(" успешно сохранен.")))
+}
+
+func saveStockAlertDaysHandler(c *RouteContext) {
+	m := c.Update.Message
+	finishConversation(m)
+	days, ok := parseNumber(m)
+	if !ok {
+		return
+	}
+	if days <= 0 {
+		days = defaultStockAlertDays
+	}
+	saveOzonSetting(m, c.Access.OwnerId, "telegram_user.settings.ozon_setting.stock_alert_days", days,
+		format.Concat(format.Plain("Уведомление придет, когда товара останется меньше чем на "), format.Bold(format.Plainf("%s", decimal.NewFromFloat(days).String())), format.Plain(" дн. продаж.")))
+}
+
+func savePurchasePriceHandler(c *RouteContext) {
+	m := c.Update.Message
+	productName := c.Conversation.Payload.NameGroup
+	finishConversation(m)
+	cost, ok := parseNumber(m)
+	if !ok {
+		return
+	}
+	coll := clientMongo.Database("MyInfantBotDB").Collection("bot_users")
+	update := bson.D{{"$set", bson.D{{"telegram_user.settings.ozon_setting.product_setting.group_products.$[elem].purchase_price", cost}}}}
+	filter := bson.D{{"telegram_user.user.id", c.Access.OwnerId}}
+	opts := options.Update().SetArrayFilters(options.ArrayFilters{
+		Filters: []interface{}{bson.D{
+			{"elem.name_group", productName},
+		}},
+	})
+	_, err := coll.UpdateOne(context.TODO(), filter, update, opts)
+	if err != nil {
+		panic(err)
+	}
+	bot := TelegramBot{}
+	SendMessageToBot(&bot, telegram.SendMessageRequestBody[telegram.InlineKeyboardMarkup, int64]{
+		ChatId:    m.Chat.Id,
+		ParseMode: format.HTML.ParseMode(),
+		Text: htmlText(format.Plain("Закупочная цена группы "), format.Bold(format.Plain(productName)),
+			format.Plain(": "), format.Bold(format.Plain(decimal.NewFromFloat(cost).StringFixed(2))), format.Plain(" успешно сохранена.")),
+		ReplyMarkup: ozonSettingButtons(),
+	})
+}
+
+func startHandler(c *RouteContext) {
+	m := c.Update.Message
+	var user UserDB
+	coll := clientMongo.Database("MyInfantBotDB").Collection("bot_users")
+	filter := bson.D{{"telegram_user.user.id", m.From.Id}}
+	err := coll.FindOne(context.TODO(), filter).Decode(&user)
+	if err != nil {
+		fmt.Println(err)
+	}
+	if user.Id.IsZero() {
+		userDB := UserDB{
+			Id: primitive.NewObjectID(),
+			TelegramUser: TelegramUser{
+				User:  m.From,
+				Chats: []telegram.Chat{m.Chat},
+				// У новых пользователей нет прежних групп, переводить нечего
+				Settings: Settings{OzonSetting: OzonSetting{ProductSetting: ProductSetting{GroupRulesMigrated: true}}},
+			}}
+		_, err := coll.InsertOne(context.TODO(), userDB)
+		if err != nil {
+			panic(err)
+		}
+	} else {
+		if result := findIndex[telegram.Chat](user.TelegramUser.Chats, func(ch telegram.Chat) bool {
+			if ch.Id == m.Chat.Id {
+				return true
+			}
+			return false
+		}); result < 0 {
+			user.TelegramUser.Chats = append(user.TelegramUser.Chats, m.Chat)
+		}
+		update := bson.D{{"$set", user}}
+		opts := options.Update().SetUpsert(true)
+		ud, err := coll.UpdateByID(context.TODO(), user.Id, update, opts)
+		if err != nil {
+			panic(err)
+		}
+		fmt.Println(ud)
+	}
+	if c.Payload != "" {
+		joinStore(m, c.Payload)
+		return
+	}
+	bot := TelegramBot{}
+	SendMessageToBot(&bot, telegram.SendMessageRequestBody[telegram.InlineKeyboardMarkup, int64]{
+		ChatId:    m.Chat.Id,
+		ParseMode: format.HTML.ParseMode(),
+		Text:      htmlText(format.Plain("Добро пожаловать! Чтобы использовать бота необходимо его настроить")),
+		ReplyMarkup: telegram.InlineKeyboardMarkup{InlineKeyboard: CreateButtonsBot[telegram.InlineKeyboardButton]([]telegram.ButtonBot[telegram.InlineKeyboardButton]{
+			{Row: 1, Col: 1, Button: telegram.InlineKeyboardButton{Text: "Перейти к настройкам?", CallbackData: "/settings"}},
+		})},
+	})
+}
+
+func settingsCallbackHandler(c *RouteContext) {
+	q := c.Update.CallbackQuery
+	bot := TelegramBot{}
+	answerCallbackQueryToBot(&bot, telegram.AnswerCallbackQueryRequestBody{CallbackQueryId: q.Id})
+	EditMessageTextToBot(&bot, telegram.EditMessageTextRequestBody{
+		ChatId:    q.Message.Chat.Id,
+		MessageId: q.Message.MessageId,
+		ParseMode: format.HTML.ParseMode(),
+		Text:      htmlText(format.Plain("Выберите, пожалуйста маркетплейс который вы бы хотели настроить.")),
+		ReplyMarkup: telegram.InlineKeyboardMarkup{InlineKeyboard: CreateButtonsBot[telegram.InlineKeyboardButton]([]telegram.ButtonBot[telegram.InlineKeyboardButton]{
+			{Row: 1, Col: 1, Button: telegram.InlineKeyboardButton{Text: "OZON", CallbackData: "/ozonsetting"}},
+			{Row: 1, Col: 2, Button: telegram.InlineKeyboardButton{Text: "Wildberries", CallbackData: "/wbsetting"}},
+			{Row: 1, Col: 3, Button: telegram.InlineKeyboardButton{Text: "Яндекс Маркет", CallbackData: "/ymsetting"}},
+			{Row: 2, Col: 1, Button: telegram.InlineKeyboardButton{Text: "Рассылка отчетов", CallbackData: "/digests"}},
+			{Row: 3, Col: 1, Button: telegram.InlineKeyboardButton{Text: "Часовой пояс", CallbackData: "/timezones"}},
+			{Row: 3, Col: 2, Button: telegram.InlineKeyboardButton{Text: "Доступ к магазину", CallbackData: "/store"}},
+			{Row: 4, Col: 1, Button: telegram.InlineKeyboardButton{Text: "Назад", CallbackData: "/backsettings"}},
+		})},
+	})
+}
+
+func settingsCommandHandler(c *RouteContext) {
+	bot := TelegramBot{}
+	SendMessageToBot(&bot, telegram.SendMessageRequestBody[telegram.InlineKeyboardMarkup, int64]{
+		ChatId:    c.Update.Message.Chat.Id,
+		ParseMode: format.HTML.ParseMode(),
+		Text:      htmlText(format.Plain("Выберите, пожалуйста маркетплейс который вы бы хотели настроить.")),
+		ReplyMarkup: telegram.InlineKeyboardMarkup{InlineKeyboard: CreateButtonsBot[telegram.InlineKeyboardButton]([]telegram.ButtonBot[telegram.InlineKeyboardButton]{
+			{Row: 1, Col: 1, Button: telegram.InlineKeyboardButton{Text: "OZON", CallbackData: "/ozonsetting"}},
+			{Row: 1, Col: 2, Button: telegram.InlineKeyboardButton{Text: "Wildberries", CallbackData: "/wbsetting"}},
+			{Row: 1, Col: 3, Button: telegram.InlineKeyboardButton{Text: "Яндекс Маркет", CallbackData: "/ymsetting"}},
+			{Row: 2, Col: 1, Button: telegram.InlineKeyboardButton{Text: "Рассылка отчетов", CallbackData: "/digests"}},
+			{Row: 3, Col: 1, Button: telegram.InlineKeyboardButton{Text: "Часовой пояс", CallbackData: "/timezones"}},
+			{Row: 3, Col: 2, Button: telegram.InlineKeyboardButton{Text: "Доступ к магазину", CallbackData: "/store"}},
+		})},
+	})
+}
+
+func ozonSettingHandler(c *RouteContext) {
+	q := c.Update.CallbackQuery
+	bot := TelegramBot{}
+	answerCallbackQueryToBot(&bot, telegram.AnswerCallbackQueryRequestBody{CallbackQueryId: q.Id})
+	EditMessageTextToBot(&bot, telegram.EditMessageTextRequestBody{
+		ChatId:    q.Message.Chat.Id,
+		MessageId: q.Message.MessageId,
+		ParseMode: format.HTML.ParseMode(),
+		Text:      htmlText(format.Plain("Для получения данных из OZON seller добавьте кабинет с ClientId и Token. Их можно получить в личном кабинете продавца.")),
+		ReplyMarkup: telegram.InlineKeyboardMarkup{InlineKeyboard: CreateButtonsBot[telegram.InlineKeyboardButton]([]telegram.ButtonBot[telegram.InlineKeyboardButton]{
+			{Row: 1, Col: 1, Button: telegram.InlineKeyboardButton{Text: "Кабинеты", CallbackData: "/accounts-ozon"}},
+			{Row: 2, Col: 1, Button: telegram.InlineKeyboardButton{Text: "Схемы работы FBO/FBS", CallbackData: "/ozonschemes"}},
+			{Row: 3, Col: 1, Button: telegram.InlineKeyboardButton{Text: "Настройка локального ценообразования", CallbackData: "/settinglocalpricing"}},
+			{Row: 4, Col: 1, Button: telegram.InlineKeyboardButton{Text: "Группы товаров", CallbackData: "/grouprules"}},
+			{Row: 5, Col: 1, Button: telegram.InlineKeyboardButton{Text: "Уведомления об остатках", CallbackData: "/setstockalertdays"}},
+			{Row: 6, Col: 1, Button: telegram.InlineKeyboardButton{Text: "Назад", CallbackData: "/backsettings"}},
+		})},
+	})
+}
+
+// ozonSchemesMarkup Переключатели схем работы, включаемых в отчеты
+func ozonSchemesMarkup(setting OzonSetting) telegram.InlineKeyboardMarkup {
+	var buttons []telegram.ButtonBot[telegram.InlineKeyboardButton]
+	for i, scheme := range deliverySchemes {
+		text := "☐ " + scheme.String()
+		if setting.hasScheme(scheme) {
+			text = "✅ " + scheme.String()
+		}
+		buttons = append(buttons, telegram.ButtonBot[telegram.InlineKeyboardButton]{
+			Row: 1, Col: i + 1, Button: telegram.InlineKeyboardButton{Text: text, CallbackData: "/toggleozonscheme-" + string(scheme)},
+		})
+	}
+	buttons = append(buttons, telegram.ButtonBot[telegram.InlineKeyboardButton]{
+		Row: 2, Col: 1, Button: telegram.InlineKeyboardButton{Text: "Назад", CallbackData: "/ozonsetting"},
+	})
+	return telegram.InlineKeyboardMarkup{InlineKeyboard: CreateButtonsBot[telegram.InlineKeyboardButton](buttons)}
+}
+
+func editOzonSchemes(q telegram.CallbackQuery, setting OzonSetting) {
+	bot := TelegramBot{}
+	EditMessageTextToBot(&bot, telegram.EditMessageTextRequestBody{
+		ChatId:      q.Message.Chat.Id,
+		MessageId:   q.Message.MessageId,
+		ParseMode:   format.HTML.ParseMode(),
+		Text:        htmlText(format.Plain("Выберите схемы работы, которые нужно включать в отчеты: FBO - продажи со склада OZON, FBS - со своего склада.")),
+		ReplyMarkup: ozonSchemesMarkup(setting),
+	})
+}
+
+func ozonSchemesHandler(c *RouteContext) {
+	q := c.Update.CallbackQuery
+	bot := TelegramBot{}
+	answerCallbackQueryToBot(&bot, telegram.AnswerCallbackQueryRequestBody{CallbackQueryId: q.Id})
+	setting, err := UserDB{}.getOzonSetting(c.Access.OwnerId)
+	if err != nil {
+		log.Printf("Не удалось получить настройки пользователя %d: %v", c.Access.OwnerId, err)
+		return
+	}
+	editOzonSchemes(q, *setting)
+}
+
+func toggleOzonSchemeHandler(c *RouteContext) {
+	q := c.Update.CallbackQuery
+	bot := TelegramBot{}
+	scheme := DeliveryScheme(c.Payload)
+	setting, err := UserDB{}.getOzonSetting(c.Access.OwnerId)
+	if err != nil || findIndex(deliverySchemes, func(s DeliveryScheme) bool { return s == scheme }) < 0 {
+		answerCallbackQueryToBot(&bot, telegram.AnswerCallbackQueryRequestBody{CallbackQueryId: q.Id, Text: "Кнопка устарела."})
+		return
+	}
+	schemes, ok := setting.toggleScheme(scheme)
+	if !ok {
+		answerCallbackQueryToBot(&bot, telegram.AnswerCallbackQueryRequestBody{CallbackQueryId: q.Id, Text: "Должна быть выбрана хотя бы одна схема работы.", ShowAlert: true})
+		return
+	}
+	if err := (UserDB{}).setOzonSchemes(c.Access.OwnerId, schemes); err != nil {
+		panic(err)
+	}
+	answerCallbackQueryToBot(&bot, telegram.AnswerCallbackQueryRequestBody{CallbackQueryId: q.Id})
+	setting.Schemes = schemes
+	editOzonSchemes(q, *setting)
+}
+
+func settingLocalPricingHandler(c *RouteContext) {
+	q := c.Update.CallbackQuery
+	bot := TelegramBot{}
+	answerCallbackQueryToBot(&bot, telegram.AnswerCallbackQueryRequestBody{CallbackQueryId: q.Id})
+	EditMessageTextToBot(&bot, telegram.EditMessageTextRequestBody{
+		ChatId:    q.Message.Chat.Id,
+		MessageId: q.Message.MessageId,
+		ParseMode: format.HTML.ParseMode(),
+		Text:      htmlText(format.Plain("Для получения данных из OZON seller необходимо указать ClientId и Token. Их можно получить в личном кабинете продавца.")),
+		ReplyMarkup: telegram.InlineKeyboardMarkup{InlineKeyboard: CreateButtonsBot[telegram.InlineKeyboardButton]([]telegram.ButtonBot[telegram.InlineKeyboardButton]{
+			{Row: 1, Col: 1, Button: telegram.InlineKeyboardButton{Text: "Внести % сборов OZON", CallbackData: "/setcostozon"}},
+			{Row: 2, Col: 1, Button: telegram.InlineKeyboardButton{Text: "Указать закупочную цену групп товаров", CallbackData: "/settingpurchaseprice"}},
+		})},
+	})
+}
+
+// purchasePricePageSize Групп на одной странице закупочных цен
+const purchasePricePageSize = 10
+
+// purchasePriceKey Короткий ключ группы для callback_data: название группы может не уложиться в 64 байта
+func purchasePriceKey(name string) string {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return strconv.FormatUint(h.Sum64(), 36)
+}
+
+// purchasePriceGroup Группа по ключу из кнопки
+func purchasePriceGroup(groups []GroupProducts, key string) (GroupProducts, bool) {
+	i := findIndex(groups, func(gp GroupProducts) bool { return purchasePriceKey(gp.NameGroup) == key })
+	if i < 0 {
+		return GroupProducts{}, false
+	}
+	return groups[i], true
+}
+
+// purchasePriceMarkup Страница групп товаров с закупочными ценами и переходами между страницами
+func purchasePriceMarkup(groups []GroupProducts, page int) telegram.InlineKeyboardMarkup {
+	pages := max(1, (len(groups)+purchasePricePageSize-1)/purchasePricePageSize)
+	page = min(max(page, 0), pages-1)
+	var buttons []telegram.ButtonBot[telegram.InlineKeyboardButton]
+	row := 0
+	for _, gp := range groups[page*purchasePricePageSize : min((page+1)*purchasePricePageSize, len(groups))] {
+		row++
+		text := fmt.Sprintf("%s (Цена: %s)", gp.NameGroup, decimal.NewFromFloat(gp.PurchasePrice).StringFixed(2))
+		buttons = append(buttons, telegram.ButtonBot[telegram.InlineKeyboardButton]{
+			Row:    row,
+			Col:    1,
+			Button: telegram.InlineKeyboardButton{Text: text, CallbackData: "/setpurchaseprice-" + purchasePriceKey(gp.NameGroup)},
+		})
+	}
+	row++
+	if page > 0 {
+		buttons = append(buttons, telegram.ButtonBot[telegram.InlineKeyboardButton]{Row: row, Col: 1, Button: telegram.InlineKeyboardButton{
+			Text: "◀ Назад", CallbackData: "/purchaseprices-" + strconv.Itoa(page-1)}})
+	}
+	if page < pages-1 {
+		buttons = append(buttons, telegram.ButtonBot[telegram.InlineKeyboardButton]{Row: row, Col: 2, Button: telegram.InlineKeyboardButton{
+			Text: fmt.Sprintf("Далее ▶ (%d/%d)", page+1, pages), CallbackData: "/purchaseprices-" + strconv.Itoa(page+1)}})
+	}
+	return telegram.InlineKeyboardMarkup{InlineKeyboard: CreateButtonsBot[telegram.InlineKeyboardButton](buttons)}
+}
+
+func editPurchasePrices(q telegram.CallbackQuery, userId int64, page int) {
+	bot := TelegramBot{}
+	answerCallbackQueryToBot(&bot, telegram.AnswerCallbackQueryRequestBody{CallbackQueryId: q.Id})
+	set, err := UserDB{}.getOzonSetting(userId)
+	if err != nil {
+		log.Printf("Не удалось получить настройки пользователя %d: %v", userId, err)
+		return
+	}
+	EditMessageTextToBot(&bot, telegram.EditMessageTextRequestBody{
+		ChatId:      q.Message.Chat.Id,
+		MessageId:   q.Message.MessageId,
+		ParseMode:   format.HTML.ParseMode(),
+		Text:        htmlText(format.Plain("Выберите группу товаров, чтобы указать ее закупочную цену.")),
+		ReplyMarkup: purchasePriceMarkup(set.ProductSetting.GroupProducts, page),
+	})
+}
+
+func settingPurchasePriceHandler(c *RouteContext) {
+	editPurchasePrices(c.Update.CallbackQuery, c.Access.OwnerId, 0)
+}
+
+func purchasePricesPageHandler(c *RouteContext) {
+	page, _ := strconv.Atoi(c.Payload)
+	editPurchasePrices(c.Update.CallbackQuery, c.Access.OwnerId, page)
+}
+
+// askSettingValue Запоминает, какое значение ожидается от пользователя, и просит его прислать
+func askSettingValue(q telegram.CallbackQuery, state ConversationState, payload ConversationPayload, text format.Fragment) {
+	bot := TelegramBot{}
+	answerCallbackQueryToBot(&bot, telegram.AnswerCallbackQueryRequestBody{CallbackQueryId: q.Id})
+	if err := conversations.enter(callbackConversationKey(q), state, payload); err != nil {
+		panic(err)
+	}
+	SendMessageToBot(&bot, telegram.SendMessageRequestBody[telegram.InlineKeyboardMarkup, int64]{
+		ChatId:    q.Message.Chat.Id,
+		ParseMode: format.HTML.ParseMode(),
+		Text:      htmlText(text),
+	})
+}
+
+func askPurchasePriceHandler(c *RouteContext) {
+	q := c.Update.CallbackQuery
+	set, err := UserDB{}.getOzonSetting(c.Access.OwnerId)
+	if err != nil {
+		log.Printf("Не удалось получить настройки пользователя %d: %v", c.Access.OwnerId, err)
+		return
+	}
+	gp, ok := purchasePriceGroup(set.ProductSetting.GroupProducts, c.Payload)
+	if !ok {
+		answerCallbackQueryToBot(&TelegramBot{}, telegram.AnswerCallbackQueryRequestBody{CallbackQueryId: q.Id, Text: "Кнопка устарела."})
+		return
+	}
+	askSettingValue(q, StateAwaitPurchasePrice, ConversationPayload{NameGroup: gp.NameGroup},
+		format.Concat(format.Plain("ОК. Пришлите, пожалуйста себестоимость товаров группы "), format.Bold(format.Plain(gp.NameGroup)), format.Plain(".")))
+}
+
+func askCostOzonHandler(c *RouteContext) {
+	askSettingValue(c.Update.CallbackQuery, StateAwaitCostOzon, ConversationPayload{}, format.Plain("ОК. Пришлите, пожалуйста % расходом на услуги OZON."))
+}
+
+func askStockAlertDaysHandler(c *RouteContext) {
+	askSettingValue(c.Update.CallbackQuery, StateAwaitStockAlertDays, ConversationPayload{},
+		format.Plainf("ОК. Пришлите, пожалуйста, за сколько дней продаж до окончания остатка на складах OZON предупреждать (по умолчанию %d).", defaultStockAlertDays))
+}
+
+func backSettingsHandler(c *RouteContext) {
+	q := c.Update.CallbackQuery
+	bot := TelegramBot{}
+	answerCallbackQueryToBot(&bot, telegram.AnswerCallbackQueryRequestBody{CallbackQueryId: q.Id})
+	EditMessageTextToBot(&bot, telegram.EditMessageTextRequestBody{
+		ChatId:    q.Message.Chat.Id,
+		MessageId: q.Message.MessageId,
+		ParseMode: format.HTML.ParseMode(),
+		Text:      htmlText(format.Plain("Настроить бота?")),
+		ReplyMarkup: telegram.InlineKeyboardMarkup{InlineKeyboard: CreateButtonsBot[telegram.InlineKeyboardButton]([]telegram.ButtonBot[telegram.InlineKeyboardButton]{
+			{Row: 1, Col: 1, Button: telegram.InlineKeyboardButton{Text: "Да", CallbackData: "/settings"}},
+		})},
+	})
+}
+
+// sendReportKeyboard Клавиатура с отчетами, отправляется после проверки подключения к кабинету
+func sendReportKeyboard(chatId int64) {
+	bot := TelegramBot{}
+	SendMessageToBot(&bot, telegram.SendMessageRequestBody[telegram.ReplyKeyboardMarkup, int64]{
+		ChatId:    chatId,
+		ParseMode: format.HTML.ParseMode(),
+		Text:      htmlText(format.Plain("Выберите отчет.")),
+		ReplyMarkup: telegram.ReplyKeyboardMarkup{Keyboard: CreateButtonsBot[telegram.KeyboardButton]([]telegram.ButtonBot[telegram.KeyboardButton]{
+			{Row: 1, Col: 1, Button: telegram.KeyboardButton{Text: GenReportArbitraryDate.String(), WebApp: &telegram.WebAppInfo{
+				Url: "https://bot.my-infant.com/static/",
+			}}},
+			{Row: 2, Col: 1, Button: telegram.KeyboardButton{Text: GenReportToday.String()}},
+			{Row: 2, Col: 2, Button: telegram.KeyboardButton{Text: GenReportYesterday.String()}},
+			{Row: 3, Col: 1, Button: telegram.KeyboardButton{Text: GenReportTrend.String()}},
+			{Row: 3, Col: 2, Button: telegram.KeyboardButton{Text: GenReportFinance.String()}},
+			{Row: 4, Col: 1, Button: telegram.KeyboardButton{Text: GenReportReturns.String()}},
+		}),
+			ResizeKeyboard: true},
+	})
+}
+
+// sendOrderSummaryReport Формирование и отправка сводного отчета за период по каждому кабинету из marketplaces.
+// Если кабинетов несколько, после них отправляются общие итоги.
+func sendOrderSummaryReport(userId int64, chatId int64, period DateRange, marketplaces []ReportMarketplace) {
+	bot := TelegramBot{}
+	var reports []OrderReport
+	for _, marketplace := range marketplaces {
+		report, err := orderSummaryReport(marketplace, userId, period)
+		if err != nil {
+			log.Printf("Не удалось сформировать отчет %s пользователя %d: %v", reportTitle(marketplace), userId, err)
+			text := format.Plainf("Не удалось получить данные %s, попробуйте позже.", reportTitle(marketplace))
+			if seconds, ok := retryAfterSeconds(err); ok {
+				text = format.Plainf("Лимит запросов %s исчерпан, попробуйте через %d сек.", reportTitle(marketplace), seconds)
+			}
+			SendMessageToBot(&bot, telegram.SendMessageRequestBody[telegram.InlineKeyboardMarkup, int64]{
+				ChatId:    chatId,
+				ParseMode: format.HTML.ParseMode(),
+				Text:      htmlText(text),
+			})
+			continue
+		}
+		reports = append(reports, report)
+		body := telegram.SendMessageRequestBody[telegram.InlineKeyboardMarkup, int64]{
+			ChatId:      chatId,
+			ParseMode:   format.HTML.ParseMode(),
+			Text:        printOrderSummaryReport(report),
+			ReplyMarkup: exportReportButtons(period, exportAccount(marketplace)),
+		}
+		SendLongMessageToBot(&bot, body)
+	}
+	if len(reports) > 1 {
+		SendMessageToBot(&bot, telegram.SendMessageRequestBody[telegram.InlineKeyboardMarkup, int64]{
+			ChatId:      chatId,
+			ParseMode:   format.HTML.ParseMode(),
+			Text:        printCombinedReport(reports),
+			ReplyMarkup: exportReportButtons(period, allAccounts),
+		})
+	}
+}
+
+func reportTodayHandler(c *RouteContext) {
+	m := c.Update.Message
+	requestOrderSummaryReport(m, c.Access.OwnerId, dayRange(time.Now(), UserDB{}.userLocation(m.From.Id), 0))
+}
+
+func reportYesterdayHandler(c *RouteContext) {
+	m := c.Update.Message
+	requestOrderSummaryReport(m, c.Access.OwnerId, dayRange(time.Now(), UserDB{}.userLocation(m.From.Id), -1))
+}
+
+// reportArbitraryDateHandler Отчет за даты из WebApp: "с::по" и, в новых версиях WebApp, "::пояс браузера".
+// Пояс браузера сохраняется, если пользователь еще не выбрал свой.
+func reportArbitraryDateHandler(c *RouteContext) {
+	m := c.Update.Message
+	data := strings.Split(m.WebAppData.Data, "::")
+	if len(data) != 2 && len(data) != 3 {
+		log.Printf("Некорректные данные WebApp %q", m.WebAppData.Data)
+		return
+	}
+	from, errFrom := time.Parse(time.DateOnly, data[0])
+	to, errTo := time.Parse(time.DateOnly, data[1])
+	if errFrom != nil || errTo != nil || to.Before(from) {
+		log.Printf("Некорректные даты WebApp %q", m.WebAppData.Data)
+		return
+	}
+	loc := UserDB{}.userLocation(m.From.Id)
+	if len(data) == 3 && loc == defaultLocation {
+		if browser, err := time.LoadLocation(data[2]); err == nil && data[2] != "" && data[2] != "Local" {
+			if err := saveTimezone(m.From.Id, browser, time.Now()); err != nil {
+				log.Printf("Не удалось сохранить часовой пояс пользователя %d: %v", m.From.Id, err)
+			} else {
+				loc = browser
+			}
+		}
+	}
+	requestOrderSummaryReport(m, c.Access.OwnerId, daysRange(from, to, loc))
+}
+
+// fallbackHandler Обновления, для которых не нашлось обработчика
+func fallbackHandler(c *RouteContext) {
+	bot := TelegramBot{}
+	if q := c.Update.CallbackQuery; q.Id != "" {
+		answerCallbackQueryToBot(&bot, telegram.AnswerCallbackQueryRequestBody{CallbackQueryId: q.Id})
+		return
+	}
+	if m := c.Update.Message; m.Text != "" {
+		SendMessageToBot(&bot, telegram.SendMessageRequestBody[telegram.InlineKeyboardMarkup, int64]{
+			ChatId:    m.Chat.Id,
+			ParseMode: format.HTML.ParseMode(),
+			Text:      htmlText(format.Plain("Не понял команду. Для настройки бота отправьте /settings")),
+		})
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// jobCheckInterval Как часто реплика проверяет, не пора ли выполнить фоновую задачу
+	jobCheckInterval = time.Minute
+	// jobLeaseTimeout Время, на которое реплика захватывает задачу, аренда продлевается, пока задача выполняется
+	jobLeaseTimeout = 10 * time.Minute
+)
+
+// keepLease Выполнение fn с продлением аренды каждые every, пока fn не завершится.
+// extend возвращает false, если аренду уже перехватила другая реплика, тогда продление прекращается.
+func keepLease(every time.Duration, extend func() (bool, error), name string, fn func() error) error {
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(every)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				held, err := extend()
+				if err != nil {
+					log.Printf("Не удалось продлить захват %s: %v", name, err)
+				} else if !held {
+					log.Printf("Захват %s перехвачен другой репликой", name)
+					return
+				}
+			}
+		}
+	}()
+	defer func() {
+		close(stop)
+		<-stopped
+	}()
+	return fn()
+}
+
+// Job Срок и аренда периодической задачи, общей для всех реплик
+type Job struct {
+	Name       string    `bson:"_id"`
+	NextRunAt  time.Time `bson:"next_run_at"`
+	LeaseUntil time.Time `bson:"lease_until"`
+	LeaseOwner string    `bson:"lease_owner,omitempty"`
+}
+
+type JobRepository interface {
+	// claim Захват задачи до leaseUntil, если ее срок наступил, false если срок не наступил или задачу захватила другая реплика
+	claim(name string, owner string, now time.Time, leaseUntil time.Time) (bool, error)
+	// extend Продление захвата, false если задача больше не захвачена owner
+	extend(name string, owner string, leaseUntil time.Time) (bool, error)
+	// complete Перенос задачи на следующий срок и освобождение захвата
+	complete(name string, owner string, nextRunAt time.Time) error
+}
+
+type JobDB struct{}
+
+func (d JobDB) collection() *mongo.Collection {
+	return clientMongo.Database("MyInfantBotDB").Collection("bot_jobs")
+}
+
+// claim Задача, которой еще нет, создается уже захваченной. Если задача есть, но не подходит под фильтр,
+// upsert пытается вставить дубль _id и получает ошибку дубля - это значит, что захватить не удалось.
+func (d JobDB) claim(name string, owner string, now time.Time, leaseUntil time.Time) (bool, error) {
+	filter := append(bson.D{{"_id", name}}, dueFilter(now)...)
+	update := bson.D{
+		{"$set", bson.D{{"lease_until", leaseUntil}, {"lease_owner", owner}}},
+		{"$setOnInsert", bson.D{{"next_run_at", now}}},
+	}
+	result, err := d.collection().UpdateOne(context.TODO(), filter, update, options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return result.ModifiedCount == 1 || result.UpsertedCount == 1, nil
+}
+
+func (d JobDB) extend(name string, owner string, leaseUntil time.Time) (bool, error) {
+	filter := bson.D{{"_id", name}, {"lease_owner", owner}}
+	result, err := d.collection().UpdateOne(context.TODO(), filter, bson.D{{"$set", bson.D{{"lease_until", leaseUntil}}}})
+	if err != nil {
+		return false, err
+	}
+	return result.MatchedCount == 1, nil
+}
+
+func (d JobDB) complete(name string, owner string, nextRunAt time.Time) error {
+	update := bson.D{
+		{"$set", bson.D{{"next_run_at", nextRunAt}, {"lease_until", time.Time{}}}},
+		{"$unset", bson.D{{"lease_owner", ""}}},
+	}
+	_, err := d.collection().UpdateOne(context.TODO(), bson.D{{"_id", name}, {"lease_owner", owner}}, update)
+	return err
+}
+
+// JobMemory Задачи в памяти процесса
+type JobMemory struct {
+	mu   sync.Mutex
+	jobs map[string]Job
+}
+
+func NewJobMemory() *JobMemory {
+	return &JobMemory{jobs: make(map[string]Job)}
+}
+
+func (d *JobMemory) claim(name string, owner string, now time.Time, leaseUntil time.Time) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	job, ok := d.jobs[name]
+	if !ok {
+		job = Job{Name: name, NextRunAt: now}
+	}
+	if job.NextRunAt.After(now) || !job.LeaseUntil.Before(now) {
+		return false, nil
+	}
+	job.LeaseUntil, job.LeaseOwner = leaseUntil, owner
+	d.jobs[name] = job
+	return true, nil
+}
+
+func (d *JobMemory) extend(name string, owner string, leaseUntil time.Time) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	job, ok := d.jobs[name]
+	if !ok || job.LeaseOwner != owner {
+		return false, nil
+	}
+	job.LeaseUntil = leaseUntil
+	d.jobs[name] = job
+	return true, nil
+}
+
+func (d *JobMemory) complete(name string, owner string, nextRunAt time.Time) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	job, ok := d.jobs[name]
+	if !ok || job.LeaseOwner != owner {
+		return nil
+	}
+	job.NextRunAt, job.LeaseUntil, job.LeaseOwner = nextRunAt, time.Time{}, ""
+	d.jobs[name] = job
+	return nil
+}
+
+// ScheduledJob Периодическая задача, которую выполняет только одна из реплик бота.
+//
+// Срок хранится в репозитории, поэтому перезапуск реплики не откладывает задачу:
+// при старте она выполняется сразу, если срок уже наступил или задача еще ни разу не выполнялась.
+type ScheduledJob struct {
+	name     string
+	interval time.Duration
+	repo     JobRepository
+	owner    string
+	run      func(now time.Time)
+	now      func() time.Time
+	// renewInterval Период продления аренды во время выполнения
+	renewInterval time.Duration
+}
+
+func NewScheduledJob(repo JobRepository, name string, interval time.Duration, run func(now time.Time)) *ScheduledJob {
+	return &ScheduledJob{
+		name:     name,
+		interval: interval,
+		repo:     repo,
+		owner:    primitive.NewObjectID().Hex(),
+		run:      run,
+		now:      time.Now,
+
+		renewInterval: jobLeaseTimeout / 3,
+	}
+}
+
+// tick Выполнение задачи, если ее срок наступил и ее удалось захватить
+func (j *ScheduledJob) tick() bool {
+	now := j.now()
+	claimed, err := j.repo.claim(j.name, j.owner, now, now.Add(jobLeaseTimeout))
+	if err != nil {
+		log.Printf("Не удалось захватить задачу %s: %v", j.name, err)
+		return false
+	}
+	if !claimed {
+		return false
+	}
+	extend := func() (bool, error) { return j.repo.extend(j.name, j.owner, j.now().Add(jobLeaseTimeout)) }
+	err = keepLease(j.renewInterval, extend, "задачи "+j.name, func() (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("%v", r)
+			}
+		}()
+		j.run(now)
+		return nil
+	})
+	if err != nil {
+		log.Printf("Задача %s завершилась с ошибкой: %v", j.name, err)
+	}
+	if err := j.repo.complete(j.name, j.owner, now.Add(j.interval)); err != nil {
+		log.Printf("Не удалось перенести задачу %s: %v", j.name, err)
+	}
+	return true
+}
+
+func (j *ScheduledJob) loop(ctx context.Context) {
+	ticker := time.NewTicker(jobCheckInterval)
+	defer ticker.Stop()
+	for {
+		j.tick()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// start Запуск задачи в фоне, done закрывается после остановки
+func (j *ScheduledJob) start(ctx context.Context) (done chan struct{}) {
+	done = make(chan struct{})
+	go func() {
+		defer close(done)
+		j.loop(ctx)
+	}()
+	return done
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestScheduledJob_tick(t *testing.T) {
+	var mu sync.Mutex
+	now := time.Date(2024, 1, 10, 5, 0, 0, 0, time.UTC)
+	clock := func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+	setNow := func(at time.Time) {
+		mu.Lock()
+		defer mu.Unlock()
+		now = at
+	}
+	repo := NewJobMemory()
+	var runs []string
+	replica := func(name string) *ScheduledJob {
+		j := NewScheduledJob(repo, "stocks", stockCheckInterval, func(time.Time) {
+			mu.Lock()
+			runs = append(runs, name)
+			mu.Unlock()
+		})
+		j.now = clock
+		return j
+	}
+	first, second := replica("first"), replica("second")
+
+	tests := []struct {
+		name  string
+		at    time.Time
+		job   *ScheduledJob
+		want  bool
+		total int
+	}{
+		{name: "Первый запуск - сразу", at: now, job: first, want: true, total: 1},
+		{name: "Другая реплика при запуске не повторяет", at: now.Add(time.Minute), job: second, want: false, total: 1},
+		{name: "Перезапуск до срока не повторяет", at: now.Add(time.Hour), job: replica("restarted"), want: false, total: 1},
+		{name: "После срока выполняет одна реплика", at: now.Add(stockCheckInterval), job: second, want: true, total: 2},
+		{name: "И только одна", at: now.Add(stockCheckInterval), job: first, want: false, total: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setNow(tt.at)
+			if got := tt.job.tick(); got != tt.want {
+				t.Errorf("tick() = %v, want %v", got, tt.want)
+			}
+			if len(runs) != tt.total {
+				t.Errorf("runs = %v, want %d", runs, tt.total)
+			}
+		})
+	}
+}
+
+func TestScheduledJob_slowRun(t *testing.T) {
+	var mu sync.Mutex
+	now := time.Date(2024, 1, 10, 5, 0, 0, 0, time.UTC)
+	clock := func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+	repo := NewJobMemory()
+	runs := 0
+	var other *ScheduledJob
+	slow := NewScheduledJob(repo, "stocks", stockCheckInterval, func(time.Time) {
+		mu.Lock()
+		runs++
+		// Проверка идет дольше аренды
+		now = now.Add(2 * jobLeaseTimeout)
+		mu.Unlock()
+		for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+			repo.mu.Lock()
+			renewed := repo.jobs["stocks"].LeaseUntil.After(clock())
+			repo.mu.Unlock()
+			if renewed {
+				break
+			}
+		}
+		if other.tick() {
+			t.Errorf("другая реплика захватила выполняющуюся задачу")
+		}
+	})
+	other = NewScheduledJob(repo, "stocks", stockCheckInterval, func(time.Time) { runs++ })
+	for _, j := range []*ScheduledJob{slow, other} {
+		j.now = clock
+		j.renewInterval = time.Millisecond
+	}
+	slow.tick()
+	if runs != 1 {
+		t.Errorf("runs = %d, want 1", runs)
+	}
+}
@@ -1,10 +1,11 @@
 package main
 
 import (
-	"bytes"
 	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
+	"format"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/adaptor"
 	"github.com/gofiber/fiber/v2/middleware/logger"
@@ -14,22 +15,25 @@ import (
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"gqlgen"
-	"io"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"sort"
-	"strconv"
-	"strings"
+	"syscall"
 	"telegram"
 	"time"
 )
 
 var (
-	clientMongo      *mongo.Client
-	urlOzon          string
-	urlTelegramBot   string
-	tokenTelegramBot string
+	clientMongo        *mongo.Client
+	urlOzon            string
+	urlTelegramBot     string
+	tokenTelegramBot   string
+	telegramClient     *telegram.Client
+	updateMode         string
+	urlWebhook         string
+	secretTokenWebhook string
 )
 
 type FilterFbo struct {
@@ -53,78 +57,97 @@ type ListRequestFBO struct {
 	Body ListBodyRequestFBO
 }
 type ListResponseFBO struct {
-	Result []struct {
-		OrderId        int       `json:"order_id"`
-		OrderNumber    string    `json:"order_number"`
-		PostingNumber  string    `json:"posting_number"`
-		Status         string    `json:"status"`
-		CancelReasonId int       `json:"cancel_reason_id"`
-		CreatedAt      time.Time `json:"created_at"`
-		InProcessAt    time.Time `json:"in_process_at"`
-		Products       []struct {
-			Sku          int           `json:"sku"`
-			Name         string        `json:"name"`
-			Quantity     int           `json:"quantity"`
-			OfferId      string        `json:"offer_id"`
-			Price        string        `json:"price"`
-			DigitalCodes []interface{} `json:"digital_codes"`
-			CurrencyCode string        `json:"currency_code"`
-		} `json:"products"`
-		AnalyticsData struct {
-			Region               string `json:"region"`
-			City                 string `json:"city"`
-			DeliveryType         string `json:"delivery_type"`
-			IsPremium            bool   `json:"is_premium"`
-			PaymentTypeGroupName string `json:"payment_type_group_name"`
-			WarehouseId          int64  `json:"warehouse_id"`
-			WarehouseName        string `json:"warehouse_name"`
-			IsLegal              bool   `json:"is_legal"`
-		} `json:"analytics_data"`
-		FinancialData struct {
-			Products []struct {
-				CommissionAmount     float64     `json:"commission_amount"`
-				CommissionPercent    int         `json:"commission_percent"`
-				Payout               float64     `json:"payout"`
-				ProductId            int         `json:"product_id"`
-				CurrencyCode         string      `json:"currency_code"`
-				OldPrice             int         `json:"old_price"`
-				Price                int         `json:"price"`
-				TotalDiscountValue   int         `json:"total_discount_value"`
-				TotalDiscountPercent float64     `json:"total_discount_percent"`
-				Actions              []string    `json:"actions"`
-				Picking              interface{} `json:"picking"`
-				Quantity             int         `json:"quantity"`
-				ClientPrice          string      `json:"client_price"`
-				ItemServices         struct {
-					MarketplaceServiceItemFulfillment                float64 `json:"marketplace_service_item_fulfillment"`
-					MarketplaceServiceItemPickup                     int     `json:"marketplace_service_item_pickup"`
-					MarketplaceServiceItemDropoffPvz                 int     `json:"marketplace_service_item_dropoff_pvz"`
-					MarketplaceServiceItemDropoffSc                  int     `json:"marketplace_service_item_dropoff_sc"`
-					MarketplaceServiceItemDropoffFf                  int     `json:"marketplace_service_item_dropoff_ff"`
-					MarketplaceServiceItemDirectFlowTrans            int     `json:"marketplace_service_item_direct_flow_trans"`
-					MarketplaceServiceItemReturnFlowTrans            int     `json:"marketplace_service_item_return_flow_trans"`
-					MarketplaceServiceItemDelivToCustomer            int     `json:"marketplace_service_item_deliv_to_customer"`
-					MarketplaceServiceItemReturnNotDelivToCustomer   int     `json:"marketplace_service_item_return_not_deliv_to_customer"`
-					MarketplaceServiceItemReturnPartGoodsCustomer    int     `json:"marketplace_service_item_return_part_goods_customer"`
-					MarketplaceServiceItemReturnAfterDelivToCustomer int     `json:"marketplace_service_item_return_after_deliv_to_customer"`
-				} `json:"item_services"`
-			} `json:"products"`
-			PostingServices struct {
-				MarketplaceServiceItemFulfillment                int `json:"marketplace_service_item_fulfillment"`
-				MarketplaceServiceItemPickup                     int `json:"marketplace_service_item_pickup"`
-				MarketplaceServiceItemDropoffPvz                 int `json:"marketplace_service_item_dropoff_pvz"`
-				MarketplaceServiceItemDropoffSc                  int `json:"marketplace_service_item_dropoff_sc"`
-				MarketplaceServiceItemDropoffFf                  int `json:"marketplace_service_item_dropoff_ff"`
-				MarketplaceServiceItemDirectFlowTrans            int `json:"marketplace_service_item_direct_flow_trans"`
-				MarketplaceServiceItemReturnFlowTrans            int `json:"marketplace_service_item_return_flow_trans"`
-				MarketplaceServiceItemDelivToCustomer            int `json:"marketplace_service_item_deliv_to_customer"`
-				MarketplaceServiceItemReturnNotDelivToCustomer   int `json:"marketplace_service_item_return_not_deliv_to_customer"`
-				MarketplaceServiceItemReturnPartGoodsCustomer    int `json:"marketplace_service_item_return_part_goods_customer"`
-				MarketplaceServiceItemReturnAfterDelivToCustomer int `json:"marketplace_service_item_return_after_deliv_to_customer"`
-			} `json:"posting_services"`
-		} `json:"financial_data"`
-		AdditionalData []interface{} `json:"additional_data"`
-	} `json:"result"`
+	Result []PostingFBO `json:"result"`
+}
+type PostingFBO struct {
+	OrderId        int               `json:"order_id"`
+	OrderNumber    string            `json:"order_number"`
+	PostingNumber  string            `json:"posting_number"`
+	Status         string            `json:"status"`
+	CancelReasonId int               `json:"cancel_reason_id"`
+	CreatedAt      time.Time         `json:"created_at"`
+	InProcessAt    time.Time         `json:"in_process_at"`
+	Products       []PostingProduct  `json:"products"`
+	AnalyticsData  AnalyticsDataFBO  `json:"analytics_data"`
+	FinancialData  PostingFinancials `json:"financial_data"`
+	AdditionalData []interface{}     `json:"additional_data"`
+}
+type PostingProduct struct {
+	Sku          int           `json:"sku"`
+	Name         string        `json:"name"`
+	Quantity     int           `json:"quantity"`
+	OfferId      string        `json:"offer_id"`
+	Price        string        `json:"price"`
+	DigitalCodes []interface{} `json:"digital_codes"`
+	CurrencyCode string        `json:"currency_code"`
+}
+type AnalyticsDataFBO struct {
+	Region               string `json:"region"`
+	City                 string `json:"city"`
+	DeliveryType         string `json:"delivery_type"`
+	IsPremium            bool   `json:"is_premium"`
+	PaymentTypeGroupName string `json:"payment_type_group_name"`
+	WarehouseId          int64  `json:"warehouse_id"`
+	WarehouseName        string `json:"warehouse_name"`
+	IsLegal              bool   `json:"is_legal"`
+}
+type PostingFinancials struct {
+	Products        []FinancialDataProduct `json:"products"`
+	PostingServices ItemServices           `json:"posting_services"`
+}
+type FinancialDataProduct struct {
+	CommissionAmount     float64      `json:"commission_amount"`
+	CommissionPercent    float64      `json:"commission_percent"`
+	Payout               float64      `json:"payout"`
+	ProductId            int          `json:"product_id"`
+	CurrencyCode         string       `json:"currency_code"`
+	OldPrice             float64      `json:"old_price"`
+	Price                float64      `json:"price"`
+	TotalDiscountValue   float64      `json:"total_discount_value"`
+	TotalDiscountPercent float64      `json:"total_discount_percent"`
+	Actions              []string     `json:"actions"`
+	Picking              interface{}  `json:"picking"`
+	Quantity             int          `json:"quantity"`
+	ClientPrice          string       `json:"client_price"`
+	ItemServices         ItemServices `json:"item_services"`
+}
+
+// ItemServices Стоимость услуг Ozon, списания приходят отрицательными числами
+type ItemServices struct {
+	MarketplaceServiceItemFulfillment                float64 `json:"marketplace_service_item_fulfillment"`
+	MarketplaceServiceItemPickup                     float64 `json:"marketplace_service_item_pickup"`
+	MarketplaceServiceItemDropoffPvz                 float64 `json:"marketplace_service_item_dropoff_pvz"`
+	MarketplaceServiceItemDropoffSc                  float64 `json:"marketplace_service_item_dropoff_sc"`
+	MarketplaceServiceItemDropoffFf                  float64 `json:"marketplace_service_item_dropoff_ff"`
+	MarketplaceServiceItemDirectFlowTrans            float64 `json:"marketplace_service_item_direct_flow_trans"`
+	MarketplaceServiceItemReturnFlowTrans            float64 `json:"marketplace_service_item_return_flow_trans"`
+	MarketplaceServiceItemDelivToCustomer            float64 `json:"marketplace_service_item_deliv_to_customer"`
+	MarketplaceServiceItemReturnNotDelivToCustomer   float64 `json:"marketplace_service_item_return_not_deliv_to_customer"`
+	MarketplaceServiceItemReturnPartGoodsCustomer    float64 `json:"marketplace_service_item_return_part_goods_customer"`
+	MarketplaceServiceItemReturnAfterDelivToCustomer float64 `json:"marketplace_service_item_return_after_deliv_to_customer"`
+}
+
+// productOf Финансовые данные i-го товара отправления. Ozon сопоставляет их только по product_id = sku:
+// если sku встречается в отправлении несколько раз, k-й товар получает k-ю запись с этим sku.
+// Без подходящей записи финансовых данных нет, и выплата считается по % сборов.
+func (f PostingFinancials) productOf(products []PostingProduct, i int) (FinancialDataProduct, bool) {
+	sku := products[i].Sku
+	occurrence := 0
+	for _, p := range products[:i] {
+		if p.Sku == sku {
+			occurrence++
+		}
+	}
+	for _, p := range f.Products {
+		if p.ProductId != sku {
+			continue
+		}
+		if occurrence == 0 {
+			return p, true
+		}
+		occurrence--
+	}
+	return FinancialDataProduct{}, false
 }
 
 //purchase price
@@ -136,16 +159,31 @@ type GroupProducts struct {
 type ProductSetting struct {
 	Cost          float64         `bson:"cost"`
 	GroupProducts []GroupProducts `bson:"group_products"`
+	// GroupRules Правила объединения товаров в группы, см. GroupRule
+	GroupRules []GroupRule `bson:"group_rules"`
+	// GroupRulesMigrated Прежние группы переведены в правила, см. migrateGroupRules
+	GroupRulesMigrated bool `bson:"group_rules_migrated"`
 }
 
 type OzonSetting struct {
 	ClientId       string         `bson:"client_id"`
 	Token          string         `bson:"token"`
 	ProductSetting ProductSetting `bson:"product_setting"`
+	// Schemes Схемы работы, включаемые в отчеты, пусто - все
+	Schemes []DeliveryScheme `bson:"schemes"`
+	// StockAlertDays Порог запаса в днях продаж для уведомлений о заканчивающихся товарах, 0 - по умолчанию
+	StockAlertDays float64 `bson:"stock_alert_days"`
 }
 
 type Settings struct {
-	OzonSetting OzonSetting `bson:"ozon_setting"`
+	OzonSetting         OzonSetting         `bson:"ozon_setting"`
+	WildberriesSetting  WildberriesSetting  `bson:"wildberries_setting"`
+	YandexMarketSetting YandexMarketSetting `bson:"yandex_market_setting"`
+	// Accounts Кабинеты всех маркетплейсов, см. accounts. Ключи в настройках маркетплейсов - кабинет,
+	// сохраненный до появления нескольких кабинетов.
+	Accounts []MarketplaceAccount `bson:"accounts"`
+	// Timezone Часовой пояс IANA для границ дней отчетов и расписания рассылок, пусто - defaultTimezone
+	Timezone string `bson:"timezone"`
 }
 type TelegramUser struct {
 	NameBot  string          `bson:"name_bot"`
@@ -191,6 +229,9 @@ const (
 	GenReportToday
 	GenReportYesterday
 	GenReportArbitraryDate
+	GenReportTrend
+	GenReportFinance
+	GenReportReturns
 )
 
 func (c CommandBot) String() string {
@@ -199,85 +240,212 @@ func (c CommandBot) String() string {
 		"Сформировать отчет за сегодня",
 		"Сформировать отчет за вчера",
 		"Сформировать отчет за произвольную дату",
+		"Динамика продаж",
+		"Финансы",
+		"Возвраты",
 	}[c]
 }
 
-type СonsolidatedReportFBO struct {
-	TotalCount                        int
-	CancelledTotalCount               int
-	SumCount                          decimal.Decimal
-	SumWithoutCommission              decimal.Decimal
-	SumWithoutCommissionPurchasePrice decimal.Decimal
-	products                          map[string]int
-	CancelledProducts                 map[string]int
-}
-
 type SendMessageBot interface {
-	sendMessage(body interface{}) bool
+	sendMessage(body telegram.SendMessageBody) (*telegram.Message, error)
 }
 
 type AnswerCallbackQueryBot interface {
-	answerCallbackQuery(body interface{}) bool
+	answerCallbackQuery(body telegram.AnswerCallbackQueryRequestBody) error
 }
 
 type EditMessageTextBot interface {
-	editMessageText(body interface{}) bool
+	editMessageText(body telegram.EditMessageTextRequestBody) (*telegram.Message, error)
+}
+
+type SendDocumentBot interface {
+	sendDocument(body telegram.SendDocumentRequestBody) (*telegram.Message, error)
+}
+
+type SendPhotoBot interface {
+	sendPhoto(body telegram.SendPhotoRequestBody) (*telegram.Message, error)
 }
 
 type DeleteMessageBot interface {
-	deleteMessage(body interface{}) bool
+	deleteMessage(body telegram.DeleteMessageRequestBody) error
+}
+
+// SendMessageToBot Ответ пользователю. Если запущена очередь отправки, сообщение отправляется через нее
+func SendMessageToBot(bot SendMessageBot, body telegram.SendMessageBody) {
+	if outbox != nil {
+		err := outbox.enqueue(PriorityInteractive, body)
+		if err == nil {
+			return
+		}
+		log.Printf("Не удалось поставить сообщение в очередь: %v", err)
+	}
+	if _, err := bot.sendMessage(body); err != nil {
+		log.Printf("Не удалось отправить сообщение: %v", err)
+	}
 }
 
-func SendMessageToBot(bot SendMessageBot, body interface{}) {
-	bot.sendMessage(body)
+// SendLongMessageToBot Отправка HTML текста длиннее лимита Telegram несколькими сообщениями,
+// клавиатура прикрепляется только к последнему из них
+func SendLongMessageToBot[T telegram.InlineKeyboardMarkup | telegram.ReplyKeyboardMarkup](bot SendMessageBot, body telegram.SendMessageRequestBody[T, int64]) {
+	chunks := telegram.SplitHTML(body.Text, telegram.MessageTextLimit)
+	parts := make([]telegram.SendMessageBody, 0, len(chunks))
+	for i, chunk := range chunks {
+		part := body
+		part.Text = chunk
+		if i < len(chunks)-1 {
+			var withoutMarkup T
+			part.ReplyMarkup = withoutMarkup
+		}
+		parts = append(parts, part)
+	}
+	if outbox != nil {
+		err := outbox.enqueueParts(PriorityInteractive, parts)
+		if err == nil {
+			return
+		}
+		log.Printf("Не удалось поставить сообщение в очередь: %v", err)
+	}
+	for _, part := range parts {
+		if _, err := bot.sendMessage(part); err != nil {
+			log.Printf("Не удалось отправить сообщение: %v", err)
+			return
+		}
+	}
+}
+
+// BroadcastMessageToBot Рассылка (отчеты по расписанию, уведомления), отправляется после ответов пользователям
+func BroadcastMessageToBot(body telegram.SendMessageBody) error {
+	if outbox == nil {
+		_, err := telegramClient.SendMessage(context.TODO(), body)
+		return err
+	}
+	return outbox.enqueue(PriorityBroadcast, body)
+}
+
+// broadcastPartsToBot Рассылка частей одного длинного текста
+func broadcastPartsToBot(parts []telegram.SendMessageBody) error {
+	if outbox == nil {
+		for _, part := range parts {
+			if _, err := telegramClient.SendMessage(context.TODO(), part); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return outbox.enqueueParts(PriorityBroadcast, parts)
+}
+
+// BroadcastToChats Рассылка HTML текста во все чаты пользователя, длинный текст делится на несколько сообщений
+func BroadcastToChats(chats []telegram.Chat, text string) {
+	chunks := telegram.SplitHTML(text, telegram.MessageTextLimit)
+	for _, chat := range chats {
+		parts := make([]telegram.SendMessageBody, 0, len(chunks))
+		for _, chunk := range chunks {
+			parts = append(parts, telegram.SendMessageRequestBody[telegram.InlineKeyboardMarkup, int64]{
+				ChatId:    chat.Id,
+				ParseMode: format.HTML.ParseMode(),
+				Text:      chunk,
+			})
+		}
+		if err := broadcastPartsToBot(parts); err != nil {
+			log.Printf("Не удалось поставить рассылку в чат %d в очередь: %v", chat.Id, err)
+		}
+	}
 }
 
 // answerCallbackQueryToBot Реакция на нажатие кнопки под сообщение
-func answerCallbackQueryToBot(bot AnswerCallbackQueryBot, body interface{}) {
-	bot.answerCallbackQuery(body)
+func answerCallbackQueryToBot(bot AnswerCallbackQueryBot, body telegram.AnswerCallbackQueryRequestBody) {
+	if err := bot.answerCallbackQuery(body); err != nil {
+		log.Printf("Не удалось ответить на нажатие кнопки: %v", err)
+	}
 }
 
-func DeleteMessageToBot(bot DeleteMessageBot, body interface{}) {
-	bot.deleteMessage(body)
+// SendDocumentToBot Отправка файла пользователю, минуя очередь сообщений
+func SendDocumentToBot(bot SendDocumentBot, body telegram.SendDocumentRequestBody) error {
+	_, err := bot.sendDocument(body)
+	if err != nil {
+		log.Printf("Не удалось отправить файл %s: %v", body.Document.Name, err)
+	}
+	return err
 }
 
-func EditMessageTextToBot(bot EditMessageTextBot, body interface{}) {
-	bot.editMessageText(body)
+// SendPhotoToBot Отправка изображения пользователю, минуя очередь сообщений
+func SendPhotoToBot(bot SendPhotoBot, body telegram.SendPhotoRequestBody) error {
+	_, err := bot.sendPhoto(body)
+	if err != nil {
+		log.Printf("Не удалось отправить изображение %s: %v", body.Photo.Name, err)
+	}
+	return err
 }
 
-type TelegramBot struct{}
+func DeleteMessageToBot(bot DeleteMessageBot, body telegram.DeleteMessageRequestBody) {
+	if err := bot.deleteMessage(body); err != nil {
+		log.Printf("Не удалось удалить сообщение: %v", err)
+	}
+}
 
-type ReportMarketplace interface {
-	orderSummaryReport(userId int64, filter FilterFbo) СonsolidatedReportFBO
+func EditMessageTextToBot(bot EditMessageTextBot, body telegram.EditMessageTextRequestBody) {
+	if _, err := bot.editMessageText(body); err != nil {
+		log.Printf("Не удалось изменить сообщение: %v", err)
+	}
 }
 
+// TelegramBot Методы бота поверх общего клиента Bot API telegramClient
+type TelegramBot struct{}
+
 type UserRepository interface {
 	getOzonSetting(id int64) (*OzonSetting, error)
 }
-type Marketplace interface {
-	ReportMarketplace
+
+// ExportMarketplace Выгрузка отправлений маркетплейса для отчетов в файлах
+type ExportMarketplace interface {
+	postings(userId int64, filter FilterFbo, with WithFbo) (*ListResponseFBO, error)
 }
 
-type OzonMarketplace struct{}
+// OzonMarketplace Отчеты по кабинету Account, без кабинета - по основному кабинету OZON
+type OzonMarketplace struct {
+	Account *MarketplaceAccount
+}
+
+func (m *OzonMarketplace) name() Marketplace {
+	return MarketplaceOzon
+}
 
-type DataCash struct {
-	LastCommand string
+// reportAccount Кабинет отчета: заданный или основной из настроек s
+func (m *OzonMarketplace) reportAccount(s Settings) (MarketplaceAccount, bool) {
+	if m.Account != nil {
+		return *m.Account, true
+	}
+	return s.defaultAccount(MarketplaceOzon)
 }
 
-var Cash map[int64]DataCash
+func (m *OzonMarketplace) accountName() string {
+	if m.Account == nil {
+		return ""
+	}
+	return m.Account.Name
+}
 
 func main() {
-	Cash = make(map[int64]DataCash)
-	//TelegramBot =
 	urlOzon = os.Getenv("URL_OZON")
 	if urlOzon == "" {
 		urlOzon = "https://api-seller.ozon.ru"
 		log.Printf("Defaulting to ury %s", urlOzon)
 	}
 
+	urlWildberriesStatistics = os.Getenv("URL_WB_STATISTICS")
+	if urlWildberriesStatistics == "" {
+		urlWildberriesStatistics = "https://statistics-api.wildberries.ru"
+	}
+
+	urlYandexMarket = os.Getenv("URL_YANDEX_MARKET")
+	if urlYandexMarket == "" {
+		urlYandexMarket = "https://api.partner.market.yandex.ru"
+	}
+
 	urlTelegramBot = os.Getenv("URL_TELEGRAM_BOT")
 	if urlTelegramBot == "" {
-		urlTelegramBot = "https://api.telegram.org/bot"
+		urlTelegramBot = telegram.DefaultBaseURL
 		log.Printf("Defaulting to ury %s", urlTelegramBot)
 	}
 
@@ -285,6 +453,29 @@ func main() {
 	if tokenTelegramBot == "" {
 		log.Panic("Token telegram бота не обнаружен")
 	}
+	telegramClient = telegram.NewClient(urlTelegramBot, tokenTelegramBot, &http.Client{})
+
+	botUsername = os.Getenv("BOT_USERNAME")
+	if botUsername == "" {
+		log.Printf("BOT_USERNAME не задан, приглашения в магазин будут отправляться командой /start")
+	}
+
+	updateMode = os.Getenv("UPDATE_MODE")
+	if updateMode == "" {
+		updateMode = UpdateModeWebhook
+		log.Printf("Defaulting to update mode %s", updateMode)
+	}
+	if updateMode != UpdateModeWebhook && updateMode != UpdateModePolling {
+		log.Panicf("Неизвестный режим получения обновлений %s", updateMode)
+	}
+
+	urlWebhook = os.Getenv("URL_WEBHOOK")
+
+	secretTokenWebhook = os.Getenv("SECRET_TOKEN_WEBHOOK")
+	if updateMode == UpdateModeWebhook && secretTokenWebhook == "" {
+		// Общий секрет нужен всем репликам и webhook, зарегистрированному вне бота
+		log.Panic("SECRET_TOKEN_WEBHOOK не задан, в режиме webhook он обязателен")
+	}
 
 	mongodbUry := os.Getenv("MONGODB_URY")
 	if mongodbUry == "" {
@@ -292,6 +483,27 @@ func main() {
 		log.Printf("Defaulting to ury %s", mongodbUry)
 	}
 	clientMongo = connectMongoDB(mongodbUry)
+	if err := (ConversationDB{}).createIndexes(); err != nil {
+		log.Printf("Не удалось создать индексы диалогов: %v", err)
+	}
+	if err := (FinanceLedgerDB{}).createIndexes(); err != nil {
+		log.Printf("Не удалось создать индексы журнала операций: %v", err)
+	}
+	if err := (FinanceLedgerDB{}).removeUnkeyed(); err != nil {
+		log.Printf("Не удалось удалить операции без кабинета: %v", err)
+	}
+	if err := (ReturnsDB{}).createIndexes(); err != nil {
+		log.Printf("Не удалось создать индексы возвратов: %v", err)
+	}
+	if err := (ReturnsDB{}).removeUnkeyed(); err != nil {
+		log.Printf("Не удалось удалить возвраты без кабинета: %v", err)
+	}
+	if err := (StoreDB{}).createIndexes(); err != nil {
+		log.Printf("Не удалось создать индексы магазинов: %v", err)
+	}
+	if err := (UserDB{}).migrateGroupRules(); err != nil {
+		log.Printf("Не удалось перевести группы товаров в правила: %v", err)
+	}
 
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -316,7 +528,49 @@ func main() {
 	query, playground := gqlgen.GraphQLPlaygroundHandler(routeGQR)
 	app.Get("/playground", adaptor.HTTPHandlerFunc(playground))
 	app.Post("/query", adaptor.HTTPHandler(query))
-	app.Listen(":" + port)
+	app.Post("/webhooks", verifySecretToken, adaptor.HTTPHandlerFunc(webHooks))
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go func() {
+		if err := app.Listen(":" + port); err != nil {
+			log.Panic(err)
+		}
+	}()
+
+	outboxDone := startOutbox(ctx)
+	stockDone := startStockMonitor(ctx)
+	digestsDone := startDigests(ctx)
+	returnsDone := startReturnsSync(ctx)
+	financeDone := startFinanceSync(ctx)
+
+	bot := TelegramBot{}
+	polling := make(chan struct{})
+	if updateMode == UpdateModePolling {
+		go func() {
+			defer close(polling)
+			runPolling(ctx, &bot)
+		}()
+	} else {
+		registerWebhook(&bot)
+		close(polling)
+	}
+
+	<-ctx.Done()
+	log.Printf("Остановка бота")
+	<-polling
+	if err := app.Shutdown(); err != nil {
+		log.Println(err)
+	}
+	<-stockDone
+	<-digestsDone
+	<-returnsDone
+	<-financeDone
+	<-outboxDone
+	if err := clientMongo.Disconnect(context.TODO()); err != nil {
+		log.Println(err)
+	}
 
 	//router := mux.NewRouter()
 	//router.HandleFunc("/webhooks", webHooks)
@@ -337,6 +591,32 @@ func connectMongoDB(applyUrI string) *mongo.Client {
 	return client
 }
 
+// registerWebhook Регистрация webhook в Telegram, если задан URL_WEBHOOK
+func registerWebhook(bot *TelegramBot) {
+	if urlWebhook == "" {
+		log.Printf("URL_WEBHOOK не задан, регистрация webhook пропущена")
+		return
+	}
+	err := bot.setWebhook(telegram.SetWebhookRequestBody{
+		Url:         urlWebhook,
+		SecretToken: secretTokenWebhook,
+	})
+	if err != nil {
+		log.Panicf("Не удалось зарегистрировать webhook %s: %v", urlWebhook, err)
+	}
+	log.Printf("Webhook зарегистрирован %s", urlWebhook)
+}
+
+// verifySecretToken Отклоняет запросы на webhook, не содержащие secret_token, указанный при регистрации
+func verifySecretToken(c *fiber.Ctx) error {
+	token := c.Get(telegram.SecretTokenHeader)
+	if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(secretTokenWebhook)) != 1 {
+		log.Printf("Отклонен запрос на webhook с неверным secret token от %s", c.IP())
+		return c.SendStatus(fiber.StatusUnauthorized)
+	}
+	return c.Next()
+}
+
 func indexHandler(w http.ResponseWriter, r *http.Request) {
 	if r.URL.Path != "/" {
 		http.NotFound(w, r)
@@ -351,394 +631,99 @@ func indexHandler(w http.ResponseWriter, r *http.Request) {
 
 func webHooks(w http.ResponseWriter, r *http.Request) {
 	var m telegram.Update
-	json.NewDecoder(r.Body).Decode(&m)
-	var buf bytes.Buffer
-	enc := json.NewEncoder(&buf)
-	enc.Encode(&m.Message.Text)
-	mes := &m.Message
-	bot := TelegramBot{}
-	if Cash[m.Message.From.Id+m.Message.Chat.Id].LastCommand == "/setclientidozonsetting" {
-		Cash[m.Message.From.Id+m.Message.Chat.Id] = DataCash{LastCommand: ""}
-		coll := clientMongo.Database("MyInfantBotDB").Collection("bot_users")
-		update := bson.D{{"$set", bson.D{{"telegram_user.settings.ozon_setting.client_id", m.Message.Text}}}}
-		filter := bson.D{{"telegram_user.user.id", mes.From.Id}}
-		opts := options.Update().SetUpsert(true)
-		_, err := coll.UpdateOne(context.TODO(), filter, update, opts)
-		if err != nil {
-			panic(err)
-		} else {
-			smm := telegram.SendMessageRequestBody[telegram.InlineKeyboardMarkup, int64]{
-				ChatId: m.Message.Chat.Id,
-				Text:   "ClientId успешно сохранен.",
-				ReplyMarkup: telegram.InlineKeyboardMarkup{
-					InlineKeyboard: CreateButtonsBot[telegram.InlineKeyboardButton]([]telegram.ButtonBot[telegram.InlineKeyboardButton]{
-						{Row: 1, Col: 1, Button: telegram.InlineKeyboardButton{Text: "ClientId", CallbackData: "/setclientidozonsetting"}},
-						{Row: 1, Col: 2, Button: telegram.InlineKeyboardButton{Text: "Token", CallbackData: "/settokenozonsetting"}},
-						{Row: 2, Col: 1, Button: telegram.InlineKeyboardButton{Text: "Назад", CallbackData: "/backsettings"}},
-					})},
-			}
-			SendMessageToBot(&bot, smm)
-		}
+	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+		log.Printf("Не удалось разобрать обновление: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
 	}
-	if Cash[m.Message.From.Id+m.Message.Chat.Id].LastCommand == "/settokenozonsetting" {
-		Cash[m.Message.From.Id+m.Message.Chat.Id] = DataCash{LastCommand: ""}
-		coll := clientMongo.Database("MyInfantBotDB").Collection("bot_users")
-		update := bson.D{{"$set", bson.D{{"telegram_user.settings.ozon_setting.token", m.Message.Text}}}}
-		filter := bson.D{{"telegram_user.user.id", mes.From.Id}}
-		opts := options.Update().SetUpsert(true)
-		_, err := coll.UpdateOne(context.TODO(), filter, update, opts)
-		if err != nil {
-			panic(err)
-		} else {
-			sm := TelegramBot{}
-			smm := telegram.SendMessageRequestBody[telegram.InlineKeyboardMarkup, int64]{
-				ChatId: m.Message.Chat.Id,
-				Text:   "Token успешно сохранен.",
-				ReplyMarkup: telegram.InlineKeyboardMarkup{CreateButtonsBot[telegram.InlineKeyboardButton]([]telegram.ButtonBot[telegram.InlineKeyboardButton]{
-					{Row: 1, Col: 1, Button: telegram.InlineKeyboardButton{Text: "ClientId", CallbackData: "/setclientidozonsetting"}},
-					{Row: 1, Col: 2, Button: telegram.InlineKeyboardButton{Text: "Token", CallbackData: "/settokenozonsetting"}},
-					{Row: 2, Col: 1, Button: telegram.InlineKeyboardButton{Text: "Назад", CallbackData: "/backsettings"}},
-				})},
-			}
-			SendMessageToBot(&sm, smm)
-		}
+	handleUpdate(m)
+	_, err := fmt.Fprint(w, "Hello, World!11111")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
 	}
-	if Cash[m.Message.From.Id+m.Message.Chat.Id].LastCommand == "/setcostozon" {
-		Cash[m.Message.From.Id+m.Message.Chat.Id] = DataCash{LastCommand: ""}
-		cost, err := strconv.ParseFloat(m.Message.Text, 64)
-		if err != nil {
-			//panic(err)
-			//TODO отправить сообщение об ошибки боту
-		}
-		coll := clientMongo.Database("MyInfantBotDB").Collection("bot_users")
-		update := bson.D{{"$set", bson.D{{"telegram_user.settings.ozon_setting.product_setting.cost", cost}}}}
-		filter := bson.D{{"telegram_user.user.id", mes.From.Id}}
-		opts := options.Update().SetUpsert(true)
-		_, err = coll.UpdateOne(context.TODO(), filter, update, opts)
-		if err != nil {
-			panic(err)
-		} else {
-			sm := TelegramBot{}
-			smm := telegram.SendMessageRequestBody[telegram.InlineKeyboardMarkup, int64]{
-				ChatId: m.Message.Chat.Id,
-				Text:   "Token успешно сохранен.",
-				ReplyMarkup: telegram.InlineKeyboardMarkup{CreateButtonsBot[telegram.InlineKeyboardButton]([]telegram.ButtonBot[telegram.InlineKeyboardButton]{
-					{Row: 1, Col: 1, Button: telegram.InlineKeyboardButton{Text: "ClientId", CallbackData: "/setclientidozonsetting"}},
-					{Row: 1, Col: 2, Button: telegram.InlineKeyboardButton{Text: "Token", CallbackData: "/settokenozonsetting"}},
-					{Row: 2, Col: 1, Button: telegram.InlineKeyboardButton{Text: "Назад", CallbackData: "/backsettings"}},
-				})},
-			}
-			SendMessageToBot(&sm, smm)
-		}
+}
+
+// handleUpdate Обработка обновления Telegram, полученного через webhook или getUpdates
+func handleUpdate(m telegram.Update) {
+	botRouter.Dispatch(m)
+	log.Printf("Рассылка сообщения %v", m)
+}
+
+func printOrderSummaryReport(c OrderReport) string {
+	indent := format.Plain("    ")
+	itemIndent := format.Plain("        ")
+	name := string(c.Marketplace)
+	if name == "" {
+		name = string(MarketplaceOzon)
 	}
-	if strings.Contains(Cash[m.Message.From.Id+m.Message.Chat.Id].LastCommand, "/setpurchaseprice") {
-		productName := strings.Split(Cash[m.Message.From.Id+m.Message.Chat.Id].LastCommand, "-")[1]
-		Cash[m.Message.From.Id+m.Message.Chat.Id] = DataCash{LastCommand: ""}
-		cost, err := strconv.ParseFloat(m.Message.Text, 64)
-		if err != nil {
-			//panic(err)
-			//TODO отправить сообщение об ошибки боту
-		}
-		coll := clientMongo.Database("MyInfantBotDB").Collection("bot_users")
-		update := bson.D{{"$set", bson.D{{"telegram_user.settings.ozon_setting.product_setting.group_products.$[elem].purchase_price", cost}}}}
-		filter := bson.D{{"telegram_user.user.id", mes.From.Id}}
-		opts := options.Update().SetArrayFilters(options.ArrayFilters{
-			Filters: []interface{}{bson.D{
-				{"elem.name_group", productName},
-			}},
-		})
-		_, err = coll.UpdateOne(context.TODO(), filter, update, opts)
-		if err != nil {
-			panic(err)
+	marketplace := marketplaceTitle(c.Marketplace, c.Account)
+	for i, summary := range c.Schemes {
+		if i == 0 {
+			marketplace += " " + summary.Scheme.String()
 		} else {
-			sm := TelegramBot{}
-			smm := telegram.SendMessageRequestBody[telegram.InlineKeyboardMarkup, int64]{
-				ChatId: m.Message.Chat.Id,
-				Text:   "Token успешно сохранен.",
-				ReplyMarkup: telegram.InlineKeyboardMarkup{CreateButtonsBot[telegram.InlineKeyboardButton]([]telegram.ButtonBot[telegram.InlineKeyboardButton]{
-					{Row: 1, Col: 1, Button: telegram.InlineKeyboardButton{Text: "ClientId", CallbackData: "/setclientidozonsetting"}},
-					{Row: 1, Col: 2, Button: telegram.InlineKeyboardButton{Text: "Token", CallbackData: "/settokenozonsetting"}},
-					{Row: 2, Col: 1, Button: telegram.InlineKeyboardButton{Text: "Назад", CallbackData: "/backsettings"}},
-				})},
-			}
-			SendMessageToBot(&sm, smm)
+			marketplace += " + " + summary.Scheme.String()
 		}
 	}
-	if mes.Text == "/start" {
-		var user UserDB
-		coll := clientMongo.Database("MyInfantBotDB").Collection("bot_users")
-		filter := bson.D{{"telegram_user.user.id", mes.From.Id}}
-		err := coll.FindOne(context.TODO(), filter).Decode(&user)
-		if err != nil {
-			fmt.Println(err)
-		}
-		if user.Id.IsZero() {
-			userDB := UserDB{
-				Id: primitive.NewObjectID(),
-				TelegramUser: TelegramUser{
-					User:  m.Message.From,
-					Chats: []telegram.Chat{m.Message.Chat},
-				}}
-			_, err := coll.InsertOne(context.TODO(), userDB)
-			if err != nil {
-				panic(err)
-			}
-		} else {
-			if result := findIndex[telegram.Chat](user.TelegramUser.Chats, func(c telegram.Chat) bool {
-				if c.Id == m.Message.Chat.Id {
-					return true
-				}
-				return false
-			}); result < 0 {
-				user.TelegramUser.Chats = append(user.TelegramUser.Chats, m.Message.Chat)
-			}
-			update := bson.D{{"$set", user}}
-			opts := options.Update().SetUpsert(true)
-			ud, err := coll.UpdateByID(context.TODO(), user.Id, update, opts)
-			if err != nil {
-				panic(err)
-			}
-			fmt.Println(ud)
-		}
-		sm := TelegramBot{}
-		smm := telegram.SendMessageRequestBody[telegram.InlineKeyboardMarkup, int64]{
-			ChatId: m.Message.Chat.Id,
-			Text:   "Добро пожаловать! Чтобы использовать бота необходимо его настроить",
-			ReplyMarkup: telegram.InlineKeyboardMarkup{CreateButtonsBot[telegram.InlineKeyboardButton]([]telegram.ButtonBot[telegram.InlineKeyboardButton]{
-				{Row: 1, Col: 1, Button: telegram.InlineKeyboardButton{Text: "Перейти к настройкам?", CallbackData: "/settings"}},
-			})},
-		}
-		SendMessageToBot(&sm, smm)
-		return
-	}
-	if m.CallbackQuery.Data == "/settings" {
-		answerCallbackQueryToBot(&bot, telegram.AnswerCallbackQueryRequestBody{CallbackQueryId: m.CallbackQuery.Id})
-		smm := telegram.EditMessageTextRequestBody{
-			ChatId:    m.CallbackQuery.Message.Chat.Id,
-			MessageId: m.CallbackQuery.Message.MessageId,
-			Text:      "Выберите, пожалуйста маркетплейс который вы бы хотели настроить.",
-			ReplyMarkup: telegram.InlineKeyboardMarkup{CreateButtonsBot[telegram.InlineKeyboardButton]([]telegram.ButtonBot[telegram.InlineKeyboardButton]{
-				{Row: 1, Col: 1, Button: telegram.InlineKeyboardButton{Text: "OZON", CallbackData: "/ozonsetting"}},
-				{Row: 2, Col: 1, Button: telegram.InlineKeyboardButton{Text: "Назад", CallbackData: "/backsettings"}},
-			})},
-		}
-		EditMessageTextToBot(&bot, smm)
-	}
-	if mes.Text == "/settings" {
-		smm := telegram.SendMessageRequestBody[telegram.InlineKeyboardMarkup, int64]{
-			ChatId: mes.Chat.Id,
-			Text:   "Выберите, пожалуйста маркетплейс который вы бы хотели настроить.",
-			ReplyMarkup: telegram.InlineKeyboardMarkup{CreateButtonsBot[telegram.InlineKeyboardButton]([]telegram.ButtonBot[telegram.InlineKeyboardButton]{
-				{Row: 1, Col: 1, Button: telegram.InlineKeyboardButton{Text: "OZON", CallbackData: "/ozonsetting"}},
-			})},
-		}
-		SendMessageToBot(&bot, smm)
-	}
-	if m.CallbackQuery.Data == "/ozonsetting" {
-		answerCallbackQueryToBot(&bot, telegram.AnswerCallbackQueryRequestBody{CallbackQueryId: m.CallbackQuery.Id})
-		sm := TelegramBot{}
-		smm := telegram.EditMessageTextRequestBody{
-			ChatId:    m.CallbackQuery.Message.Chat.Id,
-			MessageId: m.CallbackQuery.Message.MessageId,
-			Text:      "Для получения данных из OZON seller необходимо указать ClientId и Token. Их можно получить в личном кабинете продавца.",
-			ReplyMarkup: telegram.InlineKeyboardMarkup{CreateButtonsBot[telegram.InlineKeyboardButton]([]telegram.ButtonBot[telegram.InlineKeyboardButton]{
-				{Row: 1, Col: 1, Button: telegram.InlineKeyboardButton{Text: "ClientId", CallbackData: "/setclientidozonsetting"}},
-				{Row: 1, Col: 2, Button: telegram.InlineKeyboardButton{Text: "Token", CallbackData: "/settokenozonsetting"}},
-				{Row: 3, Col: 1, Button: telegram.InlineKeyboardButton{Text: "Настройка локального ценообразования", CallbackData: "/settinglocalpricing"}},
-				{Row: 4, Col: 1, Button: telegram.InlineKeyboardButton{Text: "Проверка подключения к Ozon Seller", CallbackData: "/testconnectozonseller"}},
-				{Row: 5, Col: 1, Button: telegram.InlineKeyboardButton{Text: "Назад", CallbackData: "/backsettings"}},
-			})},
-		}
-		EditMessageTextToBot(&sm, smm)
-	}
-	if m.CallbackQuery.Data == "/settinglocalpricing" {
-		answerCallbackQueryToBot(&bot, telegram.AnswerCallbackQueryRequestBody{CallbackQueryId: m.CallbackQuery.Id})
-		sm := TelegramBot{}
-		smm := telegram.EditMessageTextRequestBody{
-			ChatId:    m.CallbackQuery.Message.Chat.Id,
-			MessageId: m.CallbackQuery.Message.MessageId,
-			Text:      "Для получения данных из OZON seller необходимо указать ClientId и Token. Их можно получить в личном кабинете продавца.",
-			ReplyMarkup: telegram.InlineKeyboardMarkup{CreateButtonsBot[telegram.InlineKeyboardButton]([]telegram.ButtonBot[telegram.InlineKeyboardButton]{
-				{Row: 1, Col: 1, Button: telegram.InlineKeyboardButton{Text: "Внести % сборов OZON", CallbackData: "/setcostozon"}},
-				{Row: 2, Col: 1, Button: telegram.InlineKeyboardButton{Text: "Указать закупочную цену групп товаров", CallbackData: "/settingpurchaseprice"}},
-			})},
-		}
-		EditMessageTextToBot(&sm, smm)
-	}
-	if m.CallbackQuery.Data == "/settingpurchaseprice" {
-		answerCallbackQueryToBot(&bot, telegram.AnswerCallbackQueryRequestBody{CallbackQueryId: m.CallbackQuery.Id})
-		set, _ := UserDB{}.getOzonSetting(m.CallbackQuery.From.Id)
-		var buttons []telegram.ButtonBot[telegram.InlineKeyboardButton]
-		for i, gp := range set.ProductSetting.GroupProducts {
-			text := fmt.Sprintf("%s (Цена: %s)", gp.NameGroup, decimal.NewFromFloat(gp.PurchasePrice).StringFixed(2))
-			buttons = append(buttons, telegram.ButtonBot[telegram.InlineKeyboardButton]{
-				Row:    i + 1,
-				Col:    1,
-				Button: telegram.InlineKeyboardButton{Text: text, CallbackData: "/setpurchaseprice-" + gp.NameGroup},
-			})
-		}
-
-		sm := TelegramBot{}
-		smm := telegram.EditMessageTextRequestBody{
-			ChatId:      m.CallbackQuery.Message.Chat.Id,
-			MessageId:   m.CallbackQuery.Message.MessageId,
-			Text:        "Для получения данных из OZON seller необходимо указать ClientId и Token. Их можно получить в личном кабинете продавца.",
-			ReplyMarkup: telegram.InlineKeyboardMarkup{CreateButtonsBot[telegram.InlineKeyboardButton](buttons)},
-		}
-		EditMessageTextToBot(&sm, smm)
-	}
-	if strings.Contains(m.CallbackQuery.Data, "/setpurchaseprice") {
-		answerCallbackQueryToBot(&bot, telegram.AnswerCallbackQueryRequestBody{CallbackQueryId: m.CallbackQuery.Id})
-		Cash[m.CallbackQuery.From.Id+m.CallbackQuery.Message.Chat.Id] = DataCash{LastCommand: m.CallbackQuery.Data}
-		sm := TelegramBot{}
-		smm := telegram.SendMessageRequestBody[telegram.InlineKeyboardMarkup, int64]{
-			ChatId: m.CallbackQuery.Message.Chat.Id,
-			Text:   "ОК. Пришлите, пожалуйста себистоимость товара.",
-		}
-		SendMessageToBot(&sm, smm)
-	}
-	if m.CallbackQuery.Data == "/setcostozon" {
-		answerCallbackQueryToBot(&bot, telegram.AnswerCallbackQueryRequestBody{CallbackQueryId: m.CallbackQuery.Id})
-		Cash[m.CallbackQuery.From.Id+m.CallbackQuery.Message.Chat.Id] = DataCash{LastCommand: "/setcostozon"}
-		sm := TelegramBot{}
-		smm := telegram.SendMessageRequestBody[telegram.InlineKeyboardMarkup, int64]{
-			ChatId: m.CallbackQuery.Message.Chat.Id,
-			Text:   "ОК. Пришлите, пожалуйста % расходом на услуги OZON.",
-		}
-		SendMessageToBot(&sm, smm)
-	}
-	if m.CallbackQuery.Data == "/settokenozonsetting" {
-		answerCallbackQueryToBot(&bot, telegram.AnswerCallbackQueryRequestBody{CallbackQueryId: m.CallbackQuery.Id})
-		Cash[m.CallbackQuery.From.Id+m.CallbackQuery.Message.Chat.Id] = DataCash{LastCommand: "/settokenozonsetting"}
-		sm := TelegramBot{}
-		smm := telegram.SendMessageRequestBody[telegram.InlineKeyboardMarkup, int64]{
-			ChatId: m.CallbackQuery.Message.Chat.Id,
-			Text:   "ОК. Пришлите, пожалуйста Token для бота.",
-		}
-		SendMessageToBot(&sm, smm)
-	}
-	if m.CallbackQuery.Data == "/setclientidozonsetting" {
-		answerCallbackQueryToBot(&bot, telegram.AnswerCallbackQueryRequestBody{CallbackQueryId: m.CallbackQuery.Id})
-		Cash[m.CallbackQuery.From.Id+m.CallbackQuery.Message.Chat.Id] = DataCash{LastCommand: "/setclientidozonsetting"}
-		sm := TelegramBot{}
-		smm := telegram.SendMessageRequestBody[telegram.InlineKeyboardMarkup, int64]{
-			ChatId: m.CallbackQuery.Message.Chat.Id,
-			Text:   "ОК. Пришлите, пожалуйста ClientID для бота.",
-		}
-		SendMessageToBot(&sm, smm)
-	}
-	if m.CallbackQuery.Data == "/backsettings" {
-		answerCallbackQueryToBot(&bot, telegram.AnswerCallbackQueryRequestBody{CallbackQueryId: m.CallbackQuery.Id})
-		sm := TelegramBot{}
-		smm := telegram.EditMessageTextRequestBody{
-			ChatId:    m.CallbackQuery.Message.Chat.Id,
-			MessageId: m.CallbackQuery.Message.MessageId,
-			Text:      "Настроить бота?",
-			ReplyMarkup: telegram.InlineKeyboardMarkup{CreateButtonsBot[telegram.InlineKeyboardButton]([]telegram.ButtonBot[telegram.InlineKeyboardButton]{
-				{Row: 1, Col: 1, Button: telegram.InlineKeyboardButton{Text: "Да", CallbackData: "/settings"}},
-			})},
-		}
-		EditMessageTextToBot(&sm, smm)
+	mess := []format.Fragment{
+		format.Line(format.Bold(format.Plainf("Статистика продаж за день %s:", marketplace))),
+		format.Line(),
+		format.Line(indent, format.Bold(format.Plainf("Количество заказов: %d", c.TotalCount))),
+		format.Line(),
 	}
-	if m.CallbackQuery.Data == "/testconnectozonseller" {
-		var user UserDB
-		coll := clientMongo.Database("MyInfantBotDB").Collection("bot_users")
-		filter := bson.D{{"telegram_user.user.id", m.CallbackQuery.From.Id}}
-		err := coll.FindOne(context.TODO(), filter).Decode(&user)
-		if err != nil {
-			panic(err)
-		}
-		answerCallbackQueryToBot(&bot, telegram.AnswerCallbackQueryRequestBody{
-			CallbackQueryId: m.CallbackQuery.Id,
-			Text:            checkAuthOzonSeller(user.TelegramUser.Settings.OzonSetting.ClientId, user.TelegramUser.Settings.OzonSetting.Token),
-			ShowAlert:       false,
-		})
-		SendMessageToBot(&bot, telegram.SendMessageRequestBody[telegram.ReplyKeyboardMarkup, int64]{
-			ChatId: m.CallbackQuery.Message.Chat.Id,
-			Text:   "sdfsf",
-			ReplyMarkup: telegram.ReplyKeyboardMarkup{Keyboard: CreateButtonsBot[telegram.KeyboardButton]([]telegram.ButtonBot[telegram.KeyboardButton]{
-				{Row: 1, Col: 1, Button: telegram.KeyboardButton{Text: GenReportArbitraryDate.String(), WebApp: &telegram.WebAppInfo{
-					Url: "https://bot.my-infant.com/static/",
-				}}},
-				{Row: 2, Col: 1, Button: telegram.KeyboardButton{Text: GenReportToday.String()}},
-				{Row: 2, Col: 2, Button: telegram.KeyboardButton{Text: GenReportYesterday.String()}},
-			}),
-				ResizeKeyboard: true},
-		})
+	for value, key := range c.Products {
+		mess = append(mess, format.Line(itemIndent, format.Italic(format.Plain(value+": "), format.Bold(format.Plainf("%d", key)))))
 	}
-	if mes.Text == GenReportToday.String() {
-		var marketplace Marketplace = &OzonMarketplace{}
-		filter := FilterFbo{
-			Since:  time.Now().Truncate(24 * time.Hour).UTC().Add(-(4 * time.Hour)).Format(time.RFC3339),
-			Status: "",
-			To:     time.Now().Truncate(24 * time.Hour).UTC().Add(-(4 * time.Hour)).Add(24 * time.Hour).Format(time.RFC3339),
-		}
-
-		SendMessageToBot(&bot, telegram.SendMessageRequestBody[telegram.InlineKeyboardMarkup, int64]{
-			ChatId:    mes.Chat.Id,
-			ParseMode: "HTML", //TODO приминить паттерн стратегия
-			Text:      printOrderSummaryReport(marketplace.orderSummaryReport(m.Message.From.Id, filter)),
-		})
-	}
-	if mes.Text == GenReportYesterday.String() {
-		var marketplace Marketplace = &OzonMarketplace{}
-		filter := FilterFbo{
-			Since:  time.Now().Truncate(24 * time.Hour).UTC().Add(-(4 * time.Hour)).Add(-(24 * time.Hour)).Format(time.RFC3339),
-			Status: "",
-			To:     time.Now().Truncate(24 * time.Hour).UTC().Add(-(4 * time.Hour)).Add(24 * time.Hour).Add(-(24 * time.Hour)).Format(time.RFC3339),
+	mess = append(mess, format.Line())
+	if c.CancelledTotalCount > 0 {
+		mess = append(mess,
+			format.Line(indent, format.Bold(format.Plainf("Количество отмененных заказов: %d", c.CancelledTotalCount))),
+			format.Line(),
+		)
+		for value, key := range c.CancelledProducts {
+			mess = append(mess, format.Line(itemIndent, format.Italic(format.Plain(value+": "), format.Bold(format.Plainf("%d", key)))))
 		}
-		SendMessageToBot(&bot, telegram.SendMessageRequestBody[telegram.InlineKeyboardMarkup, int64]{
-			ChatId:    mes.Chat.Id,
-			ParseMode: "HTML", //TODO приминить паттерн стратегия
-			Text:      printOrderSummaryReport(marketplace.orderSummaryReport(m.Message.From.Id, filter)),
-		})
+		mess = append(mess, format.Line())
 	}
-	if mes.WebAppData.ButtonText == GenReportArbitraryDate.String() {
-		var marketplace Marketplace = &OzonMarketplace{}
-		data := strings.Split(mes.WebAppData.Data, "::")
-		from, _ := time.Parse("2006-01-02", data[0])
-		to, _ := time.Parse("2006-01-02", data[1])
-		filter := FilterFbo{
-			Since:  from.Truncate(24 * time.Hour).UTC().Add(-(4 * time.Hour)).Add(-(24 * time.Hour)).Format(time.RFC3339),
-			Status: "",
-			To:     to.Truncate(24 * time.Hour).UTC().Add(-(4 * time.Hour)).Add(24 * time.Hour).Add(-(24 * time.Hour)).Format(time.RFC3339),
+	if len(c.Schemes) > 1 {
+		mess = append(mess, format.Line(indent, format.Bold(format.Plain("По схемам работы:"))), format.Line())
+		for _, summary := range c.Schemes {
+			mess = append(mess, format.Line(itemIndent, format.Italic(format.Plain(summary.Scheme.String()+": "),
+				format.Bold(format.Plainf("%d шт. на %s", summary.TotalCount-summary.CancelledTotalCount, summary.SumCount.StringFixed(2))),
+				format.Plainf(", отменено %d", summary.CancelledTotalCount))))
 		}
-		SendMessageToBot(&bot, telegram.SendMessageRequestBody[telegram.InlineKeyboardMarkup, int64]{
-			ChatId:    mes.Chat.Id,
-			ParseMode: "HTML", //TODO приминить паттерн стратегия
-			Text:      printOrderSummaryReport(marketplace.orderSummaryReport(m.Message.From.Id, filter)),
-		})
+		mess = append(mess, format.Line())
 	}
-	log.Printf("Рассылка сообщения %v", m)
-	_, err := fmt.Fprint(w, "Hello, World!11111")
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+	mess = append(mess,
+		format.Line(format.Plain("------------------------------------------")),
+		format.Line(indent, format.Bold(format.Plainf("Итого количество: %d", c.TotalCount-c.CancelledTotalCount))),
+		format.Line(indent, format.Bold(format.Plainf("Итого сумма: %s", c.SumCount.StringFixed(2)))),
+		format.Line(indent, format.Plainf("Комиссия %s: %s", name, c.Payout.Commission.StringFixed(2))),
+	)
+	// Логистику и фулфилмент отдельно показывает только OZON, у остальных они входят в комиссию
+	if name == string(MarketplaceOzon) {
+		mess = append(mess,
+			format.Line(indent, format.Plainf("Логистика: %s", c.Payout.Logistics.StringFixed(2))),
+			format.Line(indent, format.Plainf("Фулфилмент: %s", c.Payout.Fulfillment.StringFixed(2))),
+		)
+	}
+	mess = append(mess,
+		format.Line(indent, format.Bold(format.Plainf("Итого к выплате %s: %s", name, c.SumWithoutCommission.StringFixed(2)))),
+	)
+	if c.ReturnedCount > 0 {
+		mess = append(mess, format.Line(indent, format.Plainf("Возвраты: %d шт., обратная логистика %s", c.ReturnedCount, c.ReturnLogistics.StringFixed(2))))
 	}
-}
-
-func printOrderSummaryReport(c СonsolidatedReportFBO) string {
-	mess := "<b>Статистика продаж за день OZON FBO:</b>\n\n"
-	mess += fmt.Sprintf("    <b>Количество заказов: %d</b> \n", c.TotalCount)
-	mess += "\n"
-	for value, key := range c.products {
-		mess += fmt.Sprintf("        <i>%s: <b>%d</b></i> \n", value, key)
+	mess = append(mess,
+		format.Line(indent, format.Bold(format.Plainf("Итого доход: %s", c.SumWithoutCommissionPurchasePrice.StringFixed(2)))),
+	)
+	if c.EstimatedCount > 0 {
+		mess = append(mess, format.Line(), format.Line(format.Italic(format.Plainf(
+			"Для %d шт. %s еще не рассчитал выплату, по ним использован %% сборов из настроек.", c.EstimatedCount, name))))
 	}
-	mess += "\n"
-	if c.CancelledTotalCount > 0 {
-		mess += fmt.Sprintf("    <b>Количество отмененных заказов: %d</b>\n", c.CancelledTotalCount)
-		mess += "\n"
-		for value, key := range c.CancelledProducts {
-			mess += fmt.Sprintf("        <i>%s: <b>%d</b></i> \n", value, key)
-		}
-		mess += "\n"
+	if c.Incomplete {
+		mess = append(mess, format.Line(), format.Line(format.Italic(format.Plainf(
+			"%s ответил ошибкой, загружены не все заказы: отчет неполный. Попробуйте запросить его позже.", name))))
 	}
-	mess += "------------------------------------------\n"
-	mess += fmt.Sprintf("    <b>Итого количество: %d</b>\n", c.TotalCount-c.CancelledTotalCount)
-	mess += fmt.Sprintf("    <b>Итого сумма: %s</b>\n", c.SumCount.StringFixed(2))
-	mess += fmt.Sprintf("    <b>Итого сумма без комиссии OZON: %s</b>\n", c.SumWithoutCommission.StringFixed(2))
-	mess += fmt.Sprintf("    <b>Итого доход: %s</b>\n",
-		c.SumWithoutCommissionPurchasePrice.StringFixed(2))
-	return mess
+	return format.Render(format.HTML, mess...)
 }
 
 func CreateButtonsBot[Q telegram.ButtonTelegrmBot](b []telegram.ButtonBot[Q]) [][]Q {
@@ -774,93 +759,45 @@ func CreateButtonsBot[Q telegram.ButtonTelegrmBot](b []telegram.ButtonBot[Q]) []
 	return matrix
 }
 
-func (t *TelegramBot) deleteMessage(body interface{}) bool {
-	client := &http.Client{}
-	requestBody, err := json.Marshal(&body)
-	if err != nil {
-		log.Fatalln(err)
-		return false
-	}
-	req, err := http.NewRequest(
-		"POST", urlTelegramBot+tokenTelegramBot+"/deleteMessage",
-		bytes.NewBuffer(requestBody),
-	)
-	req.Header.Set("content-type", "application/json")
-	resp, err := client.Do(req)
-	defer resp.Body.Close()
-	if err != nil {
-		fmt.Println(err)
-		return false
-	}
-	return true
+func (t *TelegramBot) deleteMessage(body telegram.DeleteMessageRequestBody) error {
+	return telegramClient.DeleteMessage(context.TODO(), body)
 }
 
-func (t *TelegramBot) editMessageText(body interface{}) bool {
-	client := &http.Client{}
-	command := "editMessageText"
-	if _, ok := body.(telegram.EditMessageReplyMarkupRequestBody); ok {
-		command = "editMessageReplyMarkup"
-	}
-	requestBody, err := json.Marshal(&body)
-	if err != nil {
-		log.Fatalln(err)
-		return false
-	}
-	req, err := http.NewRequest(
-		"POST", urlTelegramBot+tokenTelegramBot+"/"+command,
-		bytes.NewBuffer(requestBody),
-	)
-	req.Header.Set("content-type", "application/json")
-	resp, err := client.Do(req)
-	if err != nil {
-		fmt.Println(err)
-		return false
-	}
-	defer resp.Body.Close()
-	return true
+func (t *TelegramBot) editMessageText(body telegram.EditMessageTextRequestBody) (*telegram.Message, error) {
+	return telegramClient.EditMessageText(context.TODO(), body)
 }
 
-func (t *TelegramBot) sendMessage(body interface{}) bool {
-	client := &http.Client{}
-	requestBody, err := json.Marshal(&body)
-	if err != nil {
-		log.Fatalln(err)
-		return false
-	}
-	req, err := http.NewRequest(
-		"POST", urlTelegramBot+tokenTelegramBot+"/sendMessage",
-		bytes.NewBuffer(requestBody),
-	)
-	req.Header.Set("content-type", "application/json")
-	resp, err := client.Do(req)
-	if err != nil {
-		fmt.Println(err)
-		return false
-	}
-	defer resp.Body.Close()
-	return true
+func (t *TelegramBot) sendMessage(body telegram.SendMessageBody) (*telegram.Message, error) {
+	return telegramClient.SendMessage(context.TODO(), body)
 }
 
-func (t *TelegramBot) answerCallbackQuery(body interface{}) bool {
-	client := &http.Client{}
-	requestBody, err := json.Marshal(&body)
-	if err != nil {
-		log.Fatalln(err)
-		return false
-	}
-	req, err := http.NewRequest(
-		"POST", urlTelegramBot+tokenTelegramBot+"/answerCallbackQuery",
-		bytes.NewBuffer(requestBody),
-	)
-	req.Header.Set("content-type", "application/json")
-	resp, err := client.Do(req)
-	if err != nil {
-		fmt.Println(err)
-		return false
-	}
-	defer resp.Body.Close()
-	return true
+func (t *TelegramBot) sendDocument(body telegram.SendDocumentRequestBody) (*telegram.Message, error) {
+	return telegramClient.SendDocument(context.TODO(), body)
+}
+
+func (t *TelegramBot) sendPhoto(body telegram.SendPhotoRequestBody) (*telegram.Message, error) {
+	return telegramClient.SendPhoto(context.TODO(), body)
 }
+
+// setWebhook Регистрация адреса, на который Telegram будет присылать обновления
+func (t *TelegramBot) setWebhook(body telegram.SetWebhookRequestBody) error {
+	return telegramClient.SetWebhook(context.TODO(), body)
+}
+
+// deleteWebhook Отключение webhook, без этого getUpdates возвращает ошибку
+func (t *TelegramBot) deleteWebhook(body telegram.DeleteWebhookRequestBody) error {
+	return telegramClient.DeleteWebhook(context.TODO(), body)
+}
+
+// getUpdates Получение обновлений методом long polling
+func (t *TelegramBot) getUpdates(ctx context.Context, body telegram.GetUpdatesRequestBody) ([]telegram.Update, error) {
+	return telegramClient.GetUpdates(ctx, body)
+}
+
+func (t *TelegramBot) answerCallbackQuery(body telegram.AnswerCallbackQueryRequestBody) error {
+	return telegramClient.AnswerCallbackQuery(context.TODO(), body)
+}
+
 func checkAuthOzonSeller(clientId string, token string) string {
 	client := &http.Client{}
 	req, _ := http.NewRequest("GET", urlOzon+"/v1/actions", nil)
@@ -881,129 +818,70 @@ func (m UserDB) getOzonSetting(id int64) (*OzonSetting, error) {
 	return &m.TelegramUser.Settings.OzonSetting, err
 }
 
-func (m UserDB) setProductGroupSetting(userId int64, name string) {
-	var userDB UserDB
-	coll := clientMongo.Database("MyInfantBotDB").Collection("bot_users")
-	filter := bson.D{{"telegram_user.user.id", userId}}
-	err := coll.FindOne(context.TODO(), filter).Decode(&userDB)
-	if err != nil {
-		//TODO написать обработку ошибки
-	}
-
-	pl := userDB.TelegramUser.Settings.OzonSetting.ProductSetting.GroupProducts
-	isFindProduct := findIndex[GroupProducts](pl, func(ps GroupProducts) bool {
-		if ps.NameGroup == name {
-			return true
-		}
-		return false
-	})
-	if isFindProduct == -1 {
-		newPl := append(pl, GroupProducts{NameGroup: name, PurchasePrice: 0})
-		update := bson.D{{"$set", bson.D{{"telegram_user.settings.ozon_setting.product_setting.group_products", newPl}}}}
-		opts := options.Update().SetUpsert(true)
-		_, err := coll.UpdateOne(context.TODO(), filter, update, opts)
-		if err != nil {
-			//TODO написать обработку ошибки
-		}
-	}
-}
-
-func fboListHandler(userId int64, body ListBodyRequestFBO) (*ListResponseFBO, error) {
-	client := &http.Client{}
-	requestBody, err := json.Marshal(body)
-	if err != nil {
-		log.Fatalln(err)
-		return nil, err
-	}
-	r, err := http.NewRequest(
-		"POST", urlOzon+"/v2/posting/fbo/list",
-		bytes.NewBuffer(requestBody),
-	)
-	var userDb UserRepository = UserDB{}
-	setting, err := userDb.getOzonSetting(userId)
-	if err != nil {
-		panic(err)
-	}
-
-	r.Header.Set("Client-Id", setting.ClientId)
-	r.Header.Set("Api-Key", setting.Token)
-	r.Header.Set("content-type", "application/json")
-
-	response, err := client.Do(r)
-	defer response.Body.Close()
-	if err != nil {
-		fmt.Println(err)
-		return nil, err
-	}
+func (m *OzonMarketplace) fboListHandler(userId int64, body ListBodyRequestFBO) (*ListResponseFBO, error) {
 	var l ListResponseFBO
-	b, err := io.ReadAll(response.Body)
-	err = json.Unmarshal(b, &l)
-	if err != nil {
-		fmt.Println(err)
+	if err := m.ozonRequest(userId, "/v2/posting/fbo/list", body, &l); err != nil {
 		return nil, err
 	}
 	return &l, nil
 }
 
-func (m *OzonMarketplace) orderSummaryReport(userId int64, filter FilterFbo) СonsolidatedReportFBO {
-	defer fmt.Println("sss")
-	crfbo := СonsolidatedReportFBO{}
-	var userDb UserRepository = UserDB{}
-	setting, err := userDb.getOzonSetting(userId)
-	if err != nil {
-		return crfbo
-	}
-	cost := setting.ProductSetting.Cost
-	mp := make(map[string]float64)
-	for _, iteam := range setting.ProductSetting.GroupProducts {
-		mp[iteam.NameGroup] = iteam.PurchasePrice
-	}
-	crfbo.CancelledProducts = make(map[string]int)
-	var bb = make(map[string]int)
-	replacer := strings.NewReplacer("Получешки Colibri ", "", "Полупальцы Colibri ", "")
-	limit := 1000
-	offset := 0
-	var resp = ListResponseFBO{}
-	for {
-		response, err := fboListHandler(userId, ListBodyRequestFBO{
+// postings Все отправления FBO за период. При ошибке на середине выгрузки возвращает
+// полученные отправления и PartialResultError.
+func (m *OzonMarketplace) postings(userId int64, filter FilterFbo, with WithFbo) (*ListResponseFBO, error) {
+	result, err := paginate(1000, func(offset int, limit int) ([]PostingFBO, bool, error) {
+		response, err := m.fboListHandler(userId, ListBodyRequestFBO{
 			Dir:    "ASC",
 			Filter: filter,
 			Limit:  int64(limit),
 			Offset: int64(offset),
+			With:   with,
 		})
-		resp.Result = append(resp.Result, response.Result...)
 		if err != nil {
-			panic(err)
-		}
-		if len(response.Result) == 0 {
-			break
+			return nil, false, err
 		}
-		offset += limit
-	}
-	var pp float64
-	for _, aa := range resp.Result {
-		for _, product := range aa.Products {
-			crfbo.TotalCount += product.Quantity
-			user := UserDB{}
-			// TODO массовое изменение товаров или горутину
-			user.setProductGroupSetting(userId, replacer.Replace(product.Name))
-			if aa.Status != Cancelled.String() {
-				pp += mp[replacer.Replace(product.Name)]
-				if price, err := strconv.ParseFloat(product.Price, 64); err == nil {
-					crfbo.SumCount = decimal.NewFromFloat(crfbo.SumCount.InexactFloat64() + price)
-				}
-				bb[replacer.Replace(product.Name)] += product.Quantity
-			} else {
-				crfbo.CancelledTotalCount += product.Quantity
-				crfbo.CancelledProducts[replacer.Replace(product.Name)] += product.Quantity
-			}
+		return response.Result, true, nil
+	})
+	if result == nil && err != nil {
+		return nil, err
+	}
+	return &ListResponseFBO{Result: result}, err
+}
 
+// periodOrders Отправления OZON по схемам работы, включенным в отчеты, и возвраты за период
+func (m *OzonMarketplace) periodOrders(userId int64, s Settings, period DateRange) (MarketplaceOrders, error) {
+	setting := s.OzonSetting
+	filter := period.filter()
+	schemeLines, fetchErr := m.schemeLines(userId, &setting, filter)
+	if fetchErr != nil && !isPartialResult(fetchErr) {
+		return MarketplaceOrders{}, fetchErr
+	}
+	var allLines []ozonLine
+	var orders []Order
+	for _, scheme := range setting.schemes() {
+		allLines = append(allLines, schemeLines[scheme]...)
+		orders = append(orders, normalizeOzonLines(schemeLines[scheme])...)
+	}
+	batch := MarketplaceOrders{
+		Orders:  orders,
+		Schemes: setting.schemes(),
+		Cost:    setting.ProductSetting.Cost,
+		Grouper: productGrouper(m, userId, setting.ProductSetting.GroupRules, lineSkus(allLines)),
+	}
+	// Возвраты только этого кабинета, иначе в итогах по всем кабинетам они учитываются несколько раз
+	account, _ := m.reportAccount(s)
+	if returns, err := filterReturns(userId, account.Id, filter); err != nil {
+		log.Printf("Не удалось получить возвраты пользователя %d: %v", userId, err)
+		if fetchErr == nil {
+			// Отчет без возвратов неполный
+			fetchErr = &PartialResultError{Fetched: len(orders), Err: err}
+		}
+	} else {
+		for _, r := range returns {
+			batch.Returns = append(batch.Returns, OrderReturn{Quantity: r.Quantity, Logistics: decimal.NewFromFloat(r.Logistics)})
 		}
 	}
-	crfbo.products = bb
-	crfbo.SumWithoutCommission = decimal.NewFromFloat(crfbo.SumCount.InexactFloat64() - ((cost / 100) * crfbo.SumCount.InexactFloat64()))
-	crfbo.SumWithoutCommissionPurchasePrice = decimal.NewFromFloat(crfbo.SumWithoutCommission.InexactFloat64() - pp)
-	return crfbo
+	return batch, fetchErr
 }
 
 func findIndex[T any](obj []T, f func(e T) (result bool)) int {
@@ -1,46 +1,49 @@
 package main
 
 import (
+	"github.com/gofiber/fiber/v2"
+	"net/http/httptest"
 	"reflect"
+	"telegram"
 	"testing"
 )
 
 func TestCreateInlineKeyboardButtonsBot(t *testing.T) {
-	matrix := make([][]InlineKeyboardButton, 4)
-	matrix[0] = make([]InlineKeyboardButton, 5)
-	matrix[1] = make([]InlineKeyboardButton, 2)
-	matrix[2] = make([]InlineKeyboardButton, 1)
-	matrix[3] = make([]InlineKeyboardButton, 1)
-	matrix[0][0] = InlineKeyboardButton{Text: "1:1", CallbackData: "/setting"}
-	matrix[0][1] = InlineKeyboardButton{Text: "1:2", CallbackData: "/setting"}
-	matrix[0][2] = InlineKeyboardButton{Text: "1:3", CallbackData: "/setting"}
-	matrix[0][3] = InlineKeyboardButton{Text: "1:4", CallbackData: "/setting"}
-	matrix[0][4] = InlineKeyboardButton{Text: "1:5", CallbackData: "/setting"}
-	matrix[1][0] = InlineKeyboardButton{Text: "2:1", CallbackData: "/setting"}
-	matrix[1][1] = InlineKeyboardButton{Text: "2:2", CallbackData: "/setting"}
-	matrix[2][0] = InlineKeyboardButton{Text: "3:2", CallbackData: "/setting"}
-	matrix[3][0] = InlineKeyboardButton{Text: "5:2", CallbackData: "/setting"}
+	matrix := make([][]telegram.InlineKeyboardButton, 4)
+	matrix[0] = make([]telegram.InlineKeyboardButton, 5)
+	matrix[1] = make([]telegram.InlineKeyboardButton, 2)
+	matrix[2] = make([]telegram.InlineKeyboardButton, 1)
+	matrix[3] = make([]telegram.InlineKeyboardButton, 1)
+	matrix[0][0] = telegram.InlineKeyboardButton{Text: "1:1", CallbackData: "/setting"}
+	matrix[0][1] = telegram.InlineKeyboardButton{Text: "1:2", CallbackData: "/setting"}
+	matrix[0][2] = telegram.InlineKeyboardButton{Text: "1:3", CallbackData: "/setting"}
+	matrix[0][3] = telegram.InlineKeyboardButton{Text: "1:4", CallbackData: "/setting"}
+	matrix[0][4] = telegram.InlineKeyboardButton{Text: "1:5", CallbackData: "/setting"}
+	matrix[1][0] = telegram.InlineKeyboardButton{Text: "2:1", CallbackData: "/setting"}
+	matrix[1][1] = telegram.InlineKeyboardButton{Text: "2:2", CallbackData: "/setting"}
+	matrix[2][0] = telegram.InlineKeyboardButton{Text: "3:2", CallbackData: "/setting"}
+	matrix[3][0] = telegram.InlineKeyboardButton{Text: "5:2", CallbackData: "/setting"}
 	type args struct {
-		b []ButtonBot[InlineKeyboardButton]
+		b []telegram.ButtonBot[telegram.InlineKeyboardButton]
 	}
 	tests := []struct {
 		name string
 		args args
-		want [][]InlineKeyboardButton
+		want [][]telegram.InlineKeyboardButton
 	}{
 		{
 			name: "Create struct button for bot telegram",
 			args: args{
-				b: []ButtonBot[InlineKeyboardButton]{
-					{Row: 1, Col: 1, Button: InlineKeyboardButton{Text: "1:1", CallbackData: "/setting"}},
-					{Row: 1, Col: 2, Button: InlineKeyboardButton{Text: "1:2", CallbackData: "/setting"}},
-					{Row: 1, Col: 3, Button: InlineKeyboardButton{Text: "1:3", CallbackData: "/setting"}},
-					{Row: 1, Col: 4, Button: InlineKeyboardButton{Text: "1:4", CallbackData: "/setting"}},
-					{Row: 1, Col: 5, Button: InlineKeyboardButton{Text: "1:5", CallbackData: "/setting"}},
-					{Row: 2, Col: 1, Button: InlineKeyboardButton{Text: "2:1", CallbackData: "/setting"}},
-					{Row: 2, Col: 2, Button: InlineKeyboardButton{Text: "2:2", CallbackData: "/setting"}},
-					{Row: 5, Col: 2, Button: InlineKeyboardButton{Text: "5:2", CallbackData: "/setting"}},
-					{Row: 3, Col: 2, Button: InlineKeyboardButton{Text: "3:2", CallbackData: "/setting"}},
+				b: []telegram.ButtonBot[telegram.InlineKeyboardButton]{
+					{Row: 1, Col: 1, Button: telegram.InlineKeyboardButton{Text: "1:1", CallbackData: "/setting"}},
+					{Row: 1, Col: 2, Button: telegram.InlineKeyboardButton{Text: "1:2", CallbackData: "/setting"}},
+					{Row: 1, Col: 3, Button: telegram.InlineKeyboardButton{Text: "1:3", CallbackData: "/setting"}},
+					{Row: 1, Col: 4, Button: telegram.InlineKeyboardButton{Text: "1:4", CallbackData: "/setting"}},
+					{Row: 1, Col: 5, Button: telegram.InlineKeyboardButton{Text: "1:5", CallbackData: "/setting"}},
+					{Row: 2, Col: 1, Button: telegram.InlineKeyboardButton{Text: "2:1", CallbackData: "/setting"}},
+					{Row: 2, Col: 2, Button: telegram.InlineKeyboardButton{Text: "2:2", CallbackData: "/setting"}},
+					{Row: 5, Col: 2, Button: telegram.InlineKeyboardButton{Text: "5:2", CallbackData: "/setting"}},
+					{Row: 3, Col: 2, Button: telegram.InlineKeyboardButton{Text: "3:2", CallbackData: "/setting"}},
 				},
 			},
 			want: matrix,
@@ -48,9 +51,41 @@ func TestCreateInlineKeyboardButtonsBot(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := CreateButtonsBot[InlineKeyboardButton](tt.args.b); !reflect.DeepEqual(got, tt.want) {
+			if got := CreateButtonsBot[telegram.InlineKeyboardButton](tt.args.b); !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("CreateInlineKeyboardButtonsBot() = %v, want %v", got, tt.want)
 			}
 		})
 	}
 }
+
+func TestVerifySecretToken(t *testing.T) {
+	secretTokenWebhook = "secret-token_1"
+	app := fiber.New()
+	app.Post("/webhooks", verifySecretToken, func(c *fiber.Ctx) error {
+		return c.SendStatus(fiber.StatusOK)
+	})
+	tests := []struct {
+		name  string
+		token string
+		want  int
+	}{
+		{name: "Верный secret token", token: "secret-token_1", want: fiber.StatusOK},
+		{name: "Неверный secret token", token: "secret-token_2", want: fiber.StatusUnauthorized},
+		{name: "Без secret token", token: "", want: fiber.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/webhooks", nil)
+			if tt.token != "" {
+				req.Header.Set(telegram.SecretTokenHeader, tt.token)
+			}
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.want {
+				t.Errorf("verifySecretToken() status = %d, want %d", resp.StatusCode, tt.want)
+			}
+		})
+	}
+}
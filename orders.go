@@ -0,0 +1,326 @@
+package main
+
+import (
+	"fmt"
+	"format"
+	"log"
+
+	"github.com/shopspring/decimal"
+)
+
+// Marketplace Маркетплейс, из которого получены заказы, значение - название в отчетах
+type Marketplace string
+
+const (
+	MarketplaceOzon        Marketplace = "OZON"
+	MarketplaceWildberries Marketplace = "WB"
+	MarketplaceYandex      Marketplace = "Яндекс Маркет"
+)
+
+// Money Сумма в рублях: все маркетплейсы рассчитываются с продавцом в рублях
+type Money = decimal.Decimal
+
+type FeeKind string
+
+const (
+	FeeCommission  FeeKind = "commission"
+	FeeLogistics   FeeKind = "logistics"
+	FeeFulfillment FeeKind = "fulfillment"
+)
+
+// Fee Удержание маркетплейса по товару, положительное
+type Fee struct {
+	Kind   FeeKind
+	Amount Money
+}
+
+// Order Заказ (отправление) маркетплейса в общей модели. Адаптеры маркетплейсов переводят в нее свои
+// ответы, отчет по ней считается одинаково для всех.
+type Order struct {
+	Marketplace Marketplace
+	Number      string
+	Scheme      DeliveryScheme
+	// Status Статус в модели статусов OZON, для отчета важны отмена и доставка
+	Status Status
+	Lines  []OrderLine
+}
+
+// OrderLine Товар заказа
+type OrderLine struct {
+	// Sku SKU OZON, у других маркетплейсов 0: правила групп по SKU относятся только к OZON
+	Sku      int64
+	OfferId  string
+	Name     string
+	Quantity int
+	// Price Цена единицы товара для продавца
+	Price Money
+	// Fees Удержания маркетплейса по товару
+	Fees []Fee
+	// Net Выплата по данным маркетплейса, nil пока маркетплейс ее не рассчитал
+	Net *Money
+}
+
+// OrderReturn Возврат, оформленный за период
+type OrderReturn struct {
+	Quantity int
+	// Logistics Обратная логистика, вычитается из дохода
+	Logistics Money
+}
+
+func (l OrderLine) amount() Money {
+	return l.Price.Mul(decimal.NewFromInt(int64(l.Quantity)))
+}
+
+// settle Удержания и выплата товара по данным маркетплейса
+func (l *OrderLine) settle(p Payout) {
+	l.Fees = []Fee{
+		{Kind: FeeCommission, Amount: p.Commission},
+		{Kind: FeeLogistics, Amount: p.Logistics},
+		{Kind: FeeFulfillment, Amount: p.Fulfillment},
+	}
+	net := p.Net
+	l.Net = &net
+}
+
+// payout Удержания и выплата по данным маркетплейса, false - выплата еще не рассчитана
+func (l OrderLine) payout() (Payout, bool) {
+	if l.Net == nil {
+		return Payout{}, false
+	}
+	p := Payout{Net: *l.Net}
+	for _, f := range l.Fees {
+		switch f.Kind {
+		case FeeCommission:
+			p.Commission = p.Commission.Add(f.Amount)
+		case FeeLogistics:
+			p.Logistics = p.Logistics.Add(f.Amount)
+		case FeeFulfillment:
+			p.Fulfillment = p.Fulfillment.Add(f.Amount)
+		}
+	}
+	return p, true
+}
+
+// MarketplaceOrders Заказы, созданные за период, и возвраты, оформленные за период, с настройками отчета маркетплейса
+type MarketplaceOrders struct {
+	Orders  []Order
+	Returns []OrderReturn
+	// Schemes Схемы работы для разбивки отчета в порядке вывода, пусто - без разбивки
+	Schemes []DeliveryScheme
+	// Cost % сборов маркетплейса для товаров, выплата по которым еще не рассчитана
+	Cost float64
+	// Grouper Правила групп товаров, nil - группа по названию товара
+	Grouper *ProductGrouper
+}
+
+// ReportMarketplace Адаптер маркетплейса для сводного отчета
+type ReportMarketplace interface {
+	name() Marketplace
+	// accountName Кабинет, по которому строится отчет, пусто - основной кабинет
+	accountName() string
+	// periodOrders Заказы и возвраты за период в общей модели. Если выгрузка прервана на середине,
+	// возвращается полученная часть и PartialResultError.
+	periodOrders(userId int64, s Settings, period DateRange) (MarketplaceOrders, error)
+}
+
+// reportMarketplaces Подключенные кабинеты всех маркетплейсов для сводного отчета. Если не подключен ни один,
+// отчет строится по OZON, как до появления других маркетплейсов.
+func reportMarketplaces(s Settings) []ReportMarketplace {
+	var marketplaces []ReportMarketplace
+	for _, a := range s.reportAccounts() {
+		marketplaces = append(marketplaces, accountMarketplace(a))
+	}
+	if len(marketplaces) == 0 {
+		marketplaces = append(marketplaces, &OzonMarketplace{})
+	}
+	return marketplaces
+}
+
+// marketplaceTitle Маркетплейс и кабинет в заголовках отчетов
+func marketplaceTitle(marketplace Marketplace, account string) string {
+	if marketplace == "" {
+		marketplace = MarketplaceOzon
+	}
+	if account == "" {
+		return string(marketplace)
+	}
+	return fmt.Sprintf("%s «%s»", marketplace, account)
+}
+
+func reportTitle(m ReportMarketplace) string {
+	return marketplaceTitle(m.name(), m.accountName())
+}
+
+// OrderReport Сводный отчет по заказам маркетплейса или по всем маркетплейсам, см. combineReports
+type OrderReport struct {
+	Marketplace Marketplace
+	// Account Кабинет маркетплейса, пусто - основной
+	Account                           string
+	TotalCount                        int
+	CancelledTotalCount               int
+	SumCount                          decimal.Decimal
+	SumWithoutCommission              decimal.Decimal
+	SumWithoutCommissionPurchasePrice decimal.Decimal
+	// Products Количество неотмененных товаров по группам
+	Products map[string]int
+	// CancelledProducts Количество отмененных товаров по группам
+	CancelledProducts map[string]int
+	Schemes           []SchemeSummary
+	// Payout Удержания маркетплейса и выплата по неотмененным товарам
+	Payout Payout
+	// EstimatedCount Количество товаров, выплата по которым рассчитана по % сборов из настроек
+	EstimatedCount int
+	// ReturnedCount Количество товаров, возвращенных за период
+	ReturnedCount int
+	// ReturnLogistics Обратная логистика по возвратам за период, вычитается из дохода
+	ReturnLogistics decimal.Decimal
+	// Incomplete Выгрузка заказов прервана ошибкой маркетплейса, отчет построен по полученной части
+	Incomplete bool
+}
+
+// SchemeSummary Итоги отчета по одной схеме работы
+type SchemeSummary struct {
+	Scheme              DeliveryScheme
+	TotalCount          int
+	CancelledTotalCount int
+	SumCount            decimal.Decimal
+}
+
+// orderSummaryReport Сводный отчет маркетплейса за период. При неполной выгрузке отчет строится
+// по полученной части и помечается неполным.
+func orderSummaryReport(m ReportMarketplace, userId int64, period DateRange) (OrderReport, error) {
+	user, err := UserDB{}.getTelegramUser(userId)
+	if err != nil {
+		return OrderReport{}, err
+	}
+	orders, fetchErr := m.periodOrders(userId, user.Settings, period)
+	if fetchErr != nil && !isPartialResult(fetchErr) {
+		return OrderReport{}, fetchErr
+	}
+	// Группы товаров и закупочные цены общие для всех маркетплейсов
+	report, groups := summarizeOrders(m.name(), orders, user.Settings.OzonSetting.ProductSetting.GroupProducts)
+	report.Account = m.accountName()
+	if fetchErr != nil {
+		log.Printf("Отчет %s пользователя %d неполный: %v", reportTitle(m), userId, fetchErr)
+		report.Incomplete = true
+	}
+	if err := productGroupRepo.addProductGroups(userId, groups); err != nil {
+		log.Printf("Не удалось сохранить группы товаров пользователя %d: %v", userId, err)
+	}
+	return report, nil
+}
+
+// summarizeOrders Сводка по товарам заказов и группы, встреченные в заказах, в порядке появления.
+// Группы сохраняются после прохода одним запросом, см. ProductGroupRepository.
+func summarizeOrders(marketplace Marketplace, batch MarketplaceOrders, prices []GroupProducts) (OrderReport, []string) {
+	report := OrderReport{Marketplace: marketplace, Products: make(map[string]int), CancelledProducts: make(map[string]int)}
+	grouper := batch.Grouper
+	if grouper == nil {
+		grouper = newProductGrouper(nil)
+	}
+	purchasePrices := make(map[string]float64)
+	for _, gp := range prices {
+		purchasePrices[gp.NameGroup] = gp.PurchasePrice
+	}
+	schemes := make(map[DeliveryScheme]*SchemeSummary)
+	report.Schemes = make([]SchemeSummary, len(batch.Schemes))
+	for i, scheme := range batch.Schemes {
+		report.Schemes[i].Scheme = scheme
+		schemes[scheme] = &report.Schemes[i]
+	}
+	var purchase float64
+	seen := make(map[string]bool)
+	var groups []string
+	for _, o := range batch.Orders {
+		summary := schemes[o.Scheme]
+		if summary == nil {
+			summary = &SchemeSummary{}
+		}
+		for _, line := range o.Lines {
+			group := grouper.group(line.Sku, line.OfferId, line.Name)
+			if !seen[group] {
+				seen[group] = true
+				groups = append(groups, group)
+			}
+			report.TotalCount += line.Quantity
+			summary.TotalCount += line.Quantity
+			if o.Status == Cancelled {
+				report.CancelledTotalCount += line.Quantity
+				summary.CancelledTotalCount += line.Quantity
+				report.CancelledProducts[group] += line.Quantity
+				continue
+			}
+			report.Products[group] += line.Quantity
+			report.SumCount = report.SumCount.Add(line.amount())
+			summary.SumCount = summary.SumCount.Add(line.amount())
+			purchase += purchasePrices[group] * float64(line.Quantity)
+			if p, ok := line.payout(); ok {
+				report.Payout = report.Payout.Add(p)
+			} else {
+				report.Payout = report.Payout.Add(fallbackPayout(line.amount().InexactFloat64(), batch.Cost))
+				report.EstimatedCount += line.Quantity
+			}
+		}
+	}
+	for _, r := range batch.Returns {
+		report.ReturnedCount += r.Quantity
+		report.ReturnLogistics = report.ReturnLogistics.Add(r.Logistics)
+	}
+	report.SumWithoutCommission = report.Payout.Net
+	report.SumWithoutCommissionPurchasePrice = report.Payout.Net.Sub(decimal.NewFromFloat(purchase)).Sub(report.ReturnLogistics)
+	return report, groups
+}
+
+// combineReports Итоги по всем маркетплейсам. Разбивка по схемам работы не объединяется:
+// у маркетплейсов они разные.
+func combineReports(reports []OrderReport) OrderReport {
+	total := OrderReport{Products: make(map[string]int), CancelledProducts: make(map[string]int)}
+	for _, r := range reports {
+		total.TotalCount += r.TotalCount
+		total.CancelledTotalCount += r.CancelledTotalCount
+		total.SumCount = total.SumCount.Add(r.SumCount)
+		total.SumWithoutCommission = total.SumWithoutCommission.Add(r.SumWithoutCommission)
+		total.SumWithoutCommissionPurchasePrice = total.SumWithoutCommissionPurchasePrice.Add(r.SumWithoutCommissionPurchasePrice)
+		total.Payout = total.Payout.Add(r.Payout)
+		total.EstimatedCount += r.EstimatedCount
+		total.ReturnedCount += r.ReturnedCount
+		total.ReturnLogistics = total.ReturnLogistics.Add(r.ReturnLogistics)
+		total.Incomplete = total.Incomplete || r.Incomplete
+		for group, count := range r.Products {
+			total.Products[group] += count
+		}
+		for group, count := range r.CancelledProducts {
+			total.CancelledProducts[group] += count
+		}
+	}
+	return total
+}
+
+// printCombinedReport Итоги по всем маркетплейсам со строкой на каждый маркетплейс
+func printCombinedReport(reports []OrderReport) string {
+	indent := format.Plain("    ")
+	itemIndent := format.Plain("        ")
+	total := combineReports(reports)
+	mess := []format.Fragment{
+		format.Line(format.Bold(format.Plain("Итого по всем маркетплейсам:"))),
+		format.Line(),
+	}
+	for _, r := range reports {
+		mess = append(mess, format.Line(itemIndent, format.Italic(format.Plain(marketplaceTitle(r.Marketplace, r.Account)+": "),
+			format.Bold(format.Plainf("%d шт. на %s", r.TotalCount-r.CancelledTotalCount, r.SumCount.StringFixed(2))),
+			format.Plainf(", к выплате %s", r.SumWithoutCommission.StringFixed(2)))))
+	}
+	mess = append(mess,
+		format.Line(),
+		format.Line(indent, format.Bold(format.Plainf("Итого количество: %d", total.TotalCount-total.CancelledTotalCount))),
+		format.Line(indent, format.Plainf("Отменено: %d", total.CancelledTotalCount)),
+		format.Line(indent, format.Bold(format.Plainf("Итого сумма: %s", total.SumCount.StringFixed(2)))),
+		format.Line(indent, format.Plainf("Удержания маркетплейсов: %s", total.Payout.Commission.Add(total.Payout.Logistics).Add(total.Payout.Fulfillment).StringFixed(2))),
+		format.Line(indent, format.Bold(format.Plainf("Итого к выплате: %s", total.SumWithoutCommission.StringFixed(2)))),
+		format.Line(indent, format.Bold(format.Plainf("Итого доход: %s", total.SumWithoutCommissionPurchasePrice.StringFixed(2)))),
+	)
+	if total.Incomplete {
+		mess = append(mess, format.Line(), format.Line(format.Italic(format.Plain("Часть маркетплейсов ответила ошибкой: итоги неполные."))))
+	}
+	return format.Render(format.HTML, mess...)
+}
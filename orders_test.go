@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestSummarizeOrders(t *testing.T) {
+	settled := &Payout{Commission: decimal.NewFromInt(15), Logistics: decimal.NewFromInt(5), Net: decimal.NewFromInt(80)}
+	lines := []ozonLine{
+		{Scheme: SchemeFBO, PostingNumber: "1", Product: PostingProduct{Sku: 1, OfferId: "A-1", Name: "Получешки белые", Price: "100", Quantity: 1}, Payout: settled},
+		{Scheme: SchemeFBO, PostingNumber: "2", Product: PostingProduct{Sku: 2, OfferId: "A-2", Name: "Получешки черные", Price: "100", Quantity: 1}},
+		{Scheme: SchemeFBS, PostingNumber: "3", Product: PostingProduct{Sku: 3, OfferId: "C-1", Name: "Гольфы", Price: "50", Quantity: 2}},
+		{Scheme: SchemeFBS, PostingNumber: "4", Product: PostingProduct{Sku: 1, OfferId: "A-1", Name: "Получешки белые", Price: "100", Quantity: 1}, Cancelled: true},
+	}
+	batch := MarketplaceOrders{
+		Orders:  normalizeOzonLines(lines),
+		Returns: []OrderReturn{{Quantity: 1, Logistics: decimal.NewFromInt(10)}},
+		Schemes: []DeliveryScheme{SchemeFBO, SchemeFBS},
+		Cost:    10,
+		Grouper: newProductGrouper([]GroupRule{{Kind: GroupByOfferPrefix, Value: "A-", Group: "Получешки"}}),
+	}
+	report, groups := summarizeOrders(MarketplaceOzon, batch, []GroupProducts{{NameGroup: "Получешки", PurchasePrice: 20}, {NameGroup: "Гольфы", PurchasePrice: 5}})
+	if fmt.Sprint(groups) != "[Получешки Гольфы]" {
+		t.Errorf("groups = %v", groups)
+	}
+	if report.TotalCount != 5 || report.CancelledTotalCount != 1 || report.Products["Получешки"] != 2 || report.Products["Гольфы"] != 2 ||
+		report.CancelledProducts["Получешки"] != 1 || report.EstimatedCount != 3 || report.ReturnedCount != 1 {
+		t.Errorf("report = %+v", report)
+	}
+	if !report.SumCount.Equal(decimal.NewFromInt(300)) {
+		t.Errorf("SumCount = %s, want 300: цена умножается на количество", report.SumCount)
+	}
+	if len(report.Schemes) != 2 || report.Schemes[1].TotalCount != 3 || report.Schemes[1].CancelledTotalCount != 1 || !report.Schemes[1].SumCount.Equal(decimal.NewFromInt(100)) {
+		t.Errorf("Schemes = %+v", report.Schemes)
+	}
+	// 80 по данным OZON + (100 + 100) - 10% сборов
+	if !report.SumWithoutCommission.Equal(decimal.NewFromInt(260)) || !report.Payout.Logistics.Equal(decimal.NewFromInt(5)) {
+		t.Errorf("SumWithoutCommission = %s, Payout = %+v", report.SumWithoutCommission, report.Payout)
+	}
+	// 260 - 2 * 20 - 2 * 5 закупка - 10 обратной логистики
+	if !report.SumWithoutCommissionPurchasePrice.Equal(decimal.NewFromInt(200)) {
+		t.Errorf("SumWithoutCommissionPurchasePrice = %s, want 200", report.SumWithoutCommissionPurchasePrice)
+	}
+}
+
+// TestSummarizeOrders_quantity Строка отправления с несколькими штуками товара учитывается по количеству:
+// раньше сумма, закупка и расчетная выплата считались по одной штуке на строку.
+func TestSummarizeOrders_quantity(t *testing.T) {
+	lines := []ozonLine{
+		{Scheme: SchemeFBO, PostingNumber: "1", Product: PostingProduct{Sku: 1, OfferId: "A-1", Name: "Получешки белые", Price: "100", Quantity: 1}},
+		{Scheme: SchemeFBO, PostingNumber: "2", Product: PostingProduct{Sku: 2, OfferId: "A-2", Name: "Получешки черные", Price: "100", Quantity: 3}},
+		{Scheme: SchemeFBS, PostingNumber: "3", Product: PostingProduct{Sku: 3, OfferId: "C-1", Name: "Гольфы", Price: "50", Quantity: 2}},
+	}
+	batch := MarketplaceOrders{
+		Orders:  normalizeOzonLines(lines),
+		Schemes: []DeliveryScheme{SchemeFBO, SchemeFBS},
+		Cost:    10,
+		Grouper: newProductGrouper([]GroupRule{{Kind: GroupByOfferPrefix, Value: "A-", Group: "Получешки"}}),
+	}
+	report, _ := summarizeOrders(MarketplaceOzon, batch, []GroupProducts{{NameGroup: "Получешки", PurchasePrice: 20}})
+	// 100 + 3 * 100 + 2 * 50
+	if !report.SumCount.Equal(decimal.NewFromInt(500)) || report.EstimatedCount != 6 {
+		t.Errorf("SumCount = %s, EstimatedCount = %d, want 500 и 6", report.SumCount, report.EstimatedCount)
+	}
+	// 500 - 10% сборов - 4 штуки по закупочной цене 20, прежний расчет по строкам давал 185
+	if !report.SumWithoutCommissionPurchasePrice.Equal(decimal.NewFromInt(370)) {
+		t.Errorf("SumWithoutCommissionPurchasePrice = %s, want 370", report.SumWithoutCommissionPurchasePrice)
+	}
+}
+
+func TestNormalizeOzonLines(t *testing.T) {
+	lines := []ozonLine{
+		{Scheme: SchemeFBS, PostingNumber: "1", Product: PostingProduct{Sku: 1, Price: "10", Quantity: 1}, Delivered: true},
+		{Scheme: SchemeFBS, PostingNumber: "1", Product: PostingProduct{Sku: 2, Price: "20", Quantity: 1}, Delivered: true},
+		{Scheme: SchemeFBS, PostingNumber: "2", Product: PostingProduct{Sku: 1, Price: "10", Quantity: 1}, Cancelled: true},
+	}
+	orders := normalizeOzonLines(lines)
+	if len(orders) != 2 || len(orders[0].Lines) != 2 || orders[0].Status != Delivered || orders[1].Status != Cancelled {
+		t.Fatalf("orders = %+v", orders)
+	}
+	if orders[0].Lines[1].Sku != 2 || !orders[0].Lines[1].Price.Equal(decimal.NewFromInt(20)) || orders[0].Marketplace != MarketplaceOzon {
+		t.Errorf("line = %+v", orders[0].Lines[1])
+	}
+}
+
+func TestCombineReports(t *testing.T) {
+	reports := []OrderReport{
+		{
+			Marketplace: MarketplaceOzon, TotalCount: 3, CancelledTotalCount: 1, SumCount: decimal.NewFromInt(200),
+			SumWithoutCommission: decimal.NewFromInt(150), SumWithoutCommissionPurchasePrice: decimal.NewFromInt(100),
+			Payout:   Payout{Commission: decimal.NewFromInt(30), Logistics: decimal.NewFromInt(20), Net: decimal.NewFromInt(150)},
+			Products: map[string]int{"Носки": 2},
+		},
+		{
+			Marketplace: MarketplaceWildberries, TotalCount: 2, SumCount: decimal.NewFromInt(100),
+			SumWithoutCommission: decimal.NewFromInt(80), SumWithoutCommissionPurchasePrice: decimal.NewFromInt(60),
+			Payout:   Payout{Commission: decimal.NewFromInt(20), Net: decimal.NewFromInt(80)},
+			Products: map[string]int{"Носки": 1, "Гольфы": 1}, Incomplete: true,
+		},
+	}
+	total := combineReports(reports)
+	if total.TotalCount != 5 || total.CancelledTotalCount != 1 || total.Products["Носки"] != 3 || !total.Incomplete ||
+		!total.SumWithoutCommissionPurchasePrice.Equal(decimal.NewFromInt(160)) {
+		t.Errorf("total = %+v", total)
+	}
+	text := printCombinedReport(reports)
+	for _, want := range []string{"Итого по всем маркетплейсам", "OZON: <b>2 шт. на 200.00</b>, к выплате 150.00", "WB: <b>2 шт. на 100.00</b>",
+		"Удержания маркетплейсов: 70.00", "Итого к выплате: 230.00", "Итого доход: 160.00", "итоги неполные"} {
+		if !strings.Contains(text, want) {
+			t.Errorf("report %q does not contain %q", text, want)
+		}
+	}
+}
+
+func TestOzonMarketplace_periodOrdersReturns(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/fbs/") {
+			w.Write([]byte(`{"result":{"postings":[],"has_next":false}}`))
+			return
+		}
+		w.Write([]byte(`{"result":[]}`))
+	}))
+	defer server.Close()
+	defer func(url string, repo ReturnsRepository) { urlOzon, returnsRepo = url, repo }(urlOzon, returnsRepo)
+	urlOzon = server.URL
+	repo := NewReturnsMemory()
+	returnsRepo = repo
+
+	period := DateRange{From: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), To: time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)}
+	first := MarketplaceAccount{Id: primitive.NewObjectID(), Marketplace: MarketplaceOzon, Name: "Первый", ClientId: "1", Default: true}
+	second := MarketplaceAccount{Id: primitive.NewObjectID(), Marketplace: MarketplaceOzon, Name: "Второй", ClientId: "2"}
+	repo.upsertReturns([]ReturnRecord{
+		{Key: ReturnKey{UserId: 7, AccountId: first.Id, ReturnId: 1}, Quantity: 2, Logistics: 50, ReturnDate: period.From.AddDate(0, 0, 3)},
+		{Key: ReturnKey{UserId: 7, AccountId: second.Id, ReturnId: 1}, Quantity: 1, Logistics: 30, ReturnDate: period.From.AddDate(0, 0, 5)},
+	})
+	settings := Settings{OzonSetting: OzonSetting{Schemes: []DeliveryScheme{SchemeFBO, SchemeFBS}}, Accounts: []MarketplaceAccount{first, second}}
+
+	var reports []OrderReport
+	for _, m := range []*OzonMarketplace{{Account: &first}, {Account: &second}} {
+		batch, err := m.periodOrders(7, settings, period)
+		if err != nil {
+			t.Fatal(err)
+		}
+		report, _ := summarizeOrders(m.name(), batch, nil)
+		reports = append(reports, report)
+	}
+	if reports[0].ReturnedCount != 2 || reports[1].ReturnedCount != 1 {
+		t.Errorf("returned = %d, %d, want возвраты своего кабинета 2 и 1", reports[0].ReturnedCount, reports[1].ReturnedCount)
+	}
+	total := combineReports(reports)
+	if total.ReturnedCount != 3 || !total.ReturnLogistics.Equal(decimal.NewFromInt(80)) {
+		t.Errorf("combined returned = %d, logistics = %s, want 3 и 80", total.ReturnedCount, total.ReturnLogistics)
+	}
+
+	// Без кабинета отчет строится по основному
+	if account, ok := (&OzonMarketplace{}).reportAccount(settings); !ok || account.Id != first.Id {
+		t.Errorf("reportAccount() = %+v, want основной кабинет", account)
+	}
+}
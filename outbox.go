@@ -0,0 +1,550 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"telegram"
+	"time"
+)
+
+// OutboxPriority Очередь отправки: ответы пользователю отправляются раньше рассылок
+type OutboxPriority int
+
+const (
+	PriorityInteractive OutboxPriority = iota
+	PriorityBroadcast
+)
+
+type OutboxStatus string
+
+const (
+	OutboxPending OutboxStatus = "pending"
+	OutboxSending OutboxStatus = "sending"
+	OutboxDead    OutboxStatus = "dead"
+)
+
+// Ограничения Telegram на отправку сообщений
+const (
+	globalMessagesPerSecond  = 30
+	privateMessagesPerSecond = 1
+	groupMessagesPerSecond   = 20.0 / 60
+	// chatMessagesBurst Сообщения в чат идут строго по лимиту, без серии подряд
+	chatMessagesBurst = 1
+)
+
+const (
+	outboxMaxAttempts  = 5
+	outboxConcurrency  = 8
+	outboxBatchSize    = 100
+	outboxLeaseTimeout = time.Minute
+	outboxIdleInterval = time.Second
+)
+
+var outbox *Outbox
+
+type OutboxMessage struct {
+	Id            primitive.ObjectID `bson:"_id"`
+	ChatId        string             `bson:"chat_id"`
+	Priority      OutboxPriority     `bson:"priority"`
+	Body          string             `bson:"body"`
+	Status        OutboxStatus       `bson:"status"`
+	Attempts      int                `bson:"attempts"`
+	NextAttemptAt time.Time          `bson:"next_attempt_at"`
+	LeaseUntil    time.Time          `bson:"lease_until"`
+	LastError     string             `bson:"last_error,omitempty"`
+	CreatedAt     time.Time          `bson:"created_at"`
+	// Parts Общий id частей одного длинного текста, пусто у отдельного сообщения
+	Parts primitive.ObjectID `bson:"parts,omitempty"`
+}
+
+// ready Сообщение можно отправлять: ожидает отправки или прошлая попытка не завершилась (упал процесс)
+func (m OutboxMessage) ready(now time.Time) bool {
+	switch m.Status {
+	case OutboxPending:
+		return !m.NextAttemptAt.After(now)
+	case OutboxSending:
+		return m.LeaseUntil.Before(now)
+	}
+	return false
+}
+
+type OutboxRepository interface {
+	enqueue(m OutboxMessage) error
+	// pending Первые в очереди сообщения чатов, кроме skipChats, не больше limit чатов. Чат попадает
+	// в результат, только если его первое сообщение готово к отправке: пока оно ждет повтора,
+	// следующие сообщения чата тоже ждут. Чаты упорядочены по приоритету и времени постановки
+	// в очередь их первого сообщения.
+	pending(now time.Time, limit int, skipChats []string) ([]OutboxMessage, error)
+	// claim Захват сообщения для отправки, false если его уже захватил другой обработчик
+	claim(id primitive.ObjectID, now time.Time, leaseUntil time.Time) (bool, error)
+	remove(id primitive.ObjectID) error
+	retry(id primitive.ObjectID, attempts int, nextAttemptAt time.Time, lastError string) error
+	deadLetter(id primitive.ObjectID, attempts int, lastError string) error
+	// dropParts Пометка dead неотправленных частей длинного текста
+	dropParts(parts primitive.ObjectID, lastError string) error
+}
+
+type OutboxDB struct{}
+
+func (d OutboxDB) collection() *mongo.Collection {
+	return clientMongo.Database("MyInfantBotDB").Collection("bot_outbox")
+}
+
+func (d OutboxDB) createIndexes() error {
+	_, err := d.collection().Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys: bson.D{{"status", 1}, {"priority", 1}, {"created_at", 1}},
+	})
+	return err
+}
+
+func readyFilter(now time.Time) bson.D {
+	return bson.D{{"$or", bson.A{
+		bson.D{{"status", OutboxPending}, {"next_attempt_at", bson.D{{"$lte", now}}}},
+		bson.D{{"status", OutboxSending}, {"lease_until", bson.D{{"$lt", now}}}},
+	}}}
+}
+
+func (d OutboxDB) enqueue(m OutboxMessage) error {
+	_, err := d.collection().InsertOne(context.TODO(), m)
+	return err
+}
+
+func (d OutboxDB) pending(now time.Time, limit int, skipChats []string) ([]OutboxMessage, error) {
+	order := bson.D{{"priority", 1}, {"created_at", 1}, {"_id", 1}}
+	match := bson.D{
+		{"status", bson.D{{"$ne", OutboxDead}}},
+		{"chat_id", bson.D{{"$nin", append([]string{}, skipChats...)}}},
+	}
+	pipeline := mongo.Pipeline{
+		{{"$match", match}},
+		{{"$sort", order}},
+		{{"$group", bson.D{{"_id", "$chat_id"}, {"message", bson.D{{"$first", "$$ROOT"}}}}}},
+		{{"$replaceRoot", bson.D{{"newRoot", "$message"}}}},
+		// Готовность проверяется после выбора первого сообщения чата, иначе пока оно ждет повтора,
+		// отправилось бы следующее
+		{{"$match", readyFilter(now)}},
+		{{"$sort", order}},
+		{{"$limit", limit}},
+	}
+	cursor, err := d.collection().Aggregate(context.TODO(), pipeline)
+	if err != nil {
+		return nil, err
+	}
+	var messages []OutboxMessage
+	err = cursor.All(context.TODO(), &messages)
+	return messages, err
+}
+
+func (d OutboxDB) claim(id primitive.ObjectID, now time.Time, leaseUntil time.Time) (bool, error) {
+	filter := append(bson.D{{"_id", id}}, readyFilter(now)...)
+	update := bson.D{{"$set", bson.D{{"status", OutboxSending}, {"lease_until", leaseUntil}}}}
+	result, err := d.collection().UpdateOne(context.TODO(), filter, update)
+	if err != nil {
+		return false, err
+	}
+	return result.ModifiedCount == 1, nil
+}
+
+func (d OutboxDB) remove(id primitive.ObjectID) error {
+	_, err := d.collection().DeleteOne(context.TODO(), bson.D{{"_id", id}})
+	return err
+}
+
+func (d OutboxDB) retry(id primitive.ObjectID, attempts int, nextAttemptAt time.Time, lastError string) error {
+	update := bson.D{{"$set", bson.D{
+		{"status", OutboxPending},
+		{"attempts", attempts},
+		{"next_attempt_at", nextAttemptAt},
+		{"last_error", lastError},
+	}}}
+	_, err := d.collection().UpdateByID(context.TODO(), id, update)
+	return err
+}
+
+func (d OutboxDB) deadLetter(id primitive.ObjectID, attempts int, lastError string) error {
+	update := bson.D{{"$set", bson.D{
+		{"status", OutboxDead},
+		{"attempts", attempts},
+		{"last_error", lastError},
+	}}}
+	_, err := d.collection().UpdateByID(context.TODO(), id, update)
+	return err
+}
+
+func (d OutboxDB) dropParts(parts primitive.ObjectID, lastError string) error {
+	filter := bson.D{{"parts", parts}, {"status", OutboxPending}}
+	update := bson.D{{"$set", bson.D{{"status", OutboxDead}, {"last_error", lastError}}}}
+	_, err := d.collection().UpdateMany(context.TODO(), filter, update)
+	return err
+}
+
+// OutboxMemory Очередь в памяти процесса
+type OutboxMemory struct {
+	mu       sync.Mutex
+	messages map[primitive.ObjectID]OutboxMessage
+}
+
+func NewOutboxMemory() *OutboxMemory {
+	return &OutboxMemory{messages: make(map[primitive.ObjectID]OutboxMessage)}
+}
+
+func (d *OutboxMemory) enqueue(m OutboxMessage) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.messages[m.Id] = m
+	return nil
+}
+
+func (d *OutboxMemory) pending(now time.Time, limit int, skipChats []string) ([]OutboxMessage, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	skip := make(map[string]bool, len(skipChats))
+	for _, chatId := range skipChats {
+		skip[chatId] = true
+	}
+	var messages []OutboxMessage
+	for _, m := range d.messages {
+		if m.Status != OutboxDead && !skip[m.ChatId] {
+			messages = append(messages, m)
+		}
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		if messages[i].Priority != messages[j].Priority {
+			return messages[i].Priority < messages[j].Priority
+		}
+		return messages[i].Id.Hex() < messages[j].Id.Hex()
+	})
+	first := messages[:0]
+	seen := make(map[string]bool)
+	for _, m := range messages {
+		if !seen[m.ChatId] {
+			seen[m.ChatId] = true
+			if m.ready(now) {
+				first = append(first, m)
+			}
+		}
+	}
+	messages = first
+	if len(messages) > limit {
+		messages = messages[:limit]
+	}
+	return messages, nil
+}
+
+func (d *OutboxMemory) claim(id primitive.ObjectID, now time.Time, leaseUntil time.Time) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	m, ok := d.messages[id]
+	if !ok || !m.ready(now) {
+		return false, nil
+	}
+	m.Status = OutboxSending
+	m.LeaseUntil = leaseUntil
+	d.messages[id] = m
+	return true, nil
+}
+
+func (d *OutboxMemory) remove(id primitive.ObjectID) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.messages, id)
+	return nil
+}
+
+func (d *OutboxMemory) retry(id primitive.ObjectID, attempts int, nextAttemptAt time.Time, lastError string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	m := d.messages[id]
+	m.Status = OutboxPending
+	m.Attempts = attempts
+	m.NextAttemptAt = nextAttemptAt
+	m.LastError = lastError
+	d.messages[id] = m
+	return nil
+}
+
+func (d *OutboxMemory) deadLetter(id primitive.ObjectID, attempts int, lastError string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	m := d.messages[id]
+	m.Status = OutboxDead
+	m.Attempts = attempts
+	m.LastError = lastError
+	d.messages[id] = m
+	return nil
+}
+
+func (d *OutboxMemory) dropParts(parts primitive.ObjectID, lastError string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for id, m := range d.messages {
+		if m.Parts == parts && m.Status == OutboxPending {
+			m.Status = OutboxDead
+			m.LastError = lastError
+			d.messages[id] = m
+		}
+	}
+	return nil
+}
+
+// Outbox Очередь исходящих сообщений.
+//
+// Сообщения сохраняются в репозитории до успешной отправки, поэтому переживают перезапуск.
+// Отправка ограничена общим лимитом бота и лимитом каждого чата, сообщения одного чата
+// отправляются по одному в порядке очереди. За проход берется первое сообщение каждого чата,
+// а чаты, которые сейчас ждут своего лимита, пропускаются, поэтому длинная очередь одного чата
+// не задерживает остальные. После outboxMaxAttempts неудачных попыток
+// или ошибки, которую повтор не исправит, сообщение помечается как dead. Вместе с ним dead
+// помечаются оставшиеся части того же длинного текста: без пропущенной части они бессмысленны.
+// Остальные сообщения чата после этого отправляются как обычно.
+type Outbox struct {
+	repo     OutboxRepository
+	sender   SendMessageBot
+	global   *TokenBucket
+	chats    map[string]*TokenBucket
+	inFlight map[string]bool
+	mu       sync.Mutex
+	wg       sync.WaitGroup
+	wake     chan struct{}
+	now      func() time.Time
+}
+
+func NewOutbox(repo OutboxRepository, sender SendMessageBot) *Outbox {
+	return &Outbox{
+		repo:     repo,
+		sender:   sender,
+		global:   NewTokenBucket(globalMessagesPerSecond, globalMessagesPerSecond),
+		chats:    make(map[string]*TokenBucket),
+		inFlight: make(map[string]bool),
+		wake:     make(chan struct{}, 1),
+		now:      time.Now,
+	}
+}
+
+// chatIdOf chat_id из тела sendMessage, может быть числом или @username канала
+func chatIdOf(body []byte) (string, error) {
+	var b struct {
+		ChatId json.RawMessage `json:"chat_id"`
+	}
+	if err := json.Unmarshal(body, &b); err != nil {
+		return "", err
+	}
+	var id string
+	if err := json.Unmarshal(b.ChatId, &id); err == nil {
+		return id, nil
+	}
+	return string(b.ChatId), nil
+}
+
+// isGroupChat Идентификаторы групп и каналов отрицательные, каналы могут быть указаны через @username
+func isGroupChat(chatId string) bool {
+	id, err := strconv.ParseInt(chatId, 10, 64)
+	return err != nil || id < 0
+}
+
+func (o *Outbox) enqueue(priority OutboxPriority, body telegram.SendMessageBody) error {
+	return o.enqueueParts(priority, []telegram.SendMessageBody{body})
+}
+
+// enqueueParts Постановка в очередь частей одного длинного текста, см. OutboxMessage.Parts
+func (o *Outbox) enqueueParts(priority OutboxPriority, bodies []telegram.SendMessageBody) error {
+	var parts primitive.ObjectID
+	if len(bodies) > 1 {
+		parts = primitive.NewObjectID()
+	}
+	for _, body := range bodies {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		chatId, err := chatIdOf(b)
+		if err != nil {
+			return err
+		}
+		now := o.now()
+		err = o.repo.enqueue(OutboxMessage{
+			Id:            primitive.NewObjectID(),
+			ChatId:        chatId,
+			Priority:      priority,
+			Body:          string(b),
+			Status:        OutboxPending,
+			NextAttemptAt: now,
+			CreatedAt:     now,
+			Parts:         parts,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	o.signal()
+	return nil
+}
+
+func (o *Outbox) signal() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (o *Outbox) chatBucket(chatId string) *TokenBucket {
+	b, ok := o.chats[chatId]
+	if !ok {
+		if isGroupChat(chatId) {
+			b = NewTokenBucket(groupMessagesPerSecond, chatMessagesBurst)
+		} else {
+			b = NewTokenBucket(privateMessagesPerSecond, chatMessagesBurst)
+		}
+		o.chats[chatId] = b
+	}
+	return b
+}
+
+// run Отправка сообщений до отмены ctx, затем ожидание уже начатых отправок
+func (o *Outbox) run(ctx context.Context) {
+	for {
+		wait := o.dispatch()
+		select {
+		case <-ctx.Done():
+			o.wg.Wait()
+			return
+		case <-o.wake:
+		case <-time.After(wait):
+		}
+	}
+}
+
+// dispatch Запуск отправки всех сообщений, для которых позволяют лимиты.
+// Возвращает время, через которое стоит проверить очередь снова.
+func (o *Outbox) dispatch() time.Duration {
+	now := o.now()
+	wait := outboxIdleInterval
+	o.mu.Lock()
+	var busy []string
+	for chatId, b := range o.chats {
+		if o.inFlight[chatId] {
+			busy = append(busy, chatId)
+		} else if d := b.wait(now); d > 0 {
+			busy = append(busy, chatId)
+			wait = min(wait, d)
+		} else if b.full(now) {
+			delete(o.chats, chatId)
+		}
+	}
+	o.mu.Unlock()
+	messages, err := o.repo.pending(now, outboxBatchSize, busy)
+	if err != nil {
+		log.Printf("Не удалось получить очередь сообщений: %v", err)
+		return outboxIdleInterval
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, m := range messages {
+		if len(o.inFlight) >= outboxConcurrency {
+			break
+		}
+		if o.inFlight[m.ChatId] {
+			continue
+		}
+		chat := o.chatBucket(m.ChatId)
+		if d := chat.wait(now); d > 0 {
+			wait = min(wait, d)
+			continue
+		}
+		if d := o.global.wait(now); d > 0 {
+			wait = min(wait, d)
+			break
+		}
+		claimed, err := o.repo.claim(m.Id, now, now.Add(outboxLeaseTimeout))
+		if err != nil {
+			log.Printf("Не удалось захватить сообщение %s: %v", m.Id.Hex(), err)
+			continue
+		}
+		if !claimed {
+			continue
+		}
+		chat.take(now)
+		o.global.take(now)
+		o.inFlight[m.ChatId] = true
+		o.wg.Add(1)
+		go o.deliver(m)
+	}
+	return wait
+}
+
+func (o *Outbox) deliver(m OutboxMessage) {
+	defer o.wg.Done()
+	defer func() {
+		o.mu.Lock()
+		delete(o.inFlight, m.ChatId)
+		o.mu.Unlock()
+		o.signal()
+	}()
+	_, err := o.sender.sendMessage(telegram.RawSendMessageBody(m.Body))
+	if err == nil {
+		err = o.repo.remove(m.Id)
+		if err != nil {
+			log.Printf("Не удалось удалить отправленное сообщение %s: %v", m.Id.Hex(), err)
+		}
+		return
+	}
+	now := o.now()
+	var apiErr *telegram.APIError
+	if errors.As(err, &apiErr) && apiErr.IsTooManyRequests() {
+		// Превышение лимита не считается неудачной попыткой
+		err = o.repo.retry(m.Id, m.Attempts, now.Add(time.Duration(apiErr.Parameters.RetryAfter)*time.Second), err.Error())
+	} else if attempts := m.Attempts + 1; attempts >= outboxMaxAttempts || isPermanentSendError(err) {
+		log.Printf("Сообщение %s в чат %s не отправлено: %v", m.Id.Hex(), m.ChatId, err)
+		err = o.repo.deadLetter(m.Id, attempts, err.Error())
+		if err == nil && !m.Parts.IsZero() {
+			err = o.repo.dropParts(m.Parts, "не отправлена часть "+m.Id.Hex())
+		}
+	} else {
+		err = o.repo.retry(m.Id, attempts, now.Add(time.Second<<attempts), err.Error())
+	}
+	if err != nil {
+		log.Printf("Не удалось обновить сообщение %s в очереди: %v", m.Id.Hex(), err)
+	}
+}
+
+// isPermanentSendError Повторная отправка не поможет: неверный запрос или бот заблокирован в чате
+func isPermanentSendError(err error) bool {
+	var apiErr *telegram.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	return apiErr.ErrorCode == http.StatusBadRequest || apiErr.ErrorCode == http.StatusForbidden
+}
+
+// clientBot Отправка сообщений без повторов внутри клиента, повторами управляет очередь
+type clientBot struct {
+	client *telegram.Client
+}
+
+func (b clientBot) sendMessage(body telegram.SendMessageBody) (*telegram.Message, error) {
+	return b.client.SendMessage(context.TODO(), body)
+}
+
+func startOutbox(ctx context.Context) (done chan struct{}) {
+	if err := (OutboxDB{}).createIndexes(); err != nil {
+		log.Printf("Не удалось создать индексы очереди сообщений: %v", err)
+	}
+	client := *telegramClient
+	client.MaxRetries = 0
+	outbox = NewOutbox(OutboxDB{}, clientBot{client: &client})
+	done = make(chan struct{})
+	go func() {
+		defer close(done)
+		outbox.run(ctx)
+	}()
+	return done
+}
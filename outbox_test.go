@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sort"
+	"sync"
+	"telegram"
+	"testing"
+	"time"
+)
+
+type senderMock struct {
+	mu   sync.Mutex
+	sent []string
+	err  error
+}
+
+func (s *senderMock) sendMessage(body telegram.SendMessageBody) (*telegram.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return nil, s.err
+	}
+	b := body.(telegram.RawSendMessageBody)
+	text, _ := chatIdOf(b)
+	s.sent = append(s.sent, text)
+	return &telegram.Message{}, nil
+}
+
+func newTestOutbox(sender *senderMock) (*Outbox, *OutboxMemory, *time.Time) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	repo := NewOutboxMemory()
+	o := NewOutbox(repo, sender)
+	o.now = func() time.Time { return now }
+	return o, repo, &now
+}
+
+func TestOutbox_dispatch(t *testing.T) {
+	sender := &senderMock{}
+	o, repo, now := newTestOutbox(sender)
+	for i := 0; i < 5; i++ {
+		o.enqueue(PriorityBroadcast, telegram.SendMessageRequestBody[telegram.InlineKeyboardMarkup, int64]{ChatId: 1, Text: "report"})
+	}
+	o.enqueue(PriorityBroadcast, telegram.SendMessageRequestBody[telegram.InlineKeyboardMarkup, int64]{ChatId: -100, Text: "report"})
+	o.enqueue(PriorityInteractive, telegram.SendMessageRequestBody[telegram.InlineKeyboardMarkup, int64]{ChatId: 2, Text: "reply"})
+
+	messages, _ := repo.pending(*now, 100, nil)
+	if len(messages) != 3 || messages[0].ChatId != "2" {
+		t.Errorf("first pending chat = %s, want interactive reply to 2", messages[0].ChatId)
+	}
+
+	// Сообщения одного чата отправляются по одному
+	o.dispatch()
+	o.wg.Wait()
+	sort.Strings(sender.sent)
+	if want := []string{"-100", "1", "2"}; !reflect.DeepEqual(sender.sent, want) {
+		t.Errorf("sent = %v, want %v", sender.sent, want)
+	}
+
+	// Лимит чата: 1 сообщение в секунду, без серии подряд
+	sender.sent = nil
+	for i := 0; i < 3; i++ {
+		o.dispatch()
+		o.wg.Wait()
+	}
+	if len(sender.sent) != 0 {
+		t.Errorf("sent = %v, want nothing within a second", sender.sent)
+	}
+	sender.sent = nil
+	*now = now.Add(time.Second)
+	o.dispatch()
+	o.wg.Wait()
+	if want := []string{"1"}; !reflect.DeepEqual(sender.sent, want) {
+		t.Errorf("sent after 1s = %v, want %v", sender.sent, want)
+	}
+	if messages, _ = repo.pending(*now, 100, []string{"1"}); len(messages) != 0 {
+		t.Errorf("pending = %+v, want throttled chat skipped", messages)
+	}
+}
+
+func TestOutbox_dispatchLongQueue(t *testing.T) {
+	sender := &senderMock{}
+	o, repo, now := newTestOutbox(sender)
+	for i := 0; i < outboxBatchSize*2; i++ {
+		o.enqueue(PriorityInteractive, telegram.SendMessageRequestBody[telegram.InlineKeyboardMarkup, int64]{ChatId: 1, Text: "report"})
+	}
+	*now = now.Add(time.Second)
+	o.enqueue(PriorityInteractive, telegram.SendMessageRequestBody[telegram.InlineKeyboardMarkup, int64]{ChatId: 2, Text: "reply"})
+
+	if messages, _ := repo.pending(*now, outboxBatchSize, nil); len(messages) != 2 {
+		t.Fatalf("pending = %d сообщений, want первое сообщение каждого из 2 чатов", len(messages))
+	}
+	o.dispatch()
+	o.wg.Wait()
+	// Чат 1 ждет своего лимита, его очередь не задерживает чат 2
+	o.enqueue(PriorityBroadcast, telegram.SendMessageRequestBody[telegram.InlineKeyboardMarkup, int64]{ChatId: 3, Text: "digest"})
+	o.dispatch()
+	o.wg.Wait()
+	sort.Strings(sender.sent)
+	if want := []string{"1", "2", "3"}; !reflect.DeepEqual(sender.sent, want) {
+		t.Errorf("sent = %v, want %v", sender.sent, want)
+	}
+}
+
+func TestOutbox_deadLetter(t *testing.T) {
+	sender := &senderMock{err: errors.New("connection reset")}
+	o, repo, now := newTestOutbox(sender)
+	o.enqueue(PriorityBroadcast, telegram.SendMessageRequestBody[telegram.InlineKeyboardMarkup, int64]{ChatId: 1, Text: "report"})
+	for i := 0; i < outboxMaxAttempts; i++ {
+		*now = now.Add(time.Hour)
+		o.dispatch()
+		o.wg.Wait()
+	}
+	for _, m := range repo.messages {
+		if m.Status != OutboxDead || m.Attempts != outboxMaxAttempts || m.LastError != "connection reset" {
+			t.Errorf("message = %+v, want dead after %d attempts", m, outboxMaxAttempts)
+		}
+	}
+
+	sender.err = &telegram.APIError{ErrorCode: 403, Description: "Forbidden: bot was blocked by the user"}
+	o.enqueue(PriorityBroadcast, telegram.SendMessageRequestBody[telegram.InlineKeyboardMarkup, int64]{ChatId: 3, Text: "report"})
+	o.dispatch()
+	o.wg.Wait()
+	for _, m := range repo.messages {
+		if m.ChatId == "3" && (m.Status != OutboxDead || m.Attempts != 1) {
+			t.Errorf("message = %+v, want dead after first attempt", m)
+		}
+	}
+}
+
+func TestOutbox_dispatchHeadInBackoff(t *testing.T) {
+	sender := &senderMock{err: errors.New("connection reset")}
+	o, repo, now := newTestOutbox(sender)
+	o.enqueue(PriorityInteractive, telegram.SendMessageRequestBody[telegram.InlineKeyboardMarkup, int64]{ChatId: 1, Text: "1"})
+	o.dispatch()
+	o.wg.Wait()
+	sender.err = nil
+	o.enqueue(PriorityInteractive, telegram.SendMessageRequestBody[telegram.InlineKeyboardMarkup, int64]{ChatId: 1, Text: "2"})
+
+	// Первое сообщение ждет повтора 2 секунды, второе не обгоняет его
+	*now = now.Add(time.Second)
+	if messages, _ := repo.pending(*now, 100, nil); len(messages) != 0 {
+		t.Errorf("pending = %+v, want чат ждет повтора первого сообщения", messages)
+	}
+	o.dispatch()
+	o.wg.Wait()
+	if len(sender.sent) != 0 {
+		t.Fatalf("sent = %v, want второе сообщение ждет первое", sender.sent)
+	}
+
+	*now = now.Add(2 * time.Second)
+	var texts []string
+	for i := 0; i < 2; i++ {
+		messages, _ := repo.pending(*now, 100, nil)
+		if len(messages) != 1 {
+			t.Fatalf("pending = %+v, want 1 сообщение", messages)
+		}
+		var body struct {
+			Text string `json:"text"`
+		}
+		json.Unmarshal([]byte(messages[0].Body), &body)
+		texts = append(texts, body.Text)
+		o.dispatch()
+		o.wg.Wait()
+		*now = now.Add(time.Second)
+	}
+	if want := []string{"1", "2"}; !reflect.DeepEqual(texts, want) {
+		t.Errorf("порядок отправки = %v, want %v", texts, want)
+	}
+}
+
+func TestOutbox_deadLetterParts(t *testing.T) {
+	sender := &senderMock{err: &telegram.APIError{ErrorCode: 400, Description: "Bad Request: can't parse entities"}}
+	o, repo, now := newTestOutbox(sender)
+	var parts []telegram.SendMessageBody
+	for _, text := range []string{"часть 1", "часть 2", "часть 3"} {
+		parts = append(parts, telegram.SendMessageRequestBody[telegram.InlineKeyboardMarkup, int64]{ChatId: 1, Text: text})
+	}
+	o.enqueueParts(PriorityInteractive, parts)
+	o.dispatch()
+	o.wg.Wait()
+	sender.err = nil
+	o.enqueue(PriorityInteractive, telegram.SendMessageRequestBody[telegram.InlineKeyboardMarkup, int64]{ChatId: 1, Text: "reply"})
+
+	for i := 0; i < 3; i++ {
+		*now = now.Add(time.Second)
+		o.dispatch()
+		o.wg.Wait()
+	}
+	// Без первой части остальные не отправляются, следующее сообщение чата отправляется
+	if want := []string{"1"}; !reflect.DeepEqual(sender.sent, want) {
+		t.Errorf("sent = %v, want только следующее сообщение", sender.sent)
+	}
+	dead := 0
+	for _, m := range repo.messages {
+		if m.Status == OutboxDead {
+			dead++
+		}
+	}
+	if dead != 3 {
+		t.Errorf("dead = %d, want 3 части", dead)
+	}
+}
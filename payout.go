@@ -0,0 +1,85 @@
+package main
+
+import "github.com/shopspring/decimal"
+
+// Payout Расходы OZON и выплата продавцу по товару отправления, расходы положительные
+type Payout struct {
+	Commission  decimal.Decimal
+	Logistics   decimal.Decimal
+	Fulfillment decimal.Decimal
+	// Net Выплата за вычетом комиссии, логистики и фулфилмента
+	Net decimal.Decimal
+}
+
+func (p Payout) Add(o Payout) Payout {
+	return Payout{
+		Commission:  p.Commission.Add(o.Commission),
+		Logistics:   p.Logistics.Add(o.Logistics),
+		Fulfillment: p.Fulfillment.Add(o.Fulfillment),
+		Net:         p.Net.Add(o.Net),
+	}
+}
+
+// logistics Приемка и доставка отправления покупателю, со знаком OZON (списания отрицательные).
+// Обратная логистика учитывается отдельно по возвратам, см. returnLogistics.
+func (s ItemServices) logistics() float64 {
+	return s.MarketplaceServiceItemPickup +
+		s.MarketplaceServiceItemDropoffPvz +
+		s.MarketplaceServiceItemDropoffSc +
+		s.MarketplaceServiceItemDropoffFf +
+		s.MarketplaceServiceItemDirectFlowTrans +
+		s.MarketplaceServiceItemDelivToCustomer
+}
+
+// returnLogistics Обратная логистика и обработка возврата, со знаком OZON
+func (s ItemServices) returnLogistics() float64 {
+	return s.MarketplaceServiceItemReturnFlowTrans +
+		s.MarketplaceServiceItemReturnNotDelivToCustomer +
+		s.MarketplaceServiceItemReturnPartGoodsCustomer +
+		s.MarketplaceServiceItemReturnAfterDelivToCustomer
+}
+
+// servicesPayout Расходы на услуги OZON, уменьшающие выплату
+func servicesPayout(s ItemServices) Payout {
+	logistics := decimal.NewFromFloat(-s.logistics())
+	fulfillment := decimal.NewFromFloat(-s.MarketplaceServiceItemFulfillment)
+	return Payout{
+		Logistics:   logistics,
+		Fulfillment: fulfillment,
+		Net:         logistics.Add(fulfillment).Neg(),
+	}
+}
+
+// productPayout Выплата по товару: payout OZON уже учитывает комиссию, услуги вычитаются отдельно
+func productPayout(f FinancialDataProduct) Payout {
+	p := servicesPayout(f.ItemServices)
+	p.Commission = decimal.NewFromFloat(f.CommissionAmount)
+	p.Net = p.Net.Add(decimal.NewFromFloat(f.Payout))
+	return p
+}
+
+// postingPayouts Выплаты по товарам отправления, nil для товаров без финансовых данных.
+// Услуги уровня отправления относятся к первому товару с финансовыми данными.
+func postingPayouts(f PostingFinancials, products []PostingProduct) []*Payout {
+	payouts := make([]*Payout, len(products))
+	postingServices := true
+	for i := range products {
+		data, ok := f.productOf(products, i)
+		if !ok {
+			continue
+		}
+		p := productPayout(data)
+		if postingServices {
+			p = p.Add(servicesPayout(f.PostingServices))
+			postingServices = false
+		}
+		payouts[i] = &p
+	}
+	return payouts
+}
+
+// fallbackPayout Выплата по проценту сборов OZON из настроек, когда финансовых данных нет
+func fallbackPayout(price float64, cost float64) Payout {
+	commission := decimal.NewFromFloat(price * cost / 100)
+	return Payout{Commission: commission, Net: decimal.NewFromFloat(price).Sub(commission)}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestPostingPayouts(t *testing.T) {
+	products := []PostingProduct{{Sku: 10, Price: "1000"}, {Sku: 20, Price: "500"}, {Sku: 30, Price: "300"}}
+	f := PostingFinancials{
+		Products: []FinancialDataProduct{
+			{ProductId: 20, CommissionAmount: 75, Payout: 425, ItemServices: ItemServices{
+				MarketplaceServiceItemDirectFlowTrans: -40,
+				MarketplaceServiceItemDelivToCustomer: -25.5,
+				MarketplaceServiceItemFulfillment:     -10,
+			}},
+			{ProductId: 10, CommissionAmount: 150, Payout: 850},
+		},
+		PostingServices: ItemServices{MarketplaceServiceItemPickup: -20},
+	}
+	payouts := postingPayouts(f, products)
+	if payouts[2] != nil {
+		t.Errorf("payout without financial data = %+v, want nil", payouts[2])
+	}
+	tests := []struct {
+		name string
+		got  *Payout
+		want Payout
+	}{
+		{
+			name: "Первый товар получает услуги отправления",
+			got:  payouts[0],
+			want: Payout{Commission: decimal.NewFromInt(150), Logistics: decimal.NewFromInt(20), Fulfillment: decimal.Zero, Net: decimal.NewFromInt(830)},
+		},
+		{
+			name: "Товар сопоставлен по sku",
+			got:  payouts[1],
+			want: Payout{Commission: decimal.NewFromInt(75), Logistics: decimal.NewFromFloat(65.5), Fulfillment: decimal.NewFromInt(10), Net: decimal.NewFromFloat(349.5)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.got == nil {
+				t.Fatal("payout is nil")
+			}
+			if !tt.got.Commission.Equal(tt.want.Commission) || !tt.got.Logistics.Equal(tt.want.Logistics) ||
+				!tt.got.Fulfillment.Equal(tt.want.Fulfillment) || !tt.got.Net.Equal(tt.want.Net) {
+				t.Errorf("payout = %+v, want %+v", *tt.got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPostingFinancials_productOf(t *testing.T) {
+	f := PostingFinancials{Products: []FinancialDataProduct{
+		{ProductId: 10, Payout: 100},
+		{ProductId: 20, Payout: 200},
+		{ProductId: 10, Payout: 110},
+	}}
+	products := []PostingProduct{{Sku: 30}, {Sku: 10}, {Sku: 10}, {Sku: 10}}
+	tests := []struct {
+		name       string
+		i          int
+		wantOk     bool
+		wantPayout float64
+	}{
+		{name: "Нет sku в данных - без финансовых данных, а не по позиции", i: 0},
+		{name: "Первый товар с повторяющимся sku", i: 1, wantOk: true, wantPayout: 100},
+		{name: "Второй товар с тем же sku - своя запись", i: 2, wantOk: true, wantPayout: 110},
+		{name: "Записей с sku меньше, чем товаров", i: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := f.productOf(products, tt.i)
+			if ok != tt.wantOk || got.Payout != tt.wantPayout {
+				t.Errorf("productOf(%d) = %+v, %v", tt.i, got, ok)
+			}
+		})
+	}
+}
+
+func TestFallbackPayout(t *testing.T) {
+	p := fallbackPayout(1000, 17.5)
+	if !p.Commission.Equal(decimal.NewFromInt(175)) || !p.Net.Equal(decimal.NewFromInt(825)) {
+		t.Errorf("fallbackPayout() = %+v", p)
+	}
+}
+
+func TestPrintOrderSummaryReport_Payout(t *testing.T) {
+	text := printOrderSummaryReport(OrderReport{
+		TotalCount:           2,
+		SumWithoutCommission: decimal.NewFromInt(1179),
+		Payout:               Payout{Commission: decimal.NewFromInt(225), Logistics: decimal.NewFromFloat(85.5), Fulfillment: decimal.NewFromInt(10), Net: decimal.NewFromInt(1179)},
+		EstimatedCount:       1,
+		ReturnedCount:        2,
+		ReturnLogistics:      decimal.NewFromFloat(95.5),
+		Schemes:              []SchemeSummary{{Scheme: SchemeFBO, TotalCount: 2}},
+	})
+	for _, want := range []string{"Комиссия OZON: 225.00", "Логистика: 85.50", "Фулфилмент: 10.00", "Итого к выплате OZON: 1179.00", "Возвраты: 2 шт., обратная логистика 95.50", "Для 1 шт. OZON еще не рассчитал выплату"} {
+		if !strings.Contains(text, want) {
+			t.Errorf("report %q does not contain %q", text, want)
+		}
+	}
+}
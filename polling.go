@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"log"
+	"strings"
+	"telegram"
+	"time"
+)
+
+// Режимы получения обновлений от Telegram (переменная окружения UPDATE_MODE)
+const (
+	UpdateModeWebhook = "webhook"
+	UpdateModePolling = "polling"
+)
+
+// pollingTimeout Время ожидания обновлений в одном запросе getUpdates, в секундах
+const pollingTimeout = 50
+
+type UpdatesSource interface {
+	getUpdates(ctx context.Context, body telegram.GetUpdatesRequestBody) ([]telegram.Update, error)
+}
+
+// UpdatesOffsetRepository Хранение offset последнего обработанного обновления между перезапусками
+type UpdatesOffsetRepository interface {
+	getUpdatesOffset(botId string) (int64, error)
+	setUpdatesOffset(botId string, offset int64) error
+}
+
+type UpdatesOffsetDB struct {
+	BotId  string `bson:"_id"`
+	Offset int64  `bson:"offset"`
+}
+
+func (o UpdatesOffsetDB) getUpdatesOffset(botId string) (int64, error) {
+	coll := clientMongo.Database("MyInfantBotDB").Collection("bot_updates_offset")
+	filter := bson.D{{"_id", botId}}
+	err := coll.FindOne(context.TODO(), filter).Decode(&o)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return 0, nil
+	}
+	return o.Offset, err
+}
+
+func (o UpdatesOffsetDB) setUpdatesOffset(botId string, offset int64) error {
+	coll := clientMongo.Database("MyInfantBotDB").Collection("bot_updates_offset")
+	filter := bson.D{{"_id", botId}}
+	update := bson.D{{"$set", bson.D{{"offset", offset}}}}
+	opts := options.Update().SetUpsert(true)
+	_, err := coll.UpdateOne(context.TODO(), filter, update, opts)
+	return err
+}
+
+type UpdatesPoller struct {
+	source  UpdatesSource
+	offsets UpdatesOffsetRepository
+	botId   string
+	timeout int64
+	handle  func(m telegram.Update)
+}
+
+// run Цикл long polling. Полученная пачка обновлений всегда обрабатывается до конца,
+// после отмены ctx цикл завершается, не запрашивая новых обновлений.
+func (p *UpdatesPoller) run(ctx context.Context) error {
+	offset, err := p.offsets.getUpdatesOffset(p.botId)
+	if err != nil {
+		return err
+	}
+	retry := time.Second
+	for ctx.Err() == nil {
+		updates, err := p.source.getUpdates(ctx, telegram.GetUpdatesRequestBody{
+			Offset:  offset,
+			Timeout: p.timeout,
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			log.Printf("Ошибка получения обновлений, повтор через %s: %v", retry, err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(retry):
+			}
+			retry = min(retry*2, time.Minute)
+			continue
+		}
+		retry = time.Second
+		for _, u := range updates {
+			if u.UpdateId < offset {
+				continue
+			}
+			p.dispatch(u)
+			offset = u.UpdateId + 1
+			if err := p.offsets.setUpdatesOffset(p.botId, offset); err != nil {
+				log.Printf("Не удалось сохранить offset %d: %v", offset, err)
+			}
+		}
+	}
+	return nil
+}
+
+// dispatch Обработка одного обновления. Паника в обработчике не должна останавливать цикл.
+func (p *UpdatesPoller) dispatch(m telegram.Update) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Ошибка обработки обновления %d: %v", m.UpdateId, r)
+		}
+	}()
+	p.handle(m)
+}
+
+// botIdFromToken Идентификатор бота - часть token до двоеточия
+func botIdFromToken(token string) string {
+	return strings.Split(token, ":")[0]
+}
+
+func runPolling(ctx context.Context, bot *TelegramBot) {
+	if err := bot.deleteWebhook(telegram.DeleteWebhookRequestBody{}); err != nil {
+		log.Panicf("Не удалось отключить webhook: %v", err)
+	}
+	poller := UpdatesPoller{
+		source:  bot,
+		offsets: UpdatesOffsetDB{},
+		botId:   botIdFromToken(tokenTelegramBot),
+		timeout: pollingTimeout,
+		handle:  handleUpdate,
+	}
+	log.Printf("Получение обновлений через getUpdates")
+	if err := poller.run(ctx); err != nil {
+		log.Panic(err)
+	}
+	log.Printf("Получение обновлений через getUpdates остановлено")
+}
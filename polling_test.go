@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"telegram"
+	"testing"
+)
+
+type updatesSourceMock struct {
+	updates []telegram.Update
+	cancel  context.CancelFunc
+	offsets []int64
+}
+
+func (s *updatesSourceMock) getUpdates(ctx context.Context, body telegram.GetUpdatesRequestBody) ([]telegram.Update, error) {
+	s.offsets = append(s.offsets, body.Offset)
+	var result []telegram.Update
+	for _, u := range s.updates {
+		if u.UpdateId >= body.Offset {
+			result = append(result, u)
+		}
+	}
+	if len(result) == 0 {
+		s.cancel()
+	}
+	return result, nil
+}
+
+type updatesOffsetMock map[string]int64
+
+func (o updatesOffsetMock) getUpdatesOffset(botId string) (int64, error) {
+	return o[botId], nil
+}
+
+func (o updatesOffsetMock) setUpdatesOffset(botId string, offset int64) error {
+	o[botId] = offset
+	return nil
+}
+
+func TestUpdatesPoller_run(t *testing.T) {
+	offsets := updatesOffsetMock{}
+	updates := []telegram.Update{{UpdateId: 10}, {UpdateId: 11}, {UpdateId: 12}}
+	tests := []struct {
+		name        string
+		wantHandled []int64
+		wantOffsets []int64
+	}{
+		{name: "Первый запуск", wantHandled: []int64{10, 11, 12}, wantOffsets: []int64{0, 13}},
+		{name: "Перезапуск без повторной обработки", wantHandled: nil, wantOffsets: []int64{13}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			source := &updatesSourceMock{updates: updates, cancel: cancel}
+			var handled []int64
+			poller := UpdatesPoller{
+				source:  source,
+				offsets: offsets,
+				botId:   "1",
+				handle: func(m telegram.Update) {
+					handled = append(handled, m.UpdateId)
+					if m.UpdateId == 11 {
+						panic("ошибка обработчика")
+					}
+				},
+			}
+			if err := poller.run(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(handled, tt.wantHandled) {
+				t.Errorf("handled = %v, want %v", handled, tt.wantHandled)
+			}
+			if !reflect.DeepEqual(source.offsets, tt.wantOffsets) {
+				t.Errorf("offsets = %v, want %v", source.offsets, tt.wantOffsets)
+			}
+			if offsets["1"] != 13 {
+				t.Errorf("saved offset = %d, want 13", offsets["1"])
+			}
+		})
+	}
+}
@@ -0,0 +1,736 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"format"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"telegram"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// groupRulesTestDays Период заказов, на которых проверяются правила группировки
+	groupRulesTestDays = 14
+	// groupRulesTestProducts Сколько товаров группы показывать при проверке правил
+	groupRulesTestProducts = 10
+	productInfoPageLimit   = 1000
+)
+
+// GroupRuleKind Признак товара, по которому правило относит его к группе
+type GroupRuleKind string
+
+const (
+	GroupByOfferPrefix GroupRuleKind = "offer_prefix"
+	GroupBySku         GroupRuleKind = "sku"
+	GroupByNameRegex   GroupRuleKind = "name_regex"
+	GroupByCategory    GroupRuleKind = "category"
+)
+
+var groupRuleKinds = []GroupRuleKind{GroupByOfferPrefix, GroupBySku, GroupByNameRegex, GroupByCategory}
+
+func (k GroupRuleKind) String() string {
+	switch k {
+	case GroupByOfferPrefix:
+		return "Префикс артикула"
+	case GroupBySku:
+		return "Список SKU"
+	case GroupByNameRegex:
+		return "Название (regexp)"
+	case GroupByCategory:
+		return "Категория OZON"
+	}
+	return string(k)
+}
+
+// hint Подсказка, что присылать в первой строке правила
+func (k GroupRuleKind) hint() string {
+	switch k {
+	case GroupByOfferPrefix:
+		return "начало артикула (offer_id), например SOCK-W"
+	case GroupBySku:
+		return "SKU OZON через запятую, например 123456789, 987654321"
+	case GroupByNameRegex:
+		return "регулярное выражение для названия товара, например (?i)^получешки"
+	case GroupByCategory:
+		return "номер категории или типа товара OZON либо его название, например Носки"
+	}
+	return ""
+}
+
+// GroupRule Правило группировки товаров. Правила проверяются по порядку, товар попадает в группу первого подошедшего,
+// товар без подходящего правила образует группу из своего названия.
+type GroupRule struct {
+	Id    primitive.ObjectID `bson:"id"`
+	Kind  GroupRuleKind      `bson:"kind"`
+	Value string             `bson:"value"`
+	Group string             `bson:"group"`
+}
+
+func (r GroupRule) String() string {
+	return fmt.Sprintf("%s: %s → %s", r.Kind, r.Value, r.Group)
+}
+
+// ProductCategory Категория и тип товара OZON
+type ProductCategory struct {
+	CategoryId   int64
+	TypeId       int64
+	CategoryName string
+	TypeName     string
+}
+
+// groupMatcher Скомпилированное правило группировки
+type groupMatcher struct {
+	rule       GroupRule
+	skus       map[int64]bool
+	re         *regexp.Regexp
+	categoryId int64
+}
+
+// compile Проверка и подготовка правила, ошибка описывает, что не так со значением
+func (r GroupRule) compile() (groupMatcher, error) {
+	m := groupMatcher{rule: r}
+	if strings.TrimSpace(r.Group) == "" {
+		return m, errors.New("не указано название группы")
+	}
+	if strings.TrimSpace(r.Value) == "" {
+		return m, errors.New("не указано значение правила")
+	}
+	switch r.Kind {
+	case GroupByOfferPrefix:
+	case GroupBySku:
+		m.skus = make(map[int64]bool)
+		for _, s := range strings.Split(r.Value, ",") {
+			sku, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+			if err != nil {
+				return m, fmt.Errorf("SKU %q не число", strings.TrimSpace(s))
+			}
+			m.skus[sku] = true
+		}
+	case GroupByNameRegex:
+		re, err := regexp.Compile(r.Value)
+		if err != nil {
+			return m, fmt.Errorf("неверное регулярное выражение: %v", err)
+		}
+		m.re = re
+	case GroupByCategory:
+		m.categoryId, _ = strconv.ParseInt(r.Value, 10, 64)
+	default:
+		return m, fmt.Errorf("неизвестный вид правила %q", r.Kind)
+	}
+	return m, nil
+}
+
+func (m groupMatcher) match(sku int64, offerId string, name string, category ProductCategory) bool {
+	switch m.rule.Kind {
+	case GroupByOfferPrefix:
+		return strings.HasPrefix(offerId, m.rule.Value)
+	case GroupBySku:
+		return m.skus[sku]
+	case GroupByNameRegex:
+		return m.re.MatchString(name)
+	case GroupByCategory:
+		if m.categoryId != 0 {
+			return category.CategoryId == m.categoryId || category.TypeId == m.categoryId
+		}
+		return strings.EqualFold(category.CategoryName, m.rule.Value) || strings.EqualFold(category.TypeName, m.rule.Value)
+	}
+	return false
+}
+
+// ProductGrouper Группировка товаров по правилам пользователя
+type ProductGrouper struct {
+	matchers []groupMatcher
+	// categories Категории товаров по sku, заполняются, только если есть правила по категории
+	categories map[int64]ProductCategory
+}
+
+// newProductGrouper Группировка по правилам, неверные правила пропускаются
+func newProductGrouper(rules []GroupRule) *ProductGrouper {
+	g := &ProductGrouper{}
+	for _, rule := range rules {
+		m, err := rule.compile()
+		if err != nil {
+			log.Printf("Правило группировки %s пропущено: %v", rule, err)
+			continue
+		}
+		g.matchers = append(g.matchers, m)
+	}
+	return g
+}
+
+// needsCategories Есть правила по категории OZON, для них нужны категории товаров
+func (g *ProductGrouper) needsCategories() bool {
+	for _, m := range g.matchers {
+		if m.rule.Kind == GroupByCategory {
+			return true
+		}
+	}
+	return false
+}
+
+// needsCategoryNames Есть правила по названию категории, для них нужно дерево категорий OZON
+func (g *ProductGrouper) needsCategoryNames() bool {
+	for _, m := range g.matchers {
+		if m.rule.Kind == GroupByCategory && m.categoryId == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// match Группа товара и правило, по которому она определена. Без подходящего правила группа - название товара.
+func (g *ProductGrouper) match(sku int64, offerId string, name string) (string, *GroupRule) {
+	category := g.categories[sku]
+	for _, m := range g.matchers {
+		if m.match(sku, offerId, name, category) {
+			return m.rule.Group, &m.rule
+		}
+	}
+	return name, nil
+}
+
+func (g *ProductGrouper) group(sku int64, offerId string, name string) string {
+	group, _ := g.match(sku, offerId, name)
+	return group
+}
+
+func (g *ProductGrouper) productGroup(p PostingProduct) string {
+	return g.group(int64(p.Sku), p.OfferId, p.Name)
+}
+
+// ProductGroupRepository Группы товаров пользователя, для которых задается закупочная цена
+type ProductGroupRepository interface {
+	// addProductGroups Добавление групп, которых еще нет, с нулевой закупочной ценой
+	addProductGroups(userId int64, groups []string) error
+}
+
+// addProductGroups Все группы добавляются одним BulkWrite. Каждая операция добавляет группу, только если ее еще нет,
+// проверка и добавление атомарны в пределах документа, поэтому параллельные отчеты не создают дублей
+// и не затирают закупочные цены.
+func (m UserDB) addProductGroups(userId int64, groups []string) error {
+	if len(groups) == 0 {
+		return nil
+	}
+	coll := clientMongo.Database("MyInfantBotDB").Collection("bot_users")
+	models := make([]mongo.WriteModel, 0, len(groups))
+	for _, name := range groups {
+		filter := bson.D{
+			{"telegram_user.user.id", userId},
+			{"telegram_user.settings.ozon_setting.product_setting.group_products.name_group", bson.D{{"$ne", name}}},
+		}
+		update := bson.D{{"$push", bson.D{{"telegram_user.settings.ozon_setting.product_setting.group_products", GroupProducts{NameGroup: name}}}}}
+		models = append(models, mongo.NewUpdateOneModel().SetFilter(filter).SetUpdate(update))
+	}
+	_, err := coll.BulkWrite(context.TODO(), models, options.BulkWrite().SetOrdered(false))
+	return err
+}
+
+// ProductGroupMemory Группы товаров в памяти процесса
+type ProductGroupMemory struct {
+	mu     sync.Mutex
+	groups map[int64][]GroupProducts
+}
+
+func NewProductGroupMemory() *ProductGroupMemory {
+	return &ProductGroupMemory{groups: make(map[int64][]GroupProducts)}
+}
+
+func (d *ProductGroupMemory) addProductGroups(userId int64, groups []string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, name := range groups {
+		if findIndex(d.groups[userId], func(gp GroupProducts) bool { return gp.NameGroup == name }) < 0 {
+			d.groups[userId] = append(d.groups[userId], GroupProducts{NameGroup: name})
+		}
+	}
+	return nil
+}
+
+// GroupCatalog Категории товаров OZON для правил группировки
+type GroupCatalog interface {
+	productCategories(userId int64, skus []int64) (map[int64]ProductCategory, error)
+	categoryNames(userId int64) (categories map[int64]string, types map[int64]string, err error)
+}
+
+type ProductInfoListRequest struct {
+	Sku []int64 `json:"sku"`
+}
+type ProductInfoListResponse struct {
+	Items []struct {
+		OfferId               string `json:"offer_id"`
+		DescriptionCategoryId int64  `json:"description_category_id"`
+		TypeId                int64  `json:"type_id"`
+		Sources               []struct {
+			Sku int64 `json:"sku"`
+		} `json:"sources"`
+	} `json:"items"`
+}
+
+type CategoryTreeRequest struct {
+	Language string `json:"language"`
+}
+type CategoryTreeNode struct {
+	DescriptionCategoryId int64              `json:"description_category_id"`
+	CategoryName          string             `json:"category_name"`
+	TypeId                int64              `json:"type_id"`
+	TypeName              string             `json:"type_name"`
+	Children              []CategoryTreeNode `json:"children"`
+}
+type CategoryTreeResponse struct {
+	Result []CategoryTreeNode `json:"result"`
+}
+
+func (m *OzonMarketplace) productCategories(userId int64, skus []int64) (map[int64]ProductCategory, error) {
+	categories := make(map[int64]ProductCategory, len(skus))
+	for start := 0; start < len(skus); start += productInfoPageLimit {
+		end := min(start+productInfoPageLimit, len(skus))
+		var r ProductInfoListResponse
+		if err := m.ozonRequest(userId, "/v3/product/info/list", ProductInfoListRequest{Sku: skus[start:end]}, &r); err != nil {
+			return nil, err
+		}
+		for _, item := range r.Items {
+			for _, source := range item.Sources {
+				categories[source.Sku] = ProductCategory{CategoryId: item.DescriptionCategoryId, TypeId: item.TypeId}
+			}
+		}
+	}
+	return categories, nil
+}
+
+func (m *OzonMarketplace) categoryNames(userId int64) (map[int64]string, map[int64]string, error) {
+	var r CategoryTreeResponse
+	if err := m.ozonRequest(userId, "/v1/description-category/tree", CategoryTreeRequest{Language: "DEFAULT"}, &r); err != nil {
+		return nil, nil, err
+	}
+	categories := make(map[int64]string)
+	types := make(map[int64]string)
+	var walk func(nodes []CategoryTreeNode)
+	walk = func(nodes []CategoryTreeNode) {
+		for _, node := range nodes {
+			if node.DescriptionCategoryId != 0 {
+				categories[node.DescriptionCategoryId] = node.CategoryName
+			}
+			if node.TypeId != 0 {
+				types[node.TypeId] = node.TypeName
+			}
+			walk(node.Children)
+		}
+	}
+	walk(r.Result)
+	return categories, types, nil
+}
+
+// productGrouper Группировка товаров skus по правилам пользователя. Категории запрашиваются у OZON,
+// только если есть правила по категории; если OZON не ответил, такие правила не срабатывают.
+func productGrouper(catalog GroupCatalog, userId int64, rules []GroupRule, skus []int64) *ProductGrouper {
+	g := newProductGrouper(rules)
+	if !g.needsCategories() || len(skus) == 0 {
+		return g
+	}
+	categories, err := catalog.productCategories(userId, skus)
+	if err != nil {
+		log.Printf("Не удалось получить категории товаров пользователя %d: %v", userId, err)
+		return g
+	}
+	if g.needsCategoryNames() {
+		categoryNames, typeNames, err := catalog.categoryNames(userId)
+		if err != nil {
+			log.Printf("Не удалось получить дерево категорий OZON пользователя %d: %v", userId, err)
+		}
+		for sku, c := range categories {
+			c.CategoryName = categoryNames[c.CategoryId]
+			c.TypeName = typeNames[c.TypeId]
+			categories[sku] = c
+		}
+	}
+	g.categories = categories
+	return g
+}
+
+// lineSkus Различные sku товаров отправлений
+func lineSkus(lines []ozonLine) []int64 {
+	seen := make(map[int64]bool)
+	var skus []int64
+	for _, line := range lines {
+		sku := int64(line.Product.Sku)
+		if !seen[sku] {
+			seen[sku] = true
+			skus = append(skus, sku)
+		}
+	}
+	return skus
+}
+
+// schemeLines Товары отправлений за период по схемам работы, включенным в отчеты. Схемы загружаются параллельно.
+// При PartialResultError любой из схем возвращаются все полученные товары и эта ошибка.
+func (m *OzonMarketplace) schemeLines(userId int64, setting *OzonSetting, filter FilterFbo) (map[DeliveryScheme][]ozonLine, error) {
+	schemes := setting.schemes()
+	lines := make([][]ozonLine, len(schemes))
+	errs := make([]error, len(schemes))
+	var wg sync.WaitGroup
+	for i, scheme := range schemes {
+		wg.Add(1)
+		go func(i int, scheme DeliveryScheme) {
+			defer wg.Done()
+			lines[i], errs[i] = m.orderLines(userId, scheme, filter)
+		}(i, scheme)
+	}
+	wg.Wait()
+	result := make(map[DeliveryScheme][]ozonLine, len(schemes))
+	var partial error
+	for i, scheme := range schemes {
+		if errs[i] != nil && !isPartialResult(errs[i]) {
+			return nil, errs[i]
+		}
+		if partial == nil {
+			partial = errs[i]
+		}
+		result[scheme] = lines[i]
+	}
+	return result, partial
+}
+
+// periodLines Товары отправлений за период по всем схемам работы, включенным в отчеты.
+// Неполная выгрузка считается ошибкой.
+func (m *OzonMarketplace) periodLines(userId int64, setting *OzonSetting, filter FilterFbo) ([]ozonLine, error) {
+	schemeLines, err := m.schemeLines(userId, setting, filter)
+	if err != nil {
+		return nil, err
+	}
+	var lines []ozonLine
+	for _, scheme := range setting.schemes() {
+		lines = append(lines, schemeLines[scheme]...)
+	}
+	return lines, nil
+}
+
+// GroupTest Результат проверки правил: товары, попавшие в группу
+type GroupTest struct {
+	Group    string
+	Rule     *GroupRule
+	Products []string
+}
+
+// testGroupRules Распределение товаров заказов по группам. Сначала группы по правилам в порядке правил,
+// затем товары без подходящего правила.
+func testGroupRules(g *ProductGrouper, lines []ozonLine) (matched []GroupTest, unmatched []string) {
+	groups := make(map[string]*GroupTest)
+	seen := make(map[int64]bool)
+	for _, line := range lines {
+		p := line.Product
+		if seen[int64(p.Sku)] {
+			continue
+		}
+		seen[int64(p.Sku)] = true
+		group, rule := g.match(int64(p.Sku), p.OfferId, p.Name)
+		if rule == nil {
+			unmatched = append(unmatched, p.Name)
+			continue
+		}
+		t, ok := groups[group]
+		if !ok {
+			t = &GroupTest{Group: group, Rule: rule}
+			groups[group] = t
+		}
+		t.Products = append(t.Products, p.Name)
+	}
+	for _, m := range g.matchers {
+		if t, ok := groups[m.rule.Group]; ok {
+			sort.Strings(t.Products)
+			matched = append(matched, *t)
+			delete(groups, m.rule.Group)
+		}
+	}
+	sort.Strings(unmatched)
+	return matched, unmatched
+}
+
+func printGroupRulesTest(matched []GroupTest, unmatched []string, days int) string {
+	indent := format.Plain("    ")
+	mess := []format.Fragment{
+		format.Line(format.Bold(format.Plainf("Группы товаров по заказам за %d дн.:", days))),
+	}
+	products := func(names []string) {
+		for i, name := range names {
+			if i == groupRulesTestProducts {
+				mess = append(mess, format.Line(indent, format.Italic(format.Plainf("и еще %d", len(names)-i))))
+				break
+			}
+			mess = append(mess, format.Line(indent, format.Plain(name)))
+		}
+	}
+	for _, t := range matched {
+		mess = append(mess, format.Line(), format.Line(format.Bold(format.Plain(t.Group)), format.Plainf(" - %d тов.", len(t.Products))))
+		products(t.Products)
+	}
+	if len(unmatched) > 0 {
+		mess = append(mess, format.Line(), format.Line(format.Bold(format.Plainf("Без правила, группа - название товара: %d тов.", len(unmatched)))))
+		products(unmatched)
+	}
+	if len(matched) == 0 && len(unmatched) == 0 {
+		mess = append(mess, format.Line(format.Italic(format.Plain("Заказов за период нет."))))
+	}
+	return format.Render(format.HTML, mess...)
+}
+
+// parseGroupRule Правило из сообщения пользователя: в первой строке значение, во второй название группы
+func parseGroupRule(kind GroupRuleKind, text string) (GroupRule, error) {
+	parts := strings.SplitN(strings.TrimSpace(text), "\n", 2)
+	rule := GroupRule{Id: primitive.NewObjectID(), Kind: kind, Value: strings.TrimSpace(parts[0])}
+	if len(parts) == 2 {
+		rule.Group = strings.TrimSpace(parts[1])
+	}
+	_, err := rule.compile()
+	return rule, err
+}
+
+func (m UserDB) addGroupRule(userId int64, rule GroupRule) error {
+	coll := clientMongo.Database("MyInfantBotDB").Collection("bot_users")
+	update := bson.D{{"$push", bson.D{{"telegram_user.settings.ozon_setting.product_setting.group_rules", rule}}}}
+	filter := bson.D{{"telegram_user.user.id", userId}}
+	_, err := coll.UpdateOne(context.TODO(), filter, update)
+	return err
+}
+
+func (m UserDB) deleteGroupRule(userId int64, id primitive.ObjectID) error {
+	coll := clientMongo.Database("MyInfantBotDB").Collection("bot_users")
+	update := bson.D{{"$pull", bson.D{{"telegram_user.settings.ozon_setting.product_setting.group_rules", bson.D{{"id", id}}}}}}
+	filter := bson.D{{"telegram_user.user.id", userId}}
+	_, err := coll.UpdateOne(context.TODO(), filter, update)
+	return err
+}
+
+// legacyGroupLines Линейки, которые прежняя группировка вырезала из названия товара
+var legacyGroupLines = []string{"Получешки Colibri ", "Полупальцы Colibri "}
+
+// legacyGroupRules Правила, повторяющие прежнюю группировку для уже сохраненных групп: товар «Получешки Colibri Белые»
+// по-прежнему попадает в группу «Белые» и сохраняет ее закупочную цену. Группы, уже заданные правилами,
+// и полные названия товаров линеек пропускаются.
+func legacyGroupRules(groups []GroupProducts, rules []GroupRule) []GroupRule {
+	lines := make([]string, len(legacyGroupLines))
+	for i, line := range legacyGroupLines {
+		lines[i] = regexp.QuoteMeta(line)
+	}
+	var seeded []GroupRule
+	for _, gp := range groups {
+		name := strings.TrimSpace(gp.NameGroup)
+		if name == "" || findIndex(rules, func(r GroupRule) bool { return r.Group == name }) >= 0 ||
+			findIndex(seeded, func(r GroupRule) bool { return r.Group == name }) >= 0 ||
+			findIndex(legacyGroupLines, func(line string) bool { return strings.HasPrefix(name, line) }) >= 0 {
+			continue
+		}
+		seeded = append(seeded, GroupRule{
+			Id:    primitive.NewObjectID(),
+			Kind:  GroupByNameRegex,
+			Value: "^(?:" + strings.Join(lines, "|") + ")" + regexp.QuoteMeta(name) + "$",
+			Group: name,
+		})
+	}
+	return seeded
+}
+
+// migrateGroupRules Однократный перевод пользователей с прежней группировки на правила. Обновление атомарно
+// по признаку group_rules_migrated, поэтому запуск на нескольких репликах не дублирует правила.
+func (m UserDB) migrateGroupRules() error {
+	coll := clientMongo.Database("MyInfantBotDB").Collection("bot_users")
+	migrated := "telegram_user.settings.ozon_setting.product_setting.group_rules_migrated"
+	cursor, err := coll.Find(context.TODO(), bson.D{{migrated, bson.D{{"$ne", true}}}})
+	if err != nil {
+		return err
+	}
+	var users []UserDB
+	if err := cursor.All(context.TODO(), &users); err != nil {
+		return err
+	}
+	for _, user := range users {
+		product := user.TelegramUser.Settings.OzonSetting.ProductSetting
+		rules := legacyGroupRules(product.GroupProducts, product.GroupRules)
+		update := bson.D{{"$set", bson.D{{migrated, true}}}}
+		if len(rules) > 0 {
+			update = append(update, bson.E{Key: "$push", Value: bson.D{{"telegram_user.settings.ozon_setting.product_setting.group_rules", bson.D{{"$each", rules}}}}})
+		}
+		filter := bson.D{{"_id", user.Id}, {migrated, bson.D{{"$ne", true}}}}
+		if _, err := coll.UpdateOne(context.TODO(), filter, update); err != nil {
+			return err
+		}
+		if len(rules) > 0 {
+			log.Printf("Пользователю %d добавлено правил группировки из прежних групп: %d", user.TelegramUser.User.Id, len(rules))
+		}
+	}
+	return nil
+}
+
+func groupRulesMarkup(rules []GroupRule) telegram.InlineKeyboardMarkup {
+	var buttons []telegram.ButtonBot[telegram.InlineKeyboardButton]
+	for i, rule := range rules {
+		buttons = append(buttons, telegram.ButtonBot[telegram.InlineKeyboardButton]{
+			Row: i + 1, Col: 1, Button: telegram.InlineKeyboardButton{Text: "❌ " + rule.String(), CallbackData: "/groupruledel-" + rule.Id.Hex()},
+		})
+	}
+	buttons = append(buttons,
+		telegram.ButtonBot[telegram.InlineKeyboardButton]{Row: len(rules) + 1, Col: 1, Button: telegram.InlineKeyboardButton{Text: "Добавить правило", CallbackData: "/groupruleadd"}},
+		telegram.ButtonBot[telegram.InlineKeyboardButton]{Row: len(rules) + 1, Col: 2, Button: telegram.InlineKeyboardButton{Text: "Проверить на заказах", CallbackData: "/grouprulestest"}},
+		telegram.ButtonBot[telegram.InlineKeyboardButton]{Row: len(rules) + 2, Col: 1, Button: telegram.InlineKeyboardButton{Text: "Назад", CallbackData: "/ozonsetting"}},
+	)
+	return telegram.InlineKeyboardMarkup{InlineKeyboard: CreateButtonsBot[telegram.InlineKeyboardButton](buttons)}
+}
+
+func editGroupRules(q telegram.CallbackQuery, userId int64) {
+	bot := TelegramBot{}
+	setting, err := UserDB{}.getOzonSetting(userId)
+	if err != nil {
+		log.Printf("Не удалось получить настройки пользователя %d: %v", userId, err)
+		return
+	}
+	rules := setting.ProductSetting.GroupRules
+	text := "Правила проверяются по порядку, товар попадает в группу первого подошедшего. Закупочная цена задается для группы. Нажмите на правило, чтобы удалить его."
+	if len(rules) == 0 {
+		text = "Правил пока нет, каждый товар - отдельная группа. Добавьте правила, чтобы объединить товары в группы с общей закупочной ценой."
+	}
+	EditMessageTextToBot(&bot, telegram.EditMessageTextRequestBody{
+		ChatId:      q.Message.Chat.Id,
+		MessageId:   q.Message.MessageId,
+		ParseMode:   format.HTML.ParseMode(),
+		Text:        htmlText(format.Plain(text)),
+		ReplyMarkup: groupRulesMarkup(rules),
+	})
+}
+
+func groupRulesHandler(c *RouteContext) {
+	bot := TelegramBot{}
+	answerCallbackQueryToBot(&bot, telegram.AnswerCallbackQueryRequestBody{CallbackQueryId: c.Update.CallbackQuery.Id})
+	editGroupRules(c.Update.CallbackQuery, c.Access.OwnerId)
+}
+
+func deleteGroupRuleHandler(c *RouteContext) {
+	q := c.Update.CallbackQuery
+	bot := TelegramBot{}
+	id, err := primitive.ObjectIDFromHex(c.Payload)
+	if err != nil {
+		answerCallbackQueryToBot(&bot, telegram.AnswerCallbackQueryRequestBody{CallbackQueryId: q.Id, Text: "Кнопка устарела."})
+		return
+	}
+	if err := (UserDB{}).deleteGroupRule(c.Access.OwnerId, id); err != nil {
+		panic(err)
+	}
+	answerCallbackQueryToBot(&bot, telegram.AnswerCallbackQueryRequestBody{CallbackQueryId: q.Id, Text: "Правило удалено."})
+	editGroupRules(q, c.Access.OwnerId)
+}
+
+// newGroupRuleHandler Выбор вида правила, затем значение и группа сообщением
+func newGroupRuleHandler(c *RouteContext) {
+	q := c.Update.CallbackQuery
+	bot := TelegramBot{}
+	if c.Payload != "" {
+		kind := GroupRuleKind(c.Payload)
+		if findIndex(groupRuleKinds, func(k GroupRuleKind) bool { return k == kind }) < 0 {
+			answerCallbackQueryToBot(&bot, telegram.AnswerCallbackQueryRequestBody{CallbackQueryId: q.Id, Text: "Кнопка устарела."})
+			return
+		}
+		askSettingValue(q, StateAwaitGroupRule, ConversationPayload{GroupRuleKind: kind},
+			format.Concat(format.Plain("ОК. Пришлите правило двумя строками: в первой "+kind.hint()+", во второй "),
+				format.Bold(format.Plain("название группы")), format.Plain(".")))
+		return
+	}
+	answerCallbackQueryToBot(&bot, telegram.AnswerCallbackQueryRequestBody{CallbackQueryId: q.Id})
+	var buttons []telegram.ButtonBot[telegram.InlineKeyboardButton]
+	for i, kind := range groupRuleKinds {
+		buttons = append(buttons, telegram.ButtonBot[telegram.InlineKeyboardButton]{
+			Row: i/2 + 1, Col: i%2 + 1, Button: telegram.InlineKeyboardButton{Text: kind.String(), CallbackData: "/grouprulenew-" + string(kind)},
+		})
+	}
+	buttons = append(buttons, telegram.ButtonBot[telegram.InlineKeyboardButton]{
+		Row: 10, Col: 1, Button: telegram.InlineKeyboardButton{Text: "Назад", CallbackData: "/grouprules"},
+	})
+	EditMessageTextToBot(&bot, telegram.EditMessageTextRequestBody{
+		ChatId:      q.Message.Chat.Id,
+		MessageId:   q.Message.MessageId,
+		ParseMode:   format.HTML.ParseMode(),
+		Text:        htmlText(format.Plain("По какому признаку объединять товары в группу?")),
+		ReplyMarkup: telegram.InlineKeyboardMarkup{InlineKeyboard: CreateButtonsBot[telegram.InlineKeyboardButton](buttons)},
+	})
+}
+
+// groupRulesTestText Проверка правил пользователя на заказах последних groupRulesTestDays дней
+func groupRulesTestText(userId int64, now time.Time) (string, error) {
+	marketplace := &OzonMarketplace{}
+	setting, err := UserDB{}.getOzonSetting(userId)
+	if err != nil {
+		return "", err
+	}
+	period := lastDaysRange(now, UserDB{}.userLocation(userId), groupRulesTestDays)
+	lines, err := marketplace.periodLines(userId, setting, period.filter())
+	if err != nil {
+		return "", err
+	}
+	grouper := productGrouper(marketplace, userId, setting.ProductSetting.GroupRules, lineSkus(lines))
+	matched, unmatched := testGroupRules(grouper, lines)
+	return printGroupRulesTest(matched, unmatched, groupRulesTestDays), nil
+}
+
+func sendGroupRulesTest(chatId int64, userId int64) {
+	bot := TelegramBot{}
+	text, err := groupRulesTestText(userId, time.Now())
+	if err != nil {
+		log.Printf("Не удалось проверить правила группировки пользователя %d: %v", userId, err)
+		text = htmlText(format.Plain("Не удалось получить заказы OZON для проверки правил, попробуйте позже."))
+	}
+	SendLongMessageToBot(&bot, telegram.SendMessageRequestBody[telegram.InlineKeyboardMarkup, int64]{
+		ChatId:    chatId,
+		ParseMode: format.HTML.ParseMode(),
+		Text:      text,
+		ReplyMarkup: telegram.InlineKeyboardMarkup{InlineKeyboard: CreateButtonsBot[telegram.InlineKeyboardButton]([]telegram.ButtonBot[telegram.InlineKeyboardButton]{
+			{Row: 1, Col: 1, Button: telegram.InlineKeyboardButton{Text: "Группы товаров", CallbackData: "/grouprules"}},
+		})},
+	})
+}
+
+func testGroupRulesHandler(c *RouteContext) {
+	q := c.Update.CallbackQuery
+	bot := TelegramBot{}
+	answerCallbackQueryToBot(&bot, telegram.AnswerCallbackQueryRequestBody{CallbackQueryId: q.Id, Text: "Проверяю правила на заказах..."})
+	sendGroupRulesTest(q.Message.Chat.Id, c.Access.OwnerId)
+}
+
+func saveGroupRuleHandler(c *RouteContext) {
+	m := c.Update.Message
+	kind := c.Conversation.Payload.GroupRuleKind
+	finishConversation(m)
+	bot := TelegramBot{}
+	rule, err := parseGroupRule(kind, m.Text)
+	if err != nil {
+		SendMessageToBot(&bot, telegram.SendMessageRequestBody[telegram.InlineKeyboardMarkup, int64]{
+			ChatId:    m.Chat.Id,
+			ParseMode: format.HTML.ParseMode(),
+			Text:      htmlText(format.Plain("Правило не сохранено: "), format.Plain(err.Error()), format.Plain(". Попробуйте еще раз через меню групп товаров.")),
+			ReplyMarkup: telegram.InlineKeyboardMarkup{InlineKeyboard: CreateButtonsBot[telegram.InlineKeyboardButton]([]telegram.ButtonBot[telegram.InlineKeyboardButton]{
+				{Row: 1, Col: 1, Button: telegram.InlineKeyboardButton{Text: "Группы товаров", CallbackData: "/grouprules"}},
+			})},
+		})
+		return
+	}
+	if err := (UserDB{}).addGroupRule(c.Access.OwnerId, rule); err != nil {
+		panic(err)
+	}
+	if err := productGroupRepo.addProductGroups(c.Access.OwnerId, []string{rule.Group}); err != nil {
+		log.Printf("Не удалось сохранить группу товаров пользователя %d: %v", c.Access.OwnerId, err)
+	}
+	SendMessageToBot(&bot, telegram.SendMessageRequestBody[telegram.InlineKeyboardMarkup, int64]{
+		ChatId:    m.Chat.Id,
+		ParseMode: format.HTML.ParseMode(),
+		Text:      htmlText(format.Plain("Правило добавлено: "), format.Bold(format.Plain(rule.String())), format.Plain(". Проверяю правила на последних заказах...")),
+	})
+	sendGroupRulesTest(m.Chat.Id, c.Access.OwnerId)
+}
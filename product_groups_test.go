@@ -0,0 +1,414 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"telegram"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type catalogMock struct {
+	categories map[int64]ProductCategory
+	err        error
+	names      int
+}
+
+func (c *catalogMock) productCategories(userId int64, skus []int64) (map[int64]ProductCategory, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	result := make(map[int64]ProductCategory)
+	for _, sku := range skus {
+		if category, ok := c.categories[sku]; ok {
+			result[sku] = category
+		}
+	}
+	return result, nil
+}
+
+func (c *catalogMock) categoryNames(userId int64) (map[int64]string, map[int64]string, error) {
+	c.names++
+	return map[int64]string{17: "Носки и гольфы"}, map[int64]string{901: "Носки"}, nil
+}
+
+func TestProductGrouper_group(t *testing.T) {
+	catalog := &catalogMock{categories: map[int64]ProductCategory{
+		5: {CategoryId: 17, TypeId: 901},
+		6: {CategoryId: 18, TypeId: 902},
+	}}
+	tests := []struct {
+		name    string
+		rules   []GroupRule
+		sku     int64
+		offerId string
+		product string
+		want    string
+	}{
+		{
+			name:    "Без правил группа - название товара",
+			sku:     1,
+			product: "Получешки Colibri Белые",
+			want:    "Получешки Colibri Белые",
+		},
+		{
+			name:    "Префикс артикула",
+			rules:   []GroupRule{{Kind: GroupByOfferPrefix, Value: "POLU-", Group: "Получешки"}},
+			sku:     1,
+			offerId: "POLU-W-38",
+			product: "Получешки Colibri Белые",
+			want:    "Получешки",
+		},
+		{
+			name:    "Префикс учитывает регистр",
+			rules:   []GroupRule{{Kind: GroupByOfferPrefix, Value: "POLU-", Group: "Получешки"}},
+			sku:     1,
+			offerId: "polu-w-38",
+			product: "Получешки Colibri Белые",
+			want:    "Получешки Colibri Белые",
+		},
+		{
+			name:    "Список SKU с пробелами",
+			rules:   []GroupRule{{Kind: GroupBySku, Value: "3, 4 ,5", Group: "Набор"}},
+			sku:     4,
+			product: "Носки",
+			want:    "Набор",
+		},
+		{
+			name:    "Регулярное выражение по названию",
+			rules:   []GroupRule{{Kind: GroupByNameRegex, Value: "(?i)^полупальцы", Group: "Полупальцы"}},
+			sku:     2,
+			product: "ПОЛУПАЛЬЦЫ Colibri Черные",
+			want:    "Полупальцы",
+		},
+		{
+			name:    "Категория по номеру типа",
+			rules:   []GroupRule{{Kind: GroupByCategory, Value: "901", Group: "Носки"}},
+			sku:     5,
+			product: "Носки белые",
+			want:    "Носки",
+		},
+		{
+			name:    "Категория по названию без учета регистра",
+			rules:   []GroupRule{{Kind: GroupByCategory, Value: "носки и гольфы", Group: "Носки"}},
+			sku:     5,
+			product: "Носки белые",
+			want:    "Носки",
+		},
+		{
+			name:    "Другая категория",
+			rules:   []GroupRule{{Kind: GroupByCategory, Value: "17", Group: "Носки"}},
+			sku:     6,
+			product: "Гольфы",
+			want:    "Гольфы",
+		},
+		{
+			name: "Срабатывает первое подошедшее правило",
+			rules: []GroupRule{
+				{Kind: GroupBySku, Value: "7", Group: "Распродажа"},
+				{Kind: GroupByOfferPrefix, Value: "POLU-", Group: "Получешки"},
+			},
+			sku:     7,
+			offerId: "POLU-B-40",
+			product: "Получешки Colibri Черные",
+			want:    "Распродажа",
+		},
+		{
+			name: "Неверное правило пропускается",
+			rules: []GroupRule{
+				{Kind: GroupByNameRegex, Value: "(", Group: "Сломанное"},
+				{Kind: GroupByNameRegex, Value: "Colibri", Group: "Colibri"},
+			},
+			sku:     1,
+			product: "Получешки Colibri Белые",
+			want:    "Colibri",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := productGrouper(catalog, 1, tt.rules, []int64{tt.sku})
+			if got := g.group(tt.sku, tt.offerId, tt.product); got != tt.want {
+				t.Errorf("group() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProductGrouper_categoriesOnDemand(t *testing.T) {
+	catalog := &catalogMock{err: errors.New("недоступно")}
+	g := productGrouper(catalog, 1, []GroupRule{{Kind: GroupByOfferPrefix, Value: "A", Group: "A"}}, []int64{1})
+	if g.categories != nil {
+		t.Errorf("categories requested without category rules")
+	}
+
+	// Ошибка OZON не ломает остальные правила
+	rules := []GroupRule{{Kind: GroupByCategory, Value: "17", Group: "Носки"}, {Kind: GroupByOfferPrefix, Value: "A", Group: "A"}}
+	g = productGrouper(catalog, 1, rules, []int64{1})
+	if got := g.group(1, "A-1", "Товар"); got != "A" {
+		t.Errorf("group() = %q, want A", got)
+	}
+
+	// Дерево категорий нужно только для правил по названию
+	catalog = &catalogMock{categories: map[int64]ProductCategory{1: {CategoryId: 17}}}
+	productGrouper(catalog, 1, rules, []int64{1})
+	if catalog.names != 0 {
+		t.Errorf("category tree requested %d times for numeric rule", catalog.names)
+	}
+}
+
+func TestParseGroupRule(t *testing.T) {
+	tests := []struct {
+		name    string
+		kind    GroupRuleKind
+		text    string
+		want    GroupRule
+		wantErr bool
+	}{
+		{name: "Значение и группа", kind: GroupByOfferPrefix, text: " POLU- \n Получешки ", want: GroupRule{Kind: GroupByOfferPrefix, Value: "POLU-", Group: "Получешки"}},
+		{name: "Нет группы", kind: GroupByOfferPrefix, text: "POLU-", wantErr: true},
+		{name: "SKU не число", kind: GroupBySku, text: "123, abc\nНабор", wantErr: true},
+		{name: "Неверное выражение", kind: GroupByNameRegex, text: "[\nНоски", wantErr: true},
+		{name: "Неизвестный вид", kind: "brand", text: "Colibri\nColibri", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseGroupRule(tt.kind, tt.text)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseGroupRule() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got.Id.IsZero() || got.Kind != tt.want.Kind || got.Value != tt.want.Value || got.Group != tt.want.Group {
+				t.Errorf("parseGroupRule() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTestGroupRules(t *testing.T) {
+	g := newProductGrouper([]GroupRule{
+		{Kind: GroupByOfferPrefix, Value: "B-", Group: "Полупальцы"},
+		{Kind: GroupByOfferPrefix, Value: "A-", Group: "Получешки"},
+		{Kind: GroupBySku, Value: "99", Group: "Нет в заказах"},
+	})
+	lines := []ozonLine{
+		{Product: PostingProduct{Sku: 1, OfferId: "A-1", Name: "Получешки белые"}},
+		{Product: PostingProduct{Sku: 1, OfferId: "A-1", Name: "Получешки белые"}},
+		{Product: PostingProduct{Sku: 2, OfferId: "A-2", Name: "Получешки черные"}},
+		{Product: PostingProduct{Sku: 3, OfferId: "B-1", Name: "Полупальцы"}},
+		{Product: PostingProduct{Sku: 4, OfferId: "C-1", Name: "Гольфы"}},
+	}
+	matched, unmatched := testGroupRules(g, lines)
+	if len(matched) != 2 || matched[0].Group != "Полупальцы" || matched[1].Group != "Получешки" || len(matched[1].Products) != 2 {
+		t.Errorf("matched = %+v", matched)
+	}
+	if len(unmatched) != 1 || unmatched[0] != "Гольфы" {
+		t.Errorf("unmatched = %v", unmatched)
+	}
+	text := printGroupRulesTest(matched, unmatched, groupRulesTestDays)
+	for _, want := range []string{"за 14 дн.", "<b>Получешки</b> - 2 тов.", "Без правила, группа - название товара: 1 тов.", "Гольфы"} {
+		if !strings.Contains(text, want) {
+			t.Errorf("text %q does not contain %q", text, want)
+		}
+	}
+}
+
+func TestLegacyGroupRules(t *testing.T) {
+	groups := []GroupProducts{
+		{NameGroup: "Белые", PurchasePrice: 100},
+		{NameGroup: "Черные (3 пары)", PurchasePrice: 150},
+		{NameGroup: "Пеленки", PurchasePrice: 200},
+		{NameGroup: "Получешки Colibri Серые"},
+		{NameGroup: ""},
+	}
+	existing := []GroupRule{{Kind: GroupByOfferPrefix, Value: "PL-", Group: "Пеленки"}}
+	rules := legacyGroupRules(groups, existing)
+	if len(rules) != 2 {
+		t.Fatalf("legacyGroupRules() = %+v, want 2 правила", rules)
+	}
+	g := newProductGrouper(append(existing, rules...))
+	tests := []struct {
+		name    string
+		product string
+		offerId string
+		want    string
+	}{
+		{name: "Получешки - прежняя группа", product: "Получешки Colibri Белые", want: "Белые"},
+		{name: "Полупальцы - прежняя группа", product: "Полупальцы Colibri Белые", want: "Белые"},
+		{name: "Спецсимволы в названии группы", product: "Получешки Colibri Черные (3 пары)", want: "Черные (3 пары)"},
+		{name: "Группа уже задана правилом", product: "Пеленка", offerId: "PL-1", want: "Пеленки"},
+		{name: "Группы нет - полное название", product: "Получешки Colibri Белые с рисунком", want: "Получешки Colibri Белые с рисунком"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := g.group(1, tt.offerId, tt.product); got != tt.want {
+				t.Errorf("group() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+	if again := legacyGroupRules(groups, append(existing, rules...)); len(again) != 0 {
+		t.Errorf("повторный перевод добавил правила %+v", again)
+	}
+}
+
+func TestProductGroupMemory_addProductGroups(t *testing.T) {
+	repo := NewProductGroupMemory()
+	repo.groups[1] = []GroupProducts{{NameGroup: "Получешки", PurchasePrice: 20}}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := repo.addProductGroups(1, []string{"Гольфы", "Получешки"}); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := repo.groups[1]; len(got) != 2 || got[0].PurchasePrice != 20 || got[1].NameGroup != "Гольфы" {
+		t.Errorf("groups = %+v", got)
+	}
+}
+
+// ordersStub Маркетплейс с заранее подготовленными заказами
+type ordersStub struct {
+	batch MarketplaceOrders
+}
+
+func (m ordersStub) name() Marketplace {
+	return MarketplaceOzon
+}
+
+func (m ordersStub) accountName() string {
+	return ""
+}
+
+func (m ordersStub) periodOrders(userId int64, s Settings, period DateRange) (MarketplaceOrders, error) {
+	return m.batch, nil
+}
+
+// setProductGroupLegacy Сохранение группы до перехода на addProductGroups: FindOne и UpdateOne на каждый товар
+func setProductGroupLegacy(userId int64, name string) error {
+	var userDB UserDB
+	coll := clientMongo.Database("MyInfantBotDB").Collection("bot_users")
+	filter := bson.D{{"telegram_user.user.id", userId}}
+	if err := coll.FindOne(context.TODO(), filter).Decode(&userDB); err != nil {
+		return err
+	}
+	pl := userDB.TelegramUser.Settings.OzonSetting.ProductSetting.GroupProducts
+	if findIndex(pl, func(gp GroupProducts) bool { return gp.NameGroup == name }) >= 0 {
+		return nil
+	}
+	update := bson.D{{"$set", bson.D{{"telegram_user.settings.ozon_setting.product_setting.group_products", append(pl, GroupProducts{NameGroup: name})}}}}
+	_, err := coll.UpdateOne(context.TODO(), filter, update)
+	return err
+}
+
+// BenchmarkOrderSummaryReport Отчет за месяц: 1000 товаров в 50 группах на тестовом MongoDB из MONGODB_TEST_URY.
+// Раньше на каждый товар выполнялись FindOne и UpdateOne, теперь orderSummaryReport сохраняет группы
+// одним BulkWrite. Каждая итерация начинается с пользователя без групп.
+func BenchmarkOrderSummaryReport(b *testing.B) {
+	ury := os.Getenv("MONGODB_TEST_URY")
+	if ury == "" {
+		b.Skip("MONGODB_TEST_URY не задан")
+	}
+	clientMongo = connectMongoDB(ury)
+	defer clientMongo.Disconnect(context.TODO())
+	productGroupRepo = UserDB{}
+
+	const userId = -19
+	coll := clientMongo.Database("MyInfantBotDB").Collection("bot_users")
+	filter := bson.D{{"telegram_user.user.id", userId}}
+	reset := func(b *testing.B) {
+		b.StopTimer()
+		defer b.StartTimer()
+		if _, err := coll.DeleteMany(context.TODO(), filter); err != nil {
+			b.Fatal(err)
+		}
+		user := UserDB{Id: primitive.NewObjectID(), TelegramUser: TelegramUser{User: telegram.User{Id: userId}}}
+		if _, err := coll.InsertOne(context.TODO(), user); err != nil {
+			b.Fatal(err)
+		}
+	}
+	defer coll.DeleteMany(context.TODO(), filter)
+
+	var lines []ozonLine
+	for i := 0; i < 1000; i++ {
+		lines = append(lines, ozonLine{Scheme: SchemeFBO, Product: PostingProduct{Sku: i, Name: fmt.Sprintf("Группа %d", i%50), Price: "100", Quantity: 1}})
+	}
+	grouper := newProductGrouper(nil)
+	stub := ordersStub{MarketplaceOrders{Orders: normalizeOzonLines(lines), Schemes: []DeliveryScheme{SchemeFBO}, Grouper: grouper}}
+	period := DateRange{From: time.Now().AddDate(0, -1, 0), To: time.Now()}
+
+	b.Run("Запросы на каждый товар", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			reset(b)
+			user, err := UserDB{}.getTelegramUser(userId)
+			if err != nil {
+				b.Fatal(err)
+			}
+			summarizeOrders(MarketplaceOzon, stub.batch, user.Settings.OzonSetting.ProductSetting.GroupProducts)
+			for _, line := range lines {
+				if err := setProductGroupLegacy(userId, grouper.productGroup(line.Product)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("Один запрос на отчет", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			reset(b)
+			if _, err := orderSummaryReport(stub, userId, period); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	user, err := UserDB{}.getTelegramUser(userId)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if got := len(user.Settings.OzonSetting.ProductSetting.GroupProducts); got != 50 {
+		b.Errorf("сохранено групп %d, want 50", got)
+	}
+}
+
+func TestPurchasePriceMarkup(t *testing.T) {
+	var groups []GroupProducts
+	for i := 0; i < purchasePricePageSize+3; i++ {
+		groups = append(groups, GroupProducts{NameGroup: fmt.Sprintf("Получешки Colibri Белые с рисунком и длинным названием %d", i)})
+	}
+	first := purchasePriceMarkup(groups, 0)
+	if len(first.InlineKeyboard) != purchasePricePageSize+1 {
+		t.Fatalf("строк на первой странице %d, want %d", len(first.InlineKeyboard), purchasePricePageSize+1)
+	}
+	for _, row := range first.InlineKeyboard {
+		for _, b := range row {
+			if len(b.CallbackData) > 64 {
+				t.Errorf("callback_data длиннее 64 байт: %s", b.CallbackData)
+			}
+		}
+	}
+	if nav := first.InlineKeyboard[purchasePricePageSize]; len(nav) != 1 || nav[0].CallbackData != "/purchaseprices-1" {
+		t.Errorf("переход на вторую страницу = %+v", nav)
+	}
+	last := purchasePriceMarkup(groups, 5)
+	if len(last.InlineKeyboard) != 4 || last.InlineKeyboard[3][0].CallbackData != "/purchaseprices-0" {
+		t.Errorf("последняя страница = %+v", last.InlineKeyboard)
+	}
+
+	key := strings.TrimPrefix(first.InlineKeyboard[2][0].CallbackData, "/setpurchaseprice-")
+	if gp, ok := purchasePriceGroup(groups, key); !ok || gp.NameGroup != groups[2].NameGroup {
+		t.Errorf("purchasePriceGroup(%s) = %+v, %v", key, gp, ok)
+	}
+	if _, ok := purchasePriceGroup(groups[:2], key); ok {
+		t.Errorf("найдена удаленная группа")
+	}
+}
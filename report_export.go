@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"export"
+	"fmt"
+	"format"
+	"log"
+	"strings"
+	"telegram"
+	"time"
+)
+
+// exportReportCallback Префикс кнопок выгрузки отчета: /exportreport-формат-ГГГГММДД-ГГГГММДД-кабинет
+const exportReportCallback = "/exportreport-"
+
+const (
+	ExportXLSX = "xlsx"
+	ExportCSV  = "csv"
+)
+
+var ordersHeader = []string{
+	"Кабинет", "Схема", "Заказ", "Статус", "SKU", "Артикул", "Товар", "Группа", "Количество",
+	"Цена", "Сумма", "Комиссия", "Логистика", "Фулфилмент", "К выплате",
+}
+
+// returnStatus Статус строки возвратов в выгрузке
+const returnStatus = "returned"
+
+// exportReportButtons Кнопки скачивания отчета за период по кабинету account, см. summaryData
+func exportReportButtons(period DateRange, account string) telegram.InlineKeyboardMarkup {
+	return telegram.InlineKeyboardMarkup{InlineKeyboard: CreateButtonsBot[telegram.InlineKeyboardButton]([]telegram.ButtonBot[telegram.InlineKeyboardButton]{
+		{Row: 1, Col: 1, Button: telegram.InlineKeyboardButton{Text: "Скачать Excel", CallbackData: exportReportData(ExportXLSX, period, account)}},
+		{Row: 1, Col: 2, Button: telegram.InlineKeyboardButton{Text: "Скачать CSV", CallbackData: exportReportData(ExportCSV, period, account)}},
+	})}
+}
+
+// exportReportData Callback data кнопки выгрузки, укладывается в лимит Telegram 64 байта
+func exportReportData(kind string, period DateRange, account string) string {
+	return exportReportCallback + kind + "-" + strings.TrimPrefix(summaryData(period, account), summaryCallback)
+}
+
+// parseExportReportData Формат файла, дни периода и кабинет из callback data без префикса
+func parseExportReportData(payload string, loc *time.Location) (string, DateRange, string, error) {
+	kind, rest, _ := strings.Cut(payload, "-")
+	if kind != ExportXLSX && kind != ExportCSV {
+		return "", DateRange{}, "", fmt.Errorf("неизвестная кнопка выгрузки %q", payload)
+	}
+	period, account, err := parseSummaryData(rest, loc)
+	if err != nil {
+		return "", DateRange{}, "", err
+	}
+	return kind, period, account, nil
+}
+
+// exportAccount Кабинет отчета для кнопок выгрузки. Отчет без кабинета строится, только когда
+// кабинеты не подключены, и совпадает с отчетом по всем кабинетам.
+func exportAccount(m ReportMarketplace) string {
+	var account *MarketplaceAccount
+	switch m := m.(type) {
+	case *OzonMarketplace:
+		account = m.Account
+	case *WildberriesMarketplace:
+		account = m.Account
+	case *YandexMarketMarketplace:
+		account = m.Account
+	}
+	if account == nil {
+		return allAccounts
+	}
+	return account.Id.Hex()
+}
+
+// exportBatch Заказы кабинета для выгрузки
+type exportBatch struct {
+	Title  string
+	Orders MarketplaceOrders
+}
+
+// ordersTable Строка на каждый товар каждого заказа и на возвраты каждого кабинета. Суммы совпадают
+// с отчетом: отмененные заказы не входят в выручку, удержания и выплата пусты, пока маркетплейс их не рассчитал.
+func ordersTable(batches []exportBatch) export.Table {
+	t := export.Table{Sheet: "Заказы", Header: ordersHeader}
+	for _, b := range batches {
+		grouper := b.Orders.Grouper
+		if grouper == nil {
+			grouper = newProductGrouper(nil)
+		}
+		for _, o := range b.Orders.Orders {
+			for _, line := range o.Lines {
+				var sku interface{}
+				if line.Sku != 0 {
+					sku = line.Sku
+				}
+				var amount, commission, logistics, fulfillment, net interface{}
+				if o.Status != Cancelled {
+					amount = line.amount().InexactFloat64()
+					if p, ok := line.payout(); ok {
+						commission = p.Commission.InexactFloat64()
+						logistics = p.Logistics.InexactFloat64()
+						fulfillment = p.Fulfillment.InexactFloat64()
+						net = p.Net.InexactFloat64()
+					}
+				}
+				t.Rows = append(t.Rows, []interface{}{
+					b.Title,
+					o.Scheme.String(),
+					o.Number,
+					o.Status.String(),
+					sku,
+					line.OfferId,
+					line.Name,
+					grouper.group(line.Sku, line.OfferId, line.Name),
+					line.Quantity,
+					line.Price.InexactFloat64(),
+					amount,
+					commission,
+					logistics,
+					fulfillment,
+					net,
+				})
+			}
+		}
+		for _, r := range b.Orders.Returns {
+			logistics := r.Logistics.InexactFloat64()
+			t.Rows = append(t.Rows, []interface{}{
+				b.Title, "", "", returnStatus, nil, "", "", "", r.Quantity,
+				nil, nil, nil, logistics, nil, -logistics,
+			})
+		}
+	}
+	return t
+}
+
+// reportDocument Файл отчета в формате kind
+func reportDocument(kind string, name string, period DateRange, t export.Table) (telegram.InputFile, error) {
+	var b bytes.Buffer
+	var err error
+	switch kind {
+	case ExportXLSX:
+		err = export.WriteXLSX(&b, t)
+	case ExportCSV:
+		err = export.WriteCSV(&b, t)
+	default:
+		err = errors.New("неизвестный формат " + kind)
+	}
+	if err != nil {
+		return telegram.InputFile{}, err
+	}
+	return telegram.InputFile{Name: reportFileName(kind, name, period), Data: b.Bytes()}, nil
+}
+
+// exportFileName Начало имени файла: маркетплейс кабинета или orders для выгрузки по нескольким кабинетам
+func exportFileName(marketplaces []ReportMarketplace) string {
+	if len(marketplaces) != 1 {
+		return "orders"
+	}
+	switch marketplaces[0].name() {
+	case MarketplaceWildberries:
+		return "wb"
+	case MarketplaceYandex:
+		return "ym"
+	default:
+		return "ozon"
+	}
+}
+
+// reportFileName Имя файла вида ozon-2024-01-02.xlsx, для периода в несколько дней - с датами начала и конца
+func reportFileName(kind string, name string, period DateRange) string {
+	since := period.From
+	name += "-" + since.Format(time.DateOnly)
+	if last := period.lastDay(); last.Format(time.DateOnly) != since.Format(time.DateOnly) {
+		name += "_" + last.Format(time.DateOnly)
+	}
+	return name + "." + kind
+}
+
+func exportReportHandler(c *RouteContext) {
+	q := c.Update.CallbackQuery
+	bot := TelegramBot{}
+	kind, period, account, err := parseExportReportData(c.Payload, UserDB{}.userLocation(q.From.Id))
+	user, userErr := UserDB{}.getTelegramUser(c.Access.OwnerId)
+	if err != nil || userErr != nil {
+		log.Printf("Выгрузка отчета: %v", errors.Join(err, userErr))
+		answerCallbackQueryToBot(&bot, telegram.AnswerCallbackQueryRequestBody{CallbackQueryId: q.Id, Text: "Кнопка устарела, сформируйте отчет заново."})
+		return
+	}
+	marketplaces, ok := summaryMarketplaces(user.Settings, account)
+	if !ok {
+		answerCallbackQueryToBot(&bot, telegram.AnswerCallbackQueryRequestBody{CallbackQueryId: q.Id, Text: "Кабинет удален, сформируйте отчет заново."})
+		return
+	}
+	answerCallbackQueryToBot(&bot, telegram.AnswerCallbackQueryRequestBody{CallbackQueryId: q.Id, Text: "Готовлю файл..."})
+
+	var batches []exportBatch
+	var incomplete []string
+	for _, m := range marketplaces {
+		var batch MarketplaceOrders
+		if batch, err = m.periodOrders(c.Access.OwnerId, user.Settings, period); err != nil && !isPartialResult(err) {
+			break
+		}
+		if err != nil {
+			log.Printf("Выгрузка %s пользователя %d неполная: %v", reportTitle(m), c.Access.OwnerId, err)
+			incomplete = append(incomplete, reportTitle(m))
+			err = nil
+		}
+		batches = append(batches, exportBatch{Title: reportTitle(m), Orders: batch})
+	}
+	if err == nil {
+		var document telegram.InputFile
+		if document, err = reportDocument(kind, exportFileName(marketplaces), period, ordersTable(batches)); err == nil {
+			err = SendDocumentToBot(&bot, telegram.SendDocumentRequestBody{ChatId: q.Message.Chat.Id, Document: document})
+		}
+	}
+	var text format.Fragment
+	switch {
+	case err != nil:
+		log.Printf("Не удалось выгрузить отчет пользователя %d: %v", c.Access.OwnerId, err)
+		text = format.Plain("Не удалось сформировать файл, попробуйте позже.")
+	case len(incomplete) > 0:
+		text = format.Plainf("Данные %s получены не полностью, в файле есть не все заказы.", strings.Join(incomplete, ", "))
+	default:
+		return
+	}
+	SendMessageToBot(&bot, telegram.SendMessageRequestBody[telegram.InlineKeyboardMarkup, int64]{
+		ChatId:    q.Message.Chat.Id,
+		ParseMode: format.HTML.ParseMode(),
+		Text:      htmlText(text),
+	})
+}
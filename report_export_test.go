@@ -0,0 +1,130 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestExportReportData(t *testing.T) {
+	loc := time.FixedZone("MSK", 3*60*60)
+	period := daysRange(time.Date(2024, 1, 2, 0, 0, 0, 0, loc), time.Date(2024, 1, 4, 0, 0, 0, 0, loc), loc)
+	account := "65a0f0e1c2b3a4d5e6f70819"
+	data := exportReportData(ExportXLSX, period, account)
+	if len(data) > 64 {
+		t.Errorf("callback data %q longer than 64 bytes", data)
+	}
+	kind, got, gotAccount, err := parseExportReportData(data[len(exportReportCallback):], loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kind != ExportXLSX || !got.From.Equal(period.From) || !got.To.Equal(period.To) || gotAccount != account {
+		t.Errorf("parseExportReportData() = %s %+v %s, want %s %+v %s", kind, got, gotAccount, ExportXLSX, period, account)
+	}
+	if _, _, _, err := parseExportReportData("pdf-20240102-20240104-all", loc); err == nil {
+		t.Error("parseExportReportData() must reject unknown format")
+	}
+	if _, _, _, err := parseExportReportData("csv-1704139200-1704225600", loc); err == nil {
+		t.Error("parseExportReportData() must reject buttons of the old format")
+	}
+}
+
+func TestReportFileName(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter FilterFbo
+		loc    *time.Location
+		want   string
+	}{
+		{
+			name:   "Один день",
+			filter: FilterFbo{Since: "2024-01-02T00:00:00Z", To: "2024-01-03T00:00:00Z"},
+			loc:    time.UTC,
+			want:   "ozon-2024-01-02.csv",
+		},
+		{
+			name:   "Даты в поясе пользователя",
+			filter: FilterFbo{Since: "2024-01-01T21:00:00Z", To: "2024-01-02T21:00:00Z"},
+			loc:    time.FixedZone("MSK", 3*60*60),
+			want:   "ozon-2024-01-02.csv",
+		},
+		{
+			name:   "Несколько дней",
+			filter: FilterFbo{Since: "2024-01-02T00:00:00Z", To: "2024-01-05T00:00:00Z"},
+			loc:    time.UTC,
+			want:   "ozon-2024-01-02_2024-01-04.csv",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := reportFileName(ExportCSV, "ozon", filterRange(tt.filter, tt.loc)); got != tt.want {
+				t.Errorf("reportFileName() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExportFileName(t *testing.T) {
+	tests := []struct {
+		name         string
+		marketplaces []ReportMarketplace
+		want         string
+	}{
+		{name: "OZON без кабинетов", marketplaces: []ReportMarketplace{&OzonMarketplace{}}, want: "ozon"},
+		{name: "Кабинет WB", marketplaces: []ReportMarketplace{&WildberriesMarketplace{Account: &MarketplaceAccount{Marketplace: MarketplaceWildberries}}}, want: "wb"},
+		{name: "Кабинет Яндекс Маркета", marketplaces: []ReportMarketplace{&YandexMarketMarketplace{Account: &MarketplaceAccount{Marketplace: MarketplaceYandex}}}, want: "ym"},
+		{name: "Все кабинеты", marketplaces: []ReportMarketplace{&OzonMarketplace{}, &WildberriesMarketplace{}}, want: "orders"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := exportFileName(tt.marketplaces); got != tt.want {
+				t.Errorf("exportFileName() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOrdersTable(t *testing.T) {
+	settled := OrderLine{Sku: 10, OfferId: "socks", Name: "Носки", Quantity: 2, Price: decimal.RequireFromString("199.50")}
+	settled.settle(Payout{
+		Commission:  decimal.NewFromInt(60),
+		Logistics:   decimal.NewFromInt(30),
+		Fulfillment: decimal.NewFromInt(10),
+		Net:         decimal.NewFromInt(299),
+	})
+	batches := []exportBatch{
+		{Title: "OZON", Orders: MarketplaceOrders{
+			Orders: []Order{
+				{Marketplace: MarketplaceOzon, Number: "0001-1", Scheme: SchemeFBO, Status: Delivered, Lines: []OrderLine{settled}},
+				{Marketplace: MarketplaceOzon, Number: "0002-1", Scheme: SchemeFBS, Status: Cancelled, Lines: []OrderLine{
+					{Sku: 10, OfferId: "socks", Name: "Носки", Quantity: 1, Price: decimal.RequireFromString("199.50")},
+				}},
+			},
+			Returns: []OrderReturn{{Quantity: 1, Logistics: decimal.NewFromInt(50)}},
+		}},
+		{Title: "WB «Второй»", Orders: MarketplaceOrders{
+			Orders: []Order{
+				{Marketplace: MarketplaceWildberries, Number: "77", Scheme: SchemeFBO, Status: Delivering, Lines: []OrderLine{
+					{OfferId: "gaiters", Name: "Гетры", Quantity: 1, Price: decimal.NewFromInt(300)},
+				}},
+			},
+		}},
+	}
+	table := ordersTable(batches)
+	want := [][]interface{}{
+		{"OZON", "FBO", "0001-1", "delivered", int64(10), "socks", "Носки", "Носки", 2, 199.5, 399.0, 60.0, 30.0, 10.0, 299.0},
+		{"OZON", "FBS", "0002-1", "cancelled", int64(10), "socks", "Носки", "Носки", 1, 199.5, nil, nil, nil, nil, nil},
+		{"OZON", "", "", returnStatus, nil, "", "", "", 1, nil, nil, nil, 50.0, nil, -50.0},
+		{"WB «Второй»", "FBO", "77", "delivering", nil, "gaiters", "Гетры", "Гетры", 1, 300.0, 300.0, nil, nil, nil, nil},
+	}
+	if !reflect.DeepEqual(table.Rows, want) {
+		t.Errorf("ordersTable() = %v, want %v", table.Rows, want)
+	}
+	for _, row := range table.Rows {
+		if len(row) != len(table.Header) {
+			t.Errorf("row has %d cells, header %d", len(row), len(table.Header))
+		}
+	}
+}
@@ -0,0 +1,573 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"format"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"telegram"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ReturnReason Класс причины возврата
+type ReturnReason int
+
+const (
+	ReturnReasonOther        ReturnReason = iota // прочее,
+	ReturnReasonDefect                           // брак или повреждение,
+	ReturnReasonMismatch                         // не соответствует описанию,
+	ReturnReasonNotFit                           // не подошел,
+	ReturnReasonNotCollected                     // не выкуплен покупателем,
+	ReturnReasonCancellation                     // отмена до получения.
+)
+
+func (r ReturnReason) String() string {
+	return [...]string{"Прочее", "Брак или повреждение", "Не соответствует описанию", "Не подошел", "Не выкуплен", "Отмена"}[r]
+}
+
+// returnReasonKeywords Слова в названии причины возврата Ozon, по которым определяется класс.
+// Проверяются по порядку, первое совпадение определяет класс.
+var returnReasonKeywords = []struct {
+	reason   ReturnReason
+	keywords []string
+}{
+	{ReturnReasonDefect, []string{"брак", "дефект", "поврежд", "сломан", "не работает"}},
+	{ReturnReasonMismatch, []string{"не соответствует", "не тот", "другой товар", "описани", "комплект", "пересорт"}},
+	{ReturnReasonNotFit, []string{"размер", "не подош", "передумал", "не понрав", "качество"}},
+	{ReturnReasonNotCollected, []string{"не забрал", "невыкуп", "не выкуп", "отказ", "срок хранения"}},
+	{ReturnReasonCancellation, []string{"отмен"}},
+}
+
+// classifyReturn Класс причины возврата по ее названию и типу возврата Ozon
+func classifyReturn(reasonName string, returnType string) ReturnReason {
+	name := strings.ToLower(reasonName)
+	for _, r := range returnReasonKeywords {
+		for _, keyword := range r.keywords {
+			if strings.Contains(name, keyword) {
+				return r.reason
+			}
+		}
+	}
+	if returnType == "Cancellation" {
+		return ReturnReasonCancellation
+	}
+	return ReturnReasonOther
+}
+
+type ReturnsTimeRange struct {
+	TimeFrom string `json:"time_from"`
+	TimeTo   string `json:"time_to"`
+}
+type ReturnsListFilter struct {
+	LogisticReturnDate *ReturnsTimeRange `json:"logistic_return_date,omitempty"`
+	PostingNumbers     []string          `json:"posting_numbers,omitempty"`
+}
+type ReturnsListRequest struct {
+	Filter ReturnsListFilter `json:"filter"`
+	Limit  int64             `json:"limit"`
+	LastId int64             `json:"last_id"`
+}
+type ReturnsListResponse struct {
+	Returns []OzonReturn `json:"returns"`
+	HasNext bool         `json:"has_next"`
+}
+type OzonReturn struct {
+	Id               int64  `json:"id"`
+	ReturnReasonName string `json:"return_reason_name"`
+	Type             string `json:"type"`
+	Schema           string `json:"schema"`
+	OrderId          int64  `json:"order_id"`
+	OrderNumber      string `json:"order_number"`
+	PostingNumber    string `json:"posting_number"`
+	Product          struct {
+		Sku     int64  `json:"sku"`
+		OfferId string `json:"offer_id"`
+		Name    string `json:"name"`
+		Price   struct {
+			CurrencyCode string  `json:"currency_code"`
+			Price        float64 `json:"price"`
+		} `json:"price"`
+		Quantity int `json:"quantity"`
+	} `json:"product"`
+	Logistic struct {
+		TechnicalReturnMoment *time.Time `json:"technical_return_moment"`
+		FinalMoment           *time.Time `json:"final_moment"`
+		ReturnDate            *time.Time `json:"return_date"`
+		Barcode               string     `json:"barcode"`
+	} `json:"logistic"`
+	Visual struct {
+		Status struct {
+			Id          int64  `json:"id"`
+			DisplayName string `json:"display_name"`
+			SysName     string `json:"sys_name"`
+		} `json:"status"`
+		ChangeMoment *time.Time `json:"change_moment"`
+	} `json:"visual"`
+}
+
+// ReturnKey Возврат хранится отдельно для каждого кабинета OZON пользователя
+type ReturnKey struct {
+	UserId    int64              `bson:"user_id"`
+	AccountId primitive.ObjectID `bson:"account_id"`
+	ReturnId  int64              `bson:"return_id"`
+}
+
+// ReturnRecord Возврат, связанный с исходным отправлением
+type ReturnRecord struct {
+	Key           ReturnKey      `bson:"_id"`
+	Scheme        DeliveryScheme `bson:"scheme"`
+	PostingNumber string         `bson:"posting_number"`
+	OrderNumber   string         `bson:"order_number"`
+	Sku           int64          `bson:"sku"`
+	OfferId       string         `bson:"offer_id"`
+	ProductName   string         `bson:"product_name"`
+	Quantity      int            `bson:"quantity"`
+	Price         float64        `bson:"price"`
+	ReasonName    string         `bson:"reason_name"`
+	Reason        ReturnReason   `bson:"reason"`
+	Status        string         `bson:"status"`
+	ReturnDate    time.Time      `bson:"return_date"`
+	// Linked Исходное отправление найдено, данные о нем и стоимость обратной логистики заполнены
+	Linked           bool      `bson:"linked"`
+	PostingCreatedAt time.Time `bson:"posting_created_at"`
+	// Logistics Стоимость обратной логистики по финансовым данным отправления, положительная
+	Logistics float64 `bson:"logistics"`
+}
+
+// record Возврат для хранения. ReturnDate - первая из известных дат возврата, нулевая, если OZON не прислал ни одной.
+func (r OzonReturn) record(userId int64, accountId primitive.ObjectID) ReturnRecord {
+	record := ReturnRecord{
+		Key:           ReturnKey{UserId: userId, AccountId: accountId, ReturnId: r.Id},
+		Scheme:        DeliveryScheme(strings.ToLower(r.Schema)),
+		PostingNumber: r.PostingNumber,
+		OrderNumber:   r.OrderNumber,
+		Sku:           r.Product.Sku,
+		OfferId:       r.Product.OfferId,
+		ProductName:   r.Product.Name,
+		Quantity:      r.Product.Quantity,
+		Price:         r.Product.Price.Price,
+		ReasonName:    r.ReturnReasonName,
+		Reason:        classifyReturn(r.ReturnReasonName, r.Type),
+		Status:        r.Visual.Status.DisplayName,
+	}
+	for _, date := range []*time.Time{r.Logistic.ReturnDate, r.Logistic.FinalMoment, r.Logistic.TechnicalReturnMoment, r.Visual.ChangeMoment} {
+		if date != nil && !date.IsZero() {
+			record.ReturnDate = date.UTC()
+			break
+		}
+	}
+	return record
+}
+
+type ReturnsRepository interface {
+	upsertReturns(returns []ReturnRecord) error
+	// returns Возвраты кабинета пользователя с датой возврата в интервале [from, to)
+	returns(userId int64, accountId primitive.ObjectID, from time.Time, to time.Time) ([]ReturnRecord, error)
+}
+
+// ReturnsDB Возвраты в MongoDB
+type ReturnsDB struct{}
+
+func (d ReturnsDB) collection() *mongo.Collection {
+	return clientMongo.Database("MyInfantBotDB").Collection("bot_returns")
+}
+
+func (d ReturnsDB) createIndexes() error {
+	_, err := d.collection().Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys: bson.D{{"_id.user_id", 1}, {"_id.account_id", 1}, {"return_date", 1}},
+	})
+	return err
+}
+
+// removeUnkeyed Удаление возвратов, сохраненных без кабинета в ключе. Их нельзя отнести к кабинету,
+// загрузка возвратов сохранит их заново с кабинетом.
+func (d ReturnsDB) removeUnkeyed() error {
+	_, err := d.collection().DeleteMany(context.TODO(), bson.D{{"_id.account_id", bson.D{{"$exists", false}}}})
+	return err
+}
+
+func (d ReturnsDB) upsertReturns(returns []ReturnRecord) error {
+	if len(returns) == 0 {
+		return nil
+	}
+	models := make([]mongo.WriteModel, 0, len(returns))
+	for _, r := range returns {
+		models = append(models, mongo.NewReplaceOneModel().SetFilter(bson.D{{"_id", r.Key}}).SetReplacement(r).SetUpsert(true))
+	}
+	_, err := d.collection().BulkWrite(context.TODO(), models, options.BulkWrite().SetOrdered(false))
+	return err
+}
+
+func (d ReturnsDB) returns(userId int64, accountId primitive.ObjectID, from time.Time, to time.Time) ([]ReturnRecord, error) {
+	filter := bson.D{{"_id.user_id", userId}, {"_id.account_id", accountId}, {"return_date", bson.D{{"$gte", from}, {"$lt", to}}}}
+	cursor, err := d.collection().Find(context.TODO(), filter, options.Find().SetSort(bson.D{{"return_date", 1}}))
+	if err != nil {
+		return nil, err
+	}
+	var returns []ReturnRecord
+	err = cursor.All(context.TODO(), &returns)
+	return returns, err
+}
+
+// ReturnsMemory Возвраты в памяти процесса
+type ReturnsMemory struct {
+	mu      sync.Mutex
+	records map[ReturnKey]ReturnRecord
+}
+
+func NewReturnsMemory() *ReturnsMemory {
+	return &ReturnsMemory{records: make(map[ReturnKey]ReturnRecord)}
+}
+
+func (d *ReturnsMemory) upsertReturns(returns []ReturnRecord) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, r := range returns {
+		d.records[r.Key] = r
+	}
+	return nil
+}
+
+func (d *ReturnsMemory) returns(userId int64, accountId primitive.ObjectID, from time.Time, to time.Time) ([]ReturnRecord, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var returns []ReturnRecord
+	for _, r := range d.records {
+		if r.Key.UserId == userId && r.Key.AccountId == accountId && !r.ReturnDate.Before(from) && r.ReturnDate.Before(to) {
+			returns = append(returns, r)
+		}
+	}
+	sort.Slice(returns, func(i, j int) bool { return returns[i].ReturnDate.Before(returns[j].ReturnDate) })
+	return returns, nil
+}
+
+// ReturnedPosting Исходное отправление возврата
+type ReturnedPosting struct {
+	CreatedAt     time.Time
+	Products      []PostingProduct
+	FinancialData PostingFinancials
+}
+
+// ReturnsSource Возвраты и исходные отправления из Seller API
+type ReturnsSource interface {
+	returnsList(userId int64, body ReturnsListRequest) (*ReturnsListResponse, error)
+	returnedPosting(userId int64, scheme DeliveryScheme, postingNumber string) (*ReturnedPosting, error)
+}
+
+func (m *OzonMarketplace) returnsList(userId int64, body ReturnsListRequest) (*ReturnsListResponse, error) {
+	var l ReturnsListResponse
+	if err := m.ozonRequest(userId, "/v1/returns/list", body, &l); err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+func (m *OzonMarketplace) returnedPosting(userId int64, scheme DeliveryScheme, postingNumber string) (*ReturnedPosting, error) {
+	switch scheme {
+	case SchemeFBO:
+		var r struct {
+			Result PostingFBO `json:"result"`
+		}
+		body := map[string]interface{}{"posting_number": postingNumber, "with": WithFbo{FinancialData: true}}
+		if err := m.ozonRequest(userId, "/v2/posting/fbo/get", body, &r); err != nil {
+			return nil, err
+		}
+		return &ReturnedPosting{CreatedAt: r.Result.CreatedAt, Products: r.Result.Products, FinancialData: r.Result.FinancialData}, nil
+	case SchemeFBS:
+		var r struct {
+			Result PostingFBS `json:"result"`
+		}
+		body := map[string]interface{}{"posting_number": postingNumber, "with": WithFbs{FinancialData: true}}
+		if err := m.ozonRequest(userId, "/v3/posting/fbs/get", body, &r); err != nil {
+			return nil, err
+		}
+		return &ReturnedPosting{CreatedAt: r.Result.InProcessAt, Products: r.Result.Products, FinancialData: r.Result.FinancialData}, nil
+	}
+	return nil, fmt.Errorf("неизвестная схема работы %s", scheme)
+}
+
+// link Связь возврата с исходным отправлением: дата заказа и стоимость обратной логистики товара
+func (r *ReturnRecord) link(p *ReturnedPosting) {
+	r.Linked = true
+	r.PostingCreatedAt = p.CreatedAt
+	for i, product := range p.Products {
+		if int64(product.Sku) != r.Sku {
+			continue
+		}
+		if f, ok := p.FinancialData.productOf(p.Products, i); ok {
+			r.Logistics = -f.ItemServices.returnLogistics()
+		}
+		return
+	}
+}
+
+// syncReturns Загрузка возвратов кабинета accountId за [from, to) и связь новых возвратов с исходными отправлениями.
+// source должен обращаться к тому же кабинету.
+// Уже связанные возвраты повторно не запрашиваются, ненайденные отправления остаются несвязанными до следующей загрузки.
+// Возвраты без единой даты не сохраняются: их не найдет ни один запрос за период.
+func syncReturns(source ReturnsSource, repo ReturnsRepository, userId int64, accountId primitive.ObjectID, from time.Time, to time.Time) error {
+	stored, err := repo.returns(userId, accountId, from, to)
+	if err != nil {
+		return err
+	}
+	linked := make(map[ReturnKey]ReturnRecord, len(stored))
+	for _, r := range stored {
+		if r.Linked {
+			linked[r.Key] = r
+		}
+	}
+	postings := make(map[string]*ReturnedPosting)
+	var lastId int64
+	for {
+		response, err := source.returnsList(userId, ReturnsListRequest{
+			Filter: ReturnsListFilter{LogisticReturnDate: &ReturnsTimeRange{
+				TimeFrom: from.UTC().Format(time.RFC3339),
+				TimeTo:   to.UTC().Format(time.RFC3339),
+			}},
+			Limit:  500,
+			LastId: lastId,
+		})
+		if err != nil {
+			return err
+		}
+		records := make([]ReturnRecord, 0, len(response.Returns))
+		for _, r := range response.Returns {
+			lastId = r.Id
+			record := r.record(userId, accountId)
+			if record.ReturnDate.IsZero() {
+				log.Printf("Возврат %d пользователя %d без даты возврата пропущен", r.Id, userId)
+				continue
+			}
+			if l, ok := linked[record.Key]; ok {
+				record.Linked, record.PostingCreatedAt, record.Logistics = true, l.PostingCreatedAt, l.Logistics
+			} else if record.PostingNumber != "" {
+				p, ok := postings[record.PostingNumber]
+				if !ok {
+					if p, err = source.returnedPosting(userId, record.Scheme, record.PostingNumber); err != nil {
+						log.Printf("Не удалось получить отправление %s возврата %d: %v", record.PostingNumber, record.Key.ReturnId, err)
+					}
+					postings[record.PostingNumber] = p
+				}
+				if p != nil {
+					record.link(p)
+				}
+			}
+			records = append(records, record)
+		}
+		if err := repo.upsertReturns(records); err != nil {
+			return err
+		}
+		if !response.HasNext || len(response.Returns) == 0 {
+			return nil
+		}
+	}
+}
+
+const (
+	// returnsPeriod Период отчета о возвратах, дней
+	returnsPeriod = 30
+	// returnsSyncInterval Период загрузки возвратов всех пользователей, отчеты читают возвраты из базы
+	returnsSyncInterval = time.Hour
+	// returnsSyncDays За сколько последних дней загружаются возвраты: статус и связь возврата
+	// с отправлением могут обновиться спустя недели
+	returnsSyncDays = 60
+)
+
+// syncAllReturns Загрузка возвратов всех кабинетов OZON всех пользователей
+func syncAllReturns(now time.Time) {
+	users, err := UserDB{}.ozonUsers()
+	if err != nil {
+		log.Printf("Не удалось получить пользователей для загрузки возвратов: %v", err)
+		return
+	}
+	for _, user := range users {
+		userId := user.TelegramUser.User.Id
+		for _, account := range user.TelegramUser.Settings.accounts(MarketplaceOzon) {
+			if !account.connected() {
+				continue
+			}
+			account := account
+			err := syncReturns(&OzonMarketplace{Account: &account}, returnsRepo, userId, account.Id, now.AddDate(0, 0, -returnsSyncDays), now)
+			if err != nil {
+				log.Printf("Не удалось загрузить возвраты %s пользователя %d: %v", account, userId, err)
+			}
+		}
+	}
+}
+
+// startReturnsSync Загрузка возвратов раз в returnsSyncInterval одной из реплик
+func startReturnsSync(ctx context.Context) (done chan struct{}) {
+	return NewScheduledJob(JobDB{}, "returns", returnsSyncInterval, syncAllReturns).start(ctx)
+}
+
+// ReturnsGroup Возвраты по группе товаров
+type ReturnsGroup struct {
+	Group    string
+	Sold     int
+	Returned int
+}
+
+// Rate Доля возвратов от проданных товаров, %
+func (g ReturnsGroup) Rate() decimal.Decimal {
+	if g.Sold == 0 {
+		return decimal.Zero
+	}
+	return decimal.NewFromInt(int64(g.Returned * 100)).Div(decimal.NewFromInt(int64(g.Sold)))
+}
+
+// ReturnsReport Отчет о возвратах за период
+type ReturnsReport struct {
+	// Account Кабинет OZON, по которому построен отчет
+	Account  string
+	Groups   []ReturnsGroup
+	Reasons  map[ReturnReason]int
+	Sold     int
+	Returned int
+	// Unlinked Возвраты, для которых не найдено исходное отправление
+	Unlinked  int
+	Logistics decimal.Decimal
+}
+
+// returnsReport Доля возвратов по группам товаров и причины возвратов
+func returnsReport(lines []ozonLine, returns []ReturnRecord, grouper *ProductGrouper) ReturnsReport {
+	r := ReturnsReport{Reasons: make(map[ReturnReason]int)}
+	groups := make(map[string]*ReturnsGroup)
+	group := func(name string) *ReturnsGroup {
+		g, ok := groups[name]
+		if !ok {
+			g = &ReturnsGroup{Group: name}
+			groups[name] = g
+		}
+		return g
+	}
+	for _, line := range lines {
+		if line.Cancelled {
+			continue
+		}
+		group(grouper.productGroup(line.Product)).Sold += line.Product.Quantity
+		r.Sold += line.Product.Quantity
+	}
+	for _, record := range returns {
+		group(grouper.group(record.Sku, record.OfferId, record.ProductName)).Returned += record.Quantity
+		r.Returned += record.Quantity
+		r.Reasons[record.Reason] += record.Quantity
+		r.Logistics = r.Logistics.Add(decimal.NewFromFloat(record.Logistics))
+		if !record.Linked {
+			r.Unlinked++
+		}
+	}
+	for _, g := range groups {
+		r.Groups = append(r.Groups, *g)
+	}
+	sort.Slice(r.Groups, func(i, j int) bool {
+		if r.Groups[i].Returned != r.Groups[j].Returned {
+			return r.Groups[i].Returned > r.Groups[j].Returned
+		}
+		return r.Groups[i].Group < r.Groups[j].Group
+	})
+	return r
+}
+
+func printReturnsReport(r ReturnsReport, from time.Time, to time.Time) string {
+	indent := format.Plain("    ")
+	mess := []format.Fragment{
+		format.Line(format.Bold(format.Plainf("Возвраты %s с %s по %s:", marketplaceTitle(MarketplaceOzon, r.Account), from.Format("02.01.2006"), to.AddDate(0, 0, -1).Format("02.01.2006")))),
+		format.Line(),
+		format.Line(indent, format.Bold(format.Plainf("Продано: %d, возвращено: %d", r.Sold, r.Returned))),
+		format.Line(indent, format.Plainf("Обратная логистика: %s", r.Logistics.StringFixed(2))),
+	}
+	if r.Returned == 0 {
+		return format.Render(format.HTML, mess...)
+	}
+	mess = append(mess, format.Line(), format.Line(indent, format.Bold(format.Plain("По группам товаров:"))))
+	for _, g := range r.Groups {
+		if g.Returned == 0 {
+			continue
+		}
+		mess = append(mess, format.Line(indent, format.Italic(format.Plain(g.Group+": ")),
+			format.Bold(format.Plainf("%d из %d", g.Returned, g.Sold)), format.Plainf(" (%s%%)", g.Rate().StringFixed(1))))
+	}
+	mess = append(mess, format.Line(), format.Line(indent, format.Bold(format.Plain("Причины:"))))
+	for reason := ReturnReasonOther; reason <= ReturnReasonCancellation; reason++ {
+		if r.Reasons[reason] > 0 {
+			mess = append(mess, format.Line(indent, format.Italic(format.Plain(reason.String()+": ")), format.Bold(format.Plainf("%d", r.Reasons[reason]))))
+		}
+	}
+	if r.Unlinked > 0 {
+		mess = append(mess, format.Line(), format.Line(format.Italic(format.Plainf(
+			"Для %d возвратов не найдено исходное отправление, обратная логистика по ним не учтена.", r.Unlinked))))
+	}
+	return format.Render(format.HTML, mess...)
+}
+
+func returnsCommandHandler(c *RouteContext) {
+	bot := TelegramBot{}
+	userId := c.Access.OwnerId
+	period := lastDaysRange(time.Now(), UserDB{}.userLocation(c.Update.Message.From.Id), returnsPeriod)
+	from, to := period.From, period.To
+	report, err := returnsReportFor(userId, from, to)
+	if err != nil {
+		log.Printf("Не удалось получить возвраты пользователя %d: %v", userId, err)
+		SendMessageToBot(&bot, telegram.SendMessageRequestBody[telegram.InlineKeyboardMarkup, int64]{
+			ChatId:    c.Update.Message.Chat.Id,
+			ParseMode: format.HTML.ParseMode(),
+			Text:      htmlText(format.Plain("Не удалось получить данные OZON, попробуйте позже.")),
+		})
+		return
+	}
+	SendLongMessageToBot(&bot, telegram.SendMessageRequestBody[telegram.InlineKeyboardMarkup, int64]{
+		ChatId:    c.Update.Message.Chat.Id,
+		ParseMode: format.HTML.ParseMode(),
+		Text:      printReturnsReport(report, from, to),
+	})
+}
+
+// returnsReportFor Отчет о возвратах основного кабинета OZON за [from, to) по загруженным возвратам, см. syncAllReturns
+func returnsReportFor(userId int64, from time.Time, to time.Time) (ReturnsReport, error) {
+	account, err := resolveAccount(nil, userId, MarketplaceOzon)
+	if err != nil {
+		return ReturnsReport{}, err
+	}
+	marketplace := &OzonMarketplace{Account: &account}
+	setting, err := UserDB{}.getOzonSetting(userId)
+	if err != nil {
+		return ReturnsReport{}, err
+	}
+	lines, err := marketplace.periodLines(userId, setting, DateRange{From: from, To: to}.filter())
+	if err != nil {
+		return ReturnsReport{}, err
+	}
+	returns, err := returnsRepo.returns(userId, account.Id, from, to)
+	if err != nil {
+		return ReturnsReport{}, err
+	}
+	skus := lineSkus(lines)
+	for _, r := range returns {
+		skus = append(skus, r.Sku)
+	}
+	report := returnsReport(lines, returns, productGrouper(marketplace, userId, setting.ProductSetting.GroupRules, skus))
+	report.Account = account.Name
+	return report, nil
+}
+
+// filterReturns Загруженные возвраты кабинета за период фильтра отчета
+func filterReturns(userId int64, accountId primitive.ObjectID, filter FilterFbo) ([]ReturnRecord, error) {
+	from, err := time.Parse(time.RFC3339, filter.Since)
+	if err != nil {
+		return nil, err
+	}
+	to, err := time.Parse(time.RFC3339, filter.To)
+	if err != nil {
+		return nil, err
+	}
+	return returnsRepo.returns(userId, accountId, from, to)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestClassifyReturn(t *testing.T) {
+	tests := []struct {
+		name       string
+		reasonName string
+		returnType string
+		want       ReturnReason
+	}{
+		{name: "Брак", reasonName: "Товар с браком", returnType: "ClientReturn", want: ReturnReasonDefect},
+		{name: "Повреждение", reasonName: "Поврежденная упаковка", returnType: "ClientReturn", want: ReturnReasonDefect},
+		{name: "Не соответствует описанию", reasonName: "Товар не соответствует описанию", returnType: "ClientReturn", want: ReturnReasonMismatch},
+		{name: "Размер", reasonName: "Не подошел размер", returnType: "ClientReturn", want: ReturnReasonNotFit},
+		{name: "Невыкуп", reasonName: "Покупатель не забрал заказ", returnType: "Cancellation", want: ReturnReasonNotCollected},
+		{name: "Отмена по типу возврата", reasonName: "", returnType: "Cancellation", want: ReturnReasonCancellation},
+		{name: "Неизвестная причина", reasonName: "Другое", returnType: "ClientReturn", want: ReturnReasonOther},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := classifyReturn(tt.reasonName, tt.returnType); got != tt.want {
+				t.Errorf("classifyReturn() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+type returnsSourceMock struct {
+	pages    map[int64][]OzonReturn
+	postings map[string]*ReturnedPosting
+	fetched  []string
+}
+
+func (s *returnsSourceMock) returnsList(userId int64, body ReturnsListRequest) (*ReturnsListResponse, error) {
+	r := &ReturnsListResponse{Returns: s.pages[body.LastId]}
+	if n := len(r.Returns); n > 0 {
+		_, r.HasNext = s.pages[r.Returns[n-1].Id]
+	}
+	return r, nil
+}
+
+func (s *returnsSourceMock) returnedPosting(userId int64, scheme DeliveryScheme, postingNumber string) (*ReturnedPosting, error) {
+	s.fetched = append(s.fetched, string(scheme)+":"+postingNumber)
+	return s.postings[postingNumber], nil
+}
+
+func TestSyncReturns(t *testing.T) {
+	var page1, page2 []OzonReturn
+	json.Unmarshal([]byte(`[{"id":1,"return_reason_name":"Брак","type":"ClientReturn","schema":"Fbo","posting_number":"0001-1",
+		"product":{"sku":10,"name":"Получешки Colibri Белые","quantity":1,"price":{"price":1000}},"logistic":{"return_date":"2024-01-05T10:00:00Z"}},
+		{"id":2,"return_reason_name":"Не подошел размер","type":"ClientReturn","schema":"Fbo","posting_number":"0001-1",
+		"product":{"sku":20,"name":"Полупальцы Colibri Черные","quantity":1,"price":{"price":500}},"logistic":{"return_date":"2024-01-06T10:00:00Z"}}]`), &page1)
+	json.Unmarshal([]byte(`[{"id":3,"return_reason_name":"","type":"Cancellation","schema":"Fbs","posting_number":"0002-1",
+		"product":{"sku":30,"name":"Носки","quantity":2,"price":{"price":300}},"logistic":{"return_date":"2024-01-07T10:00:00Z"}},
+		{"id":4,"type":"ClientReturn","schema":"Fbs","posting_number":"0003-1","product":{"sku":40,"name":"Носки","quantity":1}}]`), &page2)
+	source := &returnsSourceMock{
+		pages: map[int64][]OzonReturn{0: page1, 2: page2},
+		postings: map[string]*ReturnedPosting{
+			"0001-1": {
+				CreatedAt: time.Date(2023, 12, 28, 0, 0, 0, 0, time.UTC),
+				Products:  []PostingProduct{{Sku: 10}, {Sku: 20}},
+				FinancialData: PostingFinancials{Products: []FinancialDataProduct{
+					{ProductId: 10, ItemServices: ItemServices{MarketplaceServiceItemReturnFlowTrans: -50, MarketplaceServiceItemReturnAfterDelivToCustomer: -15.5}},
+					{ProductId: 20, ItemServices: ItemServices{MarketplaceServiceItemReturnFlowTrans: -30}},
+				}},
+			},
+		},
+	}
+	repo := NewReturnsMemory()
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := from.AddDate(0, 1, 0)
+	account, other := primitive.NewObjectID(), primitive.NewObjectID()
+	if err := syncReturns(source, repo, 7, account, from, to); err != nil {
+		t.Fatal(err)
+	}
+	if len(source.fetched) != 2 || source.fetched[0] != "fbo:0001-1" || source.fetched[1] != "fbs:0002-1" {
+		t.Errorf("fetched postings = %v, want one request per posting", source.fetched)
+	}
+	if len(repo.records) != 3 {
+		t.Errorf("stored %d returns, want 3: возврат без дат не сохраняется", len(repo.records))
+	}
+	returns, _ := repo.returns(7, account, from, to)
+	if len(returns) != 3 {
+		t.Fatalf("returns = %+v, want 3", returns)
+	}
+	if returns, _ := repo.returns(7, other, from, to); len(returns) != 0 {
+		t.Errorf("returns of another account = %+v", returns)
+	}
+	if r := returns[0]; !r.Linked || r.Logistics != 65.5 || r.Reason != ReturnReasonDefect || !r.PostingCreatedAt.Equal(source.postings["0001-1"].CreatedAt) {
+		t.Errorf("linked return = %+v", r)
+	}
+	if r := returns[2]; r.Linked || r.Reason != ReturnReasonCancellation || r.Scheme != SchemeFBS {
+		t.Errorf("unlinked return = %+v", r)
+	}
+
+	// Связанные возвраты повторно не запрашивают исходное отправление
+	source.fetched = nil
+	if err := syncReturns(source, repo, 7, account, from, to); err != nil {
+		t.Fatal(err)
+	}
+	if len(source.fetched) != 1 || source.fetched[0] != "fbs:0002-1" {
+		t.Errorf("fetched postings on resync = %v", source.fetched)
+	}
+}
+
+func TestReturnsReport(t *testing.T) {
+	lines := []ozonLine{
+		{Product: PostingProduct{Name: "Получешки Colibri Белые", Quantity: 3}, Delivered: true},
+		{Product: PostingProduct{Name: "Получешки Colibri Белые", Quantity: 1}, Delivered: true},
+		{Product: PostingProduct{Name: "Полупальцы Colibri Черные", Quantity: 2}, Delivered: true},
+		{Product: PostingProduct{Name: "Полупальцы Colibri Черные", Quantity: 5}, Cancelled: true},
+	}
+	returns := []ReturnRecord{
+		{ProductName: "Получешки Colibri Белые", Quantity: 1, Reason: ReturnReasonDefect, Linked: true, Logistics: 65.5},
+		{ProductName: "Получешки Colibri Белые", Quantity: 1, Reason: ReturnReasonNotFit, Linked: true, Logistics: 30},
+		{ProductName: "Полупальцы Colibri Черные", Quantity: 1, Reason: ReturnReasonNotFit},
+	}
+	r := returnsReport(lines, returns, newProductGrouper([]GroupRule{{Kind: GroupByNameRegex, Value: "Белые$", Group: "Белые"}}))
+	if r.Sold != 6 || r.Returned != 3 || r.Unlinked != 1 || !r.Logistics.Equal(decimal.NewFromFloat(95.5)) {
+		t.Errorf("report = %+v", r)
+	}
+	if len(r.Groups) != 2 || r.Groups[0].Group != "Белые" || !r.Groups[0].Rate().Equal(decimal.NewFromInt(50)) {
+		t.Errorf("groups = %+v", r.Groups)
+	}
+
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	r.Account = "Основной"
+	text := printReturnsReport(r, from, from.AddDate(0, 0, returnsPeriod))
+	for _, want := range []string{"Возвраты OZON «Основной» с 01.01.2024 по 30.01.2024", "Продано: 6, возвращено: 3", "Обратная логистика: 95.50",
+		"Белые: </i><b>2 из 4</b> (50.0%)", "Не подошел: </i><b>2</b>", "Для 1 возвратов не найдено"} {
+		if !strings.Contains(text, want) {
+			t.Errorf("report %q does not contain %q", text, want)
+		}
+	}
+}
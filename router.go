@@ -0,0 +1,181 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"telegram"
+)
+
+// RouteContext Обновление, переданное обработчику маршрута
+type RouteContext struct {
+	Update telegram.Update
+	// Payload Часть команды или callback data после совпавшего префикса
+	Payload string
+	// Conversation Текущий диалог пользователя в чате, из которого пришло сообщение
+	Conversation Conversation
+	// Access Чьи данные видит пользователь и с какими правами, см. forRole
+	Access StoreAccess
+}
+
+type HandlerFunc func(c *RouteContext)
+
+type prefixRoute struct {
+	prefix  string
+	handler HandlerFunc
+}
+
+// routes Таблица маршрутов одного вида: точное совпадение проверяется первым,
+// затем самый длинный из подходящих префиксов.
+type routes struct {
+	exact    map[string]HandlerFunc
+	prefixes []prefixRoute
+}
+
+func (rs *routes) add(key string, h HandlerFunc) {
+	if rs.exact == nil {
+		rs.exact = make(map[string]HandlerFunc)
+	}
+	if _, ok := rs.exact[key]; ok {
+		log.Panicf("Маршрут %s уже зарегистрирован", key)
+	}
+	rs.exact[key] = h
+}
+
+func (rs *routes) addPrefix(prefix string, h HandlerFunc) {
+	for _, p := range rs.prefixes {
+		if p.prefix == prefix {
+			log.Panicf("Маршрут %s* уже зарегистрирован", prefix)
+		}
+	}
+	rs.prefixes = append(rs.prefixes, prefixRoute{prefix: prefix, handler: h})
+	sort.SliceStable(rs.prefixes, func(i, j int) bool {
+		return len(rs.prefixes[i].prefix) > len(rs.prefixes[j].prefix)
+	})
+}
+
+func (rs *routes) match(key string) (HandlerFunc, string, bool) {
+	if key == "" {
+		return nil, "", false
+	}
+	if h, ok := rs.exact[key]; ok {
+		return h, "", true
+	}
+	for _, p := range rs.prefixes {
+		if strings.HasPrefix(key, p.prefix) {
+			return p.handler, strings.TrimPrefix(key, p.prefix), true
+		}
+	}
+	return nil, "", false
+}
+
+// Router Выбирает ровно один обработчик для обновления Telegram.
+//
+// Порядок проверки: callback data для нажатий на inline кнопки, данные WebApp,
+// текст команды, текущее состояние диалога пользователя и, если ничего не подошло, fallback.
+type Router struct {
+	commands   routes
+	callbacks  routes
+	webAppData routes
+	states     routes
+	fallback   HandlerFunc
+	// Conversations Состояния диалогов пользователей (например, ожидание ввода Token)
+	Conversations *ConversationFSM
+	// Stores Магазины для проверки прав, nil - каждый пользователь владелец своих данных
+	Stores StoreRepository
+}
+
+func NewRouter() *Router {
+	return &Router{}
+}
+
+func (r *Router) Command(text string, h HandlerFunc) {
+	r.commands.add(text, h)
+}
+
+func (r *Router) CommandPrefix(prefix string, h HandlerFunc) {
+	r.commands.addPrefix(prefix, h)
+}
+
+func (r *Router) Callback(data string, h HandlerFunc) {
+	r.callbacks.add(data, h)
+}
+
+func (r *Router) CallbackPrefix(prefix string, h HandlerFunc) {
+	r.callbacks.addPrefix(prefix, h)
+}
+
+// WebAppData Обработчик данных, отправленных из WebApp по кнопке с текстом buttonText
+func (r *Router) WebAppData(buttonText string, h HandlerFunc) {
+	r.webAppData.add(buttonText, h)
+}
+
+// State Обработчик произвольного текста, присланного пользователем в состоянии state
+func (r *Router) State(state ConversationState, h HandlerFunc) {
+	r.states.add(string(state), h)
+}
+
+func (r *Router) Fallback(h HandlerFunc) {
+	r.fallback = h
+}
+
+// route Поиск обработчика для обновления
+func (r *Router) route(c *RouteContext) HandlerFunc {
+	m := c.Update
+	if m.CallbackQuery.Id != "" {
+		if h, payload, ok := r.callbacks.match(m.CallbackQuery.Data); ok {
+			c.Payload = payload
+			return h
+		}
+		return r.fallback
+	}
+	if h, payload, ok := r.webAppData.match(m.Message.WebAppData.ButtonText); ok {
+		c.Payload = payload
+		return h
+	}
+	if h, payload, ok := r.commands.match(m.Message.Text); ok {
+		c.Payload = payload
+		return h
+	}
+	if r.Conversations != nil && m.Message.MessageId != 0 {
+		conversation, err := r.Conversations.current(messageConversationKey(m.Message))
+		if err != nil {
+			log.Printf("Не удалось получить состояние диалога: %v", err)
+		}
+		if h, _, ok := r.states.match(string(conversation.State)); ok {
+			c.Conversation = conversation
+			return h
+		}
+	}
+	return r.fallback
+}
+
+func (r *Router) Dispatch(m telegram.Update) {
+	c := &RouteContext{Update: m}
+	h := r.route(c)
+	if h == nil {
+		return
+	}
+	c.Access = r.access(m)
+	h(c)
+}
+
+// access Доступ автора обновления к данным магазина
+func (r *Router) access(m telegram.Update) StoreAccess {
+	userId := m.Message.From.Id
+	if m.CallbackQuery.Id != "" {
+		userId = m.CallbackQuery.From.Id
+	}
+	if r.Stores == nil {
+		return StoreAccess{OwnerId: userId, Role: RoleOwner}
+	}
+	return storeAccess(r.Stores, userId)
+}
+
+func messageConversationKey(m telegram.Message) ConversationKey {
+	return ConversationKey{UserId: m.From.Id, ChatId: m.Chat.Id}
+}
+
+func callbackConversationKey(q telegram.CallbackQuery) ConversationKey {
+	return ConversationKey{UserId: q.From.Id, ChatId: q.Message.Chat.Id}
+}
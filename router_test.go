@@ -0,0 +1,65 @@
+package main
+
+import (
+	"telegram"
+	"testing"
+)
+
+func TestRouter_Dispatch(t *testing.T) {
+	var called []string
+	handler := func(name string) HandlerFunc {
+		return func(c *RouteContext) {
+			called = append(called, name+":"+c.Payload)
+		}
+	}
+	r := NewRouter()
+	r.Conversations = NewConversationFSM(NewConversationMemory())
+	err := r.Conversations.enter(ConversationKey{UserId: 0, ChatId: 1}, StateAwaitPurchasePrice, ConversationPayload{NameGroup: "Носки"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Command("/start", handler("start"))
+	r.CommandPrefix("/start ", handler("start-token"))
+	r.Callback("/settingpurchaseprice", handler("setting"))
+	r.CallbackPrefix("/setpurchaseprice-", handler("price"))
+	r.CallbackPrefix("/set", handler("set"))
+	r.WebAppData("Отчет", handler("webapp"))
+	r.State(StateAwaitPurchasePrice, func(c *RouteContext) {
+		called = append(called, "state:"+c.Conversation.Payload.NameGroup)
+	})
+	r.Fallback(handler("fallback"))
+
+	callback := func(data string) telegram.Update {
+		return telegram.Update{CallbackQuery: telegram.CallbackQuery{Id: "1", Data: data}}
+	}
+	message := func(chatId int64, text string) telegram.Update {
+		return telegram.Update{Message: telegram.Message{MessageId: 1, Chat: telegram.Chat{Id: chatId}, Text: text}}
+	}
+	tests := []struct {
+		name   string
+		update telegram.Update
+		want   string
+	}{
+		{name: "Точное совпадение callback", update: callback("/settingpurchaseprice"), want: "setting:"},
+		{name: "Самый длинный префикс callback", update: callback("/setpurchaseprice-Носки"), want: "price:Носки"},
+		{name: "Короткий префикс callback", update: callback("/setcostozon"), want: "set:costozon"},
+		{name: "Неизвестный callback", update: callback("/unknown"), want: "fallback:"},
+		{name: "Команда", update: message(2, "/start"), want: "start:"},
+		{name: "Команда с параметром", update: message(2, "/start abc"), want: "start-token:abc"},
+		{name: "Команда важнее состояния", update: message(1, "/start"), want: "start:"},
+		{name: "Текст в состоянии диалога", update: message(1, "100"), want: "state:Носки"},
+		{name: "Текст без состояния", update: message(2, "100"), want: "fallback:"},
+		{name: "Данные WebApp", update: telegram.Update{Message: telegram.Message{
+			WebAppData: telegram.WebAppData{ButtonText: "Отчет", Data: "2024-01-01::2024-01-02"},
+		}}, want: "webapp:"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			called = nil
+			r.Dispatch(tt.update)
+			if len(called) != 1 || called[0] != tt.want {
+				t.Errorf("Dispatch() called %v, want [%s]", called, tt.want)
+			}
+		})
+	}
+}
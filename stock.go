@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"format"
+	"log"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// defaultStockAlertDays Порог запаса в днях продаж, если пользователь его не задал
+	defaultStockAlertDays = 7
+	// stockVelocityPeriod Период, по продажам за который считается скорость продаж, дней
+	stockVelocityPeriod = 14
+	// stockCheckInterval Период проверки остатков всех пользователей
+	stockCheckInterval = 3 * time.Hour
+	stockPageLimit     = 1000
+)
+
+// stockAlertDays Порог запаса в днях продаж для уведомлений об остатках
+func (s OzonSetting) stockAlertDays() float64 {
+	if s.StockAlertDays <= 0 {
+		return defaultStockAlertDays
+	}
+	return s.StockAlertDays
+}
+
+type StockOnWarehousesRequest struct {
+	Limit         int64  `json:"limit"`
+	Offset        int64  `json:"offset"`
+	WarehouseType string `json:"warehouse_type"`
+}
+type StockOnWarehousesResponse struct {
+	Result struct {
+		Rows []StockOnWarehouseRow `json:"rows"`
+	} `json:"result"`
+}
+type StockOnWarehouseRow struct {
+	Sku              int64  `json:"sku"`
+	ItemCode         string `json:"item_code"`
+	ItemName         string `json:"item_name"`
+	FreeToSellAmount int    `json:"free_to_sell_amount"`
+	PromisedAmount   int    `json:"promised_amount"`
+	ReservedAmount   int    `json:"reserved_amount"`
+	WarehouseName    string `json:"warehouse_name"`
+}
+
+// StockKey Остаток хранится отдельно для каждого кабинета OZON пользователя
+type StockKey struct {
+	UserId    int64              `bson:"user_id"`
+	AccountId primitive.ObjectID `bson:"account_id"`
+	Sku       int64              `bson:"sku"`
+}
+
+type WarehouseStock struct {
+	Name       string `bson:"name"`
+	FreeToSell int    `bson:"free_to_sell"`
+	Reserved   int    `bson:"reserved"`
+}
+
+// StockRecord Остаток товара на складах OZON и запас в днях продаж
+type StockRecord struct {
+	Key        StockKey         `bson:"_id"`
+	OfferId    string           `bson:"offer_id"`
+	Name       string           `bson:"name"`
+	FreeToSell int              `bson:"free_to_sell"`
+	Reserved   int              `bson:"reserved"`
+	Warehouses []WarehouseStock `bson:"warehouses"`
+	// Velocity Продажи в день за последние stockVelocityPeriod дней
+	Velocity float64 `bson:"velocity"`
+	// DaysOfCover На сколько дней хватит остатка, +Inf без продаж
+	DaysOfCover float64 `bson:"days_of_cover"`
+	// Alerted Уведомление о низком остатке уже отправлено, повторно отправляется после пополнения
+	Alerted   bool      `bson:"alerted"`
+	UpdatedAt time.Time `bson:"updated_at"`
+}
+
+type StockRepository interface {
+	upsertStocks(stocks []StockRecord) error
+	// stocks Остатки кабинета пользователя
+	stocks(userId int64, accountId primitive.ObjectID) ([]StockRecord, error)
+}
+
+// StockDB Остатки в MongoDB
+type StockDB struct{}
+
+func (d StockDB) collection() *mongo.Collection {
+	return clientMongo.Database("MyInfantBotDB").Collection("bot_stocks")
+}
+
+func (d StockDB) createIndexes() error {
+	_, err := d.collection().Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys: bson.D{{"_id.user_id", 1}, {"_id.account_id", 1}},
+	})
+	return err
+}
+
+// removeUnkeyed Удаление остатков, сохраненных без кабинета в ключе. Проверка остатков сохранит их заново с кабинетом.
+func (d StockDB) removeUnkeyed() error {
+	_, err := d.collection().DeleteMany(context.TODO(), bson.D{{"_id.account_id", bson.D{{"$exists", false}}}})
+	return err
+}
+
+func (d StockDB) upsertStocks(stocks []StockRecord) error {
+	if len(stocks) == 0 {
+		return nil
+	}
+	models := make([]mongo.WriteModel, 0, len(stocks))
+	for _, s := range stocks {
+		models = append(models, mongo.NewReplaceOneModel().SetFilter(bson.D{{"_id", s.Key}}).SetReplacement(s).SetUpsert(true))
+	}
+	_, err := d.collection().BulkWrite(context.TODO(), models, options.BulkWrite().SetOrdered(false))
+	return err
+}
+
+func (d StockDB) stocks(userId int64, accountId primitive.ObjectID) ([]StockRecord, error) {
+	cursor, err := d.collection().Find(context.TODO(), bson.D{{"_id.user_id", userId}, {"_id.account_id", accountId}})
+	if err != nil {
+		return nil, err
+	}
+	var stocks []StockRecord
+	err = cursor.All(context.TODO(), &stocks)
+	return stocks, err
+}
+
+// StockMemory Остатки в памяти процесса
+type StockMemory struct {
+	mu      sync.Mutex
+	records map[StockKey]StockRecord
+}
+
+func NewStockMemory() *StockMemory {
+	return &StockMemory{records: make(map[StockKey]StockRecord)}
+}
+
+func (d *StockMemory) upsertStocks(stocks []StockRecord) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, s := range stocks {
+		d.records[s.Key] = s
+	}
+	return nil
+}
+
+func (d *StockMemory) stocks(userId int64, accountId primitive.ObjectID) ([]StockRecord, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var stocks []StockRecord
+	for _, s := range d.records {
+		if s.Key.UserId == userId && s.Key.AccountId == accountId {
+			stocks = append(stocks, s)
+		}
+	}
+	return stocks, nil
+}
+
+// StockSource Остатки на складах и отправления FBO из Seller API
+type StockSource interface {
+	stockOnWarehouses(userId int64, body StockOnWarehousesRequest) (*StockOnWarehousesResponse, error)
+	ExportMarketplace
+}
+
+func (m *OzonMarketplace) stockOnWarehouses(userId int64, body StockOnWarehousesRequest) (*StockOnWarehousesResponse, error) {
+	var r StockOnWarehousesResponse
+	if err := m.ozonRequest(userId, "/v2/analytics/stock_on_warehouses", body, &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// salesVelocity Продажи FBO в день по sku, отмененные отправления не учитываются
+func salesVelocity(resp *ListResponseFBO, days int) (map[int64]float64, map[int64]PostingProduct) {
+	velocity := make(map[int64]float64)
+	products := make(map[int64]PostingProduct)
+	for _, posting := range resp.Result {
+		if posting.Status == Cancelled.String() {
+			continue
+		}
+		for _, product := range posting.Products {
+			velocity[int64(product.Sku)] += float64(product.Quantity) / float64(days)
+			products[int64(product.Sku)] = product
+		}
+	}
+	return velocity, products
+}
+
+// syncStocks Загрузка остатков, расчет запаса в днях и отбор товаров, по которым нужно уведомление.
+// Товары с продажами, которых нет в остатках OZON, считаются закончившимися. source должен обращаться к кабинету accountId.
+func syncStocks(source StockSource, repo StockRepository, userId int64, accountId primitive.ObjectID, threshold float64, now time.Time) ([]StockRecord, error) {
+	rows, err := paginate(stockPageLimit, func(offset int, limit int) ([]StockOnWarehouseRow, bool, error) {
+		response, err := source.stockOnWarehouses(userId, StockOnWarehousesRequest{Limit: int64(limit), Offset: int64(offset), WarehouseType: "ALL"})
+		if err != nil {
+			return nil, false, err
+		}
+		return response.Result.Rows, true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	current := make(map[int64]*StockRecord)
+	for _, row := range rows {
+		s, ok := current[row.Sku]
+		if !ok {
+			s = &StockRecord{Key: StockKey{UserId: userId, AccountId: accountId, Sku: row.Sku}, OfferId: row.ItemCode, Name: row.ItemName}
+			current[row.Sku] = s
+		}
+		s.FreeToSell += row.FreeToSellAmount
+		s.Reserved += row.ReservedAmount
+		s.Warehouses = append(s.Warehouses, WarehouseStock{Name: row.WarehouseName, FreeToSell: row.FreeToSellAmount, Reserved: row.ReservedAmount})
+	}
+
+	to := now.UTC()
+	since := to.AddDate(0, 0, -stockVelocityPeriod)
+	resp, err := source.postings(userId, FilterFbo{Since: since.Format(time.RFC3339), To: to.Format(time.RFC3339)}, WithFbo{})
+	if err != nil {
+		return nil, err
+	}
+	velocity, products := salesVelocity(resp, stockVelocityPeriod)
+	for sku, product := range products {
+		if _, ok := current[sku]; !ok {
+			current[sku] = &StockRecord{Key: StockKey{UserId: userId, AccountId: accountId, Sku: sku}, OfferId: product.OfferId, Name: product.Name}
+		}
+	}
+
+	stored, err := repo.stocks(userId, accountId)
+	if err != nil {
+		return nil, err
+	}
+	alerted := make(map[int64]bool, len(stored))
+	for _, s := range stored {
+		alerted[s.Key.Sku] = s.Alerted
+	}
+
+	var alerts []StockRecord
+	records := make([]StockRecord, 0, len(current))
+	for sku, s := range current {
+		s.Velocity = velocity[sku]
+		s.DaysOfCover = math.Inf(1)
+		if s.Velocity > 0 {
+			s.DaysOfCover = float64(s.FreeToSell) / s.Velocity
+		}
+		s.Alerted = s.DaysOfCover < threshold
+		s.UpdatedAt = to
+		if s.Alerted && !alerted[sku] {
+			alerts = append(alerts, *s)
+		}
+		records = append(records, *s)
+	}
+	if err := repo.upsertStocks(records); err != nil {
+		return nil, err
+	}
+	sort.Slice(alerts, func(i, j int) bool { return alerts[i].DaysOfCover < alerts[j].DaysOfCover })
+	return alerts, nil
+}
+
+func printStockAlert(alerts []StockRecord, account string, threshold float64) string {
+	indent := format.Plain("    ")
+	mess := []format.Fragment{
+		format.Line(format.Bold(format.Plainf("Заканчиваются товары на складах %s (запас меньше %s дн.):",
+			marketplaceTitle(MarketplaceOzon, account), decimal.NewFromFloat(threshold).String()))),
+		format.Line(),
+	}
+	for _, s := range alerts {
+		mess = append(mess, format.Line(indent, format.Italic(format.Plain(s.Name+": ")),
+			format.Bold(format.Plainf("%d шт., на %s дн.", s.FreeToSell, decimal.NewFromFloat(s.DaysOfCover).StringFixed(1))),
+			format.Plainf(" (продажи %s шт. в день)", decimal.NewFromFloat(s.Velocity).StringFixed(1))))
+	}
+	return format.Render(format.HTML, mess...)
+}
+
+// ozonUsers Пользователи с подключенным OZON: в прежних настройках или в кабинетах
+func (m UserDB) ozonUsers() ([]UserDB, error) {
+	coll := clientMongo.Database("MyInfantBotDB").Collection("bot_users")
+	filter := bson.D{{"$or", bson.A{
+		bson.D{{"telegram_user.settings.ozon_setting.client_id", bson.D{{"$nin", bson.A{"", nil}}}}},
+		bson.D{{"telegram_user.settings.accounts.marketplace", MarketplaceOzon}},
+	}}}
+	cursor, err := coll.Find(context.TODO(), filter)
+	if err != nil {
+		return nil, err
+	}
+	var users []UserDB
+	err = cursor.All(context.TODO(), &users)
+	return users, err
+}
+
+// checkUserStocks Проверка остатков каждого кабинета OZON пользователя и рассылка уведомлений во все его чаты
+func checkUserStocks(user UserDB, now time.Time) {
+	userId := user.TelegramUser.User.Id
+	threshold := user.TelegramUser.Settings.OzonSetting.stockAlertDays()
+	for _, account := range user.TelegramUser.Settings.accounts(MarketplaceOzon) {
+		if !account.connected() {
+			continue
+		}
+		account := account
+		alerts, err := syncStocks(&OzonMarketplace{Account: &account}, stockRepo, userId, account.Id, threshold, now)
+		if err != nil {
+			log.Printf("Не удалось проверить остатки %s пользователя %d: %v", account, userId, err)
+			continue
+		}
+		if len(alerts) > 0 {
+			BroadcastToChats(user.TelegramUser.Chats, printStockAlert(alerts, account.Name, threshold))
+		}
+	}
+}
+
+func checkStocks(now time.Time) {
+	users, err := UserDB{}.ozonUsers()
+	if err != nil {
+		log.Printf("Не удалось получить пользователей для проверки остатков: %v", err)
+		return
+	}
+	for _, user := range users {
+		checkUserStocks(user, now)
+	}
+}
+
+// startStockMonitor Проверка остатков раз в stockCheckInterval одной из реплик, первая - сразу при запуске,
+// если другая реплика не проверяла остатки недавно
+func startStockMonitor(ctx context.Context) (done chan struct{}) {
+	if err := (StockDB{}).createIndexes(); err != nil {
+		log.Printf("Не удалось создать индексы остатков: %v", err)
+	}
+	if err := (StockDB{}).removeUnkeyed(); err != nil {
+		log.Printf("Не удалось удалить остатки без кабинета: %v", err)
+	}
+	return NewScheduledJob(JobDB{}, "stocks", stockCheckInterval, checkStocks).start(ctx)
+}
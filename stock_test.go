@@ -0,0 +1,114 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type stockSourceMock struct {
+	rows   []StockOnWarehouseRow
+	fbo    []PostingFBO
+	filter FilterFbo
+}
+
+func (s *stockSourceMock) stockOnWarehouses(userId int64, body StockOnWarehousesRequest) (*StockOnWarehousesResponse, error) {
+	var r StockOnWarehousesResponse
+	if body.Offset < int64(len(s.rows)) {
+		r.Result.Rows = s.rows[body.Offset:]
+	}
+	return &r, nil
+}
+
+func (s *stockSourceMock) postings(userId int64, filter FilterFbo, with WithFbo) (*ListResponseFBO, error) {
+	s.filter = filter
+	return &ListResponseFBO{Result: s.fbo}, nil
+}
+
+func TestSyncStocks(t *testing.T) {
+	now := time.Date(2024, 3, 15, 12, 0, 0, 0, time.UTC)
+	source := &stockSourceMock{
+		rows: []StockOnWarehouseRow{
+			{Sku: 10, ItemName: "Получешки Colibri Белые", FreeToSellAmount: 2, WarehouseName: "Хоругвино"},
+			{Sku: 10, ItemName: "Получешки Colibri Белые", FreeToSellAmount: 4, ReservedAmount: 1, WarehouseName: "Казань"},
+			{Sku: 20, ItemName: "Полупальцы Colibri Черные", FreeToSellAmount: 100, WarehouseName: "Хоругвино"},
+			{Sku: 40, ItemName: "Без продаж", FreeToSellAmount: 0, WarehouseName: "Казань"},
+		},
+		fbo: []PostingFBO{
+			{Status: Delivered.String(), Products: []PostingProduct{{Sku: 10, Quantity: 14}, {Sku: 20, Quantity: 7}}},
+			{Status: Cancelled.String(), Products: []PostingProduct{{Sku: 20, Quantity: 70}}},
+			{Status: Delivering.String(), Products: []PostingProduct{{Sku: 30, Name: "Носки", Quantity: 2}}},
+		},
+	}
+	repo := NewStockMemory()
+	account, other := primitive.NewObjectID(), primitive.NewObjectID()
+	alerts, err := syncStocks(source, repo, 7, account, 7, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if source.filter.Since != "2024-03-01T12:00:00Z" || source.filter.To != "2024-03-15T12:00:00Z" {
+		t.Errorf("velocity filter = %+v", source.filter)
+	}
+	if len(alerts) != 2 || alerts[0].Key.Sku != 30 || alerts[1].Key.Sku != 10 {
+		t.Fatalf("alerts = %+v, want sku 30 then 10", alerts)
+	}
+	if a := alerts[1]; a.FreeToSell != 6 || a.Reserved != 1 || len(a.Warehouses) != 2 || a.Velocity != 1 || a.DaysOfCover != 6 {
+		t.Errorf("alert = %+v", a)
+	}
+	if alerts[0].Name != "Носки" || alerts[0].DaysOfCover != 0 {
+		t.Errorf("sold out alert = %+v", alerts[0])
+	}
+	stocks, _ := repo.stocks(7, account)
+	for _, s := range stocks {
+		if s.Key.Sku == 40 && !math.IsInf(s.DaysOfCover, 1) {
+			t.Errorf("stock without sales = %+v, want infinite cover", s)
+		}
+	}
+
+	// Повторное уведомление не отправляется, пока остаток не пополнят
+	alerts, _ = syncStocks(source, repo, 7, account, 7, now)
+	if len(alerts) != 0 {
+		t.Errorf("repeated alerts = %+v", alerts)
+	}
+	// Другой кабинет уведомляется о своих остатках независимо
+	if alerts, _ := syncStocks(source, repo, 7, other, 7, now); len(alerts) != 2 {
+		t.Errorf("alerts of another account = %+v, want 2", alerts)
+	}
+	source.rows[0].FreeToSellAmount = 100
+	syncStocks(source, repo, 7, account, 7, now)
+	source.rows[0].FreeToSellAmount = 2
+	alerts, _ = syncStocks(source, repo, 7, account, 7, now)
+	if len(alerts) != 1 || alerts[0].Key.Sku != 10 {
+		t.Errorf("alerts after restock = %+v", alerts)
+	}
+}
+
+func TestPrintStockAlert(t *testing.T) {
+	text := printStockAlert([]StockRecord{{Name: "Белые", FreeToSell: 3, Velocity: 1.5, DaysOfCover: 2}}, "Второй", 7.5)
+	for _, want := range []string{"складах OZON «Второй» (запас меньше 7.5 дн.)", "Белые: </i><b>3 шт., на 2.0 дн.</b> (продажи 1.5 шт. в день)"} {
+		if !strings.Contains(text, want) {
+			t.Errorf("alert %q does not contain %q", text, want)
+		}
+	}
+}
+
+func TestStockAlertDays(t *testing.T) {
+	tests := []struct {
+		name    string
+		setting OzonSetting
+		want    float64
+	}{
+		{name: "Порог не задан", setting: OzonSetting{}, want: defaultStockAlertDays},
+		{name: "Порог задан", setting: OzonSetting{StockAlertDays: 10}, want: 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.setting.stockAlertDays(); got != tt.want {
+				t.Errorf("stockAlertDays() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
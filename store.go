@@ -0,0 +1,576 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"format"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"telegram"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// storeInviteTTL Срок действия ссылки-приглашения
+const storeInviteTTL = 7 * 24 * time.Hour
+
+// botUsername Имя бота в Telegram для ссылок-приглашений t.me/<имя>?start=<код>
+var botUsername string
+
+// StoreRole Роль участника магазина
+type StoreRole string
+
+const (
+	// RoleOwner Владелец: его настройки и ключи API, доступно все
+	RoleOwner StoreRole = "owner"
+	// RoleManager Менеджер: отчеты и настройки магазина, кроме кабинетов с ключами API
+	RoleManager StoreRole = "manager"
+	// RoleViewer Наблюдатель: только отчеты
+	RoleViewer StoreRole = "viewer"
+)
+
+// storeRoles Роли по возрастанию прав
+var storeRoles = []StoreRole{RoleViewer, RoleManager, RoleOwner}
+
+func (r StoreRole) String() string {
+	switch r {
+	case RoleOwner:
+		return "владелец"
+	case RoleManager:
+		return "менеджер"
+	case RoleViewer:
+		return "наблюдатель"
+	}
+	return string(r)
+}
+
+// allows Роль дает права не меньше, чем required
+func (r StoreRole) allows(required StoreRole) bool {
+	rank := func(role StoreRole) int {
+		return findIndex(storeRoles, func(e StoreRole) bool { return e == role })
+	}
+	return rank(r) >= 0 && rank(r) >= rank(required)
+}
+
+// StoreMember Участник магазина, приглашенный владельцем
+type StoreMember struct {
+	UserId   int64     `bson:"user_id"`
+	Name     string    `bson:"name"`
+	Role     StoreRole `bson:"role"`
+	JoinedAt time.Time `bson:"joined_at"`
+}
+
+// StoreInvite Одноразовое приглашение в магазин по ссылке /start <Token>
+type StoreInvite struct {
+	Token     string    `bson:"token"`
+	Role      StoreRole `bson:"role"`
+	ExpiresAt time.Time `bson:"expires_at"`
+}
+
+// Store Магазин: настройки, кабинеты и отчеты владельца, к которым он открыл доступ участникам.
+// Данные магазина по-прежнему хранятся в настройках владельца.
+type Store struct {
+	Id      primitive.ObjectID `bson:"_id"`
+	OwnerId int64              `bson:"owner_id"`
+	Members []StoreMember      `bson:"members"`
+	Invites []StoreInvite      `bson:"invites"`
+}
+
+// StoreAccess Чьи данные видит пользователь и с какими правами
+type StoreAccess struct {
+	// OwnerId Пользователь, чьи настройки и кабинеты используются в отчетах
+	OwnerId int64
+	Role    StoreRole
+}
+
+var errInviteNotFound = errors.New("приглашение не найдено или устарело")
+
+// access Доступ участника магазина, false - пользователь не участник
+func (s Store) access(userId int64) (StoreAccess, bool) {
+	i := findIndex(s.Members, func(m StoreMember) bool { return m.UserId == userId })
+	if i < 0 {
+		return StoreAccess{}, false
+	}
+	return StoreAccess{OwnerId: s.OwnerId, Role: s.Members[i].Role}, true
+}
+
+// join Участник по приглашению token. Приглашение одноразовое, повторное приглашение меняет роль участника.
+func (s *Store) join(token string, member StoreMember, now time.Time) (StoreMember, error) {
+	i := findIndex(s.Invites, func(inv StoreInvite) bool { return inv.Token == token && inv.ExpiresAt.After(now) })
+	if i < 0 || member.UserId == s.OwnerId {
+		return StoreMember{}, errInviteNotFound
+	}
+	member.Role = s.Invites[i].Role
+	member.JoinedAt = now
+	s.Invites = append(s.Invites[:i:i], s.Invites[i+1:]...)
+	s.removeMember(member.UserId)
+	s.Members = append(s.Members, member)
+	return member, nil
+}
+
+func (s *Store) removeMember(userId int64) {
+	var members []StoreMember
+	for _, m := range s.Members {
+		if m.UserId != userId {
+			members = append(members, m)
+		}
+	}
+	s.Members = members
+}
+
+// newStoreInvite Приглашение с кодом, который помещается в параметр /start (до 64 символов A-Z, a-z, 0-9, _ и -)
+func newStoreInvite(role StoreRole, now time.Time) (StoreInvite, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return StoreInvite{}, err
+	}
+	return StoreInvite{Token: base64.RawURLEncoding.EncodeToString(b), Role: role, ExpiresAt: now.Add(storeInviteTTL)}, nil
+}
+
+// inviteLink Ссылка-приглашение. Пока имя бота не задано, приглашение передается командой.
+func inviteLink(token string) string {
+	if botUsername == "" {
+		return "/start " + token
+	}
+	return fmt.Sprintf("https://t.me/%s?start=%s", botUsername, token)
+}
+
+type StoreRepository interface {
+	// memberStore Магазин, участником которого является пользователь, nil - не участник
+	memberStore(userId int64) (*Store, error)
+	// ownerStore Магазин владельца, nil - владелец еще никого не приглашал
+	ownerStore(ownerId int64) (*Store, error)
+	addInvite(ownerId int64, invite StoreInvite) error
+	// acceptInvite Вступление в магазин по приглашению, участник выходит из магазина, в котором был раньше
+	acceptInvite(token string, member StoreMember, now time.Time) (*Store, StoreMember, error)
+	setMemberRole(ownerId int64, userId int64, role StoreRole) error
+	removeMember(ownerId int64, userId int64) error
+}
+
+// storeAccess Доступ пользователя: участник магазина работает с данными владельца,
+// остальные - владельцы своих данных
+func storeAccess(repo StoreRepository, userId int64) StoreAccess {
+	own := StoreAccess{OwnerId: userId, Role: RoleOwner}
+	store, err := repo.memberStore(userId)
+	if err != nil {
+		log.Printf("Не удалось получить магазин пользователя %d: %v", userId, err)
+		return own
+	}
+	if store == nil {
+		return own
+	}
+	if access, ok := store.access(userId); ok {
+		return access
+	}
+	return own
+}
+
+// StoreDB Магазины в MongoDB
+type StoreDB struct{}
+
+func (d StoreDB) collection() *mongo.Collection {
+	return clientMongo.Database("MyInfantBotDB").Collection("bot_stores")
+}
+
+func (d StoreDB) createIndexes() error {
+	_, err := d.collection().Indexes().CreateMany(context.TODO(), []mongo.IndexModel{
+		{Keys: bson.D{{"owner_id", 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{"members.user_id", 1}}},
+		{Keys: bson.D{{"invites.token", 1}}},
+	})
+	return err
+}
+
+func (d StoreDB) findStore(filter bson.D) (*Store, error) {
+	var store Store
+	err := d.collection().FindOne(context.TODO(), filter).Decode(&store)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &store, nil
+}
+
+func (d StoreDB) memberStore(userId int64) (*Store, error) {
+	return d.findStore(bson.D{{"members.user_id", userId}})
+}
+
+func (d StoreDB) ownerStore(ownerId int64) (*Store, error) {
+	return d.findStore(bson.D{{"owner_id", ownerId}})
+}
+
+func (d StoreDB) addInvite(ownerId int64, invite StoreInvite) error {
+	update := bson.D{
+		{"$push", bson.D{{"invites", invite}}},
+		{"$setOnInsert", bson.D{{"_id", primitive.NewObjectID()}, {"members", bson.A{}}}},
+	}
+	_, err := d.collection().UpdateOne(context.TODO(), bson.D{{"owner_id", ownerId}}, update, options.Update().SetUpsert(true))
+	return err
+}
+
+func (d StoreDB) acceptInvite(token string, member StoreMember, now time.Time) (*Store, StoreMember, error) {
+	// Приглашение забирается атомарно: по одной ссылке вступает только один пользователь
+	filter := bson.D{
+		{"invites", bson.D{{"$elemMatch", bson.D{{"token", token}, {"expires_at", bson.D{{"$gt", now}}}}}}},
+		{"owner_id", bson.D{{"$ne", member.UserId}}},
+	}
+	update := bson.D{{"$pull", bson.D{{"invites", bson.D{{"token", token}}}}}}
+	var store Store
+	err := d.collection().FindOneAndUpdate(context.TODO(), filter, update).Decode(&store)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, StoreMember{}, errInviteNotFound
+	}
+	if err != nil {
+		return nil, StoreMember{}, err
+	}
+	member, err = store.join(token, member, now)
+	if err != nil {
+		return nil, StoreMember{}, err
+	}
+	if _, err := d.collection().UpdateMany(context.TODO(), bson.D{{"members.user_id", member.UserId}},
+		bson.D{{"$pull", bson.D{{"members", bson.D{{"user_id", member.UserId}}}}}}); err != nil {
+		return nil, StoreMember{}, err
+	}
+	if _, err := d.collection().UpdateByID(context.TODO(), store.Id, bson.D{{"$push", bson.D{{"members", member}}}}); err != nil {
+		return nil, StoreMember{}, err
+	}
+	return &store, member, nil
+}
+
+func (d StoreDB) setMemberRole(ownerId int64, userId int64, role StoreRole) error {
+	filter := bson.D{{"owner_id", ownerId}, {"members.user_id", userId}}
+	_, err := d.collection().UpdateOne(context.TODO(), filter, bson.D{{"$set", bson.D{{"members.$.role", role}}}})
+	return err
+}
+
+func (d StoreDB) removeMember(ownerId int64, userId int64) error {
+	update := bson.D{{"$pull", bson.D{{"members", bson.D{{"user_id", userId}}}}}}
+	_, err := d.collection().UpdateOne(context.TODO(), bson.D{{"owner_id", ownerId}}, update)
+	return err
+}
+
+// StoreMemory Магазины в памяти процесса
+type StoreMemory struct {
+	mu     sync.Mutex
+	stores map[int64]*Store
+}
+
+func NewStoreMemory() *StoreMemory {
+	return &StoreMemory{stores: make(map[int64]*Store)}
+}
+
+func (d *StoreMemory) memberStore(userId int64) (*Store, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, s := range d.stores {
+		if _, ok := s.access(userId); ok {
+			store := *s
+			return &store, nil
+		}
+	}
+	return nil, nil
+}
+
+func (d *StoreMemory) ownerStore(ownerId int64) (*Store, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if s, ok := d.stores[ownerId]; ok {
+		store := *s
+		return &store, nil
+	}
+	return nil, nil
+}
+
+func (d *StoreMemory) addInvite(ownerId int64, invite StoreInvite) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	s, ok := d.stores[ownerId]
+	if !ok {
+		s = &Store{Id: primitive.NewObjectID(), OwnerId: ownerId}
+		d.stores[ownerId] = s
+	}
+	s.Invites = append(s.Invites, invite)
+	return nil
+}
+
+func (d *StoreMemory) acceptInvite(token string, member StoreMember, now time.Time) (*Store, StoreMember, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, s := range d.stores {
+		if findIndex(s.Invites, func(inv StoreInvite) bool { return inv.Token == token }) < 0 {
+			continue
+		}
+		joined, err := s.join(token, member, now)
+		if err != nil {
+			return nil, StoreMember{}, err
+		}
+		for _, other := range d.stores {
+			if other != s {
+				other.removeMember(joined.UserId)
+			}
+		}
+		store := *s
+		return &store, joined, nil
+	}
+	return nil, StoreMember{}, errInviteNotFound
+}
+
+func (d *StoreMemory) setMemberRole(ownerId int64, userId int64, role StoreRole) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if s, ok := d.stores[ownerId]; ok {
+		for i := range s.Members {
+			if s.Members[i].UserId == userId {
+				s.Members[i].Role = role
+			}
+		}
+	}
+	return nil
+}
+
+func (d *StoreMemory) removeMember(ownerId int64, userId int64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if s, ok := d.stores[ownerId]; ok {
+		s.removeMember(userId)
+	}
+	return nil
+}
+
+// forRole Обработчик, доступный участникам магазина с ролью не ниже role
+func forRole(role StoreRole, h HandlerFunc) HandlerFunc {
+	return func(c *RouteContext) {
+		if c.Access.Role.allows(role) {
+			h(c)
+			return
+		}
+		bot := TelegramBot{}
+		text := fmt.Sprintf("Недостаточно прав: вы %s магазина, а действие доступно с ролью %s.", c.Access.Role, role)
+		if q := c.Update.CallbackQuery; q.Id != "" {
+			answerCallbackQueryToBot(&bot, telegram.AnswerCallbackQueryRequestBody{CallbackQueryId: q.Id, Text: text, ShowAlert: true})
+			return
+		}
+		m := c.Update.Message
+		if c.Conversation.State != StateIdle {
+			finishConversation(m)
+		}
+		SendMessageToBot(&bot, telegram.SendMessageRequestBody[telegram.InlineKeyboardMarkup, int64]{
+			ChatId:    m.Chat.Id,
+			ParseMode: format.HTML.ParseMode(),
+			Text:      htmlText(format.Plain(text)),
+		})
+	}
+}
+
+// joinStore Вступление в магазин по ссылке-приглашению из /start
+func joinStore(m telegram.Message, token string) {
+	bot := TelegramBot{}
+	name := strings.TrimSpace(m.From.FirstName + " " + m.From.LastName)
+	if m.From.Username != "" {
+		name = "@" + m.From.Username
+	}
+	_, member, err := storeRepo.acceptInvite(token, StoreMember{UserId: m.From.Id, Name: name}, time.Now())
+	if err != nil {
+		if !errors.Is(err, errInviteNotFound) {
+			log.Printf("Не удалось принять приглашение пользователя %d: %v", m.From.Id, err)
+		}
+		SendMessageToBot(&bot, telegram.SendMessageRequestBody[telegram.InlineKeyboardMarkup, int64]{
+			ChatId:    m.Chat.Id,
+			ParseMode: format.HTML.ParseMode(),
+			Text:      htmlText(format.Plain("Приглашение не найдено или устарело. Попросите владельца магазина прислать новую ссылку.")),
+		})
+		return
+	}
+	SendMessageToBot(&bot, telegram.SendMessageRequestBody[telegram.InlineKeyboardMarkup, int64]{
+		ChatId:    m.Chat.Id,
+		ParseMode: format.HTML.ParseMode(),
+		Text: htmlText(format.Plain("Вы присоединились к магазину, ваша роль - "), format.Bold(format.Plain(member.Role.String())),
+			format.Plain(". Отчеты строятся по кабинетам владельца магазина.")),
+	})
+	sendReportKeyboard(m.Chat.Id)
+}
+
+func storeMarkup(store *Store) telegram.InlineKeyboardMarkup {
+	var buttons []telegram.ButtonBot[telegram.InlineKeyboardButton]
+	if store != nil {
+		for i, member := range store.Members {
+			buttons = append(buttons, telegram.ButtonBot[telegram.InlineKeyboardButton]{
+				Row: i + 1, Col: 1, Button: telegram.InlineKeyboardButton{
+					Text:         fmt.Sprintf("%s - %s", member.Name, member.Role),
+					CallbackData: fmt.Sprintf("/storemember-%d", member.UserId),
+				},
+			})
+		}
+	}
+	row := len(buttons) + 1
+	buttons = append(buttons,
+		telegram.ButtonBot[telegram.InlineKeyboardButton]{Row: row, Col: 1, Button: telegram.InlineKeyboardButton{Text: "Пригласить менеджера", CallbackData: "/storeinvite-" + string(RoleManager)}},
+		telegram.ButtonBot[telegram.InlineKeyboardButton]{Row: row, Col: 2, Button: telegram.InlineKeyboardButton{Text: "Пригласить наблюдателя", CallbackData: "/storeinvite-" + string(RoleViewer)}},
+		telegram.ButtonBot[telegram.InlineKeyboardButton]{Row: row + 1, Col: 1, Button: telegram.InlineKeyboardButton{Text: "Назад", CallbackData: "/settings"}},
+	)
+	return telegram.InlineKeyboardMarkup{InlineKeyboard: CreateButtonsBot[telegram.InlineKeyboardButton](buttons)}
+}
+
+func editStore(q telegram.CallbackQuery, ownerId int64) {
+	bot := TelegramBot{}
+	store, err := storeRepo.ownerStore(ownerId)
+	if err != nil {
+		log.Printf("Не удалось получить магазин пользователя %d: %v", ownerId, err)
+		return
+	}
+	text := "Участников пока нет. Пригласите менеджера - он увидит отчеты и сможет менять настройки, кроме кабинетов с ключами API, или наблюдателя - он увидит только отчеты."
+	if store != nil && len(store.Members) > 0 {
+		text = "Участники магазина. Нажмите на участника, чтобы сменить роль или закрыть доступ."
+	}
+	EditMessageTextToBot(&bot, telegram.EditMessageTextRequestBody{
+		ChatId:      q.Message.Chat.Id,
+		MessageId:   q.Message.MessageId,
+		ParseMode:   format.HTML.ParseMode(),
+		Text:        htmlText(format.Plain(text)),
+		ReplyMarkup: storeMarkup(store),
+	})
+}
+
+// storeHandler Владельцу - участники магазина, участнику - его роль и выход из магазина
+func storeHandler(c *RouteContext) {
+	q := c.Update.CallbackQuery
+	bot := TelegramBot{}
+	answerCallbackQueryToBot(&bot, telegram.AnswerCallbackQueryRequestBody{CallbackQueryId: q.Id})
+	if c.Access.Role == RoleOwner {
+		editStore(q, c.Access.OwnerId)
+		return
+	}
+	EditMessageTextToBot(&bot, telegram.EditMessageTextRequestBody{
+		ChatId:    q.Message.Chat.Id,
+		MessageId: q.Message.MessageId,
+		ParseMode: format.HTML.ParseMode(),
+		Text: htmlText(format.Plain("Вы участник магазина, ваша роль - "), format.Bold(format.Plain(c.Access.Role.String())),
+			format.Plain(". После выхода из магазина отчеты будут строиться по вашим кабинетам.")),
+		ReplyMarkup: telegram.InlineKeyboardMarkup{InlineKeyboard: CreateButtonsBot[telegram.InlineKeyboardButton]([]telegram.ButtonBot[telegram.InlineKeyboardButton]{
+			{Row: 1, Col: 1, Button: telegram.InlineKeyboardButton{Text: "Выйти из магазина", CallbackData: "/storeleave"}},
+			{Row: 2, Col: 1, Button: telegram.InlineKeyboardButton{Text: "Назад", CallbackData: "/settings"}},
+		})},
+	})
+}
+
+func storeInviteHandler(c *RouteContext) {
+	q := c.Update.CallbackQuery
+	bot := TelegramBot{}
+	role := StoreRole(c.Payload)
+	if role != RoleManager && role != RoleViewer {
+		answerCallbackQueryToBot(&bot, telegram.AnswerCallbackQueryRequestBody{CallbackQueryId: q.Id, Text: "Кнопка устарела."})
+		return
+	}
+	invite, err := newStoreInvite(role, time.Now())
+	if err != nil {
+		panic(err)
+	}
+	if err := storeRepo.addInvite(c.Access.OwnerId, invite); err != nil {
+		panic(err)
+	}
+	answerCallbackQueryToBot(&bot, telegram.AnswerCallbackQueryRequestBody{CallbackQueryId: q.Id})
+	SendMessageToBot(&bot, telegram.SendMessageRequestBody[telegram.InlineKeyboardMarkup, int64]{
+		ChatId:    q.Message.Chat.Id,
+		ParseMode: format.HTML.ParseMode(),
+		Text: htmlText(
+			format.Line(format.Plain("Перешлите приглашение сотруднику, его роль будет "), format.Bold(format.Plain(role.String())), format.Plain(":")),
+			format.Line(format.Code(inviteLink(invite.Token))),
+			format.Plainf("Ссылка одноразовая и действует до %s.", invite.ExpiresAt.In(UserDB{}.userLocation(q.From.Id)).Format("02.01.2006 15:04")),
+		),
+	})
+}
+
+// storeMemberAction Участник магазина по id из кнопки, действие - после второго "-"
+func storeMemberAction(payload string) (int64, string, error) {
+	id, action, _ := strings.Cut(payload, "-")
+	userId, err := strconv.ParseInt(id, 10, 64)
+	return userId, action, err
+}
+
+func storeMemberHandler(c *RouteContext) {
+	q := c.Update.CallbackQuery
+	bot := TelegramBot{}
+	userId, _, err := storeMemberAction(c.Payload)
+	store, storeErr := storeRepo.ownerStore(c.Access.OwnerId)
+	if err != nil || storeErr != nil || store == nil {
+		answerCallbackQueryToBot(&bot, telegram.AnswerCallbackQueryRequestBody{CallbackQueryId: q.Id, Text: "Кнопка устарела."})
+		return
+	}
+	i := findIndex(store.Members, func(m StoreMember) bool { return m.UserId == userId })
+	if i < 0 {
+		answerCallbackQueryToBot(&bot, telegram.AnswerCallbackQueryRequestBody{CallbackQueryId: q.Id, Text: "Кнопка устарела."})
+		return
+	}
+	member := store.Members[i]
+	answerCallbackQueryToBot(&bot, telegram.AnswerCallbackQueryRequestBody{CallbackQueryId: q.Id})
+	other := RoleViewer
+	if member.Role == RoleViewer {
+		other = RoleManager
+	}
+	EditMessageTextToBot(&bot, telegram.EditMessageTextRequestBody{
+		ChatId:    q.Message.Chat.Id,
+		MessageId: q.Message.MessageId,
+		ParseMode: format.HTML.ParseMode(),
+		Text: htmlText(format.Bold(format.Plain(member.Name)), format.Plainf(" - %s, в магазине с %s.", member.Role,
+			member.JoinedAt.In(UserDB{}.userLocation(q.From.Id)).Format("02.01.2006"))),
+		ReplyMarkup: telegram.InlineKeyboardMarkup{InlineKeyboard: CreateButtonsBot[telegram.InlineKeyboardButton]([]telegram.ButtonBot[telegram.InlineKeyboardButton]{
+			{Row: 1, Col: 1, Button: telegram.InlineKeyboardButton{Text: "Сделать: " + other.String(), CallbackData: fmt.Sprintf("/storerole-%d-%s", userId, other)}},
+			{Row: 2, Col: 1, Button: telegram.InlineKeyboardButton{Text: "Закрыть доступ", CallbackData: fmt.Sprintf("/storeremove-%d", userId)}},
+			{Row: 3, Col: 1, Button: telegram.InlineKeyboardButton{Text: "Назад", CallbackData: "/store"}},
+		})},
+	})
+}
+
+func storeRoleHandler(c *RouteContext) {
+	q := c.Update.CallbackQuery
+	bot := TelegramBot{}
+	userId, action, err := storeMemberAction(c.Payload)
+	role := StoreRole(action)
+	if err != nil || role != RoleManager && role != RoleViewer {
+		answerCallbackQueryToBot(&bot, telegram.AnswerCallbackQueryRequestBody{CallbackQueryId: q.Id, Text: "Кнопка устарела."})
+		return
+	}
+	if err := storeRepo.setMemberRole(c.Access.OwnerId, userId, role); err != nil {
+		panic(err)
+	}
+	answerCallbackQueryToBot(&bot, telegram.AnswerCallbackQueryRequestBody{CallbackQueryId: q.Id})
+	editStore(q, c.Access.OwnerId)
+}
+
+func storeRemoveHandler(c *RouteContext) {
+	q := c.Update.CallbackQuery
+	bot := TelegramBot{}
+	userId, _, err := storeMemberAction(c.Payload)
+	if err != nil {
+		answerCallbackQueryToBot(&bot, telegram.AnswerCallbackQueryRequestBody{CallbackQueryId: q.Id, Text: "Кнопка устарела."})
+		return
+	}
+	if err := storeRepo.removeMember(c.Access.OwnerId, userId); err != nil {
+		panic(err)
+	}
+	answerCallbackQueryToBot(&bot, telegram.AnswerCallbackQueryRequestBody{CallbackQueryId: q.Id, Text: "Доступ закрыт."})
+	editStore(q, c.Access.OwnerId)
+}
+
+// leaveStoreHandler Участник выходит из магазина и снова работает со своими настройками
+func leaveStoreHandler(c *RouteContext) {
+	q := c.Update.CallbackQuery
+	bot := TelegramBot{}
+	if c.Access.OwnerId != q.From.Id {
+		if err := storeRepo.removeMember(c.Access.OwnerId, q.From.Id); err != nil {
+			panic(err)
+		}
+	}
+	answerCallbackQueryToBot(&bot, telegram.AnswerCallbackQueryRequestBody{CallbackQueryId: q.Id, Text: "Вы вышли из магазина."})
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"telegram"
+	"testing"
+	"time"
+)
+
+func TestStoreRole_allows(t *testing.T) {
+	tests := []struct {
+		name     string
+		role     StoreRole
+		required StoreRole
+		want     bool
+	}{
+		{name: "Владельцу доступно все", role: RoleOwner, required: RoleOwner, want: true},
+		{name: "Менеджер видит отчеты", role: RoleManager, required: RoleViewer, want: true},
+		{name: "Менеджеру недоступны кабинеты", role: RoleManager, required: RoleOwner, want: false},
+		{name: "Наблюдателю недоступны настройки", role: RoleViewer, required: RoleManager, want: false},
+		{name: "Неизвестная роль", role: StoreRole("admin"), required: RoleViewer, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.role.allows(tt.required); got != tt.want {
+				t.Errorf("allows() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStore_join(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	store := Store{OwnerId: 1, Invites: []StoreInvite{
+		{Token: "manager", Role: RoleManager, ExpiresAt: now.Add(time.Hour)},
+		{Token: "viewer", Role: RoleViewer, ExpiresAt: now.Add(time.Hour)},
+		{Token: "old", Role: RoleManager, ExpiresAt: now.Add(-time.Hour)},
+	}}
+
+	if _, err := store.join("old", StoreMember{UserId: 2}, now); !errors.Is(err, errInviteNotFound) {
+		t.Errorf("устаревшее приглашение принято: %v", err)
+	}
+	if _, err := store.join("manager", StoreMember{UserId: 1}, now); !errors.Is(err, errInviteNotFound) {
+		t.Errorf("владелец вступил в свой магазин: %v", err)
+	}
+	member, err := store.join("manager", StoreMember{UserId: 2, Name: "@manager"}, now)
+	if err != nil || member.Role != RoleManager || !member.JoinedAt.Equal(now) {
+		t.Fatalf("join() = %+v, %v", member, err)
+	}
+	if _, err := store.join("manager", StoreMember{UserId: 3}, now); !errors.Is(err, errInviteNotFound) {
+		t.Errorf("приглашение использовано повторно: %v", err)
+	}
+	if _, err := store.join("viewer", StoreMember{UserId: 2}, now); err != nil {
+		t.Fatal(err)
+	}
+	if access, ok := store.access(2); !ok || len(store.Members) != 1 || access.Role != RoleViewer || access.OwnerId != 1 {
+		t.Errorf("повторное приглашение должно сменить роль: %+v, %+v", access, store.Members)
+	}
+}
+
+func TestStoreMemory_acceptInvite(t *testing.T) {
+	now := time.Now()
+	repo := NewStoreMemory()
+	for _, owner := range []int64{1, 2} {
+		if err := repo.addInvite(owner, StoreInvite{Token: string(rune('a' + owner)), Role: RoleViewer, ExpiresAt: now.Add(time.Hour)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := storeAccess(repo, 3); got.OwnerId != 3 || got.Role != RoleOwner {
+		t.Errorf("пользователь вне магазина - владелец своих данных, а получено %+v", got)
+	}
+	if _, _, err := repo.acceptInvite("b", StoreMember{UserId: 3}, now); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := repo.acceptInvite("c", StoreMember{UserId: 3}, now); err != nil {
+		t.Fatal(err)
+	}
+	if got := storeAccess(repo, 3); got.OwnerId != 2 || got.Role != RoleViewer {
+		t.Errorf("storeAccess() = %+v, want магазин 2", got)
+	}
+	if first, _ := repo.ownerStore(1); len(first.Members) != 0 {
+		t.Errorf("участник не вышел из прежнего магазина: %+v", first.Members)
+	}
+	if err := repo.setMemberRole(2, 3, RoleManager); err != nil {
+		t.Fatal(err)
+	}
+	if got := storeAccess(repo, 3); got.Role != RoleManager {
+		t.Errorf("роль после изменения = %s", got.Role)
+	}
+	if err := repo.removeMember(2, 3); err != nil {
+		t.Fatal(err)
+	}
+	if got := storeAccess(repo, 3); got.OwnerId != 3 {
+		t.Errorf("после удаления из магазина доступ %+v", got)
+	}
+}
+
+func TestNewStoreInvite(t *testing.T) {
+	now := time.Now()
+	invite, err := newStoreInvite(RoleViewer, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`).MatchString(invite.Token) {
+		t.Errorf("код %q не подходит для параметра /start", invite.Token)
+	}
+	if !invite.ExpiresAt.Equal(now.Add(storeInviteTTL)) {
+		t.Errorf("ExpiresAt = %v", invite.ExpiresAt)
+	}
+}
+
+func TestRouter_access(t *testing.T) {
+	repo := NewStoreMemory()
+	if err := repo.addInvite(1, StoreInvite{Token: "t", Role: RoleManager, ExpiresAt: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := repo.acceptInvite("t", StoreMember{UserId: 2}, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	var got []StoreAccess
+	r := NewRouter()
+	r.Stores = repo
+	r.Callback("/ozonsetting", forRole(RoleManager, func(c *RouteContext) { got = append(got, c.Access) }))
+	r.Command("/settings", func(c *RouteContext) { got = append(got, c.Access) })
+
+	r.Dispatch(telegram.Update{CallbackQuery: telegram.CallbackQuery{Id: "1", From: telegram.User{Id: 2}, Data: "/ozonsetting"}})
+	r.Dispatch(telegram.Update{Message: telegram.Message{MessageId: 1, From: telegram.User{Id: 3}, Text: "/settings"}})
+	want := []StoreAccess{{OwnerId: 1, Role: RoleManager}, {OwnerId: 3, Role: RoleOwner}}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("доступ обработчиков = %+v, want %+v", got, want)
+	}
+}
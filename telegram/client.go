@@ -0,0 +1,274 @@
+package telegram
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const DefaultBaseURL = "https://api.telegram.org/bot"
+
+// requestTimeout Ограничение времени одного запроса к Bot API (кроме long polling)
+const requestTimeout = 30 * time.Second
+
+// uploadTimeout Ограничение времени запроса с загрузкой файла
+const uploadTimeout = 2 * time.Minute
+
+type ResponseParameters struct {
+	MigrateToChatId int64 `json:"migrate_to_chat_id"`
+	RetryAfter      int64 `json:"retry_after"`
+}
+
+// APIError Ошибка, возвращенная Bot API в ответе с "ok": false
+type APIError struct {
+	Method      string             `json:"-"`
+	ErrorCode   int                `json:"error_code"`
+	Description string             `json:"description"`
+	Parameters  ResponseParameters `json:"parameters"`
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("telegram %s: %d %s", e.Method, e.ErrorCode, e.Description)
+}
+
+// IsTooManyRequests Превышен лимит отправки, повторить можно через Parameters.RetryAfter секунд
+func (e *APIError) IsTooManyRequests() bool {
+	return e.ErrorCode == http.StatusTooManyRequests
+}
+
+type response struct {
+	Ok     bool            `json:"ok"`
+	Result json.RawMessage `json:"result"`
+	APIError
+}
+
+// Client Клиент Bot API.
+//
+// Ответы 429 повторяются после retry_after, ответы 5xx - с экспоненциальной задержкой,
+// не более MaxRetries раз. Остальные ошибки возвращаются сразу.
+type Client struct {
+	BaseURL    string
+	Token      string
+	HTTPClient *http.Client
+	MaxRetries int
+	// sleep Ожидание перед повтором, подменяется в тестах
+	sleep func(ctx context.Context, d time.Duration) error
+}
+
+func NewClient(baseURL string, token string, httpClient *http.Client) *Client {
+	if baseURL == "" {
+		baseURL = DefaultBaseURL
+	}
+	if httpClient == nil {
+		httpClient = &http.Client{}
+	}
+	return &Client{
+		BaseURL:    baseURL,
+		Token:      token,
+		HTTPClient: httpClient,
+		MaxRetries: 3,
+		sleep:      sleepContext,
+	}
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// backoff Задержка перед повтором attempt: 1s, 2s, 4s... но не меньше retry_after
+func backoff(attempt int, retryAfter int64) time.Duration {
+	d := time.Second << attempt
+	if ra := time.Duration(retryAfter) * time.Second; ra > d {
+		d = ra
+	}
+	return d
+}
+
+func (c *Client) SendMessage(ctx context.Context, body SendMessageBody) (*Message, error) {
+	var m Message
+	if err := c.callJSON(ctx, "sendMessage", body, &m, requestTimeout); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// EditMessageText Для сообщений, отправленных через inline режим, Telegram не возвращает сообщение, тогда результат nil
+func (c *Client) EditMessageText(ctx context.Context, body EditMessageTextRequestBody) (*Message, error) {
+	return c.editMessage(ctx, "editMessageText", body)
+}
+
+func (c *Client) EditMessageReplyMarkup(ctx context.Context, body EditMessageReplyMarkupRequestBody) (*Message, error) {
+	return c.editMessage(ctx, "editMessageReplyMarkup", body)
+}
+
+func (c *Client) editMessage(ctx context.Context, method string, body interface{}) (*Message, error) {
+	var raw json.RawMessage
+	if err := c.callJSON(ctx, method, body, &raw, requestTimeout); err != nil {
+		return nil, err
+	}
+	if string(raw) == "true" {
+		return nil, nil
+	}
+	var m Message
+	if err := json.Unmarshal(raw, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func (c *Client) AnswerCallbackQuery(ctx context.Context, body AnswerCallbackQueryRequestBody) error {
+	return c.callJSON(ctx, "answerCallbackQuery", body, nil, requestTimeout)
+}
+
+func (c *Client) DeleteMessage(ctx context.Context, body DeleteMessageRequestBody) error {
+	return c.callJSON(ctx, "deleteMessage", body, nil, requestTimeout)
+}
+
+func (c *Client) SetWebhook(ctx context.Context, body SetWebhookRequestBody) error {
+	return c.callJSON(ctx, "setWebhook", body, nil, requestTimeout)
+}
+
+func (c *Client) DeleteWebhook(ctx context.Context, body DeleteWebhookRequestBody) error {
+	return c.callJSON(ctx, "deleteWebhook", body, nil, requestTimeout)
+}
+
+// GetUpdates Long polling, запрос длится до body.Timeout секунд
+func (c *Client) GetUpdates(ctx context.Context, body GetUpdatesRequestBody) ([]Update, error) {
+	var updates []Update
+	timeout := time.Duration(body.Timeout)*time.Second + requestTimeout
+	if err := c.callJSON(ctx, "getUpdates", body, &updates, timeout); err != nil {
+		return nil, err
+	}
+	return updates, nil
+}
+
+// SendDocument Отправка файла как документа
+func (c *Client) SendDocument(ctx context.Context, body SendDocumentRequestBody) (*Message, error) {
+	var m Message
+	if err := c.callMultipart(ctx, "sendDocument", body, "document", body.Document, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// SendPhoto Отправка изображения
+func (c *Client) SendPhoto(ctx context.Context, body SendPhotoRequestBody) (*Message, error) {
+	var m Message
+	if err := c.callMultipart(ctx, "sendPhoto", body, "photo", body.Photo, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func (c *Client) callJSON(ctx context.Context, method string, body interface{}, result interface{}, timeout time.Duration) error {
+	requestBody, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	return c.call(ctx, method, "application/json", requestBody, result, timeout)
+}
+
+// callMultipart Запрос multipart/form-data: поля body передаются как в JSON запросе,
+// вложенные объекты (reply_markup) - строкой JSON, файл - частью fileField
+func (c *Client) callMultipart(ctx context.Context, method string, body interface{}, fileField string, file InputFile, result interface{}) error {
+	fields, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal(fields, &values); err != nil {
+		return err
+	}
+	var b bytes.Buffer
+	w := multipart.NewWriter(&b)
+	for name, raw := range values {
+		value := string(raw)
+		var s string
+		if json.Unmarshal(raw, &s) == nil {
+			value = s
+		}
+		if err := w.WriteField(name, value); err != nil {
+			return err
+		}
+	}
+	part, err := w.CreateFormFile(fileField, file.Name)
+	if err != nil {
+		return err
+	}
+	if _, err := part.Write(file.Data); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.call(ctx, method, w.FormDataContentType(), b.Bytes(), result, uploadTimeout)
+}
+
+// call Вызов метода с повторами при 429 и 5xx
+func (c *Client) call(ctx context.Context, method string, contentType string, body []byte, result interface{}, timeout time.Duration) error {
+	for attempt := 0; ; attempt++ {
+		err := c.do(ctx, method, contentType, body, result, timeout)
+		var apiErr *APIError
+		if err == nil || !errors.As(err, &apiErr) {
+			return err
+		}
+		if !apiErr.IsTooManyRequests() && apiErr.ErrorCode < http.StatusInternalServerError {
+			return err
+		}
+		if attempt >= c.MaxRetries {
+			return err
+		}
+		if err := c.sleep(ctx, backoff(attempt, apiErr.Parameters.RetryAfter)); err != nil {
+			return err
+		}
+	}
+}
+
+func (c *Client) do(ctx context.Context, method string, contentType string, body []byte, result interface{}, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx,
+		"POST", strings.TrimSuffix(c.BaseURL, "/")+c.Token+"/"+method,
+		bytes.NewReader(body),
+	)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("content-type", contentType)
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var r response
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		if resp.StatusCode != http.StatusOK {
+			return &APIError{Method: method, ErrorCode: resp.StatusCode, Description: resp.Status}
+		}
+		return fmt.Errorf("telegram %s: %w", method, err)
+	}
+	if !r.Ok {
+		r.APIError.Method = method
+		if r.APIError.ErrorCode == 0 {
+			r.APIError.ErrorCode = resp.StatusCode
+		}
+		return &r.APIError
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(r.Result, result)
+}
@@ -0,0 +1,177 @@
+package telegram
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestClient(t *testing.T, handler http.HandlerFunc) (*Client, *[]time.Duration) {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	c := NewClient(server.URL+"/bot", "token", server.Client())
+	var sleeps []time.Duration
+	c.sleep = func(ctx context.Context, d time.Duration) error {
+		sleeps = append(sleeps, d)
+		return ctx.Err()
+	}
+	return c, &sleeps
+}
+
+func TestClient_SendMessage(t *testing.T) {
+	c, _ := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/bottoken/sendMessage" {
+			t.Errorf("path = %s", r.URL.Path)
+		}
+		w.Write([]byte(`{"ok":true,"result":{"message_id":42,"chat":{"id":7},"text":"hi"}}`))
+	})
+	m, err := c.SendMessage(context.Background(), SendMessageRequestBody[InlineKeyboardMarkup, int64]{ChatId: 7, Text: "hi"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.MessageId != 42 || m.Chat.Id != 7 {
+		t.Errorf("SendMessage() = %+v", m)
+	}
+}
+
+func TestClient_SendDocument(t *testing.T) {
+	c, _ := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/bottoken/sendDocument" {
+			t.Errorf("path = %s", r.URL.Path)
+		}
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			t.Fatal(err)
+		}
+		if got := r.FormValue("chat_id"); got != "7" {
+			t.Errorf("chat_id = %q", got)
+		}
+		if got := r.FormValue("caption"); got != "Отчет" {
+			t.Errorf("caption = %q", got)
+		}
+		if got := r.FormValue("reply_markup"); got != `{"inline_keyboard":[[{"text":"Ок","callback_data":"/ok"}]]}` {
+			t.Errorf("reply_markup = %q", got)
+		}
+		f, h, err := r.FormFile("document")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		data, _ := io.ReadAll(f)
+		if h.Filename != "report.csv" || string(data) != "a;b\n" {
+			t.Errorf("document = %s %q", h.Filename, data)
+		}
+		w.Write([]byte(`{"ok":true,"result":{"message_id":43,"chat":{"id":7}}}`))
+	})
+	m, err := c.SendDocument(context.Background(), SendDocumentRequestBody{
+		ChatId:   7,
+		Document: InputFile{Name: "report.csv", Data: []byte("a;b\n")},
+		Caption:  "Отчет",
+		ReplyMarkup: &InlineKeyboardMarkup{InlineKeyboard: [][]InlineKeyboardButton{
+			{{Text: "Ок", CallbackData: "/ok"}},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.MessageId != 43 {
+		t.Errorf("SendDocument() = %+v", m)
+	}
+}
+
+func TestClient_SendPhoto(t *testing.T) {
+	c, _ := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/bottoken/sendPhoto" {
+			t.Errorf("path = %s", r.URL.Path)
+		}
+		if got := r.FormValue("parse_mode"); got != "HTML" {
+			t.Errorf("parse_mode = %q", got)
+		}
+		if _, h, err := r.FormFile("photo"); err != nil || h.Filename != "trend.png" {
+			t.Errorf("photo = %v, %v", h, err)
+		}
+		w.Write([]byte(`{"ok":true,"result":{"message_id":44,"chat":{"id":7}}}`))
+	})
+	_, err := c.SendPhoto(context.Background(), SendPhotoRequestBody{
+		ChatId:    7,
+		Photo:     InputFile{Name: "trend.png", Data: []byte{0x89, 'P', 'N', 'G'}},
+		Caption:   "<b>Итого</b>",
+		ParseMode: "HTML",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClient_APIError(t *testing.T) {
+	calls := 0
+	c, sleeps := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"ok":false,"error_code":400,"description":"Bad Request: chat not found"}`))
+	})
+	err := c.AnswerCallbackQuery(context.Background(), AnswerCallbackQueryRequestBody{CallbackQueryId: "1"})
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("err = %v, want *APIError", err)
+	}
+	if apiErr.ErrorCode != 400 || apiErr.Description != "Bad Request: chat not found" || apiErr.Method != "answerCallbackQuery" {
+		t.Errorf("APIError = %+v", apiErr)
+	}
+	if calls != 1 || len(*sleeps) != 0 {
+		t.Errorf("calls = %d, sleeps = %v, want one call without retries", calls, *sleeps)
+	}
+}
+
+func TestClient_RetryAfter(t *testing.T) {
+	calls := 0
+	c, sleeps := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls < 3 {
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"ok":false,"error_code":429,"description":"Too Many Requests: retry after 5","parameters":{"retry_after":5}}`))
+			return
+		}
+		w.Write([]byte(`{"ok":true,"result":true}`))
+	})
+	if err := c.DeleteMessage(context.Background(), DeleteMessageRequestBody{ChatId: 1, MessageId: 2}); err != nil {
+		t.Fatal(err)
+	}
+	want := []time.Duration{5 * time.Second, 5 * time.Second}
+	if calls != 3 || len(*sleeps) != 2 || (*sleeps)[0] != want[0] || (*sleeps)[1] != want[1] {
+		t.Errorf("calls = %d, sleeps = %v, want 3 calls with sleeps %v", calls, *sleeps, want)
+	}
+}
+
+func TestClient_RetryExhausted(t *testing.T) {
+	c, sleeps := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	})
+	_, err := c.EditMessageText(context.Background(), EditMessageTextRequestBody{ChatId: 1, MessageId: 2, Text: "x"})
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.ErrorCode != http.StatusBadGateway {
+		t.Fatalf("err = %v, want 502 APIError", err)
+	}
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second}
+	if len(*sleeps) != len(want) {
+		t.Fatalf("sleeps = %v, want %v", *sleeps, want)
+	}
+	for i := range want {
+		if (*sleeps)[i] != want[i] {
+			t.Errorf("sleeps = %v, want %v", *sleeps, want)
+		}
+	}
+}
+
+func TestClient_EditMessageTextInline(t *testing.T) {
+	c, _ := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"ok":true,"result":true}`))
+	})
+	m, err := c.EditMessageText(context.Background(), EditMessageTextRequestBody{InlineMessageId: "1", Text: "x"})
+	if err != nil || m != nil {
+		t.Errorf("EditMessageText() = %v, %v, want nil, nil", m, err)
+	}
+}
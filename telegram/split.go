@@ -0,0 +1,145 @@
+package telegram
+
+import (
+	"regexp"
+	"strings"
+	"unicode/utf16"
+)
+
+// MessageTextLimit Максимальная длина текста сообщения в Telegram
+const MessageTextLimit = 4096
+
+var htmlTagRegexp = regexp.MustCompile(`<(/?)([a-zA-Z][a-zA-Z0-9-]*)[^>]*>`)
+
+type htmlTag struct {
+	name string
+	open string
+}
+
+// textLength Длина текста так, как ее считает Telegram, - в единицах UTF-16
+func textLength(s string) int {
+	return len(utf16.Encode([]rune(s)))
+}
+
+// applyTags Открытые теги после фрагмента text, если перед ним были открыты stack
+func applyTags(stack []htmlTag, text string) []htmlTag {
+	result := append([]htmlTag(nil), stack...)
+	for _, m := range htmlTagRegexp.FindAllStringSubmatch(text, -1) {
+		name := strings.ToLower(m[2])
+		if m[1] == "" {
+			result = append(result, htmlTag{name: name, open: m[0]})
+			continue
+		}
+		for i := len(result) - 1; i >= 0; i-- {
+			if result[i].name == name {
+				result = append(result[:i], result[i+1:]...)
+				break
+			}
+		}
+	}
+	return result
+}
+
+func openTags(stack []htmlTag) string {
+	var b strings.Builder
+	for _, t := range stack {
+		b.WriteString(t.open)
+	}
+	return b.String()
+}
+
+func closeTags(stack []htmlTag) string {
+	var b strings.Builder
+	for i := len(stack) - 1; i >= 0; i-- {
+		b.WriteString("</" + stack[i].name + ">")
+	}
+	return b.String()
+}
+
+// splitLongLine Разбиение строки длиннее limit на части, не разрывая теги и HTML сущности
+func splitLongLine(line string, limit int) []string {
+	if textLength(line) <= limit {
+		return []string{line}
+	}
+	var parts []string
+	var b strings.Builder
+	length := 0
+	for i := 0; i < len(line); {
+		token := line[i : i+1]
+		if loc := htmlTagRegexp.FindStringIndex(line[i:]); loc != nil && loc[0] == 0 {
+			token = line[i : i+loc[1]]
+		} else if line[i] == '&' {
+			if end := strings.IndexByte(line[i:], ';'); end > 0 && end < 10 {
+				token = line[i : i+end+1]
+			}
+		} else {
+			for j := i + 1; j <= len(line); j++ {
+				if j == len(line) || (line[j]&0xC0) != 0x80 {
+					token = line[i:j]
+					break
+				}
+			}
+		}
+		n := textLength(token)
+		if length+n > limit && length > 0 {
+			parts = append(parts, b.String())
+			b.Reset()
+			length = 0
+		}
+		b.WriteString(token)
+		length += n
+		i += len(token)
+	}
+	if b.Len() > 0 {
+		parts = append(parts, b.String())
+	}
+	return parts
+}
+
+// isBlank Фрагмент не содержит текста, кроме пробелов и тегов
+func isBlank(s string) bool {
+	return strings.TrimSpace(htmlTagRegexp.ReplaceAllString(s, "")) == ""
+}
+
+// SplitHTML Разбиение текста с HTML разметкой на части не длиннее limit.
+//
+// Текст режется по границам строк, строка разрывается только если она сама длиннее limit.
+// Теги, открытые на момент разреза, закрываются в конце части и открываются заново в начале следующей.
+func SplitHTML(text string, limit int) []string {
+	if textLength(text) <= limit {
+		return []string{text}
+	}
+	var chunks []string
+	var stack []htmlTag
+	var b strings.Builder
+	hasContent := false
+	flush := func() {
+		chunk := strings.TrimRight(b.String(), "\n") + closeTags(stack)
+		if !isBlank(chunk) {
+			chunks = append(chunks, chunk)
+		}
+		b.Reset()
+		b.WriteString(openTags(stack))
+		hasContent = false
+	}
+	// Запас на закрытие и повторное открытие тегов
+	lineLimit := limit * 3 / 4
+	for _, line := range strings.SplitAfter(text, "\n") {
+		for _, piece := range splitLongLine(line, lineLimit) {
+			next := applyTags(stack, piece)
+			if hasContent && textLength(b.String()+piece+closeTags(next)) > limit {
+				flush()
+			}
+			b.WriteString(piece)
+			stack = next
+			hasContent = true
+		}
+	}
+	if hasContent {
+		chunk := b.String() + closeTags(stack)
+		if !isBlank(chunk) {
+			chunks = append(chunks, chunk)
+		}
+	}
+	return chunks
+}
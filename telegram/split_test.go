@@ -0,0 +1,83 @@
+package telegram
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitHTML(t *testing.T) {
+	tests := []struct {
+		name  string
+		text  string
+		limit int
+		want  []string
+	}{
+		{
+			name:  "Короткий текст не разбивается",
+			text:  "<b>Итого</b>\n",
+			limit: 100,
+			want:  []string{"<b>Итого</b>\n"},
+		},
+		{
+			name:  "Разрез по границе строк",
+			text:  "строка 1\nстрока 2\nстрока 3\n",
+			limit: 20,
+			want:  []string{"строка 1\nстрока 2", "строка 3\n"},
+		},
+		{
+			name:  "Теги закрываются и открываются заново",
+			text:  "<b>Заказы:\n<i>Носки: 1</i>\n<i>Гетры: 2</i>\n</b>Итого\n",
+			limit: 40,
+			want:  []string{"<b>Заказы:\n<i>Носки: 1</i></b>", "<b><i>Гетры: 2</i>\n</b>Итого\n"},
+		},
+		{
+			name:  "Длинная строка без переносов",
+			text:  "&amp;" + strings.Repeat("а", 20),
+			limit: 10,
+			want:  []string{"&amp;аа", "ааааааа", "ааааааа", "аааа"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := SplitHTML(tt.text, tt.limit)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("SplitHTML() = %q, want %q", got, tt.want)
+			}
+			for _, chunk := range got {
+				if textLength(chunk) > tt.limit {
+					t.Errorf("chunk %q longer than %d", chunk, tt.limit)
+				}
+				if stack := applyTags(nil, chunk); len(stack) != 0 {
+					t.Errorf("chunk %q has unclosed tags %v", chunk, stack)
+				}
+			}
+		})
+	}
+}
+
+func TestSplitHTML_Report(t *testing.T) {
+	var b strings.Builder
+	b.WriteString("<b>Статистика продаж:</b>\n\n<b>")
+	for i := 0; i < 500; i++ {
+		b.WriteString("        <i>Товар с длинным названием: <b>1</b></i> \n")
+	}
+	b.WriteString("</b>Итого\n")
+	chunks := SplitHTML(b.String(), MessageTextLimit)
+	if len(chunks) < 2 {
+		t.Fatalf("SplitHTML() returned %d chunks, want more than 1", len(chunks))
+	}
+	lines := 0
+	for _, chunk := range chunks {
+		if textLength(chunk) > MessageTextLimit {
+			t.Errorf("chunk longer than %d", MessageTextLimit)
+		}
+		if stack := applyTags(nil, chunk); len(stack) != 0 {
+			t.Errorf("chunk has unclosed tags %v", stack)
+		}
+		lines += strings.Count(chunk, "Товар с длинным названием")
+	}
+	if lines != 500 {
+		t.Errorf("chunks contain %d product lines, want 500", lines)
+	}
+}
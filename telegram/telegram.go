@@ -169,9 +169,9 @@ type MessageEntity struct {
 	Type          string `json:"type"`
 	Offset        int64  `json:"offset"`
 	Length        int64  `json:"length"`
-	Url           int64  `json:"url"`
+	Url           string `json:"url"`
 	User          User   `json:"user"`
-	Language      int64  `json:"language"`
+	Language      string `json:"language"`
 	CustomEmojiId string `json:"custom_emoji_id"`
 }
 
@@ -235,6 +235,54 @@ type SendMessageRequestBody[T replyMarkup, Q chatId] struct {
 	AllowSendingWithoutReply bool            `json:"allow_sending_without_reply"`
 	ReplyMarkup              T               `json:"reply_markup,omitempty"`
 }
+
+// InputFile Файл, загружаемый в запросе multipart/form-data
+type InputFile struct {
+	Name string
+	Data []byte
+}
+
+type SendDocumentRequestBody struct {
+	ChatId              int64                 `json:"chat_id"`
+	MessageThreadId     int64                 `json:"message_thread_id,omitempty"`
+	Document            InputFile             `json:"-"`
+	Caption             string                `json:"caption,omitempty"`
+	ParseMode           string                `json:"parse_mode,omitempty"`
+	DisableNotification bool                  `json:"disable_notification,omitempty"`
+	ReplyToMessageId    int64                 `json:"reply_to_message_id,omitempty"`
+	ReplyMarkup         *InlineKeyboardMarkup `json:"reply_markup,omitempty"`
+}
+
+// CaptionLimit Максимальная длина подписи к файлу или изображению
+const CaptionLimit = 1024
+
+type SendPhotoRequestBody struct {
+	ChatId              int64                 `json:"chat_id"`
+	MessageThreadId     int64                 `json:"message_thread_id,omitempty"`
+	Photo               InputFile             `json:"-"`
+	Caption             string                `json:"caption,omitempty"`
+	ParseMode           string                `json:"parse_mode,omitempty"`
+	DisableNotification bool                  `json:"disable_notification,omitempty"`
+	ReplyToMessageId    int64                 `json:"reply_to_message_id,omitempty"`
+	ReplyMarkup         *InlineKeyboardMarkup `json:"reply_markup,omitempty"`
+}
+
+// SendMessageBody Тело запроса sendMessage с любой клавиатурой и типом chat_id
+type SendMessageBody interface {
+	sendMessageBody()
+}
+
+func (SendMessageRequestBody[T, Q]) sendMessageBody() {}
+
+// RawSendMessageBody Заранее сериализованное тело sendMessage, например, сохраненное в очереди отправки
+type RawSendMessageBody []byte
+
+func (RawSendMessageBody) sendMessageBody() {}
+
+func (b RawSendMessageBody) MarshalJSON() ([]byte, error) {
+	return b, nil
+}
+
 type DeleteMessageRequestBody struct {
 	ChatId    int64 `json:"chat_id"`
 	MessageId int64 `json:"message_id"`
@@ -245,7 +293,7 @@ type EditMessageTextRequestBody struct {
 	InlineMessageId       string               `json:"inline_message_id"`
 	Text                  string               `json:"text"`
 	ParseMode             string               `json:"parse_mode"`
-	Entities              MessageEntity        `json:"entities"`
+	Entities              []MessageEntity      `json:"entities,omitempty"`
 	DisableWebPagePreview bool                 `json:"disable_web_page_preview"`
 	ReplyMarkup           InlineKeyboardMarkup `json:"reply_markup,omitempty"`
 }
@@ -255,6 +303,27 @@ type EditMessageReplyMarkupRequestBody struct {
 	InlineMessageId string               `json:"inline_message_id"`
 	ReplyMarkup     InlineKeyboardMarkup `json:"reply_markup,omitempty"`
 }
+type SetWebhookRequestBody struct {
+	Url                string   `json:"url"`
+	MaxConnections     int64    `json:"max_connections,omitempty"`
+	AllowedUpdates     []string `json:"allowed_updates,omitempty"`
+	DropPendingUpdates bool     `json:"drop_pending_updates,omitempty"`
+	SecretToken        string   `json:"secret_token,omitempty"`
+}
+
+type DeleteWebhookRequestBody struct {
+	DropPendingUpdates bool `json:"drop_pending_updates,omitempty"`
+}
+type GetUpdatesRequestBody struct {
+	Offset         int64    `json:"offset,omitempty"`
+	Limit          int64    `json:"limit,omitempty"`
+	Timeout        int64    `json:"timeout,omitempty"`
+	AllowedUpdates []string `json:"allowed_updates,omitempty"`
+}
+
+// SecretTokenHeader Заголовок, в котором Telegram передает secret_token, указанный в setWebhook
+const SecretTokenHeader = "X-Telegram-Bot-Api-Secret-Token"
+
 type AnswerCallbackQueryRequestBody struct {
 	CallbackQueryId string `json:"callback_query_id"`
 	Text            string `json:"text"`
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"format"
+	"log"
+	"telegram"
+	"time"
+	_ "time/tzdata"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// defaultTimezone Пояс отчетов, пока пользователь не выбрал свой (UTC+4, как было раньше у всех)
+const defaultTimezone = "Europe/Samara"
+
+var defaultLocation, _ = time.LoadLocation(defaultTimezone)
+
+// timezones Часовые пояса, которые можно выбрать кнопками. Любой другой пояс IANA присылает WebApp.
+var timezones = []struct {
+	Name  string
+	Title string
+}{
+	{"Europe/Kaliningrad", "Калининград"},
+	{"Europe/Moscow", "Москва"},
+	{"Europe/Samara", "Самара"},
+	{"Asia/Yekaterinburg", "Екатеринбург"},
+	{"Asia/Omsk", "Омск"},
+	{"Asia/Novosibirsk", "Новосибирск"},
+	{"Asia/Krasnoyarsk", "Красноярск"},
+	{"Asia/Irkutsk", "Иркутск"},
+	{"Asia/Yakutsk", "Якутск"},
+	{"Asia/Vladivostok", "Владивосток"},
+	{"Asia/Magadan", "Магадан"},
+	{"Asia/Kamchatka", "Камчатка"},
+	{"Europe/Minsk", "Минск"},
+	{"Asia/Almaty", "Алматы"},
+	{"Asia/Tashkent", "Ташкент"},
+}
+
+// DateRange Период отчета [From, To), границы - полночь в поясе пользователя
+type DateRange struct {
+	From time.Time
+	To   time.Time
+}
+
+// daysRange Календарные дни с first по last включительно. Из first и last берется только дата.
+// Длина дня при переходе на летнее время и обратно учитывается time.Date.
+func daysRange(first time.Time, last time.Time, loc *time.Location) DateRange {
+	return DateRange{
+		From: time.Date(first.Year(), first.Month(), first.Day(), 0, 0, 0, 0, loc),
+		To:   time.Date(last.Year(), last.Month(), last.Day()+1, 0, 0, 0, 0, loc),
+	}
+}
+
+// dayRange День со сдвигом offset от текущего в поясе loc: 0 - сегодня, -1 - вчера
+func dayRange(now time.Time, loc *time.Location, offset int) DateRange {
+	local := now.In(loc)
+	day := time.Date(local.Year(), local.Month(), local.Day()+offset, 0, 0, 0, 0, loc)
+	return daysRange(day, day, loc)
+}
+
+// lastDaysRange Последние days полных дней, последний из них - текущий
+func lastDaysRange(now time.Time, loc *time.Location, days int) DateRange {
+	local := now.In(loc)
+	first := time.Date(local.Year(), local.Month(), local.Day()-(days-1), 0, 0, 0, 0, loc)
+	return daysRange(first, local, loc)
+}
+
+// monthRange Месяц, в который попадает t в поясе loc
+func monthRange(t time.Time, loc *time.Location) DateRange {
+	local := t.In(loc)
+	return DateRange{
+		From: time.Date(local.Year(), local.Month(), 1, 0, 0, 0, 0, loc),
+		To:   time.Date(local.Year(), local.Month()+1, 1, 0, 0, 0, 0, loc),
+	}
+}
+
+// filter Период в фильтре запросов Seller API
+func (r DateRange) filter() FilterFbo {
+	return FilterFbo{Since: r.From.UTC().Format(time.RFC3339), To: r.To.UTC().Format(time.RFC3339)}
+}
+
+// days Начала дней периода
+func (r DateRange) days() []time.Time {
+	var days []time.Time
+	for day := r.From; day.Before(r.To); day = time.Date(day.Year(), day.Month(), day.Day()+1, 0, 0, 0, 0, day.Location()) {
+		days = append(days, day)
+	}
+	return days
+}
+
+// lastDay Последний день периода, для подписей "с ... по ..."
+func (r DateRange) lastDay() time.Time {
+	return r.To.Add(-time.Nanosecond)
+}
+
+// filterRange Период фильтра в поясе loc
+func filterRange(filter FilterFbo, loc *time.Location) DateRange {
+	since, _ := time.Parse(time.RFC3339, filter.Since)
+	to, _ := time.Parse(time.RFC3339, filter.To)
+	return DateRange{From: since.In(loc), To: to.In(loc)}
+}
+
+// location Пояс пользователя, если он не выбран или неизвестен - defaultLocation
+func (s Settings) location() *time.Location {
+	if s.Timezone == "" {
+		return defaultLocation
+	}
+	loc, err := time.LoadLocation(s.Timezone)
+	if err != nil {
+		return defaultLocation
+	}
+	return loc
+}
+
+// userLocation Пояс пользователя для границ дней отчетов и расписания рассылок
+func (m UserDB) userLocation(userId int64) *time.Location {
+	coll := clientMongo.Database("MyInfantBotDB").Collection("bot_users")
+	opts := options.FindOne().SetProjection(bson.D{{"telegram_user.settings.timezone", 1}, {"_id", 0}})
+	filter := bson.D{{"telegram_user.user.id", userId}}
+	if err := coll.FindOne(context.TODO(), filter, opts).Decode(&m); err != nil {
+		log.Printf("Не удалось получить часовой пояс пользователя %d: %v", userId, err)
+		return defaultLocation
+	}
+	return m.TelegramUser.Settings.location()
+}
+
+func (m UserDB) setTimezone(userId int64, name string) error {
+	coll := clientMongo.Database("MyInfantBotDB").Collection("bot_users")
+	update := bson.D{{"$set", bson.D{{"telegram_user.settings.timezone", name}}}}
+	filter := bson.D{{"telegram_user.user.id", userId}}
+	_, err := coll.UpdateOne(context.TODO(), filter, update)
+	return err
+}
+
+// saveTimezone Сохранение пояса пользователя и перенос его рассылок на сроки в новом поясе
+func saveTimezone(userId int64, loc *time.Location, now time.Time) error {
+	if err := (UserDB{}).setTimezone(userId, loc.String()); err != nil {
+		return err
+	}
+	return rescheduleDigests(digestRepo, userId, loc, now)
+}
+
+func timezonesMarkup(current *time.Location) telegram.InlineKeyboardMarkup {
+	var buttons []telegram.ButtonBot[telegram.InlineKeyboardButton]
+	for i, tz := range timezones {
+		text := tz.Title
+		if tz.Name == current.String() {
+			text = "✅ " + text
+		}
+		buttons = append(buttons, telegram.ButtonBot[telegram.InlineKeyboardButton]{
+			Row: i/3 + 1, Col: i%3 + 1, Button: telegram.InlineKeyboardButton{Text: text, CallbackData: "/settimezone-" + tz.Name},
+		})
+	}
+	buttons = append(buttons, telegram.ButtonBot[telegram.InlineKeyboardButton]{
+		Row: len(timezones)/3 + 2, Col: 1, Button: telegram.InlineKeyboardButton{Text: "Назад", CallbackData: "/settings"},
+	})
+	return telegram.InlineKeyboardMarkup{InlineKeyboard: CreateButtonsBot[telegram.InlineKeyboardButton](buttons)}
+}
+
+func editTimezones(q telegram.CallbackQuery, loc *time.Location) {
+	bot := TelegramBot{}
+	EditMessageTextToBot(&bot, telegram.EditMessageTextRequestBody{
+		ChatId:    q.Message.Chat.Id,
+		MessageId: q.Message.MessageId,
+		ParseMode: format.HTML.ParseMode(),
+		Text: htmlText(format.Plain("Часовой пояс определяет границы дней в отчетах и время рассылок. Сейчас: "),
+			format.Bold(format.Plainf("%s (%s)", loc.String(), time.Now().In(loc).Format("15:04"))), format.Plain(".")),
+		ReplyMarkup: timezonesMarkup(loc),
+	})
+}
+
+func timezonesHandler(c *RouteContext) {
+	q := c.Update.CallbackQuery
+	bot := TelegramBot{}
+	answerCallbackQueryToBot(&bot, telegram.AnswerCallbackQueryRequestBody{CallbackQueryId: q.Id})
+	editTimezones(q, UserDB{}.userLocation(q.From.Id))
+}
+
+func setTimezoneHandler(c *RouteContext) {
+	q := c.Update.CallbackQuery
+	bot := TelegramBot{}
+	loc, err := time.LoadLocation(c.Payload)
+	if err != nil || c.Payload == "" {
+		answerCallbackQueryToBot(&bot, telegram.AnswerCallbackQueryRequestBody{CallbackQueryId: q.Id, Text: "Кнопка устарела."})
+		return
+	}
+	if err := saveTimezone(q.From.Id, loc, time.Now()); err != nil {
+		panic(err)
+	}
+	answerCallbackQueryToBot(&bot, telegram.AnswerCallbackQueryRequestBody{CallbackQueryId: q.Id, Text: "Часовой пояс сохранен."})
+	editTimezones(q, loc)
+}
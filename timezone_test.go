@@ -0,0 +1,149 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func mustLocation(t *testing.T, name string) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return loc
+}
+
+func TestDayRange(t *testing.T) {
+	berlin := mustLocation(t, "Europe/Berlin")
+	samara := mustLocation(t, "Europe/Samara")
+	tests := []struct {
+		name     string
+		now      time.Time
+		loc      *time.Location
+		offset   int
+		from, to string
+		hours    float64
+	}{
+		{
+			name: "Сегодня после полуночи по поясу пользователя, в UTC еще вчера",
+			now:  time.Date(2024, 1, 9, 21, 30, 0, 0, time.UTC), loc: samara,
+			from: "2024-01-09T20:00:00Z", to: "2024-01-10T20:00:00Z", hours: 24,
+		},
+		{
+			name: "Вчера на границе месяцев",
+			now:  time.Date(2024, 3, 1, 0, 30, 0, 0, samara), loc: samara, offset: -1,
+			from: "2024-02-28T20:00:00Z", to: "2024-02-29T20:00:00Z", hours: 24,
+		},
+		{
+			name: "Вчера на границе лет",
+			now:  time.Date(2025, 1, 1, 10, 0, 0, 0, berlin), loc: berlin, offset: -1,
+			from: "2024-12-30T23:00:00Z", to: "2024-12-31T23:00:00Z", hours: 24,
+		},
+		{
+			name: "Переход на летнее время - в сутках 23 часа",
+			now:  time.Date(2024, 3, 31, 12, 0, 0, 0, berlin), loc: berlin,
+			from: "2024-03-30T23:00:00Z", to: "2024-03-31T22:00:00Z", hours: 23,
+		},
+		{
+			name: "Вчера после перехода на зимнее время - в сутках 25 часов",
+			now:  time.Date(2024, 10, 28, 0, 30, 0, 0, berlin), loc: berlin, offset: -1,
+			from: "2024-10-26T22:00:00Z", to: "2024-10-27T23:00:00Z", hours: 25,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := dayRange(tt.now, tt.loc, tt.offset)
+			if got := r.filter(); got.Since != tt.from || got.To != tt.to {
+				t.Errorf("dayRange() = %+v, want %s - %s", got, tt.from, tt.to)
+			}
+			if got := r.To.Sub(r.From).Hours(); got != tt.hours {
+				t.Errorf("day length = %v h, want %v h", got, tt.hours)
+			}
+		})
+	}
+}
+
+func TestDaysRange(t *testing.T) {
+	samara := mustLocation(t, "Europe/Samara")
+	// Даты из WebApp приходят без пояса, отчет должен включать оба дня целиком
+	from, _ := time.Parse(time.DateOnly, "2024-01-30")
+	to, _ := time.Parse(time.DateOnly, "2024-02-01")
+	r := daysRange(from, to, samara)
+	if got := r.filter(); got.Since != "2024-01-29T20:00:00Z" || got.To != "2024-02-01T20:00:00Z" {
+		t.Errorf("daysRange() = %+v", got)
+	}
+	if got := r.lastDay().Format(time.DateOnly); got != "2024-02-01" {
+		t.Errorf("lastDay() = %s", got)
+	}
+}
+
+func TestLastDaysRange(t *testing.T) {
+	berlin := mustLocation(t, "Europe/Berlin")
+	r := lastDaysRange(time.Date(2024, 4, 2, 9, 0, 0, 0, berlin), berlin, 4)
+	var days []string
+	for _, day := range r.days() {
+		days = append(days, day.Format("2006-01-02 15:04 MST"))
+	}
+	want := []string{"2024-03-30 00:00 CET", "2024-03-31 00:00 CET", "2024-04-01 00:00 CEST", "2024-04-02 00:00 CEST"}
+	if !reflect.DeepEqual(days, want) {
+		t.Errorf("days() = %v, want %v", days, want)
+	}
+}
+
+func TestMonthRange(t *testing.T) {
+	samara := mustLocation(t, "Europe/Samara")
+	tests := []struct {
+		name     string
+		t        time.Time
+		from, to string
+	}{
+		{name: "Конец февраля по UTC - уже март по поясу", t: time.Date(2024, 2, 29, 21, 0, 0, 0, time.UTC), from: "2024-03-01", to: "2024-04-01"},
+		{name: "Февраль високосного года", t: time.Date(2024, 2, 10, 0, 0, 0, 0, samara), from: "2024-02-01", to: "2024-03-01"},
+		{name: "Декабрь", t: time.Date(2024, 12, 31, 23, 59, 0, 0, samara), from: "2024-12-01", to: "2025-01-01"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := monthRange(tt.t, samara)
+			if r.From.Format(time.DateOnly) != tt.from || r.To.Format(time.DateOnly) != tt.to || r.From.Hour() != 0 {
+				t.Errorf("monthRange() = %s - %s", r.From, r.To)
+			}
+		})
+	}
+}
+
+func TestSettings_location(t *testing.T) {
+	tests := []struct {
+		name     string
+		timezone string
+		want     string
+	}{
+		{name: "Пояс не выбран", timezone: "", want: defaultTimezone},
+		{name: "Выбранный пояс", timezone: "Asia/Novosibirsk", want: "Asia/Novosibirsk"},
+		{name: "Неизвестный пояс", timezone: "Mars/Olympus", want: defaultTimezone},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := (Settings{Timezone: tt.timezone}).location().String(); got != tt.want {
+				t.Errorf("location() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRescheduleDigests(t *testing.T) {
+	repo := NewDigestMemory()
+	now := time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)
+	novosibirsk := mustLocation(t, "Asia/Novosibirsk")
+	s := DigestSchedule{Kind: DigestDaily, Hour: 9, UserId: 7}
+	s.NextRunAt = s.nextRun(now, defaultLocation)
+	repo.saveSchedule(s)
+	if err := rescheduleDigests(repo, 7, novosibirsk, now); err != nil {
+		t.Fatal(err)
+	}
+	schedules, _ := repo.userSchedules(7)
+	if want := time.Date(2024, 1, 11, 2, 0, 0, 0, time.UTC); !schedules[0].NextRunAt.Equal(want) {
+		t.Errorf("next run = %s, want %s", schedules[0].NextRunAt, want)
+	}
+}
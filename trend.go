@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"chart"
+	"fmt"
+	"format"
+	"log"
+	"strconv"
+	"telegram"
+	"time"
+)
+
+// trendCallback Префикс кнопок выбора периода графика, далее число дней
+const trendCallback = "/trend-"
+
+var trendPeriods = []int{7, 30, 90}
+
+// SalesTrend Продажи по дням
+type SalesTrend struct {
+	Days      []time.Time
+	Ordered   []float64
+	Cancelled []float64
+	Revenue   []float64
+}
+
+// salesTrend Разбиение отправлений по дням создания в поясе периода. Выручка считается по неотмененным товарам.
+func salesTrend(resp *ListResponseFBO, period DateRange) SalesTrend {
+	t := SalesTrend{Days: period.days()}
+	index := make(map[string]int, len(t.Days))
+	for i, day := range t.Days {
+		index[day.Format(time.DateOnly)] = i
+	}
+	t.Ordered = make([]float64, len(t.Days))
+	t.Cancelled = make([]float64, len(t.Days))
+	t.Revenue = make([]float64, len(t.Days))
+	for _, posting := range resp.Result {
+		i, ok := index[posting.CreatedAt.In(period.From.Location()).Format(time.DateOnly)]
+		if !ok {
+			continue
+		}
+		for _, product := range posting.Products {
+			t.Ordered[i] += float64(product.Quantity)
+			if posting.Status == Cancelled.String() {
+				t.Cancelled[i] += float64(product.Quantity)
+				continue
+			}
+			if price, err := strconv.ParseFloat(product.Price, 64); err == nil {
+				t.Revenue[i] += price * float64(product.Quantity)
+			}
+		}
+	}
+	return t
+}
+
+func (t SalesTrend) chart() chart.Chart {
+	labels := make([]string, len(t.Days))
+	for i, day := range t.Days {
+		labels[i] = day.Format("02.01")
+	}
+	return chart.Chart{
+		Title:  fmt.Sprintf("Динамика продаж OZON FBO за %d дн.", len(t.Days)),
+		Labels: labels,
+		Panels: []chart.Panel{
+			{Title: "Выручка, руб.", Series: []chart.Series{{Name: "Выручка", Color: chart.Blue, Values: t.Revenue}}},
+			{Title: "Товары, шт.", Series: []chart.Series{
+				{Name: "Заказано", Color: chart.Green, Values: t.Ordered},
+				{Name: "Отменено", Color: chart.Red, Values: t.Cancelled},
+			}},
+		},
+	}
+}
+
+func sum(values []float64) float64 {
+	var s float64
+	for _, v := range values {
+		s += v
+	}
+	return s
+}
+
+// caption Итоги периода для подписи к графику
+func (t SalesTrend) caption() string {
+	ordered, cancelled, revenue := sum(t.Ordered), sum(t.Cancelled), sum(t.Revenue)
+	parts := []format.Fragment{
+		format.Line(format.Bold(format.Plainf("Динамика продаж за %d дн.", len(t.Days)))),
+		format.Line(format.Plain("Заказано: "), format.Bold(format.Plainf("%s шт.", chart.FormatNumber(ordered)))),
+	}
+	cancelledText := chart.FormatNumber(cancelled) + " шт."
+	if ordered > 0 {
+		cancelledText += fmt.Sprintf(" (%.1f%%)", cancelled/ordered*100)
+	}
+	parts = append(parts,
+		format.Line(format.Plain("Отменено: "), format.Bold(format.Plain(cancelledText))),
+		format.Line(format.Plain("Выручка: "), format.Bold(format.Plainf("%s руб.", chart.FormatNumber(revenue)))),
+	)
+	if len(t.Days) > 0 {
+		parts = append(parts, format.Line(format.Plain("В среднем за день: "), format.Bold(format.Plainf("%s руб.", chart.FormatNumber(revenue/float64(len(t.Days)))))))
+	}
+	best := -1
+	for i, v := range t.Revenue {
+		if v > 0 && (best < 0 || v > t.Revenue[best]) {
+			best = i
+		}
+	}
+	if best >= 0 {
+		parts = append(parts, format.Line(format.Plainf("Лучший день: %s, ", t.Days[best].Format("02.01.2006")), format.Bold(format.Plainf("%s руб.", chart.FormatNumber(t.Revenue[best])))))
+	}
+	return htmlText(parts...)
+}
+
+func trendCommandHandler(c *RouteContext) {
+	var buttons []telegram.ButtonBot[telegram.InlineKeyboardButton]
+	for i, days := range trendPeriods {
+		buttons = append(buttons, telegram.ButtonBot[telegram.InlineKeyboardButton]{
+			Row: 1, Col: i + 1, Button: telegram.InlineKeyboardButton{Text: fmt.Sprintf("%d дней", days), CallbackData: trendCallback + strconv.Itoa(days)},
+		})
+	}
+	bot := TelegramBot{}
+	SendMessageToBot(&bot, telegram.SendMessageRequestBody[telegram.InlineKeyboardMarkup, int64]{
+		ChatId:      c.Update.Message.Chat.Id,
+		ParseMode:   format.HTML.ParseMode(),
+		Text:        htmlText(format.Plain("За какой период построить график?")),
+		ReplyMarkup: telegram.InlineKeyboardMarkup{InlineKeyboard: CreateButtonsBot[telegram.InlineKeyboardButton](buttons)},
+	})
+}
+
+func trendHandler(c *RouteContext) {
+	q := c.Update.CallbackQuery
+	bot := TelegramBot{}
+	days, err := strconv.Atoi(c.Payload)
+	if err != nil || findIndex(trendPeriods, func(d int) bool { return d == days }) < 0 {
+		answerCallbackQueryToBot(&bot, telegram.AnswerCallbackQueryRequestBody{CallbackQueryId: q.Id, Text: "Кнопка устарела."})
+		return
+	}
+	answerCallbackQueryToBot(&bot, telegram.AnswerCallbackQueryRequestBody{CallbackQueryId: q.Id, Text: "Строю график..."})
+
+	period := lastDaysRange(time.Now(), UserDB{}.userLocation(q.From.Id), days)
+	var marketplace ExportMarketplace = &OzonMarketplace{}
+	resp, err := marketplace.postings(c.Access.OwnerId, period.filter(), WithFbo{})
+	if err == nil {
+		trend := salesTrend(resp, period)
+		var b bytes.Buffer
+		if err = trend.chart().PNG(&b); err == nil {
+			err = SendPhotoToBot(&bot, telegram.SendPhotoRequestBody{
+				ChatId:    q.Message.Chat.Id,
+				Photo:     telegram.InputFile{Name: fmt.Sprintf("trend-%d.png", days), Data: b.Bytes()},
+				Caption:   trend.caption(),
+				ParseMode: format.HTML.ParseMode(),
+			})
+		}
+	}
+	if err != nil {
+		log.Printf("Не удалось построить график продаж пользователя %d: %v", c.Access.OwnerId, err)
+		SendMessageToBot(&bot, telegram.SendMessageRequestBody[telegram.InlineKeyboardMarkup, int64]{
+			ChatId:    q.Message.Chat.Id,
+			ParseMode: format.HTML.ParseMode(),
+			Text:      htmlText(format.Plain("Не удалось построить график, попробуйте позже.")),
+		})
+	}
+}
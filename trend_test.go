@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSalesTrend(t *testing.T) {
+	period := filterRange(FilterFbo{Since: "2024-01-03T20:00:00Z", To: "2024-01-06T20:00:00Z"}, time.FixedZone("UTC+4", 4*60*60))
+	resp := &ListResponseFBO{Result: []PostingFBO{
+		{
+			Status:    "delivered",
+			CreatedAt: time.Date(2024, 1, 3, 20, 0, 0, 0, time.UTC),
+			Products:  []PostingProduct{{Quantity: 2, Price: "100.50"}, {Quantity: 1, Price: "300"}},
+		},
+		{
+			Status:    "cancelled",
+			CreatedAt: time.Date(2024, 1, 4, 19, 59, 0, 0, time.UTC),
+			Products:  []PostingProduct{{Quantity: 1, Price: "100.50"}},
+		},
+		{
+			Status:    "delivering",
+			CreatedAt: time.Date(2024, 1, 6, 19, 0, 0, 0, time.UTC),
+			Products:  []PostingProduct{{Quantity: 3, Price: "200"}},
+		},
+		{
+			Status:    "delivered",
+			CreatedAt: time.Date(2024, 1, 6, 20, 0, 0, 0, time.UTC),
+			Products:  []PostingProduct{{Quantity: 1, Price: "1000"}},
+		},
+	}}
+	got := salesTrend(resp, period)
+	if len(got.Days) != 3 || got.Days[0].Format(time.DateOnly) != "2024-01-04" {
+		t.Fatalf("days = %v", got.Days)
+	}
+	if want := []float64{4, 0, 3}; !reflect.DeepEqual(got.Ordered, want) {
+		t.Errorf("ordered = %v, want %v", got.Ordered, want)
+	}
+	if want := []float64{1, 0, 0}; !reflect.DeepEqual(got.Cancelled, want) {
+		t.Errorf("cancelled = %v, want %v", got.Cancelled, want)
+	}
+	if want := []float64{501, 0, 600}; !reflect.DeepEqual(got.Revenue, want) {
+		t.Errorf("revenue = %v, want %v", got.Revenue, want)
+	}
+
+	caption := got.caption()
+	for _, want := range []string{"Заказано: <b>7 шт.</b>", "Отменено: <b>1 шт. (14.3%)</b>", "Выручка: <b>1 101 руб.</b>", "Лучший день: 06.01.2024"} {
+		if !strings.Contains(caption, want) {
+			t.Errorf("caption %q does not contain %q", caption, want)
+		}
+	}
+
+	var b bytes.Buffer
+	if err := got.chart().PNG(&b); err != nil {
+		t.Fatal(err)
+	}
+	if b.Len() == 0 {
+		t.Error("chart is empty")
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"fmt"
+	"format"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"telegram"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+const (
+	// wbStatisticsPageLimit Строк в одном ответе API статистики, следующая часть запрашивается от lastChangeDate последней строки
+	wbStatisticsPageLimit = 80000
+	// wbDateLayout Даты API статистики: московское время без пояса, иногда с долями секунды
+	wbDateLayout = "2006-01-02T15:04:05"
+)
+
+// wbLocation Даты в статистике WB по московскому времени
+var wbLocation = ozonLocation
+
+var urlWildberriesStatistics string
+
+// wbClient Лимит API статистики - один запрос в минуту на метод для кабинета. Запрос сверх лимита
+// не ждет минуту в обработчике обновлений, а сразу возвращает RateLimitedError.
+var wbClient = NewFailFastAPIClient(NewRequestLimiter(1.0/60, 1))
+
+type WildberriesSetting struct {
+	// Token Ключ API категории "Статистика" из личного кабинета WB
+	Token string `bson:"token"`
+	// Cost % сборов WB для заказов, которые еще не выкуплены
+	Cost float64 `bson:"cost"`
+}
+
+// WbOrder Заказ из /api/v1/supplier/orders, одна строка - одна единица товара
+type WbOrder struct {
+	Date            string  `json:"date"`
+	LastChangeDate  string  `json:"lastChangeDate"`
+	WarehouseName   string  `json:"warehouseName"`
+	SupplierArticle string  `json:"supplierArticle"`
+	NmId            int64   `json:"nmId"`
+	Subject         string  `json:"subject"`
+	Brand           string  `json:"brand"`
+	TechSize        string  `json:"techSize"`
+	TotalPrice      float64 `json:"totalPrice"`
+	PriceWithDisc   float64 `json:"priceWithDisc"`
+	FinishedPrice   float64 `json:"finishedPrice"`
+	IsCancel        bool    `json:"isCancel"`
+	Srid            string  `json:"srid"`
+}
+
+// WbSale Продажа или возврат из /api/v1/supplier/sales: saleID продажи начинается с S, возврата - с R
+type WbSale struct {
+	Date            string  `json:"date"`
+	LastChangeDate  string  `json:"lastChangeDate"`
+	SupplierArticle string  `json:"supplierArticle"`
+	NmId            int64   `json:"nmId"`
+	Subject         string  `json:"subject"`
+	PriceWithDisc   float64 `json:"priceWithDisc"`
+	ForPay          float64 `json:"forPay"`
+	SaleID          string  `json:"saleID"`
+	Srid            string  `json:"srid"`
+}
+
+func (s WbSale) isReturn() bool {
+	return strings.HasPrefix(s.SaleID, "R")
+}
+
+// productName Название товара для отчета: в статистике WB есть только предмет и артикул продавца
+func (o WbOrder) productName() string {
+	return strings.TrimSpace(o.Subject + " " + o.SupplierArticle)
+}
+
+func parseWbDate(s string) time.Time {
+	t, _ := time.ParseInLocation(wbDateLayout, s, wbLocation)
+	return t
+}
+
+// WildberriesSource Заказы и продажи, измененные начиная с dateFrom
+type WildberriesSource interface {
+	wbOrders(userId int64, dateFrom time.Time) ([]WbOrder, error)
+	wbSales(userId int64, dateFrom time.Time) ([]WbSale, error)
+}
+
+// WildberriesMarketplace Отчеты по кабинету Account, без кабинета - по основному кабинету WB
+type WildberriesMarketplace struct {
+	Account *MarketplaceAccount
+}
+
+func (m *WildberriesMarketplace) name() Marketplace {
+	return MarketplaceWildberries
+}
+
+func (m *WildberriesMarketplace) accountName() string {
+	if m.Account == nil {
+		return ""
+	}
+	return m.Account.Name
+}
+
+// wbGet Запрос к API WB: GET с ключом в заголовке Authorization
+func wbGet(baseUrl string, token string, path string, query url.Values) func() (*http.Request, error) {
+	return func() (*http.Request, error) {
+		r, err := http.NewRequest("GET", baseUrl+path+"?"+query.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+		r.Header.Set("Authorization", token)
+		return r, nil
+	}
+}
+
+// statisticsRequest Запрос к API статистики от имени кабинета, бюджет запросов отдельный для каждого метода
+func (m *WildberriesMarketplace) statisticsRequest(userId int64, path string, dateFrom time.Time, result interface{}) error {
+	account, err := resolveAccount(m.Account, userId, MarketplaceWildberries)
+	if err != nil {
+		return err
+	}
+	query := url.Values{"dateFrom": {dateFrom.In(wbLocation).Format(wbDateLayout)}, "flag": {"0"}}
+	return wbClient.do(account.Token+path, wbGet(urlWildberriesStatistics, account.Token, path, query), result)
+}
+
+func (m *WildberriesMarketplace) wbOrders(userId int64, dateFrom time.Time) ([]WbOrder, error) {
+	var orders []WbOrder
+	if err := m.statisticsRequest(userId, "/api/v1/supplier/orders", dateFrom, &orders); err != nil {
+		return nil, err
+	}
+	return orders, nil
+}
+
+func (m *WildberriesMarketplace) wbSales(userId int64, dateFrom time.Time) ([]WbSale, error) {
+	var sales []WbSale
+	if err := m.statisticsRequest(userId, "/api/v1/supplier/sales", dateFrom, &sales); err != nil {
+		return nil, err
+	}
+	return sales, nil
+}
+
+// wbChanges Все строки, измененные начиная с dateFrom. Полный ответ означает, что есть еще строки,
+// они запрашиваются от lastChangeDate последней строки. При ошибке на следующих частях
+// возвращаются полученные строки и PartialResultError.
+func wbChanges[T any](dateFrom time.Time, fetch func(dateFrom time.Time) ([]T, error), lastChange func(T) string) ([]T, error) {
+	var items []T
+	for {
+		page, err := fetch(dateFrom)
+		if err != nil {
+			if len(items) == 0 {
+				return nil, err
+			}
+			return items, &PartialResultError{Fetched: len(items), Err: err}
+		}
+		items = append(items, page...)
+		if len(page) < wbStatisticsPageLimit {
+			return items, nil
+		}
+		next := parseWbDate(lastChange(page[len(page)-1]))
+		if !next.After(dateFrom) {
+			return items, nil
+		}
+		dateFrom = next
+	}
+}
+
+// normalizeWbOrders Заказы, созданные за период, и возвраты за период в общей модели. Одна строка
+// статистики - одна единица товара, строки одного заказа повторяются при изменениях. Выплата берется
+// из продажи того же заказа, пока продажи нет, заказ считается доставляемым.
+func normalizeWbOrders(orders []WbOrder, sales []WbSale, period DateRange) ([]Order, []OrderReturn) {
+	var returns []OrderReturn
+	payouts := make(map[string]WbSale)
+	seenSales := make(map[string]bool)
+	for _, s := range sales {
+		if seenSales[s.SaleID] {
+			continue
+		}
+		seenSales[s.SaleID] = true
+		if s.isReturn() {
+			if date := parseWbDate(s.Date); !date.Before(period.From) && date.Before(period.To) {
+				returns = append(returns, OrderReturn{Quantity: 1})
+			}
+			continue
+		}
+		payouts[s.Srid] = s
+	}
+	var result []Order
+	seen := make(map[string]bool)
+	for _, o := range orders {
+		date := parseWbDate(o.Date)
+		if seen[o.Srid] || date.Before(period.From) || !date.Before(period.To) {
+			continue
+		}
+		seen[o.Srid] = true
+		order := Order{Marketplace: MarketplaceWildberries, Number: o.Srid, Status: Delivering}
+		// SKU OZON и nmId WB не пересекаются, поэтому правила по SKU к WB не применяются
+		line := OrderLine{OfferId: o.SupplierArticle, Name: o.productName(), Quantity: 1, Price: decimal.NewFromFloat(o.PriceWithDisc)}
+		if sale, ok := payouts[o.Srid]; ok {
+			order.Status = Delivered
+			line.settle(Payout{
+				Commission: decimal.NewFromFloat(sale.PriceWithDisc - sale.ForPay),
+				Net:        decimal.NewFromFloat(sale.ForPay),
+			})
+		}
+		if o.IsCancel {
+			order.Status = Cancelled
+		}
+		order.Lines = []OrderLine{line}
+		result = append(result, order)
+	}
+	return result, returns
+}
+
+// periodOrders Заказы и продажи WB, измененные с начала периода. Группы товаров и закупочные цены
+// общие с OZON: правила по артикулу и названию работают и для WB.
+func (m *WildberriesMarketplace) periodOrders(userId int64, s Settings, period DateRange) (MarketplaceOrders, error) {
+	orders, ordersErr := wbChanges(period.From, func(dateFrom time.Time) ([]WbOrder, error) {
+		return m.wbOrders(userId, dateFrom)
+	}, func(o WbOrder) string { return o.LastChangeDate })
+	if ordersErr != nil && !isPartialResult(ordersErr) {
+		return MarketplaceOrders{}, ordersErr
+	}
+	sales, salesErr := wbChanges(period.From, func(dateFrom time.Time) ([]WbSale, error) {
+		return m.wbSales(userId, dateFrom)
+	}, func(s WbSale) string { return s.LastChangeDate })
+	if salesErr != nil && !isPartialResult(salesErr) {
+		return MarketplaceOrders{}, salesErr
+	}
+	batch := MarketplaceOrders{Cost: s.WildberriesSetting.Cost, Grouper: newProductGrouper(s.OzonSetting.ProductSetting.GroupRules)}
+	batch.Orders, batch.Returns = normalizeWbOrders(orders, sales, period)
+	if ordersErr != nil {
+		return batch, ordersErr
+	}
+	return batch, salesErr
+}
+
+// checkAuthWildberries Проверка ключа API статистики
+func checkAuthWildberries(token string) string {
+	var result struct {
+		Status string `json:"Status"`
+	}
+	if err := wbClient.do(token+"/ping", wbGet(urlWildberriesStatistics, token, "/ping", url.Values{}), &result); err != nil {
+		log.Printf("Проверка подключения к WB: %v", err)
+		if seconds, ok := retryAfterSeconds(err); ok {
+			return fmt.Sprintf("Лимит запросов WB исчерпан, попробуйте через %d сек.", seconds)
+		}
+		return "Не удалось подключиться к WB, проверьте токен."
+	}
+	return "Подключение к WB работает."
+}
+
+func wildberriesSettingButtons() telegram.InlineKeyboardMarkup {
+	return telegram.InlineKeyboardMarkup{InlineKeyboard: CreateButtonsBot[telegram.InlineKeyboardButton]([]telegram.ButtonBot[telegram.InlineKeyboardButton]{
+		{Row: 1, Col: 1, Button: telegram.InlineKeyboardButton{Text: "Кабинеты", CallbackData: "/accounts-wb"}},
+		{Row: 1, Col: 2, Button: telegram.InlineKeyboardButton{Text: "% сборов WB", CallbackData: "/setcostwb"}},
+		{Row: 2, Col: 1, Button: telegram.InlineKeyboardButton{Text: "Назад", CallbackData: "/settings"}},
+	})}
+}
+
+func wildberriesSettingHandler(c *RouteContext) {
+	q := c.Update.CallbackQuery
+	bot := TelegramBot{}
+	answerCallbackQueryToBot(&bot, telegram.AnswerCallbackQueryRequestBody{CallbackQueryId: q.Id})
+	EditMessageTextToBot(&bot, telegram.EditMessageTextRequestBody{
+		ChatId:    q.Message.Chat.Id,
+		MessageId: q.Message.MessageId,
+		ParseMode: format.HTML.ParseMode(),
+		Text: htmlText(format.Plain("Для получения данных из WB добавьте кабинет с токеном API категории "), format.Bold(format.Plain("Статистика")),
+			format.Plain(". Токен можно создать в личном кабинете продавца в разделе Настройки - Доступ к API. Группы товаров и закупочные цены общие с OZON.")),
+		ReplyMarkup: wildberriesSettingButtons(),
+	})
+}
+
+func askCostWbHandler(c *RouteContext) {
+	askSettingValue(c.Update.CallbackQuery, StateAwaitCostWb, ConversationPayload{},
+		format.Plain("ОК. Пришлите, пожалуйста % сборов WB. Он используется для заказов, которые еще не выкуплены."))
+}
+
+func saveCostWbHandler(c *RouteContext) {
+	m := c.Update.Message
+	finishConversation(m)
+	cost, ok := parseNumber(m)
+	if !ok {
+		return
+	}
+	saveUserSetting(m, c.Access.OwnerId, "telegram_user.settings.wildberries_setting.cost", cost,
+		format.Concat(format.Plain("% сборов WB "), format.Bold(format.Plainf("%s", decimal.NewFromFloat(cost).StringFixed(2))), format.Plain(" успешно сохранен.")),
+		wildberriesSettingButtons())
+}
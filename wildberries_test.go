@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNormalizeWbOrders(t *testing.T) {
+	period := DateRange{
+		From: time.Date(2024, 3, 1, 0, 0, 0, 0, wbLocation),
+		To:   time.Date(2024, 3, 2, 0, 0, 0, 0, wbLocation),
+	}
+	orders := []WbOrder{
+		{Date: "2024-03-01T10:00:00", Subject: "Пеленка", SupplierArticle: "PL-1", PriceWithDisc: 1000, Srid: "a"},
+		{Date: "2024-03-01T11:00:00", Subject: "Пеленка", SupplierArticle: "PL-1", PriceWithDisc: 1000, Srid: "a"},
+		{Date: "2024-03-01T12:00:00", Subject: "Пеленка", SupplierArticle: "PL-2", PriceWithDisc: 500, Srid: "b"},
+		{Date: "2024-03-01T13:00:00", Subject: "Одеяло", SupplierArticle: "OD-1", PriceWithDisc: 2000, Srid: "c", IsCancel: true},
+		{Date: "2024-02-29T23:00:00", Subject: "Пеленка", SupplierArticle: "PL-1", PriceWithDisc: 1000, Srid: "d"},
+	}
+	sales := []WbSale{
+		{Date: "2024-03-01T15:00:00", SaleID: "S1", Srid: "a", PriceWithDisc: 1000, ForPay: 800},
+		{Date: "2024-03-01T15:00:00", SaleID: "S1", Srid: "a", PriceWithDisc: 1000, ForPay: 800},
+		{Date: "2024-03-01T16:00:00", SaleID: "R1", Srid: "d", PriceWithDisc: 1000},
+		{Date: "2024-03-02T16:00:00", SaleID: "R2", Srid: "e", PriceWithDisc: 1000},
+	}
+	batch := MarketplaceOrders{Cost: 20, Grouper: newProductGrouper([]GroupRule{{Kind: GroupByOfferPrefix, Value: "PL-", Group: "Пеленки"}})}
+	batch.Orders, batch.Returns = normalizeWbOrders(orders, sales, period)
+	report, groups := summarizeOrders(MarketplaceWildberries, batch, []GroupProducts{{NameGroup: "Пеленки", PurchasePrice: 100}})
+
+	if report.Marketplace != MarketplaceWildberries {
+		t.Errorf("Marketplace = %q", report.Marketplace)
+	}
+	if report.TotalCount != 3 || report.CancelledTotalCount != 1 {
+		t.Errorf("TotalCount = %d, CancelledTotalCount = %d, want 3 и 1", report.TotalCount, report.CancelledTotalCount)
+	}
+	if report.ReturnedCount != 1 {
+		t.Errorf("ReturnedCount = %d, want 1", report.ReturnedCount)
+	}
+	if report.EstimatedCount != 1 {
+		t.Errorf("EstimatedCount = %d, want 1", report.EstimatedCount)
+	}
+	if got := report.SumCount.StringFixed(2); got != "1500.00" {
+		t.Errorf("SumCount = %s, want 1500.00", got)
+	}
+	// 800 по продаже + 500 - 20% по сборам
+	if got := report.SumWithoutCommission.StringFixed(2); got != "1200.00" {
+		t.Errorf("SumWithoutCommission = %s, want 1200.00", got)
+	}
+	if got := report.Payout.Commission.StringFixed(2); got != "300.00" {
+		t.Errorf("Commission = %s, want 300.00", got)
+	}
+	if got := report.SumWithoutCommissionPurchasePrice.StringFixed(2); got != "1000.00" {
+		t.Errorf("SumWithoutCommissionPurchasePrice = %s, want 1000.00", got)
+	}
+	if report.Products["Пеленки"] != 2 || report.CancelledProducts["Одеяло OD-1"] != 1 {
+		t.Errorf("products = %v, CancelledProducts = %v", report.Products, report.CancelledProducts)
+	}
+	if strings.Join(groups, ",") != "Пеленки,Одеяло OD-1" {
+		t.Errorf("groups = %v", groups)
+	}
+}
+
+func TestWbChanges(t *testing.T) {
+	from := time.Date(2024, 3, 1, 0, 0, 0, 0, wbLocation)
+	full := func(date string) []WbOrder {
+		page := make([]WbOrder, wbStatisticsPageLimit)
+		page[len(page)-1].LastChangeDate = date
+		return page
+	}
+	lastChange := func(o WbOrder) string { return o.LastChangeDate }
+	errWb := errors.New("429")
+
+	tests := []struct {
+		name        string
+		pages       [][]WbOrder
+		failAt      int
+		want        int
+		wantErr     bool
+		wantPartial bool
+	}{
+		{
+			name:   "Неполная страница - последняя",
+			pages:  [][]WbOrder{make([]WbOrder, 3)},
+			failAt: -1,
+			want:   3,
+		},
+		{
+			name:   "Следующая страница от lastChangeDate последней строки",
+			pages:  [][]WbOrder{full("2024-03-01T10:00:00"), make([]WbOrder, 2)},
+			failAt: -1,
+			want:   wbStatisticsPageLimit + 2,
+		},
+		{
+			name:   "Дата не продвинулась - выгрузка останавливается",
+			pages:  [][]WbOrder{full("2024-03-01T00:00:00")},
+			failAt: -1,
+			want:   wbStatisticsPageLimit,
+		},
+		{
+			name:    "Ошибка на первой странице",
+			failAt:  0,
+			wantErr: true,
+		},
+		{
+			name:        "Ошибка на второй странице - частичный результат",
+			pages:       [][]WbOrder{full("2024-03-01T10:00:00")},
+			failAt:      1,
+			want:        wbStatisticsPageLimit,
+			wantErr:     true,
+			wantPartial: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls []time.Time
+			got, err := wbChanges(from, func(dateFrom time.Time) ([]WbOrder, error) {
+				calls = append(calls, dateFrom)
+				if len(calls)-1 == tt.failAt {
+					return nil, errWb
+				}
+				return tt.pages[len(calls)-1], nil
+			}, lastChange)
+			if (err != nil) != tt.wantErr || isPartialResult(err) != tt.wantPartial {
+				t.Fatalf("err = %v, wantErr %v, wantPartial %v", err, tt.wantErr, tt.wantPartial)
+			}
+			if len(got) != tt.want {
+				t.Errorf("len = %d, want %d", len(got), tt.want)
+			}
+			if len(calls) > 1 && !calls[1].Equal(parseWbDate("2024-03-01T10:00:00")) {
+				t.Errorf("dateFrom второй страницы = %v", calls[1])
+			}
+		})
+	}
+}
+
+func TestPrintOrderSummaryReport_Wildberries(t *testing.T) {
+	report := OrderReport{Marketplace: MarketplaceWildberries, CancelledProducts: map[string]int{}, Products: map[string]int{}}
+	text := printOrderSummaryReport(report)
+	if !strings.Contains(text, "Итого к выплате WB") {
+		t.Errorf("нет итога WB: %s", text)
+	}
+	if strings.Contains(text, "OZON") || strings.Contains(text, "Логистика") {
+		t.Errorf("лишние строки OZON в отчете WB: %s", text)
+	}
+}
+
+func TestReportMarketplaces(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings Settings
+		want     string
+	}{
+		{name: "Ничего не подключено - OZON", want: "OZON"},
+		{name: "Только OZON", settings: Settings{OzonSetting: OzonSetting{ClientId: "1"}}, want: "OZON"},
+		{name: "Только WB", settings: Settings{WildberriesSetting: WildberriesSetting{Token: "t"}}, want: "WB"},
+		{
+			name:     "Оба маркетплейса",
+			settings: Settings{OzonSetting: OzonSetting{ClientId: "1"}, WildberriesSetting: WildberriesSetting{Token: "t"}},
+			want:     "OZON,WB",
+		},
+		{
+			name:     "Яндекс Маркет без кампаний не подключен",
+			settings: Settings{YandexMarketSetting: YandexMarketSetting{Token: "t"}},
+			want:     "OZON",
+		},
+		{
+			name:     "Только Яндекс Маркет",
+			settings: Settings{YandexMarketSetting: YandexMarketSetting{Token: "t", Campaigns: []YandexCampaign{{Id: 1}}}},
+			want:     "Яндекс Маркет",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var names []string
+			for _, m := range reportMarketplaces(tt.settings) {
+				names = append(names, string(m.name()))
+			}
+			if got := strings.Join(names, ","); got != tt.want {
+				t.Errorf("reportMarketplaces() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,559 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"format"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"telegram"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+const (
+	// yandexStatsPageLimit Максимум заказов в одном ответе отчета по заказам
+	yandexStatsPageLimit = 200
+	// yandexDateLayout Даты в теле запроса отчета по заказам
+	yandexDateLayout = "2006-01-02"
+)
+
+// yandexLocation Даты заказов Яндекс Маркет указывает по московскому времени
+var yandexLocation = ozonLocation
+
+var urlYandexMarket string
+
+// yandexClient Лимит отчета по заказам - 1000 запросов в час на кампанию
+var yandexClient = NewAPIClient(NewRequestLimiter(1000.0/3600, 10))
+
+// yandexSchemes Схемы работы Яндекс Маркета в порядке вывода в отчете
+var yandexSchemes = []DeliveryScheme{SchemeFBY, SchemeFBS, SchemeDBS}
+
+type YandexMarketSetting struct {
+	// Token API-ключ (начинается с ACMA:) или OAuth-токен из кабинета продавца
+	Token string `bson:"token"`
+	// Cost % сборов Яндекс Маркета для заказов, по которым еще нет начисленных комиссий
+	Cost float64 `bson:"cost"`
+	// Campaigns Кампании (магазины), включаемые в отчеты
+	Campaigns []YandexCampaign `bson:"campaigns"`
+}
+
+// YandexCampaign Кампания - магазин продавца на Яндекс Маркете с одной моделью работы
+type YandexCampaign struct {
+	Id            int64  `bson:"id" json:"id"`
+	Domain        string `bson:"domain" json:"domain"`
+	PlacementType string `bson:"placement_type" json:"placementType"`
+}
+
+// scheme Схема работы кампании. Экспресс-доставка - разновидность FBS.
+func (c YandexCampaign) scheme() DeliveryScheme {
+	switch c.PlacementType {
+	case "FBY":
+		return SchemeFBY
+	case "DBS":
+		return SchemeDBS
+	default:
+		return SchemeFBS
+	}
+}
+
+func (c YandexCampaign) String() string {
+	return fmt.Sprintf("%s (%s)", c.Domain, c.scheme())
+}
+
+func (s YandexMarketSetting) connected() bool {
+	return s.Token != "" && len(s.Campaigns) > 0
+}
+
+func (s YandexMarketSetting) hasCampaign(id int64) bool {
+	return findIndex(s.Campaigns, func(c YandexCampaign) bool { return c.Id == id }) >= 0
+}
+
+// toggleCampaign Кампании после включения или выключения campaign
+func (s YandexMarketSetting) toggleCampaign(campaign YandexCampaign) []YandexCampaign {
+	var result []YandexCampaign
+	for _, c := range s.Campaigns {
+		if c.Id != campaign.Id {
+			result = append(result, c)
+		}
+	}
+	if !s.hasCampaign(campaign.Id) {
+		result = append(result, campaign)
+	}
+	return result
+}
+
+// schemes Схемы работы выбранных кампаний
+func (s YandexMarketSetting) schemes() []DeliveryScheme {
+	var result []DeliveryScheme
+	for _, scheme := range yandexSchemes {
+		if findIndex(s.Campaigns, func(c YandexCampaign) bool { return c.scheme() == scheme }) >= 0 {
+			result = append(result, scheme)
+		}
+	}
+	return result
+}
+
+// YandexOrder Заказ из отчета по заказам /campaigns/{campaignId}/stats/orders
+type YandexOrder struct {
+	Id           int64              `json:"id"`
+	CreationDate string             `json:"creationDate"`
+	Status       string             `json:"status"`
+	Items        []YandexOrderItem  `json:"items"`
+	Commissions  []YandexCommission `json:"commissions"`
+}
+
+type YandexOrderItem struct {
+	OfferName string              `json:"offerName"`
+	MarketSku int64               `json:"marketSku"`
+	ShopSku   string              `json:"shopSku"`
+	Count     int                 `json:"count"`
+	Prices    []YandexPrice       `json:"prices"`
+	Details   []YandexItemDetails `json:"details"`
+}
+
+// YandexItemDetails Невыкупленные (REJECTED) и возвращенные (RETURNED) единицы товара
+type YandexItemDetails struct {
+	ItemStatus string `json:"itemStatus"`
+	ItemCount  int    `json:"itemCount"`
+}
+
+// YandexPrice Цена товара: BUYER - оплата покупателя, MARKETPLACE - скидка за счет Маркета
+type YandexPrice struct {
+	Type        string  `json:"type"`
+	CostPerItem float64 `json:"costPerItem"`
+	Total       float64 `json:"total"`
+}
+
+// YandexCommission Начисленная за заказ услуга Маркета, Actual ноль пока услуга не начислена
+type YandexCommission struct {
+	Type   string  `json:"type"`
+	Actual float64 `json:"actual"`
+}
+
+// price Цена единицы товара для продавца вместе со скидками за счет Маркета
+func (i YandexOrderItem) price() float64 {
+	var price float64
+	for _, p := range i.Prices {
+		price += p.CostPerItem
+	}
+	return price
+}
+
+func (i YandexOrderItem) total() float64 {
+	var total float64
+	for _, p := range i.Prices {
+		total += p.Total
+	}
+	return total
+}
+
+// returned Возвращенные единицы товара по деталям товара. В возвращенном заказе без деталей возвращены все.
+func (i YandexOrderItem) returned(orderStatus string) int {
+	returned := 0
+	for _, d := range i.Details {
+		if d.ItemStatus == "RETURNED" {
+			returned += d.ItemCount
+		}
+	}
+	if returned == 0 && orderStatus == "RETURNED" {
+		returned = i.Count
+	}
+	return min(returned, i.Count)
+}
+
+// yandexStatus Статус заказа Яндекс Маркета в модели статусов отправлений OZON, ok - статус известен.
+// Невыкупленные и отмененные при доставке заказы считаются отменой, возвращенные - доставленными:
+// возвращенные товары normalizeYandexOrders переносит из заказа в возвраты.
+func yandexStatus(status string) (Status, bool) {
+	switch status {
+	case "PENDING", "RESERVED", "UNPAID":
+		return AwaitingApprove, true
+	case "PROCESSING":
+		return AwaitingPackaging, true
+	case "DELIVERY":
+		return Delivering, true
+	case "PICKUP":
+		return DriverPickup, true
+	case "DELIVERED", "PARTIALLY_DELIVERED", "RETURNED", "PARTIALLY_RETURNED":
+		return Delivered, true
+	case "CANCELLED_BEFORE_PROCESSING", "CANCELLED_IN_PROCESSING", "CANCELLED_IN_DELIVERY":
+		return Cancelled, true
+	case "LOST":
+		return Arbitration, true
+	default:
+		return AwaitingRegistration, false
+	}
+}
+
+// parseYandexDate Дата заказа: с поясом или московское время без пояса
+func parseYandexDate(s string) time.Time {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t
+	}
+	for _, layout := range []string{"2006-01-02T15:04:05", yandexDateLayout, "02-01-2006 15:04:05"} {
+		if t, err := time.ParseInLocation(layout, s, yandexLocation); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// normalizeYandexOrders Заказы, созданные за период, в общей модели со схемой работы кампании scheme.
+// Начисленные услуги заказа делятся между товарами пропорционально стоимости.
+// Возвращенные единицы товара не входят в заказ, а попадают в возвраты: в выручке они не учитываются,
+// их доля услуг Маркета вычитается как обратная логистика. Возврат относится к периоду заказа,
+// полностью возвращенный заказ в заказы не попадает.
+func normalizeYandexOrders(orders []YandexOrder, period DateRange, scheme DeliveryScheme) ([]Order, []OrderReturn) {
+	var result []Order
+	var returns []OrderReturn
+	for _, o := range orders {
+		date := parseYandexDate(o.CreationDate)
+		if date.Before(period.From) || !date.Before(period.To) {
+			continue
+		}
+		status, ok := yandexStatus(o.Status)
+		if !ok {
+			log.Printf("Неизвестный статус заказа Яндекс Маркета %d: %s", o.Id, o.Status)
+		}
+		order := Order{Marketplace: MarketplaceYandex, Number: strconv.FormatInt(o.Id, 10), Scheme: scheme, Status: status}
+		var commission, orderTotal float64
+		for _, c := range o.Commissions {
+			commission += c.Actual
+		}
+		for _, item := range o.Items {
+			orderTotal += item.total()
+		}
+		settled := commission > 0 && orderTotal > 0
+		for _, item := range o.Items {
+			total := decimal.NewFromFloat(item.total())
+			share := decimal.Zero
+			if settled {
+				share = decimal.NewFromFloat(commission).Mul(total).Div(decimal.NewFromFloat(orderTotal))
+			}
+			returned := item.returned(o.Status)
+			if returned > 0 {
+				part := decimal.NewFromInt(int64(returned)).Div(decimal.NewFromInt(int64(item.Count)))
+				returns = append(returns, OrderReturn{Quantity: returned, Logistics: share.Mul(part)})
+				total = total.Sub(total.Mul(part))
+				share = share.Sub(share.Mul(part))
+			}
+			if returned == item.Count {
+				continue
+			}
+			// SKU OZON и marketSku не пересекаются, поэтому правила по SKU к Яндекс Маркету не применяются
+			line := OrderLine{
+				OfferId:  item.ShopSku,
+				Name:     item.OfferName,
+				Quantity: item.Count - returned,
+				Price:    decimal.NewFromFloat(item.price()),
+			}
+			if settled {
+				line.settle(Payout{Commission: share, Net: total.Sub(share)})
+			}
+			order.Lines = append(order.Lines, line)
+		}
+		if len(order.Lines) > 0 {
+			result = append(result, order)
+		}
+	}
+	return result, returns
+}
+
+// YandexMarketSource Кампании кабинета и заказы кампании за период
+type YandexMarketSource interface {
+	yandexCampaigns(token string) ([]YandexCampaign, error)
+	yandexOrders(token string, campaignId int64, period DateRange) ([]YandexOrder, error)
+}
+
+// YandexMarketMarketplace Отчеты по кабинету Account, без кабинета - по основному кабинету Яндекс Маркета
+type YandexMarketMarketplace struct {
+	Account *MarketplaceAccount
+}
+
+func (m *YandexMarketMarketplace) name() Marketplace {
+	return MarketplaceYandex
+}
+
+func (m *YandexMarketMarketplace) accountName() string {
+	if m.Account == nil {
+		return ""
+	}
+	return m.Account.Name
+}
+
+// yandexRequest Запрос к Partner API. API-ключ передается в заголовке Api-Key, OAuth-токен - в Authorization.
+func yandexRequest(method string, baseUrl string, token string, path string, query url.Values, body interface{}) (func() (*http.Request, error), error) {
+	var requestBody []byte
+	if body != nil {
+		var err error
+		if requestBody, err = json.Marshal(body); err != nil {
+			return nil, err
+		}
+	}
+	return func() (*http.Request, error) {
+		r, err := http.NewRequest(method, baseUrl+path+"?"+query.Encode(), bytes.NewReader(requestBody))
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(token, "ACMA:") {
+			r.Header.Set("Api-Key", token)
+		} else {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		r.Header.Set("content-type", "application/json")
+		return r, nil
+	}, nil
+}
+
+func (m *YandexMarketMarketplace) yandexCampaigns(token string) ([]YandexCampaign, error) {
+	var campaigns []YandexCampaign
+	for page := 1; ; page++ {
+		var resp struct {
+			Campaigns []YandexCampaign `json:"campaigns"`
+			Pager     struct {
+				PagesCount int `json:"pagesCount"`
+			} `json:"pager"`
+		}
+		request, err := yandexRequest("GET", urlYandexMarket, token, "/campaigns", url.Values{"page": {strconv.Itoa(page)}}, nil)
+		if err != nil {
+			return nil, err
+		}
+		if err := yandexClient.do(token+"/campaigns", request, &resp); err != nil {
+			return nil, err
+		}
+		campaigns = append(campaigns, resp.Campaigns...)
+		if page >= resp.Pager.PagesCount {
+			return campaigns, nil
+		}
+	}
+}
+
+func (m *YandexMarketMarketplace) yandexOrders(token string, campaignId int64, period DateRange) ([]YandexOrder, error) {
+	path := fmt.Sprintf("/campaigns/%d/stats/orders", campaignId)
+	body := map[string]string{
+		"dateFrom": period.From.In(yandexLocation).Format(yandexDateLayout),
+		"dateTo":   period.lastDay().In(yandexLocation).Format(yandexDateLayout),
+	}
+	return yandexPages(func(pageToken string) ([]YandexOrder, string, error) {
+		query := url.Values{"limit": {strconv.Itoa(yandexStatsPageLimit)}}
+		if pageToken != "" {
+			query.Set("page_token", pageToken)
+		}
+		var resp struct {
+			Result struct {
+				Orders []YandexOrder `json:"orders"`
+				Paging struct {
+					NextPageToken string `json:"nextPageToken"`
+				} `json:"paging"`
+			} `json:"result"`
+		}
+		request, err := yandexRequest("POST", urlYandexMarket, token, path, query, body)
+		if err != nil {
+			return nil, "", err
+		}
+		if err := yandexClient.do(token+path, request, &resp); err != nil {
+			return nil, "", err
+		}
+		return resp.Result.Orders, resp.Result.Paging.NextPageToken, nil
+	})
+}
+
+// yandexPages Все заказы отчета, следующая часть запрашивается по nextPageToken предыдущей.
+// При ошибке на следующих частях возвращаются полученные заказы и PartialResultError.
+func yandexPages(fetch func(pageToken string) ([]YandexOrder, string, error)) ([]YandexOrder, error) {
+	var orders []YandexOrder
+	pageToken := ""
+	for {
+		page, next, err := fetch(pageToken)
+		if err != nil {
+			if len(orders) == 0 {
+				return nil, err
+			}
+			return orders, &PartialResultError{Fetched: len(orders), Err: err}
+		}
+		orders = append(orders, page...)
+		if next == "" {
+			return orders, nil
+		}
+		pageToken = next
+	}
+}
+
+// yandexCampaignOrders Заказы и возвраты выбранных кампаний за период
+func yandexCampaignOrders(source YandexMarketSource, setting YandexMarketSetting, period DateRange) ([]Order, []OrderReturn, error) {
+	var orders []Order
+	var returns []OrderReturn
+	var partial error
+	for _, c := range setting.Campaigns {
+		campaignOrders, err := source.yandexOrders(setting.Token, c.Id, period)
+		if err != nil && !isPartialResult(err) {
+			return nil, nil, err
+		}
+		if partial == nil {
+			partial = err
+		}
+		o, r := normalizeYandexOrders(campaignOrders, period, c.scheme())
+		orders = append(orders, o...)
+		returns = append(returns, r...)
+	}
+	return orders, returns, partial
+}
+
+// periodOrders Заказы и возвраты выбранных кампаний кабинета. Группы товаров и закупочные цены общие с OZON, процент сборов свой.
+func (m *YandexMarketMarketplace) periodOrders(userId int64, s Settings, period DateRange) (MarketplaceOrders, error) {
+	account, err := resolveAccount(m.Account, userId, MarketplaceYandex)
+	if err != nil {
+		return MarketplaceOrders{}, err
+	}
+	setting := account.yandexSetting(s.YandexMarketSetting.Cost)
+	if !setting.connected() {
+		return MarketplaceOrders{}, fmt.Errorf("не выбраны кампании Яндекс Маркета")
+	}
+	orders, returns, err := yandexCampaignOrders(m, setting, period)
+	if err != nil && !isPartialResult(err) {
+		return MarketplaceOrders{}, err
+	}
+	return MarketplaceOrders{
+		Orders:  orders,
+		Returns: returns,
+		Schemes: setting.schemes(),
+		Cost:    setting.Cost,
+		Grouper: newProductGrouper(s.OzonSetting.ProductSetting.GroupRules),
+	}, err
+}
+
+func yandexMarketSettingButtons() telegram.InlineKeyboardMarkup {
+	return telegram.InlineKeyboardMarkup{InlineKeyboard: CreateButtonsBot[telegram.InlineKeyboardButton]([]telegram.ButtonBot[telegram.InlineKeyboardButton]{
+		{Row: 1, Col: 1, Button: telegram.InlineKeyboardButton{Text: "Кабинеты", CallbackData: "/accounts-ym"}},
+		{Row: 1, Col: 2, Button: telegram.InlineKeyboardButton{Text: "% сборов Маркета", CallbackData: "/setcostym"}},
+		{Row: 2, Col: 1, Button: telegram.InlineKeyboardButton{Text: "Назад", CallbackData: "/settings"}},
+	})}
+}
+
+func yandexMarketSettingHandler(c *RouteContext) {
+	q := c.Update.CallbackQuery
+	bot := TelegramBot{}
+	answerCallbackQueryToBot(&bot, telegram.AnswerCallbackQueryRequestBody{CallbackQueryId: q.Id})
+	EditMessageTextToBot(&bot, telegram.EditMessageTextRequestBody{
+		ChatId:    q.Message.Chat.Id,
+		MessageId: q.Message.MessageId,
+		ParseMode: format.HTML.ParseMode(),
+		Text: htmlText(format.Plain("Для получения данных из Яндекс Маркета добавьте кабинет с API-ключом или OAuth-токеном и выберите в нем "),
+			format.Bold(format.Plain("кампании")), format.Plain(", которые нужно включать в отчеты. Группы товаров и закупочные цены общие с OZON.")),
+		ReplyMarkup: yandexMarketSettingButtons(),
+	})
+}
+
+func askCostYmHandler(c *RouteContext) {
+	askSettingValue(c.Update.CallbackQuery, StateAwaitCostYm, ConversationPayload{},
+		format.Plain("ОК. Пришлите, пожалуйста % сборов Яндекс Маркета. Он используется для заказов, по которым еще нет начисленных услуг."))
+}
+
+func saveCostYmHandler(c *RouteContext) {
+	m := c.Update.Message
+	finishConversation(m)
+	cost, ok := parseNumber(m)
+	if !ok {
+		return
+	}
+	saveUserSetting(m, c.Access.OwnerId, "telegram_user.settings.yandex_market_setting.cost", cost,
+		format.Concat(format.Plain("% сборов Яндекс Маркета "), format.Bold(format.Plainf("%s", decimal.NewFromFloat(cost).StringFixed(2))), format.Plain(" успешно сохранен.")),
+		yandexMarketSettingButtons())
+}
+
+func yandexCampaignsMarkup(account MarketplaceAccount, campaigns []YandexCampaign) telegram.InlineKeyboardMarkup {
+	setting := account.yandexSetting(0)
+	var buttons []telegram.ButtonBot[telegram.InlineKeyboardButton]
+	for i, campaign := range campaigns {
+		text := "☐ " + campaign.String()
+		if setting.hasCampaign(campaign.Id) {
+			text = "✅ " + campaign.String()
+		}
+		buttons = append(buttons, telegram.ButtonBot[telegram.InlineKeyboardButton]{
+			Row: i + 1, Col: 1, Button: telegram.InlineKeyboardButton{Text: text, CallbackData: fmt.Sprintf("/toggleymcampaign-%s-%d", account.Id.Hex(), campaign.Id)},
+		})
+	}
+	buttons = append(buttons, telegram.ButtonBot[telegram.InlineKeyboardButton]{
+		Row: len(campaigns) + 1, Col: 1, Button: telegram.InlineKeyboardButton{Text: "Назад", CallbackData: "/account-" + account.Id.Hex()},
+	})
+	return telegram.InlineKeyboardMarkup{InlineKeyboard: CreateButtonsBot[telegram.InlineKeyboardButton](buttons)}
+}
+
+// ymCampaigns Кабинет и его кампании. Если получить их не удалось, пользователю отправлен ответ на кнопку.
+func ymCampaigns(q telegram.CallbackQuery, accountId string) (MarketplaceAccount, []YandexCampaign, bool) {
+	bot := TelegramBot{}
+	account, ok := userAccount(q.From.Id, accountId)
+	if !ok || account.Marketplace != MarketplaceYandex {
+		answerCallbackQueryToBot(&bot, telegram.AnswerCallbackQueryRequestBody{CallbackQueryId: q.Id, Text: "Кнопка устарела."})
+		return MarketplaceAccount{}, nil, false
+	}
+	campaigns, err := (&YandexMarketMarketplace{}).yandexCampaigns(account.Token)
+	if err != nil {
+		log.Printf("Не удалось получить кампании Яндекс Маркета пользователя %d: %v", q.From.Id, err)
+		answerCallbackQueryToBot(&bot, telegram.AnswerCallbackQueryRequestBody{CallbackQueryId: q.Id, Text: "Не удалось получить кампании Яндекс Маркета, проверьте токен.", ShowAlert: true})
+		return MarketplaceAccount{}, nil, false
+	}
+	return account, campaigns, true
+}
+
+func editYmCampaigns(q telegram.CallbackQuery, account MarketplaceAccount, campaigns []YandexCampaign) {
+	bot := TelegramBot{}
+	EditMessageTextToBot(&bot, telegram.EditMessageTextRequestBody{
+		ChatId:      q.Message.Chat.Id,
+		MessageId:   q.Message.MessageId,
+		ParseMode:   format.HTML.ParseMode(),
+		Text:        htmlText(format.Plainf("Выберите кампании кабинета «%s», которые нужно включать в отчеты.", account.Name)),
+		ReplyMarkup: yandexCampaignsMarkup(account, campaigns),
+	})
+}
+
+func ymCampaignsHandler(c *RouteContext) {
+	q := c.Update.CallbackQuery
+	account, campaigns, ok := ymCampaigns(q, c.Payload)
+	if !ok {
+		return
+	}
+	answerCallbackQueryToBot(&TelegramBot{}, telegram.AnswerCallbackQueryRequestBody{CallbackQueryId: q.Id})
+	editYmCampaigns(q, account, campaigns)
+}
+
+// toggleYmCampaignHandler Включение кампании в отчеты кабинета: /toggleymcampaign-кабинет-кампания
+func toggleYmCampaignHandler(c *RouteContext) {
+	q := c.Update.CallbackQuery
+	bot := TelegramBot{}
+	accountId, campaignId, _ := strings.Cut(c.Payload, "-")
+	id, err := strconv.ParseInt(campaignId, 10, 64)
+	if err != nil {
+		answerCallbackQueryToBot(&bot, telegram.AnswerCallbackQueryRequestBody{CallbackQueryId: q.Id, Text: "Кнопка устарела."})
+		return
+	}
+	account, campaigns, ok := ymCampaigns(q, accountId)
+	if !ok {
+		return
+	}
+	i := findIndex(campaigns, func(c YandexCampaign) bool { return c.Id == id })
+	if i < 0 {
+		answerCallbackQueryToBot(&bot, telegram.AnswerCallbackQueryRequestBody{CallbackQueryId: q.Id, Text: "Кнопка устарела."})
+		return
+	}
+	account.Campaigns = account.yandexSetting(0).toggleCampaign(campaigns[i])
+	_, err = UserDB{}.updateAccounts(q.From.Id, MarketplaceYandex, func(list []MarketplaceAccount) ([]MarketplaceAccount, error) {
+		for j := range list {
+			if list[j].Id == account.Id {
+				list[j].Campaigns = account.Campaigns
+			}
+		}
+		return list, nil
+	})
+	if err != nil {
+		panic(err)
+	}
+	answerCallbackQueryToBot(&bot, telegram.AnswerCallbackQueryRequestBody{CallbackQueryId: q.Id})
+	editYmCampaigns(q, account, campaigns)
+}
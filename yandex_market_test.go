@@ -0,0 +1,218 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestYandexStatus(t *testing.T) {
+	tests := []struct {
+		status string
+		want   Status
+		wantOk bool
+	}{
+		{status: "PROCESSING", want: AwaitingPackaging, wantOk: true},
+		{status: "DELIVERY", want: Delivering, wantOk: true},
+		{status: "DELIVERED", want: Delivered, wantOk: true},
+		{status: "PARTIALLY_RETURNED", want: Delivered, wantOk: true},
+		{status: "CANCELLED_BEFORE_PROCESSING", want: Cancelled, wantOk: true},
+		{status: "CANCELLED_IN_DELIVERY", want: Cancelled, wantOk: true},
+		{status: "UNKNOWN", want: AwaitingRegistration, wantOk: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.status, func(t *testing.T) {
+			got, ok := yandexStatus(tt.status)
+			if got != tt.want || ok != tt.wantOk {
+				t.Errorf("yandexStatus() = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
+
+func TestNormalizeYandexOrders(t *testing.T) {
+	period := DateRange{
+		From: time.Date(2024, 3, 1, 0, 0, 0, 0, yandexLocation),
+		To:   time.Date(2024, 3, 2, 0, 0, 0, 0, yandexLocation),
+	}
+	item := func(name string, price float64, subsidy float64) YandexOrderItem {
+		return YandexOrderItem{OfferName: name, ShopSku: name, Count: 1, Prices: []YandexPrice{
+			{Type: "BUYER", CostPerItem: price, Total: price},
+			{Type: "MARKETPLACE", CostPerItem: subsidy, Total: subsidy},
+		}}
+	}
+	orders := []YandexOrder{
+		{Id: 1, CreationDate: "2024-03-01T10:00:00+03:00", Status: "DELIVERED",
+			Items:       []YandexOrderItem{item("A", 900, 100), item("B", 3000, 0)},
+			Commissions: []YandexCommission{{Type: "FEE", Actual: 300}, {Type: "DELIVERY_TO_CUSTOMER", Actual: 100}}},
+		{Id: 2, CreationDate: "2024-03-01T12:00:00+03:00", Status: "CANCELLED_IN_DELIVERY", Items: []YandexOrderItem{item("A", 1000, 0)}},
+		{Id: 3, CreationDate: "2024-03-01T13:00:00+03:00", Status: "PROCESSING", Items: []YandexOrderItem{item("A", 1000, 0)}},
+		{Id: 4, CreationDate: "2024-02-29T23:59:00+03:00", Status: "DELIVERED", Items: []YandexOrderItem{item("A", 1000, 0)}},
+	}
+	got, returns := normalizeYandexOrders(orders, period, SchemeFBY)
+	if len(returns) != 0 {
+		t.Errorf("returns = %+v, want без возвратов", returns)
+	}
+	if len(got) != 3 {
+		t.Fatalf("len = %d, want 3", len(got))
+	}
+	delivered := got[0]
+	if delivered.Status != Delivered || delivered.Scheme != SchemeFBY || delivered.Marketplace != MarketplaceYandex || delivered.Number != "1" {
+		t.Errorf("order = %+v", delivered)
+	}
+	if !delivered.Lines[0].Price.Equal(decimal.NewFromInt(1000)) {
+		t.Errorf("Price = %s, want 1000 со скидкой Маркета", delivered.Lines[0].Price)
+	}
+	// 400 услуг делятся 1000 к 3000
+	a, _ := delivered.Lines[0].payout()
+	b, _ := delivered.Lines[1].payout()
+	if !a.Commission.Equal(decimal.NewFromInt(100)) || !b.Net.Equal(decimal.NewFromInt(2700)) {
+		t.Errorf("payout A = %+v, B = %+v", a, b)
+	}
+	if got[1].Status != Cancelled {
+		t.Errorf("невыкуп должен быть отменой: %+v", got[1])
+	}
+	if _, ok := got[2].Lines[0].payout(); got[2].Status != AwaitingPackaging || ok {
+		t.Errorf("заказ в обработке без выплаты: %+v", got[2])
+	}
+}
+
+func TestSummarizeOrders_yandexReturns(t *testing.T) {
+	period := DateRange{
+		From: time.Date(2024, 3, 1, 0, 0, 0, 0, yandexLocation),
+		To:   time.Date(2024, 3, 2, 0, 0, 0, 0, yandexLocation),
+	}
+	item := func(name string, count int, price float64, details ...YandexItemDetails) YandexOrderItem {
+		return YandexOrderItem{OfferName: name, ShopSku: name, Count: count, Details: details,
+			Prices: []YandexPrice{{Type: "BUYER", CostPerItem: price, Total: price * float64(count)}}}
+	}
+	orders := []YandexOrder{
+		{Id: 1, CreationDate: "2024-03-01T10:00:00+03:00", Status: "DELIVERED",
+			Items: []YandexOrderItem{item("A", 1, 1000)}, Commissions: []YandexCommission{{Type: "FEE", Actual: 100}}},
+		// Возвращен весь заказ, деталей по товарам нет
+		{Id: 2, CreationDate: "2024-03-01T11:00:00+03:00", Status: "RETURNED",
+			Items: []YandexOrderItem{item("A", 1, 1000)}, Commissions: []YandexCommission{{Type: "DELIVERY_TO_CUSTOMER", Actual: 50}}},
+		// Из 4 штук возвращена одна
+		{Id: 3, CreationDate: "2024-03-01T12:00:00+03:00", Status: "PARTIALLY_RETURNED",
+			Items:       []YandexOrderItem{item("B", 4, 500, YandexItemDetails{ItemStatus: "RETURNED", ItemCount: 1})},
+			Commissions: []YandexCommission{{Type: "FEE", Actual: 200}}},
+	}
+	got, returns := normalizeYandexOrders(orders, period, SchemeFBS)
+	if len(got) != 2 || len(returns) != 2 {
+		t.Fatalf("orders = %+v, returns = %+v, want 2 заказа и 2 возврата", got, returns)
+	}
+	report, _ := summarizeOrders(MarketplaceYandex, MarketplaceOrders{Orders: got, Returns: returns, Schemes: []DeliveryScheme{SchemeFBS}}, nil)
+	if report.TotalCount != 4 || report.ReturnedCount != 2 || report.CancelledTotalCount != 0 {
+		t.Errorf("total = %d, returned = %d, cancelled = %d, want 4, 2, 0", report.TotalCount, report.ReturnedCount, report.CancelledTotalCount)
+	}
+	// Выручка только невозвращенных товаров: 1000 + 3 * 500
+	if !report.SumCount.Equal(decimal.NewFromInt(2500)) {
+		t.Errorf("SumCount = %s, want 2500", report.SumCount)
+	}
+	// Услуги возвращенных товаров: 50 за заказ 2 и четверть от 200 за заказ 3
+	if !report.ReturnLogistics.Equal(decimal.NewFromInt(100)) {
+		t.Errorf("ReturnLogistics = %s, want 100", report.ReturnLogistics)
+	}
+	// Выплата: 1000 - 100 и 1500 - 150, минус обратная логистика
+	if !report.SumWithoutCommission.Equal(decimal.NewFromInt(2250)) || !report.SumWithoutCommissionPurchasePrice.Equal(decimal.NewFromInt(2150)) {
+		t.Errorf("net = %s, net after returns = %s", report.SumWithoutCommission, report.SumWithoutCommissionPurchasePrice)
+	}
+}
+
+type fakeYandexSource struct {
+	orders map[int64][]YandexOrder
+	errs   map[int64]error
+}
+
+func (f fakeYandexSource) yandexCampaigns(token string) ([]YandexCampaign, error) {
+	return nil, nil
+}
+
+func (f fakeYandexSource) yandexOrders(token string, campaignId int64, period DateRange) ([]YandexOrder, error) {
+	return f.orders[campaignId], f.errs[campaignId]
+}
+
+func TestYandexCampaignOrders(t *testing.T) {
+	period := DateRange{
+		From: time.Date(2024, 3, 1, 0, 0, 0, 0, yandexLocation),
+		To:   time.Date(2024, 3, 2, 0, 0, 0, 0, yandexLocation),
+	}
+	order := func(id int64) YandexOrder {
+		return YandexOrder{Id: id, CreationDate: "2024-03-01T10:00:00", Status: "DELIVERED", Items: []YandexOrderItem{{OfferName: "A", Count: 1}}}
+	}
+	setting := YandexMarketSetting{Token: "ACMA:1", Campaigns: []YandexCampaign{
+		{Id: 1, PlacementType: "FBS"}, {Id: 2, PlacementType: "FBY"}, {Id: 3, PlacementType: "EXPRESS"},
+	}}
+	errYm := errors.New("420")
+
+	t.Run("Схема работы берется из кампании", func(t *testing.T) {
+		source := fakeYandexSource{orders: map[int64][]YandexOrder{1: {order(1)}, 2: {order(2)}, 3: {order(3), order(4)}}}
+		got, _, err := yandexCampaignOrders(source, setting, period)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var schemes []DeliveryScheme
+		for _, o := range got {
+			schemes = append(schemes, o.Scheme)
+		}
+		if want := []DeliveryScheme{SchemeFBS, SchemeFBY, SchemeFBS, SchemeFBS}; !reflect.DeepEqual(schemes, want) {
+			t.Errorf("schemes = %v, want %v", schemes, want)
+		}
+		if want := []DeliveryScheme{SchemeFBY, SchemeFBS}; !reflect.DeepEqual(setting.schemes(), want) {
+			t.Errorf("schemes() = %v, want %v", setting.schemes(), want)
+		}
+	})
+	t.Run("Частичная выгрузка кампании", func(t *testing.T) {
+		source := fakeYandexSource{
+			orders: map[int64][]YandexOrder{1: {order(1)}, 2: {order(2)}},
+			errs:   map[int64]error{2: &PartialResultError{Fetched: 1, Err: errYm}},
+		}
+		got, _, err := yandexCampaignOrders(source, setting, period)
+		if !isPartialResult(err) || len(got) != 2 {
+			t.Errorf("err = %v, len = %d", err, len(got))
+		}
+	})
+	t.Run("Ошибка кампании", func(t *testing.T) {
+		source := fakeYandexSource{errs: map[int64]error{3: errYm}}
+		if _, _, err := yandexCampaignOrders(source, setting, period); !errors.Is(err, errYm) {
+			t.Errorf("err = %v, want %v", err, errYm)
+		}
+	})
+}
+
+func TestYandexPages(t *testing.T) {
+	errYm := errors.New("420")
+	pages := map[string][]YandexOrder{"": {{Id: 1}, {Id: 2}}, "p2": {{Id: 3}}}
+	next := map[string]string{"": "p2"}
+	got, err := yandexPages(func(pageToken string) ([]YandexOrder, string, error) {
+		return pages[pageToken], next[pageToken], nil
+	})
+	if err != nil || len(got) != 3 {
+		t.Errorf("len = %d, err = %v", len(got), err)
+	}
+
+	got, err = yandexPages(func(pageToken string) ([]YandexOrder, string, error) {
+		if pageToken == "p2" {
+			return nil, "", errYm
+		}
+		return pages[pageToken], next[pageToken], nil
+	})
+	if !isPartialResult(err) || len(got) != 2 {
+		t.Errorf("len = %d, err = %v, want частичный результат", len(got), err)
+	}
+}
+
+func TestYandexMarketSetting_toggleCampaign(t *testing.T) {
+	a := YandexCampaign{Id: 1, Domain: "a"}
+	b := YandexCampaign{Id: 2, Domain: "b"}
+	s := YandexMarketSetting{Campaigns: []YandexCampaign{a}}
+	if got := s.toggleCampaign(b); !reflect.DeepEqual(got, []YandexCampaign{a, b}) {
+		t.Errorf("включение: %v", got)
+	}
+	if got := s.toggleCampaign(a); len(got) != 0 {
+		t.Errorf("выключение: %v", got)
+	}
+}